@@ -2,18 +2,46 @@ package avacadovnc
 
 import (
 	"errors"
+	"fmt"
 	"image"
 	"image/color"
 	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"sort"
 	"sync"
 )
 
+// ChannelOrder is the order of the color channels in the bytes of a
+// VncCanvas's framebuffer.
+type ChannelOrder uint8
+
+const (
+	// ChannelsRGBA stores pixels as red, green, blue, alpha, the layout
+	// image.RGBA expects. It is the default.
+	ChannelsRGBA ChannelOrder = iota
+	// ChannelsBGRA stores pixels as blue, green, red, alpha, the layout of
+	// most native 32-bit surfaces. The images returned by Image then carry
+	// BGRA bytes in their Pix, so their At and RGBAAt methods report red and
+	// blue swapped; such images are meant to be handed on by their Pix.
+	ChannelsBGRA
+)
+
 // VncCanvas represents the client's view of the remote framebuffer.
 // It provides a drawable surface (an image.RGBA) and methods to manipulate it
 // based on messages received from the server. It is safe for concurrent use.
+//
+// Decoders draw into a back buffer. Publish swaps it with a front buffer once
+// a frame is complete, bringing the new back buffer up to date by copying only
+// the regions changed since the previous Publish, and Image hands out
+// published frames without taking the back buffer's lock, so snapshots never
+// stall decoding. A front buffer Image has handed out cannot be drawn into
+// again; Image then keeps a spare copy of it for Publish to bring up to date
+// in its place.
 type VncCanvas struct {
 	mu          sync.RWMutex // Use RWMutex for more granular locking
-	img         *image.RGBA  // The main framebuffer image
+	img         *image.RGBA  // The main framebuffer image (back buffer)
 	cursorImg   *image.RGBA  // The cursor image
 	cursorMask  *image.Alpha // The cursor bitmask for transparency
 	cursorX     int          // Cursor X position
@@ -21,12 +49,91 @@ type VncCanvas struct {
 	cursorHotX  int          // Cursor hotspot X
 	cursorHotY  int          // Cursor hotspot Y
 	cursorShown bool
+	cursorUnder *image.RGBA     // Framebuffer pixels covered by the painted cursor
+	underRect   image.Rectangle // Where cursorUnder came from
+	pf          PixelFormat     // Format of pixel data passed to DrawBytes
+	colorMap    ColorMap        // Palette used when pf is not true color
+	order       ChannelOrder    // Channel order of img's pixels
+
+	dirty         []image.Rectangle // Regions changed since the last ClearDirty
+	pubDirty      []image.Rectangle // Regions changed since the last Publish
+	paintedRect   image.Rectangle   // Where the cursor was last painted
+	cursorChanged bool              // Whether SetCursor was called since then
+
+	frontMu    sync.Mutex        // Guards front, frontTaken, spare and spareDirty
+	front      *image.RGBA       // The most recently published frame
+	frontTaken bool              // Whether front has been handed out by Image
+	spare      *image.RGBA       // A copy of an earlier frame, never handed out
+	spareDirty []image.Rectangle // Regions changed since the frame spare copies
 }
 
-// NewVncCanvas creates a new canvas with the specified dimensions.
+// NewVncCanvas creates a new canvas with the specified dimensions. Pixel data
+// passed to DrawBytes and Fill is interpreted in pf.
 func NewVncCanvas(width, height int, pf PixelFormat) *VncCanvas {
 	return &VncCanvas{
 		img: image.NewRGBA(image.Rect(0, 0, width, height)),
+		pf:  pf,
+	}
+}
+
+// SetPixelFormat sets the format of pixel data passed to DrawBytes and Fill.
+// ClientConn calls it whenever the connection's pixel format changes.
+func (c *VncCanvas) SetPixelFormat(pf PixelFormat) {
+	c.mu.Lock() // Use a full write lock for modifications
+	defer c.mu.Unlock()
+	c.pf = pf
+}
+
+// PixelFormat returns the format of pixel data passed to DrawBytes and Fill.
+func (c *VncCanvas) PixelFormat() PixelFormat {
+	c.mu.RLock() // Use a read lock for read-only operations
+	defer c.mu.RUnlock()
+	return c.pf
+}
+
+// SetColorMap sets the palette used to draw paletted pixel data.
+// ClientConn calls it whenever the server sends new color map entries.
+func (c *VncCanvas) SetColorMap(cm ColorMap) {
+	c.mu.Lock() // Use a full write lock for modifications
+	defer c.mu.Unlock()
+	c.colorMap = cm
+}
+
+// SetChannelOrder sets the channel order of the framebuffer's pixels and
+// converts the pixels already drawn. A frame published before the call is
+// dropped, so Image copies the converted back buffer until the next Publish.
+func (c *VncCanvas) SetChannelOrder(order ChannelOrder) {
+	c.frontMu.Lock()
+	defer c.frontMu.Unlock()
+	c.mu.Lock() // Use a full write lock for modifications
+	defer c.mu.Unlock()
+	if order == c.order {
+		return
+	}
+	swapRB(c.img, c.img.Bounds())
+	if c.cursorShown {
+		swapRB(c.cursorUnder, c.cursorUnder.Bounds())
+	}
+	c.order = order
+	c.front, c.frontTaken, c.spare = nil, false, nil
+	c.markDirty(c.img.Bounds())
+}
+
+// ChannelOrder returns the channel order of the framebuffer's pixels.
+func (c *VncCanvas) ChannelOrder() ChannelOrder {
+	c.mu.RLock() // Use a read lock for read-only operations
+	defer c.mu.RUnlock()
+	return c.order
+}
+
+// swapRB exchanges the red and blue bytes of the pixels of img in r.
+func swapRB(img *image.RGBA, r image.Rectangle) {
+	r = r.Intersect(img.Rect)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		row := img.Pix[img.PixOffset(r.Min.X, y):img.PixOffset(r.Max.X, y)]
+		for i := 0; i < len(row); i += 4 {
+			row[i], row[i+2] = row[i+2], row[i]
+		}
 	}
 }
 
@@ -44,17 +151,295 @@ func (c *VncCanvas) Height() int {
 	return c.img.Bounds().Dy()
 }
 
-// Image returns a copy of the current framebuffer image.
-// This is safe to use concurrently while the canvas is being updated.
+// Resize changes the size of the canvas. Pixels in the area covered by both
+// the old and the new size are kept; newly exposed pixels are black.
+func (c *VncCanvas) Resize(width, height int) {
+	c.mu.Lock() // Use a full write lock for modifications
+	defer c.mu.Unlock()
+	if c.img.Bounds().Dx() == width && c.img.Bounds().Dy() == height {
+		return
+	}
+	if c.cursorShown {
+		draw.Draw(c.img, c.underRect, c.cursorUnder, image.Point{}, draw.Src)
+		c.cursorShown = false
+	}
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), c.img, image.Point{}, draw.Src)
+	c.img = img
+	c.dirty, c.pubDirty = c.dirty[:0], c.pubDirty[:0]
+	c.markDirty(img.Bounds())
+}
+
+// Image returns the most recently published frame. Until the next Publish,
+// every caller gets the same image, so it must be treated as read-only; the
+// canvas never modifies it again. Its Pix holds the pixels in the canvas's
+// channel order; see SetChannelOrder. ClientConn publishes a frame after every
+// FramebufferUpdate; code driving the canvas directly must call Publish. Until
+// the first Publish, Image returns a copy of the back buffer.
 func (c *VncCanvas) Image() *image.RGBA {
+	c.frontMu.Lock()
+	if c.front != nil {
+		defer c.frontMu.Unlock()
+		if !c.frontTaken && c.spare == nil {
+			// The copy is made here rather than in Publish, which holds
+			// the lock decoders draw under.
+			c.spare, c.spareDirty = cloneRGBA(c.front, nil), c.spareDirty[:0]
+		}
+		c.frontTaken = true
+		return c.front
+	}
+	c.frontMu.Unlock()
+
+	c.mu.RLock() // Use a read lock
+	defer c.mu.RUnlock()
+	return cloneRGBA(c.img, nil)
+}
+
+// EncodePNG writes the current contents of the canvas to w as a PNG. The
+// pixels are copied under the read lock, so the image is not torn by a
+// concurrent update, and encoded after the lock is released.
+func (c *VncCanvas) EncodePNG(w io.Writer) error {
+	if err := png.Encode(w, c.snapshot()); err != nil {
+		return fmt.Errorf("canvas: failed to encode png: %w", err)
+	}
+	return nil
+}
+
+// EncodeJPEG is like EncodePNG, but writes a JPEG of the given quality, from
+// 1 to 100.
+func (c *VncCanvas) EncodeJPEG(w io.Writer, quality int) error {
+	if err := jpeg.Encode(w, c.snapshot(), &jpeg.Options{Quality: quality}); err != nil {
+		return fmt.Errorf("canvas: failed to encode jpeg: %w", err)
+	}
+	return nil
+}
+
+// snapshot returns a copy of the whole canvas in RGBA order.
+func (c *VncCanvas) snapshot() *image.RGBA {
+	c.mu.RLock()
+	img, order := cloneRGBA(c.img, nil), c.order
+	c.mu.RUnlock()
+	if order == ChannelsBGRA {
+		swapRB(img, img.Rect)
+	}
+	return img
+}
+
+// subImage returns a copy of the pixels in r, which is relative to the canvas.
+// The copy is in RGBA order whatever the canvas's channel order.
+func (c *VncCanvas) subImage(r image.Rectangle) *image.RGBA {
+	c.mu.RLock() // Use a read lock
+	defer c.mu.RUnlock()
+	r = r.Intersect(c.img.Bounds())
+	dst := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	draw.Draw(dst, dst.Bounds(), c.img, r.Min, draw.Src)
+	if c.order == ChannelsBGRA {
+		swapRB(dst, dst.Bounds())
+	}
+	return dst
+}
+
+// Publish makes the current contents of the back buffer visible to Image by
+// swapping it with the front buffer. The old front buffer becomes the back
+// buffer and gets the regions changed since the previous Publish. A front
+// buffer that Image has handed out is never drawn into again, so in that case
+// the spare copy Image made of it is brought up to date instead, and only
+// without one is the back buffer copied in full.
+func (c *VncCanvas) Publish() {
+	c.frontMu.Lock()
+	defer c.frontMu.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.front != nil && len(c.pubDirty) == 0 {
+		return // The published frame is still current.
+	}
+
+	if c.spare != nil && c.spare.Rect != c.img.Rect {
+		c.spare = nil // The canvas has been resized.
+	}
+	back := c.front
+	switch {
+	case back != nil && !c.frontTaken && back.Rect == c.img.Rect:
+		c.copyRegions(back, c.pubDirty)
+	case c.spare != nil:
+		back = c.spare
+		c.copyRegions(back, c.spareDirty)
+		c.copyRegions(back, c.pubDirty)
+		c.spare, c.spareDirty = nil, c.spareDirty[:0]
+	default:
+		back = cloneRGBA(c.img, nil)
+	}
+	if c.spare != nil {
+		for _, r := range c.pubDirty {
+			c.spareDirty = appendDirty(c.spareDirty, r)
+		}
+	}
+	c.front, c.img = c.img, back
+	c.pubDirty = c.pubDirty[:0]
+	c.frontTaken = false
+}
+
+// copyRegions copies the regions rs of the back buffer into dst.
+func (c *VncCanvas) copyRegions(dst *image.RGBA, rs []image.Rectangle) {
+	for _, r := range rs {
+		draw.Draw(dst, r, c.img, r.Min, draw.Src)
+	}
+}
+
+// maxDirtyRects is the length at which the dirty list is coalesced, so that a
+// long run of small updates without ClearDirty does not grow it unbounded.
+const maxDirtyRects = 256
+
+// DirtyRegions returns the regions of the canvas changed since the last call
+// to ClearDirty, by drawing, filling, copying, resizing or moving the cursor.
+// Overlapping and nearby regions are merged as by CoalesceRects, the way
+// SendFrame does, so the list covers every changed pixel but may also cover
+// some unchanged ones. Callers that encode frames can call it from
+// ClientConfig.OnFramebufferUpdate to learn what each update changed, and
+// re-encode only those regions. Only the geometry of the returned rectangles
+// is set.
+func (c *VncCanvas) DirtyRegions() []Rectangle {
+	c.mu.RLock() // Use a read lock
+	merged := CoalesceRects(c.dirty, coalesceGap)
+	c.mu.RUnlock()
+	regions := make([]Rectangle, len(merged))
+	for i, r := range merged {
+		regions[i] = Rectangle{X: uint16(r.Min.X), Y: uint16(r.Min.Y), Width: uint16(r.Dx()), Height: uint16(r.Dy())}
+	}
+	return regions
+}
+
+// DirtyTiles returns the tiles of a grid of tileSize by tileSize squares,
+// aligned to the canvas origin, that were changed since the last call to
+// ClearDirty, in row-major order. Tiles on the right and bottom edges are
+// clipped to the canvas. It suits renderers that keep the framebuffer in
+// fixed-size textures and upload only the tiles that changed. A tileSize
+// below 1 returns nil.
+func (c *VncCanvas) DirtyTiles(tileSize int) []image.Rectangle {
+	if tileSize < 1 {
+		return nil
+	}
+	c.mu.RLock() // Use a read lock
+	defer c.mu.RUnlock()
+	seen := make(map[image.Point]bool)
+	var tiles []image.Point
+	for _, d := range c.dirty {
+		for ty := d.Min.Y / tileSize; ty <= (d.Max.Y-1)/tileSize; ty++ {
+			for tx := d.Min.X / tileSize; tx <= (d.Max.X-1)/tileSize; tx++ {
+				if p := image.Pt(tx, ty); !seen[p] {
+					seen[p] = true
+					tiles = append(tiles, p)
+				}
+			}
+		}
+	}
+	sort.Slice(tiles, func(i, j int) bool {
+		if tiles[i].Y != tiles[j].Y {
+			return tiles[i].Y < tiles[j].Y
+		}
+		return tiles[i].X < tiles[j].X
+	})
+	rects := make([]image.Rectangle, len(tiles))
+	for i, p := range tiles {
+		rects[i] = image.Rect(p.X*tileSize, p.Y*tileSize, (p.X+1)*tileSize, (p.Y+1)*tileSize).Intersect(c.img.Bounds())
+	}
+	return rects
+}
+
+// ClearDirty empties the list returned by DirtyRegions.
+func (c *VncCanvas) ClearDirty() {
+	c.mu.Lock() // Use a full write lock for modifications
+	defer c.mu.Unlock()
+	c.dirty = c.dirty[:0]
+}
+
+// markDirty adds r, clipped to the canvas, to the dirty list and to the
+// regions Publish copies. The caller must hold the write lock.
+func (c *VncCanvas) markDirty(r image.Rectangle) {
+	r = r.Intersect(c.img.Bounds())
+	if r.Empty() {
+		return
+	}
+	c.dirty = appendDirty(c.dirty, r)
+	c.pubDirty = appendDirty(c.pubDirty, r)
+}
+
+// appendDirty adds r to list unless a region in it already covers r, and
+// coalesces the list once it reaches maxDirtyRects.
+func appendDirty(list []image.Rectangle, r image.Rectangle) []image.Rectangle {
+	for _, d := range list {
+		if r.In(d) {
+			return list
+		}
+	}
+	list = append(list, r)
+	if len(list) >= maxDirtyRects {
+		list = CoalesceRects(list, coalesceGap)
+	}
+	return list
+}
+
+// cloneRGBA copies src into dst, allocating a new image if dst is nil or has
+// different bounds.
+func cloneRGBA(src, dst *image.RGBA) *image.RGBA {
+	if dst == nil || dst.Rect != src.Rect {
+		dst = &image.RGBA{
+			Pix:    make([]byte, len(src.Pix)),
+			Stride: src.Stride,
+			Rect:   src.Rect,
+		}
+	}
+	copy(dst.Pix, src.Pix)
+	return dst
+}
+
+// At returns the color of the pixel at (x, y). Coordinates outside the canvas
+// return the zero color.
+func (c *VncCanvas) At(x, y int) color.RGBA {
+	c.mu.RLock() // Use a read lock
+	defer c.mu.RUnlock()
+	if !(image.Point{x, y}).In(c.img.Bounds()) {
+		return color.RGBA{}
+	}
+	return c.rgbaAt(x, y)
+}
+
+// rgbaAt returns the color of the pixel at (x, y), undoing the channel order.
+// The caller must hold at least the read lock.
+func (c *VncCanvas) rgbaAt(x, y int) color.RGBA {
+	clr := c.img.RGBAAt(x, y)
+	if c.order == ChannelsBGRA {
+		clr.R, clr.B = clr.B, clr.R
+	}
+	return clr
+}
+
+// RegionMatches reports whether the canvas region r matches ref, with each of
+// the red, green and blue channels within tolerance. ref is compared starting
+// at its own bounds' origin and must be at least as large as r; r must lie
+// inside the canvas.
+func (c *VncCanvas) RegionMatches(r image.Rectangle, ref image.Image, tolerance uint8) bool {
 	c.mu.RLock() // Use a read lock
 	defer c.mu.RUnlock()
-	// Return a copy to prevent race conditions if the caller modifies the image.
-	clone := *c.img
-	// Copy the pixel data as well.
-	clone.Pix = make([]byte, len(c.img.Pix))
-	copy(clone.Pix, c.img.Pix)
-	return &clone
+	if !r.In(c.img.Bounds()) {
+		return false
+	}
+	refOrigin := ref.Bounds().Min
+	if ref.Bounds().Dx() < r.Dx() || ref.Bounds().Dy() < r.Dy() {
+		return false
+	}
+	for y := 0; y < r.Dy(); y++ {
+		for x := 0; x < r.Dx(); x++ {
+			got := c.rgbaAt(r.Min.X+x, r.Min.Y+y)
+			want := color.RGBAModel.Convert(ref.At(refOrigin.X+x, refOrigin.Y+y)).(color.RGBA)
+			if !channelWithin(got.R, want.R, tolerance) ||
+				!channelWithin(got.G, want.G, tolerance) ||
+				!channelWithin(got.B, want.B, tolerance) {
+				return false
+			}
+		}
+	}
+	return true
 }
 
 // Draw updates a rectangular area of the canvas with the given image.
@@ -66,86 +451,352 @@ func (c *VncCanvas) Draw(img image.Image, rect *Rectangle) {
 	defer c.mu.Unlock()
 	r := image.Rect(int(rect.X), int(rect.Y), int(rect.X+rect.Width), int(rect.Y+rect.Height))
 	draw.Draw(c.img, r, img, image.Point{0, 0}, draw.Src)
+	if c.order == ChannelsBGRA {
+		swapRB(c.img, r)
+	}
+	c.markDirty(r)
+}
+
+// SmoothSeams applies a light blend across the edges of rect: each edge pixel
+// is moved a quarter of the way towards its neighbor just outside rect. Only
+// pixels inside rect change, so the pixels around it, which may not have
+// changed in this update, are never smeared. Edges on the canvas border are
+// left alone.
+func (c *VncCanvas) SmoothSeams(rect *Rectangle) {
+	c.mu.Lock() // Use a full write lock for modifications
+	defer c.mu.Unlock()
+	r := image.Rect(int(rect.X), int(rect.Y), int(rect.X)+int(rect.Width), int(rect.Y)+int(rect.Height)).Intersect(c.img.Bounds())
+	if r.Empty() {
+		return
+	}
+	c.markDirty(r)
+	b := c.img.Bounds()
+	if r.Min.Y > b.Min.Y {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			c.blendToward(x, r.Min.Y, x, r.Min.Y-1)
+		}
+	}
+	if r.Max.Y < b.Max.Y {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			c.blendToward(x, r.Max.Y-1, x, r.Max.Y)
+		}
+	}
+	if r.Min.X > b.Min.X {
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			c.blendToward(r.Min.X, y, r.Min.X-1, y)
+		}
+	}
+	if r.Max.X < b.Max.X {
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			c.blendToward(r.Max.X-1, y, r.Max.X, y)
+		}
+	}
+}
+
+// blendToward moves the pixel at (x0, y0) a quarter of the way towards the
+// pixel at (x1, y1), which is left as it is.
+func (c *VncCanvas) blendToward(x0, y0, x1, y1 int) {
+	i := c.img.PixOffset(x0, y0)
+	j := c.img.PixOffset(x1, y1)
+	for k := 0; k < 3; k++ {
+		p, q := uint16(c.img.Pix[i+k]), uint16(c.img.Pix[j+k])
+		c.img.Pix[i+k] = uint8((3*p + q) / 4)
+	}
 }
 
-// DrawBytes updates a rectangular area with raw pixel data.
-// The format of the pixel data is assumed to match the canvas's 32-bit RGBA format.
+// DrawBytes updates a rectangular area with raw pixel data in the canvas's
+// pixel format, as set by NewVncCanvas or SetPixelFormat. Each pixel is
+// converted with PixelToRGBA. Rows must be tightly packed.
 func (c *VncCanvas) DrawBytes(pixelData []byte, rect *Rectangle) error {
 	c.mu.Lock() // Use a full write lock for modifications
 	defer c.mu.Unlock()
-	return c.drawBytes(pixelData, rect)
+	return c.drawBytes(pixelData, int(rect.Width)*c.pf.BytesPerPixel(), rect)
+}
+
+// DrawBytesStride is like DrawBytes, but rows of pixelData start stride bytes
+// apart, so it can draw from sub-images and row-padded buffers.
+func (c *VncCanvas) DrawBytesStride(pixelData []byte, stride int, rect *Rectangle) error {
+	c.mu.Lock() // Use a full write lock for modifications
+	defer c.mu.Unlock()
+	return c.drawBytes(pixelData, stride, rect)
+}
+
+// drawBytes is the internal, non-locking version of DrawBytesStride.
+func (c *VncCanvas) drawBytes(pixelData []byte, stride int, rect *Rectangle) error {
+	if c.drawBytesDirect(pixelData, stride, rect) {
+		return nil
+	}
+	rgbaData, err := c.bytesToRGBA(pixelData, stride, rect)
+	if err != nil || rgbaData == nil {
+		return err
+	}
+	return c.drawRGBA(rgbaData, int(rect.Width)*4, rect)
+}
+
+// drawBytesDirect is the fast path of drawBytes for the common 32-bit true
+// color formats whose channels each fill one byte of the pixel. It copies the
+// channel bytes straight into the framebuffer, skipping the intermediate RGBA
+// buffer and PixelToRGBA, and serves either channel order without a swap. It
+// reports false, drawing nothing, if the format or
+// the rectangle does not qualify.
+func (c *VncCanvas) drawBytesDirect(pixelData []byte, stride int, rect *Rectangle) bool {
+	ri, gi, bi, ok := byteChannels(&c.pf)
+	if !ok {
+		return false
+	}
+	if c.order == ChannelsBGRA {
+		ri, bi = bi, ri
+	}
+	width, height := int(rect.Width), int(rect.Height)
+	r := image.Rect(int(rect.X), int(rect.Y), int(rect.X)+width, int(rect.Y)+height)
+	if width == 0 || height == 0 || !r.In(c.img.Bounds()) || stride < width*4 ||
+		len(pixelData) < stride*(height-1)+width*4 {
+		return false
+	}
+	for y := 0; y < height; y++ {
+		src := pixelData[y*stride : y*stride+width*4]
+		dst := c.img.Pix[c.img.PixOffset(r.Min.X, r.Min.Y+y):]
+		for i := 0; i < len(src); i += 4 {
+			dst[i], dst[i+1], dst[i+2], dst[i+3] = src[i+ri], src[i+gi], src[i+bi], 255
+		}
+	}
+	c.markDirty(r)
+	return true
+}
+
+// byteChannels returns the byte offsets of the red, green and blue channels
+// within a pixel of pf, if pf is a 32-bit true color format with 8-bit
+// channels on byte boundaries.
+func byteChannels(pf *PixelFormat) (r, g, b int, ok bool) {
+	if pf.TrueColor == 0 || pf.BPP != 32 || pf.RedMax != 255 || pf.GreenMax != 255 || pf.BlueMax != 255 {
+		return 0, 0, 0, false
+	}
+	offset := func(shift uint8) int {
+		if pf.BigEndian != 0 {
+			return 3 - int(shift)/8
+		}
+		return int(shift) / 8
+	}
+	for _, shift := range []uint8{pf.RedShift, pf.GreenShift, pf.BlueShift} {
+		if shift%8 != 0 || shift > 24 {
+			return 0, 0, 0, false
+		}
+	}
+	return offset(pf.RedShift), offset(pf.GreenShift), offset(pf.BlueShift), true
+}
+
+// drawBytesShared is like DrawBytes, but converts the pixels under the read
+// lock and takes the write lock only to copy them in, so that several
+// rectangles can be converted at once. Callers must ensure that rectangles
+// drawn concurrently do not overlap.
+func (c *VncCanvas) drawBytesShared(pixelData []byte, rect *Rectangle) error {
+	c.mu.RLock()
+	rgbaData, err := c.bytesToRGBA(pixelData, int(rect.Width)*c.pf.BytesPerPixel(), rect)
+	c.mu.RUnlock()
+	if err != nil || rgbaData == nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.drawRGBA(rgbaData, int(rect.Width)*4, rect)
 }
 
-// drawBytes is the internal, non-locking version of DrawBytes.
-func (c *VncCanvas) drawBytes(pixelData []byte, rect *Rectangle) error {
+// bytesToRGBA converts the pixels of rect from the canvas's pixel format to
+// tightly packed RGBA. It returns nil for an empty rectangle. The caller must
+// hold at least the read lock.
+func (c *VncCanvas) bytesToRGBA(pixelData []byte, stride int, rect *Rectangle) ([]byte, error) {
+	bytesPerPixel := c.pf.BytesPerPixel()
+	width, height := int(rect.Width), int(rect.Height)
+	if bytesPerPixel == 0 {
+		return nil, errors.New("canvas: bytes per pixel is zero")
+	}
+	if width == 0 || height == 0 {
+		return nil, nil
+	}
+	if stride < width*bytesPerPixel {
+		return nil, fmt.Errorf("canvas: stride %d is shorter than a row of %d bytes", stride, width*bytesPerPixel)
+	}
+	if need := stride*(height-1) + width*bytesPerPixel; len(pixelData) < need {
+		return nil, fmt.Errorf("canvas: got %d bytes of pixel data, need %d", len(pixelData), need)
+	}
+
+	order := pixelOrder(&c.pf)
+	rgbaData := make([]byte, width*height*4)
+	for y := 0; y < height; y++ {
+		row := pixelData[y*stride:]
+		for x := 0; x < width; x++ {
+			var pixel uint32
+			b := row[x*bytesPerPixel:]
+			switch bytesPerPixel {
+			case 1:
+				pixel = uint32(b[0])
+			case 2:
+				pixel = uint32(order.Uint16(b))
+			case 4:
+				pixel = order.Uint32(b)
+			default:
+				return nil, fmt.Errorf("canvas: unsupported BPP: %d", c.pf.BPP)
+			}
+			clr := PixelToRGBA(pixel, &c.pf, &c.colorMap)
+			i := (y*width + x) * 4
+			rgbaData[i], rgbaData[i+1], rgbaData[i+2], rgbaData[i+3] = clr.R, clr.G, clr.B, clr.A
+		}
+	}
+	return rgbaData, nil
+}
+
+// DrawRGBA updates a rectangular area with 32-bit RGBA pixel data, for
+// decoders that have already converted pixels out of the connection's format.
+func (c *VncCanvas) DrawRGBA(pixelData []byte, rect *Rectangle) error {
+	c.mu.Lock() // Use a full write lock for modifications
+	defer c.mu.Unlock()
+	return c.drawRGBA(pixelData, int(rect.Width)*4, rect)
+}
+
+// drawRGBA is the internal, non-locking version of DrawRGBA. Rows of
+// pixelData start stride bytes apart.
+func (c *VncCanvas) drawRGBA(pixelData []byte, stride int, rect *Rectangle) error {
 	img := &image.RGBA{
 		Pix:    pixelData,
-		Stride: int(rect.Width) * 4, // Assuming 32bpp RGBA
+		Stride: stride,
 		Rect:   image.Rect(0, 0, int(rect.Width), int(rect.Height)),
 	}
 	r := image.Rect(int(rect.X), int(rect.Y), int(rect.X+rect.Width), int(rect.Y+rect.Height))
-	draw.Draw(c.img, r, img, image.Point{0, 0}, draw.Src)
+	c.markDirty(r)
+	if c.order != ChannelsBGRA {
+		draw.Draw(c.img, r, img, image.Point{0, 0}, draw.Src)
+		return nil
+	}
+	clip := r.Intersect(c.img.Bounds())
+	for y := clip.Min.Y; y < clip.Max.Y; y++ {
+		src := img.Pix[img.PixOffset(clip.Min.X-r.Min.X, y-r.Min.Y):img.PixOffset(clip.Max.X-r.Min.X, y-r.Min.Y)]
+		dst := c.img.Pix[c.img.PixOffset(clip.Min.X, y):]
+		for i := 0; i < len(src); i += 4 {
+			dst[i], dst[i+1], dst[i+2], dst[i+3] = src[i+2], src[i+1], src[i], src[i+3]
+		}
+	}
 	return nil
 }
 
 // DrawPalette updates a rectangular area with indexed palette data.
+// paletteData holds the palette entries as pixels in the canvas's pixel
+// format; see DrawIndexed for the layout of indexedData.
 func (c *VncCanvas) DrawPalette(indexedData, paletteData []byte, bitsPerIndex int, rect *Rectangle) error {
 	c.mu.Lock() // Use a full write lock for modifications
 	defer c.mu.Unlock()
+	bytesPerPixel := c.pf.BytesPerPixel()
+	if bytesPerPixel == 0 {
+		return errors.New("canvas: bytes per pixel is zero")
+	}
+	palette := make([]color.RGBA, len(paletteData)/bytesPerPixel)
+	for i := range palette {
+		clr, err := c.pixelColor(paletteData[i*bytesPerPixel:])
+		if err != nil {
+			return err
+		}
+		palette[i] = clr
+	}
+	return c.drawIndexed(indexedData, palette, bitsPerIndex, rect)
+}
 
-	// This is a complex operation that requires converting indexed data to RGBA.
-	if bitsPerIndex != 1 && bitsPerIndex != 8 {
+// DrawIndexed updates a rectangular area with indexed data, where each index
+// picks a color from palette. With 1 bit per index, each row starts on a byte
+// boundary and the most significant bit comes first; with 8 bits, there is
+// one byte per pixel. Indexes beyond the palette draw black.
+func (c *VncCanvas) DrawIndexed(indexedData []byte, palette []color.RGBA, bitsPerIndex int, rect *Rectangle) error {
+	c.mu.Lock() // Use a full write lock for modifications
+	defer c.mu.Unlock()
+	return c.drawIndexed(indexedData, palette, bitsPerIndex, rect)
+}
+
+// drawIndexed is the internal, non-locking version of DrawIndexed.
+func (c *VncCanvas) drawIndexed(indexedData []byte, palette []color.RGBA, bitsPerIndex int, rect *Rectangle) error {
+	width, height := int(rect.Width), int(rect.Height)
+	var rowSize int
+	switch bitsPerIndex {
+	case 1:
+		rowSize = (width + 7) / 8
+	case 8:
+		rowSize = width
+	default:
 		return errors.New("unsupported bitsPerIndex for palette")
 	}
+	if len(indexedData) < rowSize*height {
+		return fmt.Errorf("canvas: got %d bytes of indexed data, need %d", len(indexedData), rowSize*height)
+	}
 
-	rgbaData := make([]byte, int(rect.Width)*int(rect.Height)*4)
-	bytesPerPixel := len(paletteData) / 256 // Assuming full 256-color palette data format
-
-	if bitsPerIndex == 8 {
-		for i, index := range indexedData {
-			offset := int(index) * bytesPerPixel
-			rgbaData[i*4] = paletteData[offset]
-			rgbaData[i*4+1] = paletteData[offset+1]
-			rgbaData[i*4+2] = paletteData[offset+2]
-			rgbaData[i*4+3] = 255
-		}
-	} else { // bitsPerIndex == 1
-		for i := 0; i < len(rgbaData)/4; i++ {
-			byteIndex := i / 8
-			bitIndex := 7 - (i % 8)
-			paletteIndex := (indexedData[byteIndex] >> bitIndex) & 1
-			offset := int(paletteIndex) * bytesPerPixel
-			rgbaData[i*4] = paletteData[offset]
-			rgbaData[i*4+1] = paletteData[offset+1]
-			rgbaData[i*4+2] = paletteData[offset+2]
-			rgbaData[i*4+3] = 255
+	rgbaData := make([]byte, width*height*4)
+	for y := 0; y < height; y++ {
+		row := indexedData[y*rowSize:]
+		for x := 0; x < width; x++ {
+			var index int
+			if bitsPerIndex == 8 {
+				index = int(row[x])
+			} else {
+				index = int(row[x/8]>>(7-x%8)) & 1
+			}
+			clr := color.RGBA{A: 255}
+			if index < len(palette) {
+				clr = palette[index]
+			}
+			i := (y*width + x) * 4
+			rgbaData[i], rgbaData[i+1], rgbaData[i+2], rgbaData[i+3] = clr.R, clr.G, clr.B, clr.A
 		}
 	}
-
-	return c.drawBytes(rgbaData, rect)
+	return c.drawRGBA(rgbaData, width*4, rect)
 }
 
-// Fill fills a rectangular area of the canvas with a single color.
+// Fill fills a rectangular area of the canvas with a single color, given as
+// one pixel in the canvas's pixel format.
 func (c *VncCanvas) Fill(colorBytes []byte, rect *Rectangle) error {
 	c.mu.Lock() // Use a full write lock for modifications
 	defer c.mu.Unlock()
-	col := color.RGBA{A: 255}
-	if len(colorBytes) >= 3 {
-		// Assuming BGR order, common in VNC.
-		col.R = colorBytes[2]
-		col.G = colorBytes[1]
-		col.B = colorBytes[0]
-	}
-	if len(colorBytes) == 4 {
-		col.A = colorBytes[3]
+	col, err := c.pixelColor(colorBytes)
+	if err != nil {
+		return err
 	}
 	return c.fill(col, rect)
 }
 
+// FillColor fills a rectangular area of the canvas with col.
+func (c *VncCanvas) FillColor(col color.Color, rect *Rectangle) error {
+	c.mu.Lock() // Use a full write lock for modifications
+	defer c.mu.Unlock()
+	return c.fill(col, rect)
+}
+
+// pixelColor converts one pixel in the canvas's pixel format to a color. The
+// caller must hold at least the read lock.
+func (c *VncCanvas) pixelColor(b []byte) (color.RGBA, error) {
+	bytesPerPixel := c.pf.BytesPerPixel()
+	if len(b) < bytesPerPixel {
+		return color.RGBA{}, fmt.Errorf("canvas: got %d bytes for a %d-byte pixel", len(b), bytesPerPixel)
+	}
+	order := pixelOrder(&c.pf)
+	var pixel uint32
+	switch bytesPerPixel {
+	case 1:
+		pixel = uint32(b[0])
+	case 2:
+		pixel = uint32(order.Uint16(b))
+	case 4:
+		pixel = order.Uint32(b)
+	default:
+		return color.RGBA{}, fmt.Errorf("canvas: unsupported BPP: %d", c.pf.BPP)
+	}
+	return PixelToRGBA(pixel, &c.pf, &c.colorMap), nil
+}
+
 // fill is the internal, non-locking version of Fill.
 func (c *VncCanvas) fill(col color.Color, rect *Rectangle) error {
 	r := image.Rect(int(rect.X), int(rect.Y), int(rect.X+rect.Width), int(rect.Y+rect.Height))
+	if c.order == ChannelsBGRA {
+		clr := color.RGBAModel.Convert(col).(color.RGBA)
+		clr.R, clr.B = clr.B, clr.R
+		col = clr
+	}
 	draw.Draw(c.img, r, &image.Uniform{C: col}, image.Point{}, draw.Src)
+	c.markDirty(r)
 	return nil
 }
 
@@ -158,6 +809,7 @@ func (c *VncCanvas) Copy(src, dst, size image.Point) error {
 	dstRect := image.Rect(dst.X, dst.Y, dst.X+size.X, dst.Y+size.Y)
 
 	draw.Draw(c.img, dstRect, c.img, src, draw.Src)
+	c.markDirty(dstRect)
 	return nil
 }
 
@@ -169,6 +821,7 @@ func (c *VncCanvas) SetCursor(cursorImg *image.RGBA, cursorMask *image.Alpha, ho
 	c.cursorMask = cursorMask
 	c.cursorHotX = hotX
 	c.cursorHotY = hotY
+	c.cursorChanged = true
 }
 
 // MoveCursor moves the cursor to a new position.
@@ -183,21 +836,57 @@ func (c *VncCanvas) MoveCursor(x, y int) {
 func (c *VncCanvas) PaintCursor() {
 	c.mu.Lock() // Use a full write lock for modifications
 	defer c.mu.Unlock()
-	if c.cursorImg == nil || c.cursorShown {
+	if c.cursorShown {
+		return
+	}
+	if c.cursorImg == nil {
+		if c.cursorChanged {
+			c.markDirty(c.paintedRect)
+			c.paintedRect, c.cursorChanged = image.Rectangle{}, false
+		}
 		return
 	}
 	r := c.cursorImg.Bounds().Add(image.Point{c.cursorX - c.cursorHotX, c.cursorY - c.cursorHotY})
+
+	// Save what the cursor covers, clipped to the canvas, so RemoveCursor
+	// can put it back. The saved area is kept independently of the cursor
+	// image, which SetCursor may replace before the next RemoveCursor.
+	c.underRect = r.Intersect(c.img.Bounds())
+	if c.cursorUnder == nil || c.cursorUnder.Rect.Size() != c.underRect.Size() {
+		c.cursorUnder = image.NewRGBA(image.Rectangle{Max: c.underRect.Size()})
+	}
+	draw.Draw(c.cursorUnder, c.cursorUnder.Rect, c.img, c.underRect.Min, draw.Src)
+
+	// Blending works channel by channel, so a BGRA framebuffer is blended
+	// against the RGBA cursor in RGBA order and swapped back.
+	if c.order == ChannelsBGRA {
+		swapRB(c.img, c.underRect)
+	}
 	draw.DrawMask(c.img, r, c.cursorImg, image.Point{}, c.cursorMask, image.Point{}, draw.Over)
+	if c.order == ChannelsBGRA {
+		swapRB(c.img, c.underRect)
+	}
 	c.cursorShown = true
+
+	// The cursor is removed and painted again around every message, which
+	// only changes the framebuffer if it moved or changed shape.
+	if c.cursorChanged || c.underRect != c.paintedRect {
+		c.markDirty(c.paintedRect)
+		c.markDirty(c.underRect)
+		c.paintedRect, c.cursorChanged = c.underRect, false
+	}
 }
 
-// RemoveCursor is a placeholder. A real implementation needs to restore the
-// background under the cursor, which requires saving it before painting.
+// RemoveCursor restores the framebuffer pixels that were under the cursor
+// when it was last painted.
 func (c *VncCanvas) RemoveCursor() {
 	c.mu.Lock() // Use a full write lock for modifications
 	defer c.mu.Unlock()
-	// To properly remove a cursor, you would need to have saved the pixels
-	// that were underneath it before it was painted. Then you would restore
-	// them here. For now, we rely on the server to send updates for the region.
+	if !c.cursorShown {
+		return
+	}
+	if c.cursorUnder != nil {
+		draw.Draw(c.img, c.underRect, c.cursorUnder, image.Point{}, draw.Src)
+	}
 	c.cursorShown = false
 }
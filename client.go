@@ -1,386 +1,753 @@
-package avacadovnc
-
-import (
-	"bufio"
-	"context"
-	"encoding/binary"
-	"errors"
-	"fmt"
-	"io"
-	"net"
-	"sync"
-	"time"
-
-	"github.com/bigangryrobot/avacadovnc/logger"
-
-)
-
-var (
-	// DefaultClientHandlers is the default set of handlers for the VNC client handshake.
-	// These handlers are executed in sequence to negotiate the protocol version,
-	// security, and initial framebuffer state with the server.
-	DefaultClientHandlers = []Handler{
-		&DefaultClientVersionHandler{},
-		&DefaultClientSecurityHandler{},
-		&DefaultClientClientInitHandler{},
-		&DefaultClientServerInitHandler{},
-		&DefaultClientMessageHandler{},
-	}
-)
-
-// Connect establishes a connection with a VNC server and performs the initial handshake.
-// It takes a context for cancellation, a network connection, and a client configuration.
-// On success, it returns a fully initialized ClientConn ready for interaction.
-// On failure, it returns an error and ensures the connection is closed.
-func Connect(ctx context.Context, c net.Conn, cfg *ClientConfig) (*ClientConn, error) {
-	// Set an initial deadline for the handshake process.
-	// This prevents a non-responsive server from holding the connection indefinitely.
-	c.SetDeadline(time.Now().Add(10 * time.Second))
-	defer c.SetDeadline(time.Time{}) // Clear the deadline after the handshake is done.
-
-	conn, err := NewClientConn(c, cfg)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create client connection: %w", err)
-	}
-
-	// Use default handlers if none are provided in the config.
-	if len(cfg.Handlers) == 0 {
-		cfg.Handlers = DefaultClientHandlers
-	}
-
-	// Execute the handshake handlers sequentially.
-	for _, h := range cfg.Handlers {
-		if err := h.Handle(conn); err != nil {
-			conn.Close() // Ensure connection is closed on any handshake failure.
-			return nil, fmt.Errorf("handshake failed during handler %T: %w", h, err)
-		}
-	}
-
-	return conn, nil
-}
-
-// ClientConn represents a client connection to a VNC server. It manages all
-// state and communication with the server, and implements the Conn interface.
-type ClientConn struct {
-	c        net.Conn
-	br       *bufio.Reader
-	bw       *bufio.Writer
-	cfg      *ClientConfig
-	protocol string
-
-	colorMap    ColorMap
-	Canvas      *VncCanvas
-	desktopName []byte
-	encodings   []Encoding
-
-	securityHandler SecurityHandler
-
-	fbHeight uint16
-	fbWidth  uint16
-
-	pixelFormat PixelFormat
-
-	quit   chan struct{}
-	wg     sync.WaitGroup
-	mu     sync.Mutex
-	closed bool
-}
-
-// NewClientConn creates a new, uninitialized client connection.
-func NewClientConn(c net.Conn, cfg *ClientConfig) (*ClientConn, error) {
-	if len(cfg.Encodings) == 0 {
-		return nil, errors.New("at least one encoding must be specified in the client config")
-	}
-	return &ClientConn{
-		c:           c,
-		cfg:         cfg,
-		br:          bufio.NewReader(c),
-		bw:          bufio.NewWriter(c),
-		encodings:   cfg.Encodings,
-		pixelFormat: cfg.PixelFormat,
-		quit:        make(chan struct{}),
-	}, nil
-}
-
-// Config returns the client configuration.
-func (c *ClientConn) Config() interface{} {
-	return c.cfg
-}
-
-// GetEncInstance returns the encoding instance for a given encoding type.
-func (c *ClientConn) GetEncInstance(typ EncodingType) Encoding {
-	for _, enc := range c.encodings {
-		if enc.Type() == typ {
-			return enc
-		}
-	}
-	return nil
-}
-
-// Wait blocks until the connection is fully closed and all goroutines have exited.
-func (c *ClientConn) Wait() {
-	c.wg.Wait()
-}
-
-// Conn returns the underlying network connection.
-func (c *ClientConn) Conn() net.Conn {
-	return c.c
-}
-
-// SetProtoVersion sets the protocol version for the connection.
-func (c *ClientConn) SetProtoVersion(pv string) {
-	c.protocol = pv
-}
-
-// SetEncodings sends a SetEncodings message to the server.
-func (c *ClientConn) SetEncodings(encs []EncodingType) error {
-	msg := &SetEncodings{
-		Encodings: encs,
-	}
-	return msg.Write(c)
-}
-
-// Flush writes any buffered data to the underlying connection.
-func (c *ClientConn) Flush() error {
-	return c.bw.Flush()
-}
-
-// Close gracefully shuts down the client connection, stops all related goroutines,
-// and closes the underlying network connection. It is safe to call multiple times.
-func (c *ClientConn) Close() error {
-	c.mu.Lock()
-	if c.closed {
-		c.mu.Unlock()
-		return nil
-	}
-	c.closed = true
-	c.mu.Unlock()
-
-	close(c.quit)
-	err := c.c.Close()
-	c.wg.Wait()
-	return err
-}
-
-// Read reads data from the connection's buffered reader.
-func (c *ClientConn) Read(buf []byte) (int, error) {
-	return c.br.Read(buf)
-}
-
-// Write writes data to the connection's buffered writer.
-func (c *ClientConn) Write(buf []byte) (int, error) {
-	return c.bw.Write(buf)
-}
-
-// ColorMap returns the color map for the connection.
-func (c *ClientConn) ColorMap() ColorMap {
-	return c.colorMap
-}
-
-// SetColorMap sets the color map for the connection.
-func (c *ClientConn) SetColorMap(cm ColorMap) {
-	c.colorMap = cm
-}
-
-// DesktopName returns the desktop name of the remote session.
-func (c *ClientConn) DesktopName() []byte {
-	return c.desktopName
-}
-
-// PixelFormat returns the pixel format of the connection.
-func (c *ClientConn) PixelFormat() PixelFormat {
-	return c.pixelFormat
-}
-
-// SetDesktopName sets the desktop name.
-func (c *ClientConn) SetDesktopName(name []byte) {
-	c.desktopName = name
-}
-
-// SetPixelFormat sets the pixel format for the connection.
-func (c *ClientConn) SetPixelFormat(pf PixelFormat) error {
-	c.pixelFormat = pf
-	return nil
-}
-
-// Encodings returns the list of supported encoding handlers.
-func (c *ClientConn) Encodings() []Encoding {
-	return c.encodings
-}
-
-// Width returns the framebuffer width.
-func (c *ClientConn) Width() uint16 {
-	return c.fbWidth
-}
-
-// Height returns the framebuffer height.
-func (c *ClientConn) Height() uint16 {
-	return c.fbHeight
-}
-
-// Protocol returns the negotiated VNC protocol version.
-func (c *ClientConn) Protocol() string {
-	return c.protocol
-}
-
-// SetWidth sets the framebuffer width.
-func (c *ClientConn) SetWidth(width uint16) {
-	c.fbWidth = width
-}
-
-// SetHeight sets the framebuffer height.
-func (c *ClientConn) SetHeight(height uint16) {
-	c.fbHeight = height
-}
-
-// SecurityHandler returns the security handler for the connection.
-func (c *ClientConn) SecurityHandler() SecurityHandler {
-	return c.securityHandler
-}
-
-// SetSecurityHandler sets the security handler.
-func (c *ClientConn) SetSecurityHandler(sechandler SecurityHandler) error {
-	c.securityHandler = sechandler
-	return nil
-}
-
-// ResetAllEncodings resets the internal state of all supported encoding handlers.
-func (c *ClientConn) ResetAllEncodings() {
-	for _, enc := range c.encodings {
-		enc.Reset()
-	}
-}
-
-// DefaultClientMessageHandler is the default handler for processing server messages
-// after the handshake is complete. It starts the main message handling loops.
-type DefaultClientMessageHandler struct{}
-
-// Handle starts the message handling loops for the client.
-func (*DefaultClientMessageHandler) Handle(c Conn) error {
-	logger.Trace("starting DefaultClientMessageHandler")
-	clientConn, ok := c.(*ClientConn)
-	if !ok {
-		return errors.New("handler expected a *ClientConn")
-	}
-	cfg := clientConn.cfg
-
-	// Create a map of server message types to their handlers for quick lookup.
-	serverMessages := make(map[ServerMessageType]ServerMessage)
-	for _, m := range cfg.Messages {
-		serverMessages[m.Type()] = m
-	}
-
-	// Start the goroutines for handling incoming and outgoing messages.
-	clientConn.wg.Add(2)
-	go clientConn.handleIncomingMessages(serverMessages)
-	go clientConn.handleOutgoingMessages()
-
-	// Set the client's supported encodings on the server.
-	var encTypes []EncodingType
-	for _, enc := range clientConn.Encodings() {
-		encTypes = append(encTypes, enc.Type())
-	}
-	logger.Tracef("setting encodings: %v", encTypes)
-	if err := clientConn.SetEncodings(encTypes); err != nil {
-		return fmt.Errorf("failed to set encodings: %w", err)
-	}
-
-	// Send the initial framebuffer update request.
-	req := FramebufferUpdateRequest{
-		Inc:    1, // Request an incremental update.
-		X:      0,
-		Y:      0,
-		Width:  clientConn.Width(),
-		Height: clientConn.Height(),
-	}
-	logger.Tracef("sending initial framebuffer update request: %+v", req)
-	return req.Write(clientConn)
-}
-
-// handleIncomingMessages runs in a dedicated goroutine, reading and processing
-// messages from the server.
-func (c *ClientConn) handleIncomingMessages(serverMessages map[ServerMessageType]ServerMessage) {
-	defer c.wg.Done()
-	defer c.Close() // Ensure connection is closed if this loop exits.
-
-	for {
-		// Set a read deadline to detect idle or hung connections.
-		// The deadline is extended each time a message is successfully read.
-		c.c.SetReadDeadline(time.Now().Add(30 * time.Second))
-
-		// Check for quit signal without blocking.
-		select {
-		case <-c.quit:
-			return
-		default:
-		}
-
-		var msgType ServerMessageType
-		if err := binary.Read(c, binary.BigEndian, &msgType); err != nil {
-			// A read error, often io.EOF, means the connection is closed.
-			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
-				logger.Errorf("error reading message type: %v", err)
-			}
-			return
-		}
-
-		msg, ok := serverMessages[msgType]
-		if !ok {
-			// Include the remote address for easier debugging of client issues.
-			logger.Errorf("unsupported message type %d from server %s", msgType, c.c.RemoteAddr())
-			return // Unknown message type is a fatal error.
-		}
-
-		if c.Canvas != nil {
-			c.Canvas.RemoveCursor()
-		}
-
-		parsedMsg, err := msg.Read(c)
-		if err != nil {
-			logger.Errorf("error reading message body for type %d: %v", msgType, err)
-			return
-		}
-
-		if c.Canvas != nil {
-			c.Canvas.PaintCursor()
-		}
-
-		// Send the parsed message to the application logic.
-		select {
-		case c.cfg.ServerMessageCh <- parsedMsg:
-		case <-c.quit:
-			return
-		}
-	}
-}
-
-// handleOutgoingMessages runs in a dedicated goroutine, sending messages
-// from the client to the server.
-func (c *ClientConn) handleOutgoingMessages() {
-	defer c.wg.Done()
-
-	for {
-		select {
-		case msg, ok := <-c.cfg.ClientMessageCh:
-			if !ok {
-				// Channel closed, which is a signal to shut down.
-				return
-			}
-			if err := msg.Write(c); err != nil {
-				if !errors.Is(err, net.ErrClosed) {
-					logger.Errorf("error writing message: %v", err)
-				}
-				c.Close()
-				return
-			}
-			if err := c.Flush(); err != nil {
-				if !errors.Is(err, net.ErrClosed) {
-					logger.Errorf("error flushing writer: %v", err)
-				}
-				return
-			}
-		case <-c.quit:
-			return
-		}
-	}
-}
+package avacadovnc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image/color"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/bigangryrobot/avacadovnc/logger"
+
+)
+
+var (
+	// DefaultClientHandlers is the default set of handlers for the VNC client handshake.
+	// These handlers are executed in sequence to negotiate the protocol version,
+	// security, and initial framebuffer state with the server.
+	DefaultClientHandlers = []Handler{
+		&DefaultClientVersionHandler{},
+		&DefaultClientSecurityHandler{},
+		&DefaultClientClientInitHandler{},
+		&DefaultClientServerInitHandler{},
+		&DefaultClientMessageHandler{},
+	}
+)
+
+// defaultHandshakeTimeout is used when ClientConfig.HandshakeTimeout is zero.
+const defaultHandshakeTimeout = 10 * time.Second
+
+// Connect establishes a connection with a VNC server and performs the initial handshake.
+// It takes a context for cancellation, a network connection, and a client configuration.
+// On success, it returns a fully initialized ClientConn ready for interaction.
+// On failure, it returns an error and ensures the connection is closed.
+// Cancelling ctx aborts the handshake, and the error then wraps ctx.Err().
+func Connect(ctx context.Context, c net.Conn, cfg *ClientConfig) (*ClientConn, error) {
+	// Set an initial deadline for the handshake process.
+	// This prevents a non-responsive server from holding the connection indefinitely.
+	timeout := cfg.HandshakeTimeout
+	if timeout == 0 {
+		timeout = defaultHandshakeTimeout
+	}
+	if timeout > 0 {
+		c.SetDeadline(time.Now().Add(timeout))
+		defer c.SetDeadline(time.Time{}) // Clear the deadline after the handshake is done.
+	}
+
+	conn, err := NewClientConn(c, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client connection: %w", err)
+	}
+
+	// Use default handlers if none are provided in the config.
+	if len(cfg.Handlers) == 0 {
+		cfg.Handlers = DefaultClientHandlers
+	}
+
+	// Cancelling ctx closes the connection, which unblocks a handler stuck
+	// in a read or write.
+	stop := context.AfterFunc(ctx, func() { c.Close() })
+
+	// Execute the handshake handlers sequentially.
+	for _, h := range cfg.Handlers {
+		if err := h.Handle(conn); err != nil {
+			stop()
+			conn.Close() // Ensure connection is closed on any handshake failure.
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			}
+			return nil, fmt.Errorf("handshake failed during handler %T: %w", h, err)
+		}
+	}
+	if !stop() {
+		// ctx was cancelled just as the handshake finished, and the
+		// connection is already being closed.
+		conn.Close()
+		return nil, fmt.Errorf("handshake failed: %w", ctx.Err())
+	}
+
+	return conn, nil
+}
+
+// ClientConn represents a client connection to a VNC server. It manages all
+// state and communication with the server, and implements the Conn interface.
+type ClientConn struct {
+	c        net.Conn
+	br       *bufio.Reader
+	bw       *bufio.Writer
+	cfg      *ClientConfig
+	protocol string
+
+	colorMap    ColorMap
+	Canvas      *VncCanvas
+	desktopName []byte
+	encodings   []Encoding
+
+	securityHandler SecurityHandler
+
+	fbHeight uint16
+	fbWidth  uint16
+
+	pixelFormat PixelFormat
+	decodeMu    sync.Mutex // Held by the read loop while it decodes a message
+
+	quit   chan struct{}
+	wg     sync.WaitGroup
+	mu     sync.Mutex
+	wmu    sync.Mutex // Serializes Send
+	closed bool
+
+	nilChWarning sync.Once
+
+	encMu        sync.Mutex // Guards advertised, pendingReset and lastRect
+	advertised   []EncodingType
+	pendingReset []EncodingType
+	lastRect     bool // LastRect has been advertised at some point
+
+	screens []Screen // Guarded by mu
+
+	extendedKeys bool // The server accepts QEMU extended key events; guarded by mu
+
+	reqMu          sync.Mutex // Guards the AutoRequest state below
+	reqOutstanding bool
+	reqPending     bool
+	reqPendingFull bool
+
+	continuous          bool // Continuous updates are enabled
+	continuousSupported bool // The server has sent EndOfContinuousUpdates
+	fenceSupported      bool // The server has sent a fence
+
+	frameMu   sync.Mutex    // Guards frameDone
+	frameDone chan struct{} // Closed when the next FramebufferUpdate is decoded
+}
+
+// NewClientConn creates a new, uninitialized client connection.
+func NewClientConn(c net.Conn, cfg *ClientConfig) (*ClientConn, error) {
+	if len(cfg.Encodings) == 0 {
+		return nil, fmt.Errorf("at least one encoding must be specified in the client config: %w", ErrNoCommonEncoding)
+	}
+	return &ClientConn{
+		c:           c,
+		cfg:         cfg,
+		br:          bufio.NewReader(c),
+		bw:          bufio.NewWriter(c),
+		encodings:   cfg.Encodings,
+		pixelFormat: cfg.PixelFormat,
+		quit:        make(chan struct{}),
+	}, nil
+}
+
+// Config returns the client configuration.
+func (c *ClientConn) Config() interface{} {
+	return c.cfg
+}
+
+// IsClient reports true: a ClientConn is the client end of a connection.
+func (c *ClientConn) IsClient() bool {
+	return true
+}
+
+// GetEncInstance returns the encoding instance for a given encoding type.
+func (c *ClientConn) GetEncInstance(typ EncodingType) Encoding {
+	for _, enc := range c.encodings {
+		if enc.Type() == typ {
+			return enc
+		}
+	}
+	return nil
+}
+
+// Wait blocks until the connection is fully closed and all goroutines have exited.
+func (c *ClientConn) Wait() {
+	c.wg.Wait()
+}
+
+// Conn returns the underlying network connection.
+func (c *ClientConn) Conn() net.Conn {
+	return c.c
+}
+
+// SetProtoVersion sets the protocol version for the connection.
+func (c *ClientConn) SetProtoVersion(pv string) {
+	c.protocol = pv
+}
+
+// SetEncodings sends a SetEncodings message to the server.
+func (c *ClientConn) SetEncodings(encs []EncodingType) error {
+	msg := &SetEncodings{
+		Encodings: encs,
+	}
+	if err := c.send(msg); err != nil {
+		return err
+	}
+	c.encMu.Lock()
+	c.advertised = append([]EncodingType(nil), encs...)
+	for _, e := range encs {
+		c.lastRect = c.lastRect || e == EncLastRect
+	}
+	c.encMu.Unlock()
+	return nil
+}
+
+// UpdateEncodings replaces the encodings advertised to the server mid-session.
+// Decoders for encodings that are added or dropped are reset before the next
+// message is read, so they start from a clean state if used again. Stateful
+// decoders, such as those of Zlib, ZRLE and Tight, are left alone: the
+// server keeps its zlib streams across SetEncodings, so the inflaters must
+// keep theirs too.
+func (c *ClientConn) UpdateEncodings(encs []EncodingType) error {
+	c.encMu.Lock()
+	old := make(map[EncodingType]bool, len(c.advertised))
+	for _, e := range c.advertised {
+		old[e] = true
+	}
+	for _, e := range encs {
+		if !old[e] && !e.Stateful() {
+			c.pendingReset = append(c.pendingReset, e)
+		}
+		delete(old, e)
+	}
+	for e := range old {
+		if !e.Stateful() {
+			c.pendingReset = append(c.pendingReset, e)
+		}
+	}
+	c.encMu.Unlock()
+	return c.SetEncodings(encs)
+}
+
+// applyPendingResets resets the decoders queued by UpdateEncodings. It runs on
+// the read loop, between messages, so no decoder is reset mid-rectangle.
+func (c *ClientConn) applyPendingResets() {
+	c.encMu.Lock()
+	pending := c.pendingReset
+	c.pendingReset = nil
+	c.encMu.Unlock()
+	for _, e := range pending {
+		if enc := c.GetEncInstance(e); enc != nil {
+			enc.Reset()
+		}
+	}
+}
+
+// Send writes a complete message to the server and flushes it. It is safe to
+// call from multiple goroutines: messages are never interleaved. Write and
+// Flush on their own are not synchronized and must only be used by a single
+// goroutine, such as during the handshake.
+func (c *ClientConn) Send(msg ClientMessage) error {
+	return c.send(msg)
+}
+
+// send is Send for anything that can marshal itself to the connection.
+func (c *ClientConn) send(msg interface{ Write(Conn) error }) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.cfg.WriteTimeout > 0 {
+		c.c.SetWriteDeadline(time.Now().Add(c.cfg.WriteTimeout))
+	}
+	if err := msg.Write(c); err != nil {
+		return err
+	}
+	return c.bw.Flush()
+}
+
+// Flush writes any buffered data to the underlying connection.
+func (c *ClientConn) Flush() error {
+	return c.bw.Flush()
+}
+
+// Close gracefully shuts down the client connection, stops all related goroutines,
+// and closes the underlying network connection. It is safe to call multiple times.
+func (c *ClientConn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.mu.Unlock()
+
+	close(c.quit)
+	err := c.c.Close()
+	c.wg.Wait()
+	return err
+}
+
+// Read reads data from the connection's buffered reader.
+func (c *ClientConn) Read(buf []byte) (int, error) {
+	return c.br.Read(buf)
+}
+
+// Write writes data to the connection's buffered writer.
+func (c *ClientConn) Write(buf []byte) (int, error) {
+	return c.bw.Write(buf)
+}
+
+// ColorMap returns the color map for the connection.
+func (c *ClientConn) ColorMap() ColorMap {
+	return c.colorMap
+}
+
+// SetColorMap sets the color map for the connection.
+func (c *ClientConn) SetColorMap(cm ColorMap) {
+	c.colorMap = cm
+	if c.Canvas != nil {
+		c.Canvas.SetColorMap(cm)
+	}
+}
+
+// DesktopName returns the desktop name of the remote session. The name is
+// empty if the server sent none.
+func (c *ClientConn) DesktopName() []byte {
+	return c.desktopName
+}
+
+// PixelFormat returns the pixel format of the connection.
+func (c *ClientConn) PixelFormat() PixelFormat {
+	return c.pixelFormat
+}
+
+// SetDesktopName sets the desktop name.
+func (c *ClientConn) SetDesktopName(name []byte) {
+	c.desktopName = name
+}
+
+// SetPixelFormat sets the pixel format for the connection. The attached
+// Canvas, if any, is switched to the new format too. Decoders are not reset:
+// servers carry their zlib streams across a change of pixel format, so the
+// client's inflaters must continue too, and no decoder keeps state that
+// depends on the format from one rectangle to the next. It only changes
+// local state; NegotiatePixelFormat also tells the server. The config's
+// ChannelOrderOverride, if any, is applied to pf.
+func (c *ClientConn) SetPixelFormat(pf PixelFormat) error {
+	pf = c.cfg.ChannelOrderOverride.apply(pf)
+	c.pixelFormat = pf
+	if c.Canvas != nil {
+		c.Canvas.SetPixelFormat(pf)
+	}
+	return nil
+}
+
+// NegotiatePixelFormat asks the server to send pixel data in pf from now on,
+// for example a 16bpp format to save bandwidth, and switches the connection
+// and its Canvas to it. If a message is being decoded, it waits until the
+// message is done, so no update is decoded partly in each format. The server
+// applies pf to updates it starts after reading the request; an update it had
+// already begun may still arrive in the old format and be misread.
+func (c *ClientConn) NegotiatePixelFormat(pf PixelFormat) error {
+	if err := pf.Validate(); err != nil {
+		return fmt.Errorf("negotiate pixel format: %w", err)
+	}
+	c.decodeMu.Lock()
+	defer c.decodeMu.Unlock()
+	if err := c.send(&SetPixelFormat{PixelFormat: pf}); err != nil {
+		return fmt.Errorf("negotiate pixel format: failed to send SetPixelFormat: %w", err)
+	}
+	return c.SetPixelFormat(pf)
+}
+
+// AttachCanvas makes canvas the connection's Canvas, resized to the
+// framebuffer and switched to the connection's pixel format and color map. If
+// a message is being decoded, it waits until the message is done, so no
+// update is decoded partly into each canvas. Once the message loops run, it
+// must be used instead of assigning Canvas. A nil canvas detaches the current
+// one.
+func (c *ClientConn) AttachCanvas(canvas *VncCanvas) {
+	c.decodeMu.Lock()
+	defer c.decodeMu.Unlock()
+	if canvas != nil {
+		canvas.Resize(int(c.Width()), int(c.Height()))
+		canvas.SetPixelFormat(c.PixelFormat())
+		canvas.SetColorMap(c.ColorMap())
+	}
+	c.Canvas = canvas
+}
+
+// Encodings returns the list of supported encoding handlers.
+func (c *ClientConn) Encodings() []Encoding {
+	return c.encodings
+}
+
+// Width returns the framebuffer width.
+func (c *ClientConn) Width() uint16 {
+	return c.fbWidth
+}
+
+// Height returns the framebuffer height.
+func (c *ClientConn) Height() uint16 {
+	return c.fbHeight
+}
+
+// Protocol returns the negotiated VNC protocol version.
+func (c *ClientConn) Protocol() string {
+	return c.protocol
+}
+
+// SetWidth sets the framebuffer width.
+func (c *ClientConn) SetWidth(width uint16) {
+	c.fbWidth = width
+}
+
+// SetHeight sets the framebuffer height.
+func (c *ClientConn) SetHeight(height uint16) {
+	c.fbHeight = height
+}
+
+// Screens returns the screen layout most recently reported by the server
+// with the ExtendedDesktopSize pseudo-encoding, or nil if it has sent none.
+func (c *ClientConn) Screens() []Screen {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.screens
+}
+
+// setScreens records the screen layout reported by the server.
+func (c *ClientConn) setScreens(screens []Screen) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.screens = screens
+}
+
+// SecurityHandler returns the security handler for the connection.
+func (c *ClientConn) SecurityHandler() SecurityHandler {
+	return c.securityHandler
+}
+
+// SetSecurityHandler sets the security handler.
+func (c *ClientConn) SetSecurityHandler(sechandler SecurityHandler) error {
+	c.securityHandler = sechandler
+	return nil
+}
+
+// ResetAllEncodings resets the internal state of all supported encoding handlers.
+// It is called automatically when the pixel format changes and when
+// DefaultClientMessageHandler starts a session, so reconnecting with the same
+// ClientConfig starts from clean decoders; call it directly when the server is
+// known to have restarted its compression streams mid-session.
+func (c *ClientConn) ResetAllEncodings() {
+	for _, enc := range c.encodings {
+		enc.Reset()
+	}
+}
+
+// DefaultClientMessageHandler is the default handler for processing server messages
+// after the handshake is complete. It starts the main message handling loops.
+type DefaultClientMessageHandler struct{}
+
+// Handle starts the message handling loops for the client.
+func (*DefaultClientMessageHandler) Handle(c Conn) error {
+	logger.Trace("starting DefaultClientMessageHandler")
+	clientConn, ok := c.(*ClientConn)
+	if !ok {
+		return errors.New("handler expected a *ClientConn")
+	}
+	cfg := clientConn.cfg
+
+	// Create a map of server message types to their handlers for quick lookup.
+	serverMessages := make(map[ServerMessageType]ServerMessage)
+	for _, m := range cfg.Messages {
+		serverMessages[m.Type()] = m
+	}
+	// Servers only send the ContinuousUpdates and Fence messages when the
+	// client advertises the matching pseudo-encodings, and the client must
+	// then be able to answer them.
+	extra := append(cfg.callbackMessages(), &EndOfContinuousUpdatesMessage{}, &ServerFenceMessage{})
+	for _, m := range extra {
+		if _, ok := serverMessages[m.Type()]; !ok {
+			serverMessages[m.Type()] = m
+		}
+	}
+
+	// Encoding instances come from the config and may have decoded a
+	// previous connection, such as before a reconnect. Start their streams
+	// afresh, as the server does.
+	clientConn.ResetAllEncodings()
+
+	// Set the client's supported encodings on the server. This, and the
+	// initial request below, go out before the message loops start, so no
+	// queued ClientMessage can reach the server ahead of them.
+	var encTypes []EncodingType
+	for _, enc := range clientConn.Encodings() {
+		encTypes = append(encTypes, enc.Type())
+	}
+	logger.Tracef("setting encodings: %v", encTypes)
+	if err := clientConn.SetEncodings(encTypes); err != nil {
+		return fmt.Errorf("failed to set encodings: %w", err)
+	}
+
+	// Send the initial framebuffer update request.
+	req := FramebufferUpdateRequest{
+		Inc:    1, // Request an incremental update.
+		X:      0,
+		Y:      0,
+		Width:  clientConn.Width(),
+		Height: clientConn.Height(),
+	}
+	logger.Tracef("sending initial framebuffer update request: %+v", req)
+	if cfg.AutoRequest == AutoRequestOnDemand {
+		clientConn.reqMu.Lock()
+		clientConn.reqOutstanding = true
+		clientConn.reqMu.Unlock()
+	}
+	if err := clientConn.Send(&req); err != nil {
+		return err
+	}
+
+	// Start the goroutines for handling incoming and outgoing messages.
+	clientConn.wg.Add(2)
+	go clientConn.handleIncomingMessages(serverMessages)
+	go clientConn.handleOutgoingMessages()
+	if clientConn.cfg.KeepAliveInterval > 0 {
+		clientConn.wg.Add(1)
+		go clientConn.keepAlive(clientConn.cfg.KeepAliveInterval)
+	}
+	return nil
+}
+
+// handleIncomingMessages runs in a dedicated goroutine, reading and processing
+// messages from the server.
+func (c *ClientConn) handleIncomingMessages(serverMessages map[ServerMessageType]ServerMessage) {
+	// Ensure connection is closed if this loop exits. Close waits for the
+	// loops, so it must run after wg.Done.
+	defer c.Close()
+	defer c.wg.Done()
+
+	for {
+		// Set a read deadline to detect idle or hung connections.
+		// The deadline is extended each time a message is successfully read.
+		c.extendReadDeadline()
+
+		// Check for quit signal without blocking.
+		select {
+		case <-c.quit:
+			return
+		default:
+		}
+
+		c.applyPendingResets()
+		if fbs, ok := c.c.(*FbsConnection); ok {
+			if err := fbs.messageBoundary(c.br); err != nil {
+				logger.Errorf("%v", err)
+				return
+			}
+		}
+
+		var msgType ServerMessageType
+		if err := binary.Read(c, binary.BigEndian, &msgType); err != nil {
+			// A read error, often io.EOF, means the connection is closed.
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				logger.Errorf("error reading message type: %v", err)
+			}
+			return
+		}
+
+		msg, ok := serverMessages[msgType]
+		if !ok {
+			// Include the remote address for easier debugging of client issues.
+			logger.Errorf("unsupported message type %d from server %s", msgType, c.c.RemoteAddr())
+			return // Unknown message type is a fatal error.
+		}
+
+		// NegotiatePixelFormat waits for decodeMu, so the format cannot
+		// change while a message is being decoded.
+		c.decodeMu.Lock()
+		if c.Canvas != nil {
+			c.Canvas.RemoveCursor()
+		}
+
+		parsedMsg, err := msg.Read(c)
+		if err != nil {
+			c.decodeMu.Unlock()
+			logger.Errorf("error reading message body for type %d: %v", msgType, err)
+			if !c.cfg.Resync {
+				return
+			}
+			if err := c.resync(err); err != nil {
+				logger.Errorf("%v", err)
+				return
+			}
+			continue
+		}
+
+		if c.Canvas != nil {
+			c.Canvas.PaintCursor()
+			if msgType == ServerFramebufferUpdate {
+				c.Canvas.Publish()
+			}
+		}
+		c.decodeMu.Unlock()
+
+		if msgType == ServerFramebufferUpdate {
+			c.frameDecoded()
+			if err := c.updateReceived(); err != nil {
+				logger.Errorf("error requesting framebuffer update: %v", err)
+				return
+			}
+		}
+
+		if err := c.handleExtensionMessage(parsedMsg); err != nil {
+			logger.Errorf("error handling message type %d: %v", msgType, err)
+			return
+		}
+
+		if isKeepAliveReply(parsedMsg) {
+			continue
+		}
+
+		c.runCallbacks(parsedMsg)
+
+		// Send the parsed message to the application logic. Without a
+		// channel there is no one to deliver to, so the message is dropped.
+		if c.cfg.ServerMessageCh == nil {
+			if c.cfg.hasCallbacks() {
+				continue
+			}
+			c.nilChWarning.Do(func() {
+				logger.Warn("ServerMessageCh is nil; server messages are discarded")
+			})
+			continue
+		}
+		select {
+		case c.cfg.ServerMessageCh <- parsedMsg:
+		case <-c.quit:
+			return
+		}
+	}
+}
+
+// handleOutgoingMessages runs in a dedicated goroutine, sending messages
+// from the client to the server.
+func (c *ClientConn) handleOutgoingMessages() {
+	var failed bool
+	defer func() {
+		if failed {
+			c.Close() // After wg.Done, as Close waits for the loops.
+		}
+	}()
+	defer c.wg.Done()
+
+	for {
+		select {
+		case msg, ok := <-c.cfg.ClientMessageCh:
+			if !ok {
+				// Channel closed, which is a signal to shut down.
+				return
+			}
+			if err := c.Send(msg); err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					logger.Errorf("error writing message: %v", err)
+				}
+				failed = true
+				return
+			}
+		case <-c.quit:
+			return
+		}
+	}
+}
+
+// keepAliveFencePayload marks the fences sent by keepAlive, whose replies
+// are not passed on to the application.
+var keepAliveFencePayload = []byte("keepalive")
+
+// keepAlive runs in its own goroutine when ClientConfig.KeepAliveInterval is
+// set. At every interval it sends a fence request if the server supports
+// fences, whose reply resets the read deadline in the read loop. Otherwise
+// it sends an incremental update request, which an idle server need not
+// answer, and extends the read deadline itself once the request is written.
+func (c *ClientConn) keepAlive(interval time.Duration) {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.reqMu.Lock()
+			fence := c.fenceSupported
+			c.reqMu.Unlock()
+			var err error
+			if fence {
+				err = c.SendFence(FenceRequest, keepAliveFencePayload)
+			} else if err = c.RequestUpdate(true); err == nil {
+				c.extendReadDeadline()
+			}
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					logger.Errorf("error sending keepalive: %v", err)
+				}
+				return
+			}
+		case <-c.quit:
+			return
+		}
+	}
+}
+
+// isKeepAliveReply reports whether msg is the server's answer to a fence
+// sent by keepAlive.
+func isKeepAliveReply(msg ServerMessage) bool {
+	m, ok := msg.(*ServerFenceMessage)
+	return ok && m.Flags&FenceRequest == 0 && bytes.Equal(m.Payload, keepAliveFencePayload)
+}
+
+// extendReadDeadline sets the read deadline ClientConfig.ReadTimeout from
+// now, if there is one.
+func (c *ClientConn) extendReadDeadline() {
+	if c.cfg.ReadTimeout > 0 {
+		c.c.SetReadDeadline(time.Now().Add(c.cfg.ReadTimeout))
+	}
+}
+
+// pixelPollInterval is how often WaitForPixel samples the canvas.
+const pixelPollInterval = 50 * time.Millisecond
+
+// WaitForPixel blocks until the canvas pixel at (x, y) matches want, with each
+// of the red, green and blue channels within tolerance, or until ctx is done.
+func (c *ClientConn) WaitForPixel(ctx context.Context, x, y int, want color.RGBA, tolerance uint8) error {
+	if c.Canvas == nil {
+		return errors.New("wait for pixel: connection has no canvas")
+	}
+
+	ticker := time.NewTicker(pixelPollInterval)
+	defer ticker.Stop()
+	for {
+		got := c.Canvas.At(x, y)
+		if channelWithin(got.R, want.R, tolerance) &&
+			channelWithin(got.G, want.G, tolerance) &&
+			channelWithin(got.B, want.B, tolerance) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("wait for pixel (%d,%d): last color %v: %w", x, y, got, ctx.Err())
+		case <-c.quit:
+			return errors.New("wait for pixel: connection closed")
+		case <-ticker.C:
+		}
+	}
+}
+
+// channelWithin reports whether a and b differ by at most tolerance.
+func channelWithin(a, b, tolerance uint8) bool {
+	if a > b {
+		return a-b <= tolerance
+	}
+	return b-a <= tolerance
+}
@@ -0,0 +1,123 @@
+package avacadovnc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"net"
+)
+
+// AutoRequestMode controls whether the client sends FramebufferUpdateRequests
+// on its own.
+type AutoRequestMode int
+
+const (
+	// AutoRequestOff leaves all requests after the initial one to the
+	// application.
+	AutoRequestOff AutoRequestMode = iota
+	// AutoRequestContinuous keeps an incremental request outstanding by
+	// sending a new one as soon as each update has been decoded.
+	AutoRequestContinuous
+	// AutoRequestOnDemand sends a request when the application calls
+	// RequestUpdate, keeping at most one request outstanding. A call made
+	// while a request is outstanding is sent once its update arrives.
+	AutoRequestOnDemand
+)
+
+// RequestUpdate asks the server for an update of the whole framebuffer.
+// In AutoRequestOnDemand mode the request may be deferred until the
+// outstanding update has arrived; otherwise it is sent immediately.
+func (c *ClientConn) RequestUpdate(incremental bool) error {
+	if c.cfg.AutoRequest == AutoRequestOnDemand {
+		c.reqMu.Lock()
+		if c.reqOutstanding {
+			c.reqPending = true
+			c.reqPendingFull = c.reqPendingFull || !incremental
+			c.reqMu.Unlock()
+			return nil
+		}
+		c.reqOutstanding = true
+		c.reqMu.Unlock()
+	}
+	return c.sendUpdateRequest(incremental)
+}
+
+// RequestFramebufferUpdate requests an update of the whole framebuffer and
+// waits until the next FramebufferUpdate has been decoded into the canvas,
+// then returns the published frame, which is shared and read-only; see
+// VncCanvas.Image. RFB does not tie updates to requests, so an update already
+// on its way when the request was sent may be the one waited for. It fails if ctx is done or the connection closes first.
+func (c *ClientConn) RequestFramebufferUpdate(ctx context.Context, incremental bool) (*image.RGBA, error) {
+	if c.Canvas == nil {
+		return nil, errors.New("request framebuffer update: connection has no canvas")
+	}
+	done := c.nextFrame()
+	if err := c.RequestUpdate(incremental); err != nil {
+		return nil, fmt.Errorf("request framebuffer update: %w", err)
+	}
+	select {
+	case <-done:
+		return c.Canvas.Image(), nil
+	case <-c.quit:
+		return nil, fmt.Errorf("request framebuffer update: %w", net.ErrClosed)
+	case <-ctx.Done():
+		return nil, fmt.Errorf("request framebuffer update: %w", ctx.Err())
+	}
+}
+
+// nextFrame returns a channel that is closed once the next FramebufferUpdate
+// has been decoded and published.
+func (c *ClientConn) nextFrame() <-chan struct{} {
+	c.frameMu.Lock()
+	defer c.frameMu.Unlock()
+	if c.frameDone == nil {
+		c.frameDone = make(chan struct{})
+	}
+	return c.frameDone
+}
+
+// frameDecoded wakes everyone waiting in nextFrame. It is called by the read
+// loop after each FramebufferUpdate.
+func (c *ClientConn) frameDecoded() {
+	c.frameMu.Lock()
+	defer c.frameMu.Unlock()
+	if c.frameDone != nil {
+		close(c.frameDone)
+		c.frameDone = nil
+	}
+}
+
+// updateReceived is called by the read loop after each FramebufferUpdate and
+// sends the follow-up request the AutoRequest mode calls for.
+func (c *ClientConn) updateReceived() error {
+	switch c.cfg.AutoRequest {
+	case AutoRequestContinuous:
+		if c.continuousUpdatesActive() {
+			return nil // The server sends updates on its own.
+		}
+		return c.sendUpdateRequest(true)
+	case AutoRequestOnDemand:
+		c.reqMu.Lock()
+		c.reqOutstanding = c.reqPending
+		pending, full := c.reqPending, c.reqPendingFull
+		c.reqPending, c.reqPendingFull = false, false
+		c.reqMu.Unlock()
+		if pending {
+			return c.sendUpdateRequest(!full)
+		}
+	}
+	return nil
+}
+
+// sendUpdateRequest sends a FramebufferUpdateRequest for the whole framebuffer.
+func (c *ClientConn) sendUpdateRequest(incremental bool) error {
+	req := &FramebufferUpdateRequest{
+		Width:  c.Width(),
+		Height: c.Height(),
+	}
+	if incremental {
+		req.Inc = 1
+	}
+	return c.Send(req)
+}
@@ -0,0 +1,49 @@
+package avacadovnc
+
+// callbackMessages returns the server messages that must be accepted for the
+// callbacks set in cfg to fire, even if they are not in cfg.Messages.
+func (cfg *ClientConfig) callbackMessages() []ServerMessage {
+	var msgs []ServerMessage
+	if cfg.OnFramebufferUpdate != nil {
+		msgs = append(msgs, &FramebufferUpdateMessage{})
+	}
+	if cfg.OnColorMap != nil {
+		msgs = append(msgs, &SetColorMapEntriesMessage{})
+	}
+	if cfg.OnBell != nil {
+		msgs = append(msgs, &ServerBellMessage{})
+	}
+	if cfg.OnCutText != nil {
+		msgs = append(msgs, &ServerCutTextMessage{})
+	}
+	return msgs
+}
+
+// hasCallbacks reports whether any server message callback is set.
+func (cfg *ClientConfig) hasCallbacks() bool {
+	return len(cfg.callbackMessages()) > 0
+}
+
+// runCallbacks calls the callback registered for msg, if any. The read loop
+// calls it after the message has been applied to the connection and canvas,
+// and before the message is sent on ServerMessageCh.
+func (c *ClientConn) runCallbacks(msg ServerMessage) {
+	switch m := msg.(type) {
+	case *FramebufferUpdateMessage:
+		if c.cfg.OnFramebufferUpdate != nil && c.Canvas != nil {
+			c.cfg.OnFramebufferUpdate(c.Canvas)
+		}
+	case *SetColorMapEntriesMessage:
+		if c.cfg.OnColorMap != nil {
+			c.cfg.OnColorMap(c.ColorMap())
+		}
+	case *ServerBellMessage:
+		if c.cfg.OnBell != nil {
+			c.cfg.OnBell()
+		}
+	case *ServerCutTextMessage:
+		if c.cfg.OnCutText != nil {
+			c.cfg.OnCutText(m.Decoded)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package avacadovnc
+
+import (
+	"fmt"
+	"net"
+)
+
+// SendKeyDown sends a key press to the server.
+func (c *ClientConn) SendKeyDown(key Key) error {
+	return c.sendInput("key event", &KeyEvent{Down: 1, Key: key})
+}
+
+// SendKeyUp sends a key release to the server.
+func (c *ClientConn) SendKeyUp(key Key) error {
+	return c.sendInput("key event", &KeyEvent{Down: 0, Key: key})
+}
+
+// SendKey sends a press followed by a release of key.
+func (c *ClientConn) SendKey(key Key) error {
+	if err := c.SendKeyDown(key); err != nil {
+		return err
+	}
+	return c.SendKeyUp(key)
+}
+
+// SendExtendedKey sends a QEMU extended key event, which carries the XT
+// hardware keycode of the key as well as its keysym, so that the server can
+// tell apart keys a keysym leaves ambiguous. It fails unless the server has
+// acknowledged the extension; see ExtendedKeysSupported.
+func (c *ClientConn) SendExtendedKey(down bool, keysym Key, keycode uint32) error {
+	if !c.ExtendedKeysSupported() {
+		return fmt.Errorf("client: failed to send extended key event: server has not acknowledged %s", EncQEMUExtendedKeyEvent)
+	}
+	msg := &QEMUExtendedKeyEvent{Key: keysym, KeyCode: keycode}
+	if down {
+		msg.Down = 1
+	}
+	return c.sendInput("extended key event", msg)
+}
+
+// ExtendedKeysSupported reports whether the server has acknowledged the QEMU
+// extended key event extension, which it does with a rectangle of the
+// EncQEMUExtendedKeyEvent pseudo-encoding once the client advertises it.
+func (c *ClientConn) ExtendedKeysSupported() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.extendedKeys
+}
+
+// SendPointer sends the pointer position and button state to the server.
+func (c *ClientConn) SendPointer(mask ButtonMask, x, y uint16) error {
+	return c.sendInput("pointer event", &PointerEvent{Mask: mask, X: x, Y: y})
+}
+
+// SendText types s by sending a press and release for each rune, mapped to a
+// keysym with RuneToKey.
+func (c *ClientConn) SendText(s string) error {
+	for _, r := range s {
+		if err := c.SendKey(RuneToKey(r)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SendCutText sets the server's clipboard to s. The text is sent as latin-1,
+// as the specification requires; runes outside latin-1 are sent as '?'.
+func (c *ClientConn) SendCutText(s string) error {
+	text := EncodeCutText(s)
+	return c.sendInput("cut text", &CutTextMessage{Length: uint32(len(text)), Text: text})
+}
+
+// sendInput sends an input event, failing with net.ErrClosed once the
+// connection has been closed.
+func (c *ClientConn) sendInput(what string, msg interface{ Write(Conn) error }) error {
+	c.mu.Lock()
+	closed := c.closed
+	c.mu.Unlock()
+	if closed {
+		return fmt.Errorf("client: failed to send %s: %w", what, net.ErrClosed)
+	}
+	if err := c.send(msg); err != nil {
+		return fmt.Errorf("client: failed to send %s: %w", what, err)
+	}
+	return nil
+}
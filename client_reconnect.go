@@ -0,0 +1,258 @@
+package avacadovnc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/bigangryrobot/avacadovnc/logger"
+)
+
+// BackoffPolicy sets the delays between connection attempts. Each delay is
+// the previous one times Multiplier, starting at Initial and capped at Max,
+// and is then moved by up to Jitter of itself in either direction so that
+// many clients do not retry in lockstep.
+type BackoffPolicy struct {
+	// Initial is the delay before the first retry. Zero means 500ms.
+	Initial time.Duration
+	// Max caps the delay. Zero means 30s.
+	Max time.Duration
+	// Multiplier grows the delay after each failed attempt. Values below 1
+	// mean 2.
+	Multiplier float64
+	// Jitter is the fraction, between 0 and 1, by which each delay is
+	// randomized.
+	Jitter float64
+	// MaxRetries caps the number of attempts after the first one. Zero
+	// means retrying until the context is done.
+	MaxRetries int
+}
+
+// delay returns the time to wait before retry number n, counting from zero.
+func (b BackoffPolicy) delay(n int) time.Duration {
+	d, limit, mult := b.Initial, b.Max, b.Multiplier
+	if d <= 0 {
+		d = 500 * time.Millisecond
+	}
+	if limit <= 0 {
+		limit = 30 * time.Second
+	}
+	if mult < 1 {
+		mult = 2
+	}
+	for i := 0; i < n && d < limit; i++ {
+		d = time.Duration(float64(d) * mult)
+	}
+	if d > limit {
+		d = limit
+	}
+	if j := min(max(b.Jitter, 0), 1); j > 0 {
+		d += time.Duration(float64(d) * j * (2*rand.Float64() - 1))
+	}
+	return d
+}
+
+// DialAndConnect dials the server at addr over TCP and performs the
+// handshake, retrying failed attempts as set by backoff. It returns the error
+// of the last attempt once the retries are used up, or when ctx is done.
+func DialAndConnect(ctx context.Context, addr string, cfg *ClientConfig, backoff BackoffPolicy) (*ClientConn, error) {
+	var d net.Dialer
+	for attempt := 0; ; attempt++ {
+		nc, err := d.DialContext(ctx, "tcp", addr)
+		if err == nil {
+			var conn *ClientConn
+			if conn, err = Connect(ctx, nc, cfg); err == nil {
+				return conn, nil
+			}
+			nc.Close()
+		}
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("client: failed to connect to %s: %w", addr, ctx.Err())
+		}
+		if backoff.MaxRetries > 0 && attempt >= backoff.MaxRetries {
+			return nil, fmt.Errorf("client: failed to connect to %s after %d attempts: %w", addr, attempt+1, err)
+		}
+		wait := backoff.delay(attempt)
+		logger.Warnf("client: connecting to %s failed: %v; retrying in %v", addr, err, wait)
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, fmt.Errorf("client: failed to connect to %s: %w", addr, ctx.Err())
+		case <-timer.C:
+		}
+	}
+}
+
+// ReconnectingClient keeps a session to a server alive: whenever the
+// connection drops, it dials again with DialAndConnect, which re-runs the
+// handshake and so re-sends the configured encodings, and attaches the canvas
+// set with SetCanvas to the new connection. The config must include
+// DefaultClientMessageHandler, or an equivalent, for the new connection to
+// start its message loops.
+type ReconnectingClient struct {
+	addr    string
+	cfg     *ClientConfig
+	backoff BackoffPolicy
+
+	// OnReconnect, if set, is called with each new connection once it has
+	// replaced a lost one. It must be set before the first connection drops.
+	OnReconnect func(*ClientConn)
+
+	mu     sync.Mutex // Guards conn, canvas, closed and err
+	conn   *ClientConn
+	canvas *VncCanvas
+	closed bool
+	err    error
+	done   chan struct{}
+	cancel context.CancelFunc
+}
+
+// NewReconnectingClient connects to the server at addr with DialAndConnect
+// and watches the connection until Close is called or ctx is done.
+func NewReconnectingClient(ctx context.Context, addr string, cfg *ClientConfig, backoff BackoffPolicy) (*ReconnectingClient, error) {
+	conn, err := DialAndConnect(ctx, addr, cfg, backoff)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	rc := &ReconnectingClient{
+		addr:    addr,
+		cfg:     cfg,
+		backoff: backoff,
+		conn:    conn,
+		done:    make(chan struct{}),
+		cancel:  cancel,
+	}
+	go rc.supervise(ctx)
+	return rc, nil
+}
+
+// Conn returns the current connection. Callers that hold on to it should
+// fetch it again after a reconnect; see OnReconnect.
+func (rc *ReconnectingClient) Conn() *ClientConn {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.conn
+}
+
+// SetCanvas attaches canvas to the current connection with AttachCanvas and
+// to every connection that replaces it, so that it survives reconnects.
+func (rc *ReconnectingClient) SetCanvas(canvas *VncCanvas) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.canvas = canvas
+	rc.conn.AttachCanvas(canvas)
+}
+
+// Done returns a channel that is closed once the client has stopped, either
+// through Close or because reconnecting failed; see Err.
+func (rc *ReconnectingClient) Done() <-chan struct{} {
+	return rc.done
+}
+
+// Err returns the error that stopped the client, or nil.
+func (rc *ReconnectingClient) Err() error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.err
+}
+
+// Close closes the current connection and stops reconnecting.
+func (rc *ReconnectingClient) Close() error {
+	rc.mu.Lock()
+	rc.closed = true
+	conn := rc.conn
+	rc.mu.Unlock()
+	rc.cancel()
+	err := conn.Close()
+	<-rc.done
+	return err
+}
+
+// supervise waits for the current connection to drop and replaces it.
+func (rc *ReconnectingClient) supervise(ctx context.Context) {
+	defer close(rc.done)
+	for {
+		rc.mu.Lock()
+		conn := rc.conn
+		rc.mu.Unlock()
+		conn.Wait()
+
+		rc.mu.Lock()
+		closed, canvas := rc.closed, rc.canvas
+		rc.mu.Unlock()
+		if closed || ctx.Err() != nil {
+			return
+		}
+
+		logger.Warnf("client: connection to %s lost, reconnecting", rc.addr)
+		next, err := DialAndConnect(ctx, rc.addr, rc.configWithCanvas(canvas), rc.backoff)
+		rc.mu.Lock()
+		if err != nil {
+			if !rc.closed {
+				rc.err = err
+			}
+			rc.mu.Unlock()
+			return
+		}
+		if rc.closed {
+			rc.mu.Unlock()
+			next.Close()
+			return
+		}
+		rc.conn = next
+		rc.mu.Unlock()
+
+		if rc.OnReconnect != nil {
+			rc.OnReconnect(next)
+		}
+	}
+}
+
+// configWithCanvas returns the config for a reconnect. If canvas is not nil,
+// the handshake attaches it to the new connection, matched to the new
+// framebuffer size and pixel format, before the message loops start.
+func (rc *ReconnectingClient) configWithCanvas(canvas *VncCanvas) *ClientConfig {
+	if canvas == nil {
+		return rc.cfg
+	}
+	cfg := *rc.cfg
+	handlers := cfg.Handlers
+	if len(handlers) == 0 {
+		handlers = DefaultClientHandlers
+	}
+	cfg.Handlers = nil
+	attach := &canvasAttachHandler{canvas: canvas}
+	for _, h := range handlers {
+		if _, ok := h.(*DefaultClientMessageHandler); ok && attach != nil {
+			cfg.Handlers = append(cfg.Handlers, attach)
+			attach = nil
+		}
+		cfg.Handlers = append(cfg.Handlers, h)
+	}
+	if attach != nil {
+		cfg.Handlers = append(cfg.Handlers, attach)
+	}
+	return &cfg
+}
+
+// canvasAttachHandler attaches an existing canvas to a new connection after
+// ServerInit.
+type canvasAttachHandler struct {
+	canvas *VncCanvas
+}
+
+// Handle resizes the canvas to the new framebuffer and attaches it.
+func (h *canvasAttachHandler) Handle(c Conn) error {
+	clientConn, ok := c.(*ClientConn)
+	if !ok {
+		return errors.New("reconnect: handler expected a *ClientConn")
+	}
+	clientConn.AttachCanvas(h.canvas)
+	return nil
+}
@@ -0,0 +1,96 @@
+package avacadovnc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/bigangryrobot/avacadovnc/logger"
+)
+
+// maxResyncBytes bounds how far resync scans before giving up.
+const maxResyncBytes = 16 * 1024 * 1024
+
+// resyncHeaderLen is the FramebufferUpdate header (type, padding, number of
+// rectangles) followed by the first rectangle header.
+const resyncHeaderLen = 4 + 12
+
+// rectDecodeError is returned by FramebufferUpdateMessage.Read when a
+// rectangle fails to decode, so that resync knows its encoding.
+type rectDecodeError struct {
+	encType EncodingType
+	err     error
+}
+
+func (e *rectDecodeError) Error() string { return e.err.Error() }
+func (e *rectDecodeError) Unwrap() error { return e.err }
+
+// resync discards bytes from the stream until the next bytes look like the
+// start of a FramebufferUpdate message, then asks for a full update to
+// repaint what was lost. It is used after the decode error err when
+// ClientConfig.Resync is set. Detection is heuristic: a corrupt stream can
+// contain a false match, in which case the next read fails again and resync
+// runs once more.
+//
+// It refuses to resync after a rectangle of a stateful encoding such as Zlib,
+// ZRLE or Tight failed: the server's zlib stream goes on from data the
+// client has lost, so every later rectangle of that encoding would fail too.
+func (c *ClientConn) resync(err error) error {
+	var rerr *rectDecodeError
+	if errors.As(err, &rerr) && rerr.encType.Stateful() {
+		return fmt.Errorf("resync: cannot recover the stream of the failed %v rectangle", rerr.encType)
+	}
+	for discarded := 0; discarded < maxResyncBytes; discarded++ {
+		hdr, err := c.br.Peek(resyncHeaderLen)
+		if err != nil {
+			return fmt.Errorf("resync: failed to peek: %w", err)
+		}
+		if c.plausibleUpdateHeader(hdr) {
+			logger.Warnf("resync: discarded %d bytes before next framebuffer update", discarded)
+			if err := c.sendUpdateRequest(false); err != nil {
+				return fmt.Errorf("resync: failed to request a full update: %w", err)
+			}
+			return nil
+		}
+		if _, err := c.br.Discard(1); err != nil {
+			return fmt.Errorf("resync: failed to discard: %w", err)
+		}
+	}
+	return fmt.Errorf("resync: no framebuffer update found within %d bytes", maxResyncBytes)
+}
+
+// plausibleUpdateHeader reports whether hdr could be the start of a
+// FramebufferUpdate message on this connection.
+func (c *ClientConn) plausibleUpdateHeader(hdr []byte) bool {
+	if ServerMessageType(hdr[0]) != ServerFramebufferUpdate || hdr[1] != 0 {
+		return false
+	}
+	if binary.BigEndian.Uint16(hdr[2:4]) == 0 {
+		return false
+	}
+
+	x := binary.BigEndian.Uint16(hdr[4:6])
+	y := binary.BigEndian.Uint16(hdr[6:8])
+	w := binary.BigEndian.Uint16(hdr[8:10])
+	h := binary.BigEndian.Uint16(hdr[10:12])
+	encType := EncodingType(int32(binary.BigEndian.Uint32(hdr[12:16])))
+
+	// Pseudo-encodings must have the header the server sends for them.
+	switch encType {
+	case EncLastRect:
+		return x == 0 && y == 0 && w == 0 && h == 0 && lastRectNegotiated(c)
+	case EncDesktopName:
+		return x == 0 && y == 0 && w == 0 && h == 0
+	case EncDesktopSize:
+		return x == 0 && y == 0 && w > 0 && h > 0
+	case EncExtendedDesktopSize:
+		// X is the reason for the change and Y its status.
+		return x <= 2 && y <= 3 && w > 0 && h > 0
+	}
+	if c.GetEncInstance(encType) == nil {
+		return false
+	}
+	return w > 0 && h > 0 &&
+		uint32(x)+uint32(w) <= uint32(c.Width()) &&
+		uint32(y)+uint32(h) <= uint32(c.Height())
+}
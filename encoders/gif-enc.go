@@ -0,0 +1,215 @@
+package encoders
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"os"
+	"sort"
+	"time"
+)
+
+// GifRecorder collects frames, such as successive snapshots of a VncCanvas,
+// and writes them as an animated GIF. It is a lightweight alternative to the
+// ffmpeg based encoders. Each frame is reduced to its own palette of at most
+// 256 colors with a median-cut quantizer when it is added, so only one byte
+// per pixel is kept in memory.
+type GifRecorder struct {
+	// Delay is the time each frame is shown. Zero means 100ms. GIF stores
+	// delays in hundredths of a second.
+	Delay time.Duration
+	// MaxFrames caps the number of frames kept; later frames are dropped.
+	// Zero means no cap.
+	MaxFrames int
+	// LoopCount is the number of times the animation repeats. Zero loops
+	// forever and -1 plays it once.
+	LoopCount int
+
+	frames []*image.Paletted
+}
+
+// AddFrame quantizes img and appends it to the animation. Frames beyond
+// MaxFrames are dropped.
+func (r *GifRecorder) AddFrame(img image.Image) {
+	if r.MaxFrames > 0 && len(r.frames) >= r.MaxFrames {
+		return
+	}
+	r.frames = append(r.frames, quantize(img, 256))
+}
+
+// Frames returns the number of frames added so far.
+func (r *GifRecorder) Frames() int {
+	return len(r.frames)
+}
+
+// Save writes the animation to path.
+func (r *GifRecorder) Save(path string) error {
+	if len(r.frames) == 0 {
+		return fmt.Errorf("gif-recorder: no frames to save")
+	}
+	delay := r.Delay
+	if delay == 0 {
+		delay = 100 * time.Millisecond
+	}
+	anim := &gif.GIF{
+		Image:     r.frames,
+		Delay:     make([]int, len(r.frames)),
+		LoopCount: r.LoopCount,
+	}
+	for i := range anim.Delay {
+		anim.Delay[i] = int(delay / (10 * time.Millisecond))
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("gif-recorder: failed to create %s: %w", path, err)
+	}
+	if err := gif.EncodeAll(f, anim); err != nil {
+		f.Close()
+		return fmt.Errorf("gif-recorder: failed to encode %s: %w", path, err)
+	}
+	return f.Close()
+}
+
+// quantize converts img to a paletted image with at most n colors.
+func quantize(img image.Image, n int) *image.Paletted {
+	b := img.Bounds()
+	palette := medianCut(img, n)
+	dst := image.NewPaletted(image.Rect(0, 0, b.Dx(), b.Dy()), palette)
+
+	// Screen content repeats few colors, so nearest-color lookups are cached.
+	cache := make(map[color.RGBA]uint8)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+			idx, ok := cache[c]
+			if !ok {
+				idx = uint8(palette.Index(c))
+				cache[c] = idx
+			}
+			dst.Pix[(y-b.Min.Y)*dst.Stride+(x-b.Min.X)] = idx
+		}
+	}
+	return dst
+}
+
+// colorBucket accumulates the pixels that fall into one cell of a 5 bits per
+// channel histogram.
+type colorBucket struct {
+	r, g, b, count int
+}
+
+// mean returns the average color of the bucket's pixels.
+func (cb *colorBucket) mean() [3]int {
+	return [3]int{cb.r / cb.count, cb.g / cb.count, cb.b / cb.count}
+}
+
+// medianCut returns a palette of at most n colors for img. The colors are
+// bucketed into a 15-bit histogram, then the box with the most pixels is
+// repeatedly split at the median of its widest channel. Each palette entry is
+// the mean of the pixels in one box.
+func medianCut(img image.Image, n int) color.Palette {
+	b := img.Bounds()
+	hist := make(map[int]*colorBucket)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+			key := int(c.R>>3)<<10 | int(c.G>>3)<<5 | int(c.B>>3)
+			cb := hist[key]
+			if cb == nil {
+				cb = &colorBucket{}
+				hist[key] = cb
+			}
+			cb.r += int(c.R)
+			cb.g += int(c.G)
+			cb.b += int(c.B)
+			cb.count++
+		}
+	}
+
+	all := make([]*colorBucket, 0, len(hist))
+	for _, cb := range hist {
+		all = append(all, cb)
+	}
+	boxes := [][]*colorBucket{all}
+	for len(boxes) < n {
+		// Split the box holding the most pixels that can still be split.
+		best, bestCount := -1, 0
+		for i, box := range boxes {
+			if len(box) < 2 {
+				continue
+			}
+			if count := pixelCount(box); count > bestCount {
+				best, bestCount = i, count
+			}
+		}
+		if best < 0 {
+			break
+		}
+		lo, hi := splitBox(boxes[best])
+		boxes[best] = lo
+		boxes = append(boxes, hi)
+	}
+
+	palette := make(color.Palette, 0, len(boxes))
+	for _, box := range boxes {
+		var r, g, b, count int
+		for _, cb := range box {
+			r += cb.r
+			g += cb.g
+			b += cb.b
+			count += cb.count
+		}
+		if count == 0 {
+			continue
+		}
+		palette = append(palette, color.RGBA{R: uint8(r / count), G: uint8(g / count), B: uint8(b / count), A: 255})
+	}
+	return palette
+}
+
+// pixelCount returns the number of pixels in a box.
+func pixelCount(box []*colorBucket) int {
+	count := 0
+	for _, cb := range box {
+		count += cb.count
+	}
+	return count
+}
+
+// splitBox sorts box along its widest channel and splits it where half of its
+// pixels lie on either side.
+func splitBox(box []*colorBucket) (lo, hi []*colorBucket) {
+	var minC, maxC [3]int
+	for i := range minC {
+		minC[i] = 255
+	}
+	for _, cb := range box {
+		m := cb.mean()
+		for i := range m {
+			minC[i] = min(minC[i], m[i])
+			maxC[i] = max(maxC[i], m[i])
+		}
+	}
+	channel := 0
+	for i := 1; i < 3; i++ {
+		if maxC[i]-minC[i] > maxC[channel]-minC[channel] {
+			channel = i
+		}
+	}
+	sort.Slice(box, func(i, j int) bool {
+		return box[i].mean()[channel] < box[j].mean()[channel]
+	})
+
+	half := pixelCount(box) / 2
+	split, seen := 1, 0
+	for i, cb := range box[:len(box)-1] {
+		seen += cb.count
+		split = i + 1
+		if seen >= half {
+			break
+		}
+	}
+	return box[:split], box[split:]
+}
@@ -0,0 +1,98 @@
+package encoders
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"time"
+
+	"github.com/bigangryrobot/avacadovnc"
+	"github.com/bigangryrobot/avacadovnc/logger"
+)
+
+// MJPEGStreamer is an http.Handler that serves a canvas as an MJPEG stream:
+// a multipart/x-mixed-replace response in which each part is a JPEG snapshot
+// of the canvas. Browsers show such a stream in an <img> element, which
+// makes it a lightweight live preview. Each request gets its own stream,
+// which ends when the client goes away.
+type MJPEGStreamer struct {
+	// Canvas is the canvas to stream. Its published frames are sent, so
+	// code driving the canvas directly must call Publish.
+	Canvas *avacadovnc.VncCanvas
+	// FPS is the number of frames sent per second. Zero means 5.
+	FPS int
+	// Quality is the JPEG quality, from 1 to 100. Zero means 75.
+	Quality int
+}
+
+// ServeHTTP streams the canvas until the request's context is done or a
+// write fails.
+func (s *MJPEGStreamer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fps, quality := s.FPS, s.Quality
+	if fps <= 0 {
+		fps = 5
+	}
+	if quality <= 0 {
+		quality = 75
+	}
+
+	mw := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary="+mw.Boundary())
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher, _ := w.(http.Flusher)
+
+	ticker := time.NewTicker(time.Second / time.Duration(fps))
+	defer ticker.Stop()
+	var last *image.RGBA
+	var frame bytes.Buffer
+	for {
+		// Image hands out the same frame until the next Publish, so an
+		// unchanged canvas is not encoded again.
+		if img := s.Canvas.Image(); img != last {
+			last = img
+			frame.Reset()
+			if err := jpeg.Encode(&frame, s.snapshot(img), &jpeg.Options{Quality: quality}); err != nil {
+				logger.Errorf("mjpeg-streamer: failed to encode frame: %v", err)
+				return
+			}
+		}
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":   {"image/jpeg"},
+			"Content-Length": {strconv.Itoa(frame.Len())},
+		})
+		if err == nil {
+			_, err = part.Write(frame.Bytes())
+		}
+		if err != nil {
+			logger.Debugf("mjpeg-streamer: stream to %s ended: %v", r.RemoteAddr, err)
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// snapshot returns img with its pixels in RGBA order. Images from a BGRA
+// canvas are copied and swapped, since the canvas may hand img out again.
+func (s *MJPEGStreamer) snapshot(img *image.RGBA) *image.RGBA {
+	if s.Canvas.ChannelOrder() != avacadovnc.ChannelsBGRA {
+		return img
+	}
+	rgba := image.NewRGBA(img.Rect)
+	copy(rgba.Pix, img.Pix)
+	for i := 0; i < len(rgba.Pix); i += 4 {
+		rgba.Pix[i], rgba.Pix[i+2] = rgba.Pix[i+2], rgba.Pix[i]
+	}
+	return rgba
+}
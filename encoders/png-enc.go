@@ -0,0 +1,12 @@
+package encoders
+
+import "github.com/bigangryrobot/avacadovnc"
+
+// FrameSink consumes a sequence of frames. It is avacadovnc.FrameSink, which
+// VideoEncoder implements.
+type FrameSink = avacadovnc.FrameSink
+
+// PNGSequenceSink writes each frame to its own numbered PNG file, skipping
+// repeats. It is avacadovnc.PNGSequenceSink, which a Recorder uses for
+// RecordPNG.
+type PNGSequenceSink = avacadovnc.PNGSequenceSink
@@ -0,0 +1,44 @@
+package encoders
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/bigangryrobot/avacadovnc"
+)
+
+// PPMStream writes frames streamed row by row, as RawEncoding.Rows does, to
+// w as a sequence of PPM images: the input format of ffmpeg's image2pipe, as
+// used by VideoEncoder. No frame is held in memory, only the row being
+// written, so the client must ask for full rather than incremental updates
+// and the server must send each one as a single Raw rectangle covering the
+// framebuffer.
+type PPMStream struct {
+	w             io.Writer
+	width, height int
+	row           []byte
+}
+
+// NewPPMStream returns a PPMStream writing width by height frames to w.
+func NewPPMStream(w io.Writer, width, height int) *PPMStream {
+	return &PPMStream{w: w, width: width, height: height, row: make([]byte, width*3)}
+}
+
+// WriteRow writes row y of a frame, starting the frame with its PPM header
+// at row zero.
+func (s *PPMStream) WriteRow(rect *avacadovnc.Rectangle, y int, pix []byte) error {
+	if rect.X != 0 || rect.Y != 0 || int(rect.Width) != s.width || int(rect.Height) != s.height {
+		return fmt.Errorf("ppm-stream: rectangle %dx%d at (%d,%d) does not cover the %dx%d frame",
+			rect.Width, rect.Height, rect.X, rect.Y, s.width, s.height)
+	}
+	if y == 0 {
+		if _, err := fmt.Fprintf(s.w, "P6\n%d %d\n255\n", s.width, s.height); err != nil {
+			return err
+		}
+	}
+	for x := 0; x < s.width; x++ {
+		copy(s.row[x*3:x*3+3], pix[x*4:x*4+3])
+	}
+	_, err := s.w.Write(s.row)
+	return err
+}
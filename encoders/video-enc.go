@@ -0,0 +1,186 @@
+package encoders
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+
+	"github.com/bigangryrobot/avacadovnc/logger"
+)
+
+// VideoEncoderOptions configures a VideoEncoder.
+type VideoEncoderOptions struct {
+	// FFMpegBinPath is the ffmpeg binary. The default is "ffmpeg" from PATH.
+	FFMpegBinPath string
+	// Framerate is the frame rate of the video. The default is 12.
+	Framerate int
+	// Codec is the ffmpeg video codec. The default is "libx264".
+	Codec string
+	// BufferFrames is the number of frames queued for ffmpeg before
+	// WriteFrame waits for room, or drops frames with DropFrames. The
+	// default is 32.
+	BufferFrames int
+	// DropFrames makes WriteFrame drop frames while the queue is full
+	// instead of waiting, so a slow ffmpeg never blocks the caller.
+	// WriteFrameBlocking waits regardless.
+	DropFrames bool
+}
+
+// VideoEncoder turns a sequence of frames, such as successive snapshots of a
+// VncCanvas or of an FBS playback, into a video file by piping them to ffmpeg.
+// Frames are queued and written from a separate goroutine, so WriteFrame only
+// waits when ffmpeg has fallen BufferFrames behind.
+// It implements BlockingFrameSink, so it can be the VideoEncoder of a
+// Recorder.
+type VideoEncoder struct {
+	cmd    *exec.Cmd
+	input  io.WriteCloser
+	frames chan *image.RGBA
+	done   chan error
+	ppm    ppmEncoder // Used by run only
+	drop   bool
+
+	mu      sync.Mutex
+	closed  bool
+	dropped int
+}
+
+// NewVideoEncoder starts ffmpeg writing a video to outputPath.
+func NewVideoEncoder(outputPath string, opts VideoEncoderOptions) (*VideoEncoder, error) {
+	if opts.FFMpegBinPath == "" {
+		opts.FFMpegBinPath = "ffmpeg"
+	}
+	if opts.Framerate == 0 {
+		opts.Framerate = 12
+	}
+	if opts.Codec == "" {
+		opts.Codec = "libx264"
+	}
+	if opts.BufferFrames == 0 {
+		opts.BufferFrames = 32
+	}
+	bin, err := exec.LookPath(opts.FFMpegBinPath)
+	if err != nil {
+		return nil, fmt.Errorf("video-encoder: ffmpeg not found: %w", err)
+	}
+
+	cmd := exec.Command(bin,
+		"-f", "image2pipe",
+		"-vcodec", "ppm",
+		"-r", strconv.Itoa(opts.Framerate),
+		"-i", "-",
+		"-an", // no audio
+		"-y",
+		"-vcodec", opts.Codec,
+		// Most codecs need even dimensions for yuv420p.
+		"-vf", "pad=ceil(iw/2)*2:ceil(ih/2)*2",
+		"-pix_fmt", "yuv420p",
+		outputPath,
+	)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	input, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("video-encoder: failed to get ffmpeg input pipe: %w", err)
+	}
+	logger.Debugf("launching binary: %v", cmd)
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("video-encoder: failed to start ffmpeg: %w", err)
+	}
+
+	enc := &VideoEncoder{
+		cmd:    cmd,
+		input:  input,
+		frames: make(chan *image.RGBA, opts.BufferFrames),
+		done:   make(chan error, 1),
+		drop:   opts.DropFrames,
+	}
+	go enc.run()
+	return enc, nil
+}
+
+// run writes queued frames to ffmpeg until the queue is closed, then waits
+// for ffmpeg to finish the video.
+func (enc *VideoEncoder) run() {
+	var werr error
+	for img := range enc.frames {
+		if werr != nil {
+			continue // Drain the queue so writers never wait forever.
+		}
+		if err := enc.ppm.encode(enc.input, img); err != nil {
+			werr = fmt.Errorf("video-encoder: failed to write frame: %w", err)
+			logger.Error(werr)
+		}
+	}
+	enc.input.Close()
+	if err := enc.cmd.Wait(); err != nil && werr == nil {
+		werr = fmt.Errorf("video-encoder: ffmpeg failed: %w", err)
+	}
+	enc.done <- werr
+}
+
+// WriteFrame queues a copy of img as the next frame. If ffmpeg has fallen
+// too far behind, it waits for room, or drops the frame if the encoder was
+// created with DropFrames.
+func (enc *VideoEncoder) WriteFrame(img image.Image) error {
+	return enc.queue(img, !enc.drop)
+}
+
+// WriteFrameBlocking queues a copy of img as the next frame, waiting for
+// room if ffmpeg has fallen behind even with DropFrames.
+func (enc *VideoEncoder) WriteFrameBlocking(img image.Image) error {
+	return enc.queue(img, true)
+}
+
+// queue queues a copy of img, waiting for room in the queue if wait is set
+// and dropping the frame otherwise.
+func (enc *VideoEncoder) queue(img image.Image, wait bool) error {
+	frame := image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+	draw.Draw(frame, frame.Bounds(), img, img.Bounds().Min, draw.Src)
+
+	enc.mu.Lock()
+	defer enc.mu.Unlock()
+	if enc.closed {
+		return errors.New("video-encoder: encoder is closed")
+	}
+	if wait {
+		// run drains the queue even after a write error, so this cannot
+		// block forever.
+		enc.frames <- frame
+		return nil
+	}
+	select {
+	case enc.frames <- frame:
+	default:
+		enc.dropped++
+	}
+	return nil
+}
+
+// Dropped returns the number of frames dropped because the queue was full,
+// which only happens with DropFrames.
+func (enc *VideoEncoder) Dropped() int {
+	enc.mu.Lock()
+	defer enc.mu.Unlock()
+	return enc.dropped
+}
+
+// Close writes the queued frames, finishes the video and waits for ffmpeg to
+// exit. It is safe to call more than once.
+func (enc *VideoEncoder) Close() error {
+	enc.mu.Lock()
+	if enc.closed {
+		enc.mu.Unlock()
+		return nil
+	}
+	enc.closed = true
+	close(enc.frames)
+	enc.mu.Unlock()
+	return <-enc.done
+}
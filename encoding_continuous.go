@@ -0,0 +1,39 @@
+package avacadovnc
+
+// FenceEncoding implements the Fence pseudo-encoding. Add it to the
+// encodings to tell the server the client understands fence messages; a
+// server that does too answers with a fence of its own. No rectangle is ever
+// sent with this encoding.
+type FenceEncoding struct{}
+
+// Type returns the encoding type identifier.
+func (e *FenceEncoding) Type() EncodingType {
+	return EncFence
+}
+
+// Read does nothing: servers send no rectangles of this encoding.
+func (e *FenceEncoding) Read(c Conn, rect *Rectangle) error {
+	return nil
+}
+
+// Reset does nothing as this encoding is stateless.
+func (e *FenceEncoding) Reset() {}
+
+// ContinuousUpdatesEncoding implements the ContinuousUpdates pseudo-encoding.
+// Add it to the encodings to ask the server whether it supports continuous
+// updates; a server that does answers with an EndOfContinuousUpdates
+// message. No rectangle is ever sent with this encoding.
+type ContinuousUpdatesEncoding struct{}
+
+// Type returns the encoding type identifier.
+func (e *ContinuousUpdatesEncoding) Type() EncodingType {
+	return EncContinuousUpdates
+}
+
+// Read does nothing: servers send no rectangles of this encoding.
+func (e *ContinuousUpdatesEncoding) Read(c Conn, rect *Rectangle) error {
+	return nil
+}
+
+// Reset does nothing as this encoding is stateless.
+func (e *ContinuousUpdatesEncoding) Reset() {}
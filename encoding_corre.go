@@ -6,8 +6,9 @@ import (
 	"io"
 )
 
-// CoRREEncoding implements the CoRRE (Compressed RRE) encoding.
-// It is a variation of RRE that uses a palette for colors.
+// CoRREEncoding implements the CoRRE (Compact RRE) encoding. It is RRE with
+// sub-rectangle geometry in single bytes, which limits rectangles to 255x255
+// pixels.
 type CoRREEncoding struct{}
 
 // Type returns the encoding type identifier.
@@ -22,13 +23,10 @@ func (e *CoRREEncoding) Read(c Conn, rect *Rectangle) error {
 		return fmt.Errorf("corre: failed to read number of sub-rectangles: %w", err)
 	}
 
-	clientConn, ok := c.(*ClientConn)
-	if !ok || clientConn.Canvas == nil {
-		return nil // No canvas to draw on, but we must still read the data.
-	}
+	canvas := canvasOf(c)
 
 	pf := c.PixelFormat()
-	bytesPerPixel := pf.BPP
+	bytesPerPixel := pf.BytesPerPixel()
 	if bytesPerPixel == 0 {
 		return fmt.Errorf("corre: bytes per pixel is zero")
 	}
@@ -39,8 +37,8 @@ func (e *CoRREEncoding) Read(c Conn, rect *Rectangle) error {
 		return fmt.Errorf("corre: failed to read background color: %w", err)
 	}
 
-	if clientConn.Canvas != nil {
-		clientConn.Canvas.Fill(bgBytes, rect)
+	if canvas != nil {
+		canvas.Fill(bgBytes, rect)
 	}
 
 	// Read and process each sub-rectangle.
@@ -50,16 +48,20 @@ func (e *CoRREEncoding) Read(c Conn, rect *Rectangle) error {
 			return fmt.Errorf("corre: failed to read sub-rectangle color: %w", err)
 		}
 
-		var subRect Rectangle
-		if err := binary.Read(c, binary.BigEndian, &subRect); err != nil {
+		var geometry [4]uint8 // x, y, width, height
+		if _, err := io.ReadFull(c, geometry[:]); err != nil {
 			return fmt.Errorf("corre: failed to read sub-rectangle header: %w", err)
 		}
 
-		if clientConn.Canvas != nil {
+		if canvas != nil {
 			// Adjust sub-rectangle position to be relative to the main canvas.
-			subRect.X += rect.X
-			subRect.Y += rect.Y
-			clientConn.Canvas.Fill(colorBytes, &subRect)
+			subRect := Rectangle{
+				X:      rect.X + uint16(geometry[0]),
+				Y:      rect.Y + uint16(geometry[1]),
+				Width:  uint16(geometry[2]),
+				Height: uint16(geometry[3]),
+			}
+			canvas.Fill(colorBytes, &subRect)
 		}
 	}
 
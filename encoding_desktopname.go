@@ -1,35 +1,51 @@
-package avacadovnc
-
-import (
-	"encoding/binary"
-	"fmt"
-	"io"
-)
-
-// DesktopNameEncoding implements the DesktopName pseudo-encoding, which is used
-// by the server to update the client with the session's name.
-type DesktopNameEncoding struct{}
-
-// Type returns the encoding type identifier.
-func (e *DesktopNameEncoding) Type() EncodingType {
-	return EncDesktopName
-}
-
-// Read decodes the desktop name data.
-func (e *DesktopNameEncoding) Read(c Conn, rect *Rectangle) error {
-	var nameLength uint32
-	if err := binary.Read(c, binary.BigEndian, &nameLength); err != nil {
-		return fmt.Errorf("desktop-name: failed to read name length: %w", err)
-	}
-
-	name := make([]byte, nameLength)
-	if _, err := io.ReadFull(c, name); err != nil {
-		return fmt.Errorf("desktop-name: failed to read name: %w", err)
-	}
-
-	c.SetDesktopName(name)
-	return nil
-}
-
-// Reset does nothing as this encoding is stateless.
-func (e *DesktopNameEncoding) Reset() {}
+package avacadovnc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// DesktopNameEncoding implements the DesktopName pseudo-encoding, which is used
+// by the server to update the client with the session's name.
+type DesktopNameEncoding struct{}
+
+// Type returns the encoding type identifier.
+func (e *DesktopNameEncoding) Type() EncodingType {
+	return EncDesktopName
+}
+
+// Read decodes the desktop name data.
+func (e *DesktopNameEncoding) Read(c Conn, rect *Rectangle) error {
+	name, err := readDesktopName(c)
+	if err != nil {
+		return fmt.Errorf("desktop-name: %w", err)
+	}
+	c.SetDesktopName(name)
+	return nil
+}
+
+// maxDesktopNameLength bounds the desktop names this package reads, so a
+// corrupt length cannot make it allocate gigabytes.
+const maxDesktopNameLength = 1 << 20
+
+// readDesktopName reads a desktop name preceded by its 32-bit length, as sent
+// in ServerInit, DesktopName rectangles and FBS headers. A zero-length name is
+// valid and is returned as an empty, non-nil slice.
+func readDesktopName(r io.Reader) ([]byte, error) {
+	var nameLength uint32
+	if err := binary.Read(r, binary.BigEndian, &nameLength); err != nil {
+		return nil, fmt.Errorf("failed to read name length: %w", err)
+	}
+	if nameLength > maxDesktopNameLength {
+		return nil, fmt.Errorf("name length %d exceeds %d bytes", nameLength, maxDesktopNameLength)
+	}
+	name := make([]byte, nameLength)
+	if _, err := io.ReadFull(r, name); err != nil {
+		return nil, fmt.Errorf("failed to read name: %w", err)
+	}
+	return name, nil
+}
+
+// Reset does nothing as this encoding is stateless.
+func (e *DesktopNameEncoding) Reset() {}
@@ -1,29 +1,41 @@
-package avacadovnc
-
-// DesktopSizeEncoding implements the DesktopSize pseudo-encoding, which is used
-// by the server to inform the client that the framebuffer has been resized.
-type DesktopSizeEncoding struct{}
-
-// Type returns the encoding type identifier.
-func (e *DesktopSizeEncoding) Type() EncodingType {
-	return EncDesktopSize
-}
-
-// Read handles the resize event. The new dimensions are in the rectangle header.
-func (e *DesktopSizeEncoding) Read(c Conn, rect *Rectangle) error {
-	// The new width and height are in the rectangle's header.
-	c.SetWidth(rect.Width)
-	c.SetHeight(rect.Height)
-
-	// A real client would now resize its local framebuffer/canvas.
-	if clientConn, ok := c.(*ClientConn); ok && clientConn.Canvas != nil {
-		// This part is complex: it requires re-allocating the canvas image
-		// and potentially re-requesting a full screen update.
-		// For now, we just log it.
-	}
-
-	return nil
-}
-
-// Reset does nothing as this encoding is stateless.
-func (e *DesktopSizeEncoding) Reset() {}
+package avacadovnc
+
+import "fmt"
+
+// DesktopSizeEncoding implements the DesktopSize pseudo-encoding, which is used
+// by the server to inform the client that the framebuffer has been resized.
+type DesktopSizeEncoding struct{}
+
+// Type returns the encoding type identifier.
+func (e *DesktopSizeEncoding) Type() EncodingType {
+	return EncDesktopSize
+}
+
+// Read handles the resize event. The new dimensions are in the rectangle header.
+func (e *DesktopSizeEncoding) Read(c Conn, rect *Rectangle) error {
+	// The new width and height are in the rectangle's header.
+	resizeFramebuffer(c, rect.Width, rect.Height)
+
+	if clientConn, ok := c.(*ClientConn); ok {
+		// Some servers, RealVNC among them, send nothing more after a
+		// resize until the client asks for the whole new framebuffer.
+		if err := clientConn.sendUpdateRequest(false); err != nil {
+			return fmt.Errorf("desktop-size: failed to request full update: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Reset does nothing as this encoding is stateless.
+func (e *DesktopSizeEncoding) Reset() {}
+
+// resizeFramebuffer records a new framebuffer size on c and resizes the
+// canvas decoders draw into to match.
+func resizeFramebuffer(c Conn, width, height uint16) {
+	c.SetWidth(width)
+	c.SetHeight(height)
+	if canvas := canvasOf(c); canvas != nil {
+		canvas.Resize(int(width), int(height))
+	}
+}
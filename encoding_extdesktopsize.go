@@ -0,0 +1,168 @@
+package avacadovnc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ExtendedDesktopSize change reasons, sent in the X field of the rectangle.
+const (
+	DesktopSizeReasonServer      uint16 = 0 // change initiated by the server
+	DesktopSizeReasonClient      uint16 = 1 // change requested by this client
+	DesktopSizeReasonOtherClient uint16 = 2 // change requested by another client
+)
+
+// ExtendedDesktopSize status codes, sent in the Y field of the rectangle in
+// reply to a client's resize request.
+const (
+	DesktopSizeStatusOK            uint16 = 0
+	DesktopSizeStatusProhibited    uint16 = 1 // resizing is not allowed
+	DesktopSizeStatusOutOfResource uint16 = 2 // the server ran out of resources
+	DesktopSizeStatusInvalidLayout uint16 = 3 // the requested layout is invalid
+)
+
+// Screen describes one screen of a multi-head framebuffer.
+type Screen struct {
+	ID            uint32
+	X, Y          uint16
+	Width, Height uint16
+	Flags         uint32
+}
+
+// ExtendedDesktopSizeEncoding implements the ExtendedDesktopSize pseudo-encoding,
+// which reports framebuffer resizes together with the screen layout. Servers
+// that rename the desktop at the same time send a DesktopName rectangle in the
+// same update, which is decoded as usual.
+type ExtendedDesktopSizeEncoding struct {
+	// Reason and Status hold the X and Y fields of the most recent update.
+	Reason uint16
+	Status uint16
+	// Screens holds the most recently received screen layout.
+	Screens []Screen
+}
+
+// Type returns the encoding type identifier.
+func (e *ExtendedDesktopSizeEncoding) Type() EncodingType {
+	return EncExtendedDesktopSize
+}
+
+// Read decodes the screen layout. The new dimensions are in the rectangle header.
+func (e *ExtendedDesktopSizeEncoding) Read(c Conn, rect *Rectangle) error {
+	var header [4]byte // number-of-screens, padding
+	if _, err := io.ReadFull(c, header[:]); err != nil {
+		return fmt.Errorf("extended-desktop-size: failed to read header: %w", err)
+	}
+
+	screens := make([]Screen, header[0])
+	if err := binary.Read(c, binary.BigEndian, screens); err != nil {
+		return fmt.Errorf("extended-desktop-size: failed to read screens: %w", err)
+	}
+
+	e.Reason = rect.X
+	e.Status = rect.Y
+	e.Screens = screens
+
+	// A failed client request leaves the framebuffer unchanged.
+	if e.Reason == DesktopSizeReasonClient && e.Status != DesktopSizeStatusOK {
+		return nil
+	}
+	resizeFramebuffer(c, rect.Width, rect.Height)
+	if clientConn, ok := c.(*ClientConn); ok {
+		clientConn.setScreens(screens)
+	}
+
+	// As with DesktopSize, ask for the whole new framebuffer.
+	if clientConn, ok := c.(*ClientConn); ok {
+		if err := clientConn.sendUpdateRequest(false); err != nil {
+			return fmt.Errorf("extended-desktop-size: failed to request full update: %w", err)
+		}
+	}
+	return nil
+}
+
+// writeExtendedDesktopSize writes an ExtendedDesktopSize rectangle, header
+// included, for a framebuffer of width by height with the given screens.
+func writeExtendedDesktopSize(c Conn, reason, status, width, height uint16, screens []Screen) error {
+	if len(screens) > 255 {
+		return fmt.Errorf("extended-desktop-size: too many screens (%d)", len(screens))
+	}
+	rect := &Rectangle{X: reason, Y: status, Width: width, Height: height, EncType: EncExtendedDesktopSize}
+	if err := rect.Write(c); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	buf.Write([]byte{byte(len(screens)), 0, 0, 0})
+	binary.Write(&buf, binary.BigEndian, screens)
+	_, err := c.Write(buf.Bytes())
+	return err
+}
+
+// Reset clears the recorded layout.
+func (e *ExtendedDesktopSizeEncoding) Reset() {
+	e.Reason, e.Status, e.Screens = 0, 0, nil
+}
+
+// SetDesktopSize asks the server to change the framebuffer size and screen
+// layout. The server answers with an ExtendedDesktopSize rectangle whose
+// reason is DesktopSizeReasonClient and whose status says whether the change
+// was made.
+type SetDesktopSize struct {
+	Width, Height uint16
+	// Screens is the requested layout. If empty, a single screen covering
+	// the whole framebuffer is requested.
+	Screens []Screen
+}
+
+// Supported reports whether the client advertised ExtendedDesktopSize, which
+// servers require before accepting SetDesktopSize.
+func (m *SetDesktopSize) Supported(c Conn) bool {
+	return c.GetEncInstance(EncExtendedDesktopSize) != nil
+}
+
+// String returns string
+func (m *SetDesktopSize) String() string {
+	return fmt.Sprintf("width: %d, height: %d, screens: %v", m.Width, m.Height, m.Screens)
+}
+
+// Type returns the message type.
+func (m *SetDesktopSize) Type() ClientMessageType { return ClientSetDesktopSize }
+
+// Write marshals the message to conn.
+func (m *SetDesktopSize) Write(c Conn) error {
+	if m.Width == 0 || m.Height == 0 {
+		return errors.New("set-desktop-size: width and height must be non-zero")
+	}
+	screens := m.Screens
+	if len(screens) == 0 {
+		screens = []Screen{{Width: m.Width, Height: m.Height}}
+	}
+	if len(screens) > 255 {
+		return fmt.Errorf("set-desktop-size: too many screens (%d)", len(screens))
+	}
+
+	var buf bytes.Buffer
+	buf.Write([]byte{byte(ClientSetDesktopSize), 0, byte(m.Width >> 8), byte(m.Width), byte(m.Height >> 8), byte(m.Height), byte(len(screens)), 0})
+	binary.Write(&buf, binary.BigEndian, screens)
+	_, err := c.Write(buf.Bytes())
+	return err
+}
+
+// Read unmarshals the message from conn.
+func (m *SetDesktopSize) Read(c Conn) (ClientMessage, error) {
+	var header [7]byte // padding, width, height, number-of-screens, padding
+	if _, err := io.ReadFull(c, header[:]); err != nil {
+		return nil, fmt.Errorf("set-desktop-size: failed to read header: %w", err)
+	}
+	msg := &SetDesktopSize{
+		Width:   binary.BigEndian.Uint16(header[1:3]),
+		Height:  binary.BigEndian.Uint16(header[3:5]),
+		Screens: make([]Screen, header[5]),
+	}
+	if err := binary.Read(c, binary.BigEndian, msg.Screens); err != nil {
+		return nil, fmt.Errorf("set-desktop-size: failed to read screens: %w", err)
+	}
+	return msg, nil
+}
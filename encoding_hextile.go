@@ -15,112 +15,162 @@ func (e *HextileEncoding) Type() EncodingType {
 	return EncHextile
 }
 
+// Hextile sub-encoding bits. ZlibHex adds the zlib bits to the basic ones.
+const (
+	hextileRaw                 = 1 << 0
+	hextileBackgroundSpecified = 1 << 1
+	hextileForegroundSpecified = 1 << 2
+	hextileAnySubrects         = 1 << 3
+	hextileSubrectsColored     = 1 << 4
+	hextileZlibRaw             = 1 << 5
+	hextileZlibHex             = 1 << 6
+)
+
 // Read decodes Hextile-encoded data.
 func (e *HextileEncoding) Read(c Conn, rect *Rectangle) error {
-	clientConn, ok := c.(*ClientConn)
-	if !ok {
-		return fmt.Errorf("hextile: connection is not a client connection")
-	}
-
-	bytesPerPixel := c.PixelFormat().BPP
-	if bytesPerPixel == 0 {
-		return fmt.Errorf("hextile: bytes per pixel is zero")
+	dec, err := newHextileDecoder(c, rect)
+	if err != nil {
+		return fmt.Errorf("hextile: %w", err)
 	}
+	return forEachTile(rect, func(tile *Rectangle) error {
+		var subEncoding uint8
+		if err := binary.Read(c, binary.BigEndian, &subEncoding); err != nil {
+			return fmt.Errorf("hextile: failed to read sub-encoding mask: %w", err)
+		}
+		if subEncoding&hextileRaw != 0 {
+			if err := dec.rawTile(c, tile); err != nil {
+				return fmt.Errorf("hextile: raw sub-encoding failed: %w", err)
+			}
+			return nil
+		}
+		if err := dec.tile(c, subEncoding, tile); err != nil {
+			return fmt.Errorf("hextile: %w", err)
+		}
+		return nil
+	})
+}
 
-	var bgColor, fgColor []byte
-
+// forEachTile calls fn for the 16x16 tiles of rect, row by row. Tiles in the
+// last row and column are cut to fit.
+func forEachTile(rect *Rectangle, fn func(tile *Rectangle) error) error {
 	for y := rect.Y; y < rect.Y+rect.Height; y += 16 {
 		for x := rect.X; x < rect.X+rect.Width; x += 16 {
-			tileX := x
-			tileY := y
-			tileW := uint16(16)
-			tileH := uint16(16)
-
+			tile := &Rectangle{X: x, Y: y, Width: 16, Height: 16}
 			// Adjust tile dimensions for the last tile in a row/column.
-			if tileX+tileW > rect.X+rect.Width {
-				tileW = rect.X + rect.Width - tileX
+			if tile.X+tile.Width > rect.X+rect.Width {
+				tile.Width = rect.X + rect.Width - tile.X
 			}
-			if tileY+tileH > rect.Y+rect.Height {
-				tileH = rect.Y + rect.Height - tileY
+			if tile.Y+tile.Height > rect.Y+rect.Height {
+				tile.Height = rect.Y + rect.Height - tile.Y
 			}
-
-			var subEncoding uint8
-			if err := binary.Read(c, binary.BigEndian, &subEncoding); err != nil {
-				return fmt.Errorf("hextile: failed to read sub-encoding mask: %w", err)
+			if err := fn(tile); err != nil {
+				return err
 			}
+		}
+	}
+	return nil
+}
 
-			if subEncoding&1 != 0 { // Raw sub-encoding
-				rawRect := &Rectangle{X: tileX, Y: tileY, Width: tileW, Height: tileH}
-				// The Raw encoding handler will read the pixel data.
-				rawEnc := &RawEncoding{}
-				if err := rawEnc.Read(c, rawRect); err != nil {
-					return fmt.Errorf("hextile: raw sub-encoding failed: %w", err)
-				}
-				continue
-			}
+// hextileDecoder holds the state carried from tile to tile within one
+// Hextile or ZlibHex rectangle: the background and foreground colors persist
+// until a tile specifies new ones.
+type hextileDecoder struct {
+	canvas        *VncCanvas
+	rect          *Rectangle
+	bytesPerPixel int
+	bgColor       []byte
+	fgColor       []byte
+	// raw holds the pixels of raw tiles at their place in the rectangle,
+	// so each tile is drawn straight from it. It is allocated on the first
+	// raw tile.
+	raw []byte
+}
 
-			if subEncoding&2 != 0 { // BackgroundSpecified
-				bgColor = make([]byte, bytesPerPixel)
-				if _, err := io.ReadFull(c, bgColor); err != nil {
-					return fmt.Errorf("hextile: failed to read background color: %w", err)
-				}
-			}
+func newHextileDecoder(c Conn, rect *Rectangle) (*hextileDecoder, error) {
+	bytesPerPixel := c.PixelFormat().BytesPerPixel()
+	if bytesPerPixel == 0 {
+		return nil, fmt.Errorf("bytes per pixel is zero")
+	}
+	return &hextileDecoder{canvas: canvasOf(c), rect: rect, bytesPerPixel: bytesPerPixel}, nil
+}
+
+// rawTile reads the uncompressed pixels of a raw tile from r into the
+// rectangle's buffer and draws them from there.
+func (d *hextileDecoder) rawTile(r io.Reader, tile *Rectangle) error {
+	stride := int(d.rect.Width) * d.bytesPerPixel
+	if d.raw == nil {
+		d.raw = make([]byte, stride*int(d.rect.Height))
+	}
+	offset := int(tile.Y-d.rect.Y)*stride + int(tile.X-d.rect.X)*d.bytesPerPixel
+	rowLen := int(tile.Width) * d.bytesPerPixel
+	for y := 0; y < int(tile.Height); y++ {
+		row := d.raw[offset+y*stride : offset+y*stride+rowLen]
+		if _, err := io.ReadFull(r, row); err != nil {
+			return fmt.Errorf("failed to read pixel data: %w", err)
+		}
+	}
+	if d.canvas == nil {
+		return nil
+	}
+	return d.canvas.DrawBytesStride(d.raw[offset:], stride, tile)
+}
+
+// tile reads the body of a tile that is not raw from r, following the
+// sub-encoding byte, and draws it.
+func (d *hextileDecoder) tile(r io.Reader, subEncoding uint8, tile *Rectangle) error {
+	if subEncoding&hextileBackgroundSpecified != 0 {
+		d.bgColor = make([]byte, d.bytesPerPixel)
+		if _, err := io.ReadFull(r, d.bgColor); err != nil {
+			return fmt.Errorf("failed to read background color: %w", err)
+		}
+	}
 
-			if subEncoding&4 != 0 { // ForegroundSpecified
-				fgColor = make([]byte, bytesPerPixel)
-				if _, err := io.ReadFull(c, fgColor); err != nil {
-					return fmt.Errorf("hextile: failed to read foreground color: %w", err)
-				}
+	if subEncoding&hextileForegroundSpecified != 0 {
+		d.fgColor = make([]byte, d.bytesPerPixel)
+		if _, err := io.ReadFull(r, d.fgColor); err != nil {
+			return fmt.Errorf("failed to read foreground color: %w", err)
+		}
+	}
+
+	// Fill the tile with the background color first.
+	if d.canvas != nil && d.bgColor != nil {
+		d.canvas.Fill(d.bgColor, tile)
+	}
+	if subEncoding&hextileAnySubrects == 0 {
+		return nil
+	}
+
+	var numSubRects uint8
+	if err := binary.Read(r, binary.BigEndian, &numSubRects); err != nil {
+		return fmt.Errorf("failed to read number of sub-rects: %w", err)
+	}
+	for i := 0; i < int(numSubRects); i++ {
+		subRectColor := d.fgColor
+		if subEncoding&hextileSubrectsColored != 0 {
+			subRectColor = make([]byte, d.bytesPerPixel)
+			if _, err := io.ReadFull(r, subRectColor); err != nil {
+				return fmt.Errorf("failed to read sub-rect color: %w", err)
 			}
+		}
+
+		var geometry [2]byte
+		if _, err := io.ReadFull(r, geometry[:]); err != nil {
+			return fmt.Errorf("failed to read sub-rect geometry: %w", err)
+		}
 
-			if subEncoding&8 != 0 { // AnySubrects
-				var numSubRects uint8
-				if err := binary.Read(c, binary.BigEndian, &numSubRects); err != nil {
-					return fmt.Errorf("hextile: failed to read number of sub-rects: %w", err)
-				}
-				// Fill the tile with the background color first.
-				if clientConn.Canvas != nil && bgColor != nil {
-					tileRect := &Rectangle{X: tileX, Y: tileY, Width: tileW, Height: tileH}
-					clientConn.Canvas.Fill(bgColor, tileRect)
-				}
-
-				for i := 0; i < int(numSubRects); i++ {
-					var subRectColor []byte
-					if subEncoding&16 != 0 { // SubrectsColored
-						subRectColor = make([]byte, bytesPerPixel)
-						if _, err := io.ReadFull(c, subRectColor); err != nil {
-							return fmt.Errorf("hextile: failed to read sub-rect color: %w", err)
-						}
-					} else {
-						subRectColor = fgColor
-					}
-
-					var geometry [2]byte
-					if _, err := io.ReadFull(c, geometry[:]); err != nil {
-						return fmt.Errorf("hextile: failed to read sub-rect geometry: %w", err)
-					}
-
-					xPos := (geometry[0] >> 4) & 0x0F
-					yPos := geometry[0] & 0x0F
-					width := (geometry[1] >> 4) & 0x0F
-					height := geometry[1] & 0x0F
-
-					subX := tileX + uint16(xPos)
-					subY := tileY + uint16(yPos)
-					subW := uint16(width) + 1
-					subH := uint16(height) + 1
-
-					if clientConn.Canvas != nil && subRectColor != nil {
-						sr := &Rectangle{X: subX, Y: subY, Width: subW, Height: subH}
-						clientConn.Canvas.Fill(subRectColor, sr)
-					}
-				}
-			} else { // No sub-rects, just fill the tile with the background color.
-				if clientConn.Canvas != nil && bgColor != nil {
-					tileRect := &Rectangle{X: tileX, Y: tileY, Width: tileW, Height: tileH}
-					clientConn.Canvas.Fill(bgColor, tileRect)
-				}
+		xPos := (geometry[0] >> 4) & 0x0F
+		yPos := geometry[0] & 0x0F
+		width := (geometry[1] >> 4) & 0x0F
+		height := geometry[1] & 0x0F
+
+		if d.canvas != nil && subRectColor != nil {
+			sr := &Rectangle{
+				X:      tile.X + uint16(xPos),
+				Y:      tile.Y + uint16(yPos),
+				Width:  uint16(width) + 1,
+				Height: uint16(height) + 1,
 			}
+			d.canvas.Fill(subRectColor, sr)
 		}
 	}
 	return nil
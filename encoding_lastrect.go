@@ -0,0 +1,42 @@
+package avacadovnc
+
+// lastRectSentinel is the number of rectangles a server sends when the end of
+// a FramebufferUpdate is instead marked by a LastRect rectangle.
+const lastRectSentinel = 0xFFFF
+
+// LastRectEncoding implements the LastRect pseudo-encoding, which lets a
+// server end a FramebufferUpdate with a marker rectangle instead of giving
+// the number of rectangles up front. Add it to the encodings to advertise
+// it to the server; the marker itself carries no data.
+type LastRectEncoding struct{}
+
+// Type returns the encoding type identifier.
+func (e *LastRectEncoding) Type() EncodingType {
+	return EncLastRect
+}
+
+// Read does nothing: the LastRect rectangle has no payload.
+func (e *LastRectEncoding) Read(c Conn, rect *Rectangle) error {
+	return nil
+}
+
+// Reset does nothing as this encoding is stateless.
+func (e *LastRectEncoding) Reset() {}
+
+// lastRectNegotiated reports whether LastRect was advertised on c, which is
+// what allows the server to use the rectangle count sentinel. On a client,
+// it stays true once LastRect has been advertised: a server pushing
+// continuous updates may still send updates using the sentinel after the
+// client has dropped LastRect with UpdateEncodings, until it has read the
+// new SetEncodings.
+func lastRectNegotiated(c Conn) bool {
+	switch conn := c.(type) {
+	case *ClientConn:
+		conn.encMu.Lock()
+		defer conn.encMu.Unlock()
+		return conn.lastRect
+	case *decodeConn:
+		return lastRectNegotiated(conn.wrappedConn)
+	}
+	return c.GetEncInstance(EncLastRect) != nil
+}
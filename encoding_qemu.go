@@ -0,0 +1,65 @@
+package avacadovnc
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// QEMU keyboard LED bits carried by the QEMU LED state pseudo-encoding.
+const (
+	QEMULedScrollLock uint8 = 1 << 0
+	QEMULedNumLock    uint8 = 1 << 1
+	QEMULedCapsLock   uint8 = 1 << 2
+)
+
+// QEMULedStateEncoding implements the QEMU LED state pseudo-encoding, with
+// which a server reports the guest's keyboard LEDs to a client that
+// advertises it.
+type QEMULedStateEncoding struct {
+	// State holds the most recently received LED bits, a combination of
+	// QEMULedScrollLock, QEMULedNumLock and QEMULedCapsLock.
+	State uint8
+}
+
+// Type returns the encoding type identifier.
+func (e *QEMULedStateEncoding) Type() EncodingType {
+	return EncQEMULedState
+}
+
+// Read decodes the LED state.
+func (e *QEMULedStateEncoding) Read(c Conn, rect *Rectangle) error {
+	if err := binary.Read(c, binary.BigEndian, &e.State); err != nil {
+		return fmt.Errorf("qemu-led-state: failed to read state: %w", err)
+	}
+	return nil
+}
+
+// Reset clears the recorded LED state.
+func (e *QEMULedStateEncoding) Reset() {
+	e.State = 0
+}
+
+// QEMUPointerMotionChangeEncoding implements the QEMU pointer motion change
+// pseudo-encoding, with which a server tells a client that advertises it
+// whether to send absolute pointer positions or relative motion. The mode is
+// in the X field of the rectangle header.
+type QEMUPointerMotionChangeEncoding struct {
+	// Absolute is false once the server has asked for relative motion.
+	Absolute bool
+}
+
+// Type returns the encoding type identifier.
+func (e *QEMUPointerMotionChangeEncoding) Type() EncodingType {
+	return EncQEMUPointerMotionChange
+}
+
+// Read records the pointer mode. The rectangle has no payload.
+func (e *QEMUPointerMotionChangeEncoding) Read(c Conn, rect *Rectangle) error {
+	e.Absolute = rect.X != 0
+	return nil
+}
+
+// Reset returns to absolute positions, the RFB default.
+func (e *QEMUPointerMotionChangeEncoding) Reset() {
+	e.Absolute = true
+}
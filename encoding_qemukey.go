@@ -0,0 +1,29 @@
+package avacadovnc
+
+// QEMUExtendedKeyEventEncoding implements the QEMU extended key event
+// pseudo-encoding. Advertising it asks the server whether it accepts
+// QEMUExtendedKeyEvent messages; a server that does answers with an empty
+// rectangle of this encoding, after which ClientConn.SendExtendedKey may be
+// used.
+type QEMUExtendedKeyEventEncoding struct{}
+
+// Type returns the encoding type identifier.
+func (e *QEMUExtendedKeyEventEncoding) Type() EncodingType {
+	return EncQEMUExtendedKeyEvent
+}
+
+// Read records the server's acknowledgement. The rectangle has no payload.
+func (e *QEMUExtendedKeyEventEncoding) Read(c Conn, rect *Rectangle) error {
+	if dc, ok := c.(*decodeConn); ok {
+		c = dc.wrappedConn
+	}
+	if clientConn, ok := c.(*ClientConn); ok {
+		clientConn.mu.Lock()
+		clientConn.extendedKeys = true
+		clientConn.mu.Unlock()
+	}
+	return nil
+}
+
+// Reset does nothing as this encoding is stateless.
+func (e *QEMUExtendedKeyEventEncoding) Reset() {}
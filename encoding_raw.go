@@ -1,45 +1,97 @@
-package avacadovnc
-
-import (
-	"fmt"
-	"io"
-)
-
-// RawEncoding implements the raw encoding, which is the simplest and most
-// inefficient encoding. It sends uncompressed pixel data.
-type RawEncoding struct{}
-
-// Type returns the encoding type identifier.
-func (e *RawEncoding) Type() EncodingType {
-	return EncRaw
-}
-
-// Read decodes a rectangle of raw, uncompressed pixel data.
-func (e *RawEncoding) Read(c Conn, rect *Rectangle) error {
-	bytesPerPixel := c.PixelFormat().BPP
-	if bytesPerPixel == 0 {
-		return fmt.Errorf("raw: bytes per pixel is zero")
-	}
-
-	// Calculate the total number of bytes for the rectangle.
-	bytesToRead := int(rect.Width) * int(rect.Height) * int(bytesPerPixel)
-	if bytesToRead == 0 {
-		return nil // Nothing to read.
-	}
-
-	pixelData := make([]byte, bytesToRead)
-	if _, err := io.ReadFull(c, pixelData); err != nil {
-		return fmt.Errorf("raw: failed to read pixel data: %w", err)
-	}
-
-	// Draw the decoded bytes to the canvas.
-	clientConn, ok := c.(*ClientConn)
-	if !ok || clientConn.Canvas == nil {
-		return nil // No canvas to draw on.
-	}
-
-	return clientConn.Canvas.DrawBytes(pixelData, rect)
-}
-
-// Reset does nothing as this encoding is stateless.
-func (e *RawEncoding) Reset() {}
+package avacadovnc
+
+import (
+	"fmt"
+	"io"
+)
+
+// RowSink receives decoded pixels one row at a time, for consumers that pass
+// frames on, for example to a video encoder, and need not keep a framebuffer.
+type RowSink interface {
+	// WriteRow receives row y, counted from the top of rect, as tightly
+	// packed RGBA pixels. pix is only valid during the call.
+	WriteRow(rect *Rectangle, y int, pix []byte) error
+}
+
+// RawEncoding implements the raw encoding, which is the simplest and most
+// inefficient encoding. It sends uncompressed pixel data.
+type RawEncoding struct {
+	// Rows, if set, receives Raw rectangles row by row instead of the
+	// canvas, so that no more than one row of pixels is held at a time.
+	// This suits very large framebuffers streamed to a sink, with no
+	// canvas attached and the server sending Raw updates.
+	Rows RowSink
+}
+
+// Type returns the encoding type identifier.
+func (e *RawEncoding) Type() EncodingType {
+	return EncRaw
+}
+
+// Read decodes a rectangle of raw, uncompressed pixel data.
+func (e *RawEncoding) Read(c Conn, rect *Rectangle) error {
+	bytesPerPixel := c.PixelFormat().BytesPerPixel()
+	if bytesPerPixel == 0 {
+		return fmt.Errorf("raw: bytes per pixel is zero")
+	}
+
+	// Calculate the total number of bytes for the rectangle.
+	bytesToRead := int(rect.Width) * int(rect.Height) * bytesPerPixel
+	if bytesToRead == 0 {
+		return nil // Nothing to read.
+	}
+	if e.Rows != nil {
+		return e.streamRows(c, rect, bytesPerPixel)
+	}
+
+	pixelData := make([]byte, bytesToRead)
+	if _, err := io.ReadFull(c, pixelData); err != nil {
+		return fmt.Errorf("raw: failed to read pixel data: %w", err)
+	}
+
+	// Draw the decoded bytes to the canvas.
+	canvas := canvasOf(c)
+	if canvas == nil {
+		return nil // No canvas to draw on.
+	}
+
+	return canvas.DrawBytes(pixelData, rect)
+}
+
+// streamRows reads rect one row at a time, converts each row to RGBA and
+// passes it to e.Rows.
+func (e *RawEncoding) streamRows(c Conn, rect *Rectangle, bytesPerPixel int) error {
+	pf, cm := c.PixelFormat(), c.ColorMap()
+	order := pixelOrder(&pf)
+	width := int(rect.Width)
+	row := make([]byte, width*bytesPerPixel)
+	rgba := make([]byte, width*4)
+	for y := 0; y < int(rect.Height); y++ {
+		if _, err := io.ReadFull(c, row); err != nil {
+			return fmt.Errorf("raw: failed to read pixel data: %w", err)
+		}
+		for x := 0; x < width; x++ {
+			var pixel uint32
+			b := row[x*bytesPerPixel:]
+			switch bytesPerPixel {
+			case 1:
+				pixel = uint32(b[0])
+			case 2:
+				pixel = uint32(order.Uint16(b))
+			case 4:
+				pixel = order.Uint32(b)
+			default:
+				return fmt.Errorf("raw: unsupported BPP: %d", pf.BPP)
+			}
+			clr := PixelToRGBA(pixel, &pf, &cm)
+			rgba[x*4], rgba[x*4+1], rgba[x*4+2], rgba[x*4+3] = clr.R, clr.G, clr.B, clr.A
+		}
+		if err := e.Rows.WriteRow(rect, y, rgba); err != nil {
+			return fmt.Errorf("raw: failed to write row: %w", err)
+		}
+	}
+	return nil
+}
+
+// Reset does nothing as this encoding is stateless.
+func (e *RawEncoding) Reset() {}
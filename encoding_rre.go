@@ -22,13 +22,10 @@ func (e *RREEncoding) Read(c Conn, rect *Rectangle) error {
 		return fmt.Errorf("rre: failed to read number of sub-rectangles: %w", err)
 	}
 
-	clientConn, ok := c.(*ClientConn)
-	if !ok {
-		return fmt.Errorf("rre: connection is not a client connection")
-	}
+	canvas := canvasOf(c)
 
 	pf := c.PixelFormat()
-	bytesPerPixel := pf.BPP
+	bytesPerPixel := pf.BytesPerPixel()
 	if bytesPerPixel == 0 {
 		return fmt.Errorf("rre: bytes per pixel is zero")
 	}
@@ -39,8 +36,8 @@ func (e *RREEncoding) Read(c Conn, rect *Rectangle) error {
 		return fmt.Errorf("rre: failed to read background color: %w", err)
 	}
 
-	if clientConn.Canvas != nil {
-		clientConn.Canvas.Fill(bgColor, rect)
+	if canvas != nil {
+		canvas.Fill(bgColor, rect)
 	}
 
 	// Read and process each sub-rectangle.
@@ -50,16 +47,15 @@ func (e *RREEncoding) Read(c Conn, rect *Rectangle) error {
 			return fmt.Errorf("rre: failed to read sub-rectangle color: %w", err)
 		}
 
-		var subRect Rectangle
-		if err := binary.Read(c, binary.BigEndian, &subRect); err != nil {
+		var geometry [4]uint16 // x, y, width, height
+		if err := binary.Read(c, binary.BigEndian, &geometry); err != nil {
 			return fmt.Errorf("rre: failed to read sub-rectangle header: %w", err)
 		}
 
-		if clientConn.Canvas != nil {
+		if canvas != nil {
 			// Adjust sub-rectangle position to be relative to the main canvas.
-			subRect.X += rect.X
-			subRect.Y += rect.Y
-			clientConn.Canvas.Fill(subRectColor, &subRect)
+			subRect := Rectangle{X: rect.X + geometry[0], Y: rect.Y + geometry[1], Width: geometry[2], Height: geometry[3]}
+			canvas.Fill(subRectColor, &subRect)
 		}
 	}
 
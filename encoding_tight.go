@@ -2,8 +2,8 @@ package avacadovnc
 
 import (
 	"bytes"
-	"compress/zlib"
 	"fmt"
+	"image/color"
 	"image/jpeg"
 	"image/png"
 	"io"
@@ -11,14 +11,66 @@ import (
 	"github.com/bigangryrobot/avacadovnc/logger"
 )
 
+// Tight basic compression filters, sent in an explicit filter byte when bit 6
+// of the compression control byte is set. Without one the copy filter is used.
+const (
+	tightFilterCopy     = 0
+	tightFilterPalette  = 1
+	tightFilterGradient = 2
+)
+
+// tightMinToCompress is the data size below which Tight sends basic
+// compression data as is, without a length and without using a zlib stream.
+const tightMinToCompress = 12
+
+// tightPixelSize returns the size of a Tight TPIXEL in pf. Tight sends pixels
+// of 32-bit true color formats with a depth of 24 as three bytes of red,
+// green and blue; other formats use their own pixel size.
+func tightPixelSize(pf *PixelFormat) int {
+	if isTightTPixel(pf) {
+		return 3
+	}
+	return pf.BytesPerPixel()
+}
+
+// tightPixelToRGBA converts the TPIXEL at the start of b to a color.
+func tightPixelToRGBA(b []byte, pf *PixelFormat, cm *ColorMap) color.RGBA {
+	if isTightTPixel(pf) {
+		return color.RGBA{R: b[0], G: b[1], B: b[2], A: 255}
+	}
+	order := pixelOrder(pf)
+	var pixel uint32
+	switch pf.BytesPerPixel() {
+	case 1:
+		pixel = uint32(b[0])
+	case 2:
+		pixel = uint32(order.Uint16(b))
+	case 4:
+		pixel = order.Uint32(b)
+	}
+	return PixelToRGBA(pixel, pf, cm)
+}
+
 // TightEncoding implements the Tight VNC encoding, a highly efficient encoding
 // that uses zlib compression and various filters to reduce bandwidth.
 type TightEncoding struct {
-	// zlibs holds the zlib reader streams. The protocol allows for up to 4
-	// separate streams to be used for different types of data.
-	zlibs [4]io.ReadCloser
+	// zlibs holds the zlib streams. The protocol allows for up to 4
+	// separate streams to be used for different types of data; each one
+	// continues across rectangles until the server asks for it to be reset.
+	zlibs [4]zlibStream
 	// buffer is a reusable buffer for reading compressed data, to reduce allocations.
 	buffer *bytes.Buffer
+
+	// SmoothJPEGSeams blends the edge pixels of each JPEG rectangle
+	// towards their neighbors outside it, hiding the blocking where
+	// independently decoded rectangles meet. Rectangle interiors and the
+	// pixels outside the rectangle are left untouched.
+	SmoothJPEGSeams bool
+	// SkipCorruptImages skips a JPEG or PNG rectangle whose image fails to
+	// decode, logging a warning, instead of failing the update. The image
+	// data is length-prefixed, so the next rectangle can still be read;
+	// the skipped area keeps its previous contents.
+	SkipCorruptImages bool
 }
 
 // Type returns the encoding type identifier.
@@ -38,28 +90,31 @@ func (e *TightEncoding) Read(c Conn, rect *Rectangle) error {
 	// Bits 0-3 of compControl indicate which zlib streams should be reset.
 	for i := 0; i < 4; i++ {
 		if (compControl[0]>>i)&1 != 0 {
-			if e.zlibs[i] != nil {
-				e.zlibs[i].Close()
-				e.zlibs[i] = nil
-			}
+			e.zlibs[i].reset()
 		}
 	}
 
 	// Dispatch to the correct sub-encoding handler based on the compControl byte.
 	if compControl[0]&0x80 == 0 {
-		// Bit 7 is 0: Basic compression (Copy, Palette, Gradient, or plain zlib).
+		// Bit 7 is 0: Basic compression. Bits 4-5 select the zlib stream and
+		// bit 6 says an explicit filter byte follows.
 		streamID := (compControl[0] >> 4) & 0x03
-		filterID := compControl[0] & 0x70
+		var filterID [1]byte
+		if compControl[0]&0x40 != 0 {
+			if _, err := io.ReadFull(c, filterID[:]); err != nil {
+				return fmt.Errorf("tight: failed to read filter id: %w", err)
+			}
+		}
 
-		switch filterID {
-		case 0x40: // Gradient filter
-			return e.handleGradient(c, rect)
-		case 0x20: // Palette filter
-			return e.handlePalette(c, rect, streamID)
-		case 0x10, 0x00: // Copy (plain zlib)
+		switch filterID[0] {
+		case tightFilterCopy:
 			return e.handleCopy(c, rect, streamID)
+		case tightFilterPalette:
+			return e.handlePalette(c, rect, streamID)
+		case tightFilterGradient:
+			return e.handleGradient(c, rect, streamID)
 		default:
-			return fmt.Errorf("tight: unsupported basic filter: %x", filterID)
+			return fmt.Errorf("tight: unsupported basic filter: %x", filterID[0])
 		}
 	}
 
@@ -76,47 +131,60 @@ func (e *TightEncoding) Read(c Conn, rect *Rectangle) error {
 	}
 }
 
-// handleCopy decodes raw pixel data compressed with zlib.
+// handleCopy decodes TPIXEL data compressed with zlib.
 func (e *TightEncoding) handleCopy(c Conn, rect *Rectangle, streamID byte) error {
-	bytesPerPixel := c.PixelFormat().BPP
-	rowSize := int(rect.Width) * int(bytesPerPixel)
+	pf := c.PixelFormat()
+	pixelSize := tightPixelSize(&pf)
+	if pixelSize == 0 {
+		return fmt.Errorf("tight: bytes per pixel is zero")
+	}
+	rowSize := int(rect.Width) * pixelSize
 	uncompressedSize := rowSize * int(rect.Height)
 
-	compressedData, err := e.readCompressedData(c)
+	pixelData, err := e.readBasicData(c, uncompressedSize, streamID)
 	if err != nil {
 		return err
 	}
-	if len(compressedData) == 0 {
+	if len(pixelData) == 0 {
 		return nil // No data to process.
 	}
 
-	// Decompress the data using the appropriate zlib stream.
-	pixelData, err := e.decompress(compressedData, uncompressedSize, streamID)
-	if err != nil {
-		return err
-	}
-
 	// Draw the raw pixel data to the canvas.
-	clientConn, ok := c.(*ClientConn)
-	if !ok || clientConn.Canvas == nil {
+	canvas := canvasOf(c)
+	if canvas == nil {
 		return nil // No canvas to draw on.
 	}
-	return clientConn.Canvas.DrawBytes(pixelData, rect)
+	if !isTightTPixel(&pf) {
+		return canvas.DrawBytes(pixelData, rect)
+	}
+	// TPIXELs are R, G, B; add the alpha byte.
+	numPixels := len(pixelData) / 3
+	rgbaData := make([]byte, numPixels*4)
+	for i := 0; i < numPixels; i++ {
+		copy(rgbaData[i*4:i*4+3], pixelData[i*3:i*3+3])
+		rgbaData[i*4+3] = 255
+	}
+	return canvas.DrawRGBA(rgbaData, rect)
 }
 
-// handleFill decodes a rectangle filled with a single color.
+// handleFill decodes a rectangle filled with a single TPIXEL color.
 func (e *TightEncoding) handleFill(c Conn, rect *Rectangle) error {
-	bytesPerPixel := c.PixelFormat().BPP
-	colorBytes := make([]byte, bytesPerPixel)
+	pf := c.PixelFormat()
+	pixelSize := tightPixelSize(&pf)
+	if pixelSize == 0 {
+		return fmt.Errorf("tight: bytes per pixel is zero")
+	}
+	colorBytes := make([]byte, pixelSize)
 	if _, err := io.ReadFull(c, colorBytes); err != nil {
 		return fmt.Errorf("tight: failed to read fill color: %w", err)
 	}
 
-	clientConn, ok := c.(*ClientConn)
-	if !ok || clientConn.Canvas == nil {
+	canvas := canvasOf(c)
+	if canvas == nil {
 		return nil // No canvas to draw on.
 	}
-	return clientConn.Canvas.Fill(colorBytes, rect)
+	cm := c.ColorMap()
+	return canvas.FillColor(tightPixelToRGBA(colorBytes, &pf, &cm), rect)
 }
 
 // handleJPEG decodes a JPEG-encoded rectangle.
@@ -131,14 +199,17 @@ func (e *TightEncoding) handleJPEG(c Conn, rect *Rectangle) error {
 
 	img, err := jpeg.Decode(bytes.NewReader(jpegData))
 	if err != nil {
-		return fmt.Errorf("tight: failed to decode jpeg: %w", err)
+		return e.corruptImage(rect, "jpeg", err)
 	}
 
-	clientConn, ok := c.(*ClientConn)
-	if !ok || clientConn.Canvas == nil {
+	canvas := canvasOf(c)
+	if canvas == nil {
 		return nil
 	}
-	clientConn.Canvas.Draw(img, rect)
+	canvas.Draw(img, rect)
+	if e.SmoothJPEGSeams {
+		canvas.SmoothSeams(rect)
+	}
 	return nil
 }
 
@@ -154,14 +225,24 @@ func (e *TightEncoding) handlePNG(c Conn, rect *Rectangle) error {
 
 	img, err := png.Decode(bytes.NewReader(pngData))
 	if err != nil {
-		return fmt.Errorf("tight: failed to decode png: %w", err)
+		return e.corruptImage(rect, "png", err)
 	}
 
-	clientConn, ok := c.(*ClientConn)
-	if !ok || clientConn.Canvas == nil {
+	canvas := canvasOf(c)
+	if canvas == nil {
 		return nil
 	}
-	clientConn.Canvas.Draw(img, rect)
+	canvas.Draw(img, rect)
+	return nil
+}
+
+// corruptImage handles an embedded image of rect that failed to decode: it
+// returns the error, or logs it and returns nil if SkipCorruptImages is set.
+func (e *TightEncoding) corruptImage(rect *Rectangle, format string, err error) error {
+	if !e.SkipCorruptImages {
+		return fmt.Errorf("tight: failed to decode %s: %w", format, err)
+	}
+	logger.Warnf("tight: skipping rectangle %dx%d at (%d,%d) with corrupt %s: %v", rect.Width, rect.Height, rect.X, rect.Y, format, err)
 	return nil
 }
 
@@ -172,13 +253,22 @@ func (e *TightEncoding) handlePalette(c Conn, rect *Rectangle, streamID byte) er
 		return fmt.Errorf("tight: failed to read palette size: %w", err)
 	}
 	paletteSize := int(numColors[0]) + 1
-	bytesPerPixel := c.PixelFormat().BPP
+	pf := c.PixelFormat()
+	pixelSize := tightPixelSize(&pf)
+	if pixelSize == 0 {
+		return fmt.Errorf("tight: bytes per pixel is zero")
+	}
 
 	// Read the palette.
-	paletteData := make([]byte, paletteSize*int(bytesPerPixel))
+	paletteData := make([]byte, paletteSize*pixelSize)
 	if _, err := io.ReadFull(c, paletteData); err != nil {
 		return fmt.Errorf("tight: failed to read palette data: %w", err)
 	}
+	cm := c.ColorMap()
+	palette := make([]color.RGBA, paletteSize)
+	for i := range palette {
+		palette[i] = tightPixelToRGBA(paletteData[i*pixelSize:], &pf, &cm)
+	}
 
 	// Determine if the indexed data is 1-bit or 8-bit.
 	var bitsPerIndex int
@@ -192,58 +282,62 @@ func (e *TightEncoding) handlePalette(c Conn, rect *Rectangle, streamID byte) er
 	}
 	uncompressedSize := rowSize * int(rect.Height)
 
-	// Decompress the indexed data.
-	compressedData, err := e.readCompressedData(c)
+	indexedData, err := e.readBasicData(c, uncompressedSize, streamID)
 	if err != nil {
 		return err
 	}
-	indexedData, err := e.decompress(compressedData, uncompressedSize, streamID)
-	if err != nil {
-		return err
+	if len(indexedData) == 0 {
+		return nil
 	}
 
 	// Convert indexed data to full color and draw.
-	clientConn, ok := c.(*ClientConn)
-	if !ok || clientConn.Canvas == nil {
+	canvas := canvasOf(c)
+	if canvas == nil {
 		return nil
 	}
-	return clientConn.Canvas.DrawPalette(indexedData, paletteData, bitsPerIndex, rect)
+	return canvas.DrawIndexed(indexedData, palette, bitsPerIndex, rect)
 }
 
 // handleGradient is a placeholder for gradient-filled rectangles.
-// This is rarely used in practice, so we log and skip it.
-func (e *TightEncoding) handleGradient(c Conn, rect *Rectangle) error {
+// This is rarely used in practice, so we log and skip it. The data is still
+// decompressed so the zlib stream stays in step with the server's.
+func (e *TightEncoding) handleGradient(c Conn, rect *Rectangle, streamID byte) error {
 	logger.Warn("tight: gradient filter is not implemented, skipping rectangle")
-	// Gradient data is uncompressed raw pixel data.
-	bytesToRead := int(rect.Width) * int(rect.Height) * int(c.PixelFormat().BPP)
-	if _, err := io.CopyN(io.Discard, c, int64(bytesToRead)); err != nil {
-		return fmt.Errorf("tight: failed to discard gradient data: %w", err)
+	pf := c.PixelFormat()
+	size := int(rect.Width) * int(rect.Height) * tightPixelSize(&pf)
+	if _, err := e.readBasicData(c, size, streamID); err != nil {
+		return fmt.Errorf("tight: failed to skip gradient data: %w", err)
 	}
 	return nil
 }
 
-// decompress handles the zlib decompression.
-func (e *TightEncoding) decompress(data []byte, uncompressedSize int, streamID byte) ([]byte, error) {
-	if e.zlibs[streamID] == nil {
-		zr, err := zlib.NewReader(bytes.NewReader(data))
-		if err != nil {
-			return nil, fmt.Errorf("tight: failed to create zlib reader: %w", err)
-		}
-		e.zlibs[streamID] = zr
-	} else {
-		if resetter, ok := e.zlibs[streamID].(zlib.Resetter); ok {
-			err := resetter.Reset(bytes.NewReader(data), nil)
-			if err != nil {
-				return nil, fmt.Errorf("tight: failed to reset zlib reader: %w", err)
-			}
-		} else {
-			e.zlibs[streamID].Close()
-			zr, err := zlib.NewReader(bytes.NewReader(data))
-			if err != nil {
-				return nil, fmt.Errorf("tight: failed to create new zlib reader: %w", err)
-			}
-			e.zlibs[streamID] = zr
+// readBasicData reads the size bytes of filtered data of a basic compression
+// rectangle. Data shorter than tightMinToCompress is sent as is; anything
+// longer is length-prefixed and decompressed with the given zlib stream.
+func (e *TightEncoding) readBasicData(c Conn, size int, streamID byte) ([]byte, error) {
+	if size < tightMinToCompress {
+		data := make([]byte, size)
+		if _, err := io.ReadFull(c, data); err != nil {
+			return nil, fmt.Errorf("tight: failed to read uncompressed data: %w", err)
 		}
+		return data, nil
+	}
+	compressedData, err := e.readCompressedData(c)
+	if err != nil {
+		return nil, err
+	}
+	if len(compressedData) == 0 {
+		return nil, nil
+	}
+	return e.decompress(compressedData, size, streamID)
+}
+
+// decompress feeds data to the given zlib stream and reads uncompressedSize
+// bytes from it.
+func (e *TightEncoding) decompress(data []byte, uncompressedSize int, streamID byte) ([]byte, error) {
+	zr, err := e.zlibs[streamID].feed(data)
+	if err != nil {
+		return nil, fmt.Errorf("tight: %w", err)
 	}
 
 	if e.buffer == nil {
@@ -251,7 +345,7 @@ func (e *TightEncoding) decompress(data []byte, uncompressedSize int, streamID b
 	}
 	e.buffer.Reset()
 	e.buffer.Grow(uncompressedSize)
-	if _, err := io.CopyN(e.buffer, e.zlibs[streamID], int64(uncompressedSize)); err != nil {
+	if _, err := io.CopyN(e.buffer, zr, int64(uncompressedSize)); err != nil {
 		return nil, fmt.Errorf("tight: zlib decompression failed: %w", err)
 	}
 	return e.buffer.Bytes(), nil
@@ -292,10 +386,12 @@ func (e *TightEncoding) readCompressedData(c io.Reader) ([]byte, error) {
 // Reset cleans up the zlib streams.
 func (e *TightEncoding) Reset() {
 	for i := range e.zlibs {
-		if e.zlibs[i] != nil {
-			e.zlibs[i].Close()
-			e.zlibs[i] = nil
-		}
+		e.zlibs[i].reset()
 	}
 	e.buffer = nil
 }
+
+// zlibStreams returns the four zlib streams.
+func (e *TightEncoding) zlibStreams() []*zlibStream {
+	return []*zlibStream{&e.zlibs[0], &e.zlibs[1], &e.zlibs[2], &e.zlibs[3]}
+}
@@ -0,0 +1,36 @@
+package avacadovnc
+
+// trleTileSize is the width and height of a TRLE tile.
+const trleTileSize = 16
+
+// TRLEEncoding implements the TRLE (Tiled Run-Length Encoding). It uses the
+// tile format of ZRLE without the zlib stream, with 16x16 tiles, and adds
+// sub-encodings that reuse the palette of the previous tile.
+type TRLEEncoding struct{}
+
+// Type returns the encoding type identifier.
+func (e *TRLEEncoding) Type() EncodingType {
+	return EncTRLE
+}
+
+// Read decodes TRLE-encoded data.
+func (e *TRLEEncoding) Read(c Conn, rect *Rectangle) error {
+	pf := c.PixelFormat()
+	cm := c.ColorMap()
+	d := &zrleDecoder{name: "trle", r: c, pf: &pf, cm: &cm, reusePalette: true}
+	d.cpixelLen, d.cpixelPadFirst = zrleCPixel(&pf)
+
+	rgba, err := d.decodeRect(int(rect.Width), int(rect.Height), trleTileSize)
+	if err != nil {
+		return err
+	}
+
+	canvas := canvasOf(c)
+	if canvas == nil {
+		return nil // No canvas to draw on.
+	}
+	return canvas.DrawRGBA(rgba, rect)
+}
+
+// Reset does nothing as this encoding is stateless.
+func (e *TRLEEncoding) Reset() {}
@@ -3,10 +3,14 @@ package avacadovnc
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"image"
 	"image/draw"
 	"io"
 	"net"
+	"time"
+	"unicode/utf8"
 
 	"github.com/bigangryrobot/avacadovnc/logger"
 )
@@ -44,6 +48,8 @@ type Conn interface {
 	Height() uint16
 	SetHeight(uint16)
 	Config() interface{}
+	// IsClient reports whether this end of the connection is the client.
+	IsClient() bool
 }
 
 // SecurityHandler defines the interface for a VNC security scheme.
@@ -173,7 +179,8 @@ func NewRectangle() *Rectangle {
 // 	return rgba
 // }
 
-// Write marshal rectangle to conn
+// Write marshal rectangle header to conn. The encoded pixel data, if any,
+// must be written by the caller.
 func (rect *Rectangle) Write(c Conn) error {
 	var err error
 
@@ -189,15 +196,20 @@ func (rect *Rectangle) Write(c Conn) error {
 	if err = binary.Write(c, binary.BigEndian, rect.Height); err != nil {
 		return err
 	}
-	if err = binary.Write(c, binary.BigEndian, rect.EncType); err != nil {
-		return err
-	}
-
-	return rect.Write(c)
+	return binary.Write(c, binary.BigEndian, rect.EncType)
 }
 
 // Read unmarshal rectangle from conn
 func (rect *Rectangle) Read(c Conn) error {
+	if err := rect.readHeader(c); err != nil {
+		return err
+	}
+	return rect.decode(c)
+}
+
+// readHeader reads the 12-byte rectangle header: position, size and encoding
+// type.
+func (rect *Rectangle) readHeader(c Conn) error {
 	var err error
 
 	if err = binary.Read(c, binary.BigEndian, &rect.X); err != nil {
@@ -216,6 +228,11 @@ func (rect *Rectangle) Read(c Conn) error {
 		return err
 	}
 	logger.Debug(rect)
+	return nil
+}
+
+// decode picks the decoder for the rectangle's encoding and reads its payload.
+func (rect *Rectangle) decode(c Conn) error {
 	switch rect.EncType {
 	// case EncCopyRect:
 	// 	rect.Enc = &CopyRectEncoding{}
@@ -229,16 +246,22 @@ func (rect *Rectangle) Read(c Conn) error {
 	// 	} else {
 	// 		rect.Enc = &RawEncoding{}
 	// 	}
-	case EncDesktopSize:
-		rect.Enc = &DesktopSizeEncoding{}
-	case EncDesktopName:
-		rect.Enc = &DesktopNameEncoding{}
+	case EncDesktopSize, EncDesktopName:
+		rect.Enc = newEncoding(rect.EncType)
+	case EncExtendedDesktopSize:
+		rect.Enc = c.GetEncInstance(rect.EncType)
+		if rect.Enc == nil {
+			rect.Enc = newEncoding(rect.EncType)
+		}
 	// case EncXCursorPseudo:
 	// 	rect.Enc = &XCursorPseudoEncoding{}
 	// case EncAtenHermon:
 	// 	rect.Enc = &AtenHermon{}
 	default:
 		rect.Enc = c.GetEncInstance(rect.EncType)
+		if rect.Enc == nil {
+			rect.Enc = vmwareEncodingFor(rect.EncType)
+		}
 		if rect.Enc == nil {
 			return fmt.Errorf("unsupported encoding %s", rect.EncType)
 		}
@@ -304,45 +327,28 @@ func NewPixelFormatAten() PixelFormat {
 
 // Marshal implements the Marshaler interface
 func (pf PixelFormat) Marshal() ([]byte, error) {
-	// Validation checks.
-	switch pf.BPP {
-	case 8, 16, 32:
-	default:
-		return nil, fmt.Errorf("Invalid BPP value %v; must be 8, 16, or 32", pf.BPP)
-	}
-
-	if pf.Depth < pf.BPP {
-		return nil, fmt.Errorf("Invalid Depth value %v; cannot be < BPP", pf.Depth)
-	}
-	switch pf.Depth {
-	case 8, 16, 32:
-	default:
-		return nil, fmt.Errorf("Invalid Depth value %v; must be 8, 16, or 32", pf.Depth)
+	if err := pf.Validate(); err != nil {
+		return nil, err
 	}
-
-	// Create the slice of bytes
-	buf := bPool.Get().(*bytes.Buffer)
-	buf.Reset()
-	defer bPool.Put(buf)
-
+	// The bytes are returned to the caller, so they must not come from bPool.
+	buf := bytes.NewBuffer(make([]byte, 0, pixelFormatLen))
 	if err := binary.Write(buf, binary.BigEndian, &pf); err != nil {
 		return nil, err
 	}
-
 	return buf.Bytes(), nil
 }
 
 // Read reads from an io.Reader, and populates the PixelFormat
-func (pf PixelFormat) Read(r io.Reader) error {
+func (pf *PixelFormat) Read(r io.Reader) error {
 	buf := make([]byte, pixelFormatLen)
-	if _, err := io.ReadAtLeast(r, buf, pixelFormatLen); err != nil {
+	if _, err := io.ReadFull(r, buf); err != nil {
 		return err
 	}
 	return pf.Unmarshal(buf)
 }
 
 // Unmarshal implements the Unmarshaler interface
-func (pf PixelFormat) Unmarshal(data []byte) error {
+func (pf *PixelFormat) Unmarshal(data []byte) error {
 	buf := bPool.Get().(*bytes.Buffer)
 	buf.Reset()
 	defer bPool.Put(buf)
@@ -351,7 +357,7 @@ func (pf PixelFormat) Unmarshal(data []byte) error {
 		return err
 	}
 
-	if err := binary.Read(buf, binary.BigEndian, &pf); err != nil {
+	if err := binary.Read(buf, binary.BigEndian, pf); err != nil {
 		return err
 	}
 
@@ -364,6 +370,30 @@ func (pf PixelFormat) String() string {
 		pf.BPP, pf.Depth, pf.BigEndian, pf.TrueColor, pf.RedMax, pf.GreenMax, pf.BlueMax, pf.RedShift, pf.GreenShift, pf.BlueShift)
 }
 
+// Validate reports problems with the pixel format: a bits-per-pixel value
+// other than 8, 16 or 32, a depth larger than that, or a true color channel
+// with a maximum of zero. Zero maxima are tolerated when decoding; the
+// channel is treated as always 0.
+func (pf PixelFormat) Validate() error {
+	switch pf.BPP {
+	case 8, 16, 32:
+	default:
+		return fmt.Errorf("pixel-format: unsupported bits per pixel %d", pf.BPP)
+	}
+	if pf.Depth > pf.BPP {
+		return fmt.Errorf("pixel-format: depth %d exceeds bits per pixel %d", pf.Depth, pf.BPP)
+	}
+	if pf.TrueColor != 0 && (pf.RedMax == 0 || pf.GreenMax == 0 || pf.BlueMax == 0) {
+		return fmt.Errorf("pixel-format: zero channel maximum (red %d, green %d, blue %d)", pf.RedMax, pf.GreenMax, pf.BlueMax)
+	}
+	return nil
+}
+
+// BytesPerPixel returns the number of bytes each pixel occupies on the wire.
+func (pf PixelFormat) BytesPerPixel() int {
+	return int(pf.BPP) / 8
+}
+
 func (pf PixelFormat) order() binary.ByteOrder {
 	if pf.BigEndian == 1 {
 		return binary.BigEndian
@@ -385,6 +415,68 @@ type ClientConfig struct {
 	Exclusive        bool
 	DrawCursor       bool
 	Messages         []ServerMessage
+	// AutoRequest controls whether FramebufferUpdateRequests are sent
+	// automatically after the initial one. The default is AutoRequestOff.
+	AutoRequest AutoRequestMode
+	// Resync enables experimental recovery from decode errors: instead of
+	// closing the connection, the client discards data until the next
+	// plausible FramebufferUpdate header and asks for a full update.
+	// Recovery is heuristic and may skip or misread updates. It is not
+	// attempted when a rectangle of a stateful encoding, such as Zlib,
+	// ZRLE or Tight, fails, as its stream cannot be recovered.
+	Resync bool
+	// DetectUTF8CutText decodes ServerCutText as UTF-8 when it is valid
+	// UTF-8, falling back to latin-1 otherwise. Many servers send UTF-8
+	// despite the specification requiring latin-1.
+	DetectUTF8CutText bool
+	// HandshakeTimeout bounds the whole handshake in Connect. Zero means 10
+	// seconds; a negative value disables the limit.
+	HandshakeTimeout time.Duration
+	// ReadTimeout is how long the message loop waits for the next server
+	// message before giving up on the connection. Zero or a negative value
+	// means no deadline, for sessions that may stay quiet for long.
+	ReadTimeout time.Duration
+	// WriteTimeout bounds each message written to the server. Zero or a
+	// negative value means no deadline.
+	WriteTimeout time.Duration
+	// KeepAliveInterval, if positive, makes the client send a keepalive at
+	// that interval so that an idle session does not hit its ReadTimeout.
+	// If the server supports fences, which it announces in reply to
+	// FenceEncoding, the keepalive is a fence request, and the read
+	// deadline is only extended by the server's answer. Otherwise it is an
+	// incremental FramebufferUpdateRequest, which an idle server need not
+	// answer, so the read deadline is extended when the request is written.
+	// In AutoRequestOnDemand mode that request waits like any other
+	// RequestUpdate, yet the deadline is still extended.
+	KeepAliveInterval time.Duration
+	// ChannelOrderOverride forces the byte order of the color channels in
+	// 32-bit pixels from the server, for servers, typically KVMs, whose
+	// data does not match the shifts of the pixel format they report.
+	ChannelOrderOverride ChannelOrderOverride
+	// ParallelDecode converts the Raw rectangles of a FramebufferUpdate
+	// into the canvas on several goroutines. Overlapping rectangles and
+	// other encodings are still applied in order, so the result matches
+	// serial decoding. It helps with large uncompressed updates.
+	ParallelDecode bool
+	// OnFramebufferUpdate, OnColorMap, OnBell and OnCutText are called from
+	// the message loop for the matching server message, after it has been
+	// applied to the canvas and before it is sent on ServerMessageCh, so a
+	// callback that blocks holds up both. Setting a callback accepts its
+	// message even if it is not in Messages. With callbacks set,
+	// ServerMessageCh may be nil.
+	//
+	// OnFramebufferUpdate receives the canvas once the update is drawn and
+	// published, OnColorMap the updated color map, and OnCutText the
+	// decoded clipboard text. The canvas's DirtyRegions report what changed
+	// since the callback last called ClearDirty.
+	OnFramebufferUpdate func(*VncCanvas)
+	OnColorMap          func(ColorMap)
+	OnBell              func()
+	OnCutText           func(string)
+	// OnHandshakeEvent is called for each step of the handshake performed
+	// by the default handlers, such as the versions exchanged and the
+	// security type chosen, for auditing.
+	OnHandshakeEvent func(HandshakeEvent)
 }
 
 type ServerConfig struct {
@@ -394,29 +486,90 @@ type ServerConfig struct {
 	PixelFormat      PixelFormat
 	Width, Height    uint16
 	DesktopName      string
-	quit             chan struct{}
+	ClientMessageCh  chan ClientMessage
+	Messages         []ClientMessage
+	// Password is checked by a server-side SecurityVNC handler that has no
+	// password of its own.
+	Password []byte
+	// FramebufferSource supplies the pixels for framebuffer updates. If nil,
+	// FramebufferUpdateRequests are answered with an empty update.
+	FramebufferSource FramebufferSource
+	// EncodingStrategy chooses the encoding of each region of an update. If
+	// nil, updates are sent as a single Raw rectangle.
+	EncodingStrategy EncodingStrategy
+	// OnFramebufferRequest is called for each FramebufferUpdateRequest. If
+	// set, it is responsible for answering the request; otherwise the
+	// request is answered from FramebufferSource.
+	OnFramebufferRequest func(sc *ServerConn, req *FramebufferUpdateRequest) error
+	// OnKeyEvent is called for each KeyEvent from the client.
+	OnKeyEvent func(sc *ServerConn, ev *KeyEvent)
+	// OnPointerEvent is called for each PointerEvent from the client.
+	OnPointerEvent func(sc *ServerConn, ev *PointerEvent)
+	// OnCutText is called for each ClientCutText message from the client.
+	OnCutText func(sc *ServerConn, msg *CutTextMessage)
+	// OnQEMUExtendedKeyEvent is called for each QEMU extended key event
+	// from the client.
+	OnQEMUExtendedKeyEvent func(sc *ServerConn, ev *QEMUExtendedKeyEvent)
+	// OnQEMUAudio is called for each QEMU audio message from the client.
+	OnQEMUAudio func(sc *ServerConn, msg *QEMUAudioMessage)
+	// OnSetDesktopSize is called for each valid SetDesktopSize request from
+	// a client that advertised ExtendedDesktopSize, and returns one of the
+	// DesktopSizeStatus codes. On DesktopSizeStatusOK the connection takes
+	// the requested size and layout. If nil, resizing is prohibited.
+	OnSetDesktopSize func(sc *ServerConn, req *SetDesktopSize) uint16
+	// DetectUTF8CutText decodes ClientCutText as UTF-8 when it is valid
+	// UTF-8, falling back to latin-1 otherwise.
+	DetectUTF8CutText bool
+	quit              chan struct{}
+}
+
+// FramebufferSource supplies the framebuffer contents served to clients.
+type FramebufferSource interface {
+	// Framebuffer returns the current framebuffer image.
+	Framebuffer() image.Image
 }
 
 // --- Enumerations and Stringers ---
 type EncodingType int32
 
 const (
-	EncRaw         EncodingType = 0
-	EncCopyRect    EncodingType = 1
-	EncRRE         EncodingType = 2
-	EncCoRRE       EncodingType = 4
-	EncHextile     EncodingType = 5
-	EncZlib        EncodingType = 6
-	EncTight       EncodingType = 7
-	EncZRLE        EncodingType = 16
-	EncTightPNG    EncodingType = -260
-	EncDesktopSize EncodingType = -223
-	EncLastRect    EncodingType = -224
-	EncCursor      EncodingType = -239
-	EncXCursor     EncodingType = -240
-	EncAtenHermon  EncodingType = -305
-	EncDesktopName EncodingType = -307
-	EncPointerPos  EncodingType = -258
+	EncRaw                 EncodingType = 0
+	EncCopyRect            EncodingType = 1
+	EncRRE                 EncodingType = 2
+	EncCoRRE               EncodingType = 4
+	EncHextile             EncodingType = 5
+	EncZlib                EncodingType = 6
+	EncTight               EncodingType = 7
+	EncZlibHex             EncodingType = 8
+	EncTRLE                EncodingType = 15
+	EncZRLE                EncodingType = 16
+	EncTightPNG            EncodingType = -260
+	EncDesktopSize         EncodingType = -223
+	EncLastRect            EncodingType = -224
+	EncCursor              EncodingType = -239
+	EncXCursor             EncodingType = -240
+	EncAtenHermon          EncodingType = -305
+	EncDesktopName         EncodingType = -307
+	EncExtendedDesktopSize EncodingType = -308
+	EncPointerPos          EncodingType = -232
+
+	// QEMU pseudo-encodings. A client advertises these in SetEncodings to
+	// announce that it understands the matching QEMU extensions.
+	EncQEMUExtendedKeyEvent    EncodingType = -258
+	EncQEMUPointerMotionChange EncodingType = -257
+	EncQEMULedState            EncodingType = -261
+
+	// Tight JPEG quality pseudo-encodings. A client that advertises one of
+	// EncJPEGQualityLevel0 (lowest) to EncJPEGQualityLevel9 (highest), or a
+	// level in between, accepts Tight JPEG rectangles at that quality.
+	EncJPEGQualityLevel0 EncodingType = -32
+	EncJPEGQualityLevel9 EncodingType = -23
+
+	// VMware pseudo-encodings, sent by VMware and ESXi VNC servers.
+	EncVMwareCursor         EncodingType = 0x574d5664
+	EncVMwareCursorState    EncodingType = 0x574d5665
+	EncVMwareCursorPosition EncodingType = 0x574d5666
+	EncVMwareLEDState       EncodingType = 0x574d5668
 )
 
 type ClientMessageType uint8
@@ -428,6 +581,7 @@ const (
 	ClientKeyEvent                 ClientMessageType = 4
 	ClientPointerEvent             ClientMessageType = 5
 	ClientCutText                  ClientMessageType = 6
+	ClientSetDesktopSize           ClientMessageType = 251
 )
 
 type ServerMessageType uint8
@@ -452,6 +606,7 @@ const (
 	SecTypeAtenTLS      SecurityType = 22
 	SecTypeAtenSASL     SecurityType = 23
 	SecTypeAtenXVP      SecurityType = 24
+	SecTypeARD          SecurityType = 30
 )
 
 // --- Client-to-Server Messages ---
@@ -467,20 +622,68 @@ func (m *SetPixelFormat) Write(c Conn) error {
 	return binary.Write(c, binary.BigEndian, m.PixelFormat)
 }
 
+func (m *SetPixelFormat) Supported(c Conn) bool { return true }
+
+// String returns string
+func (m *SetPixelFormat) String() string {
+	return fmt.Sprintf("pixel format: %+v", m.PixelFormat)
+}
+
+// Read unmarshal message from conn
+func (m *SetPixelFormat) Read(c Conn) (ClientMessage, error) {
+	msg := SetPixelFormat{}
+	var pad [3]byte
+	if _, err := io.ReadFull(c, pad[:]); err != nil {
+		return nil, fmt.Errorf("set-pixel-format: failed to read padding: %w", err)
+	}
+	if err := binary.Read(c, binary.BigEndian, &msg.PixelFormat); err != nil {
+		return nil, fmt.Errorf("set-pixel-format: failed to read pixel format: %w", err)
+	}
+	return &msg, nil
+}
+
 type SetEncodings struct{ Encodings []EncodingType }
 
 func (m *SetEncodings) Type() ClientMessageType { return ClientSetEncodings }
+
+// Write marshals the message to conn: the type, a padding byte, the number
+// of encodings and each encoding as a signed 32-bit integer.
 func (m *SetEncodings) Write(c Conn) error {
-	if err := binary.Write(c, binary.BigEndian, ClientSetEncodings); err != nil {
-		return err
+	n := len(m.Encodings)
+	if n > 0xffff {
+		return fmt.Errorf("set-encodings: too many encodings (%d)", n)
 	}
-	if err := binary.Write(c, binary.BigEndian, [1]byte{}); err != nil {
-		return err
+	buf := make([]byte, 4, 4+4*n)
+	buf[0] = byte(ClientSetEncodings)
+	binary.BigEndian.PutUint16(buf[2:], uint16(n))
+	for _, enc := range m.Encodings {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(enc))
 	}
-	if err := binary.Write(c, binary.BigEndian, uint16(len(m.Encodings))); err != nil {
-		return err
+	_, err := c.Write(buf)
+	return err
+}
+
+func (m *SetEncodings) Supported(c Conn) bool { return true }
+
+// String returns string
+func (m *SetEncodings) String() string {
+	return fmt.Sprintf("encodings: %v", m.Encodings)
+}
+
+// Read unmarshal message from conn
+func (m *SetEncodings) Read(c Conn) (ClientMessage, error) {
+	var hdr struct {
+		_   [1]byte
+		Num uint16
+	}
+	if err := binary.Read(c, binary.BigEndian, &hdr); err != nil {
+		return nil, fmt.Errorf("set-encodings: failed to read header: %w", err)
 	}
-	return binary.Write(c, binary.BigEndian, m.Encodings)
+	msg := SetEncodings{Encodings: make([]EncodingType, hdr.Num)}
+	if err := binary.Read(c, binary.BigEndian, msg.Encodings); err != nil {
+		return nil, fmt.Errorf("set-encodings: failed to read encodings: %w", err)
+	}
+	return &msg, nil
 }
 
 type FramebufferUpdateRequest struct {
@@ -525,6 +728,22 @@ func (m *KeyEvent) Write(c Conn) error {
 	return err
 }
 
+func (m *KeyEvent) Supported(c Conn) bool { return true }
+
+// String returns string
+func (m *KeyEvent) String() string {
+	return fmt.Sprintf("down: %d, key: %v", m.Down, m.Key)
+}
+
+// Read unmarshal message from conn
+func (m *KeyEvent) Read(c Conn) (ClientMessage, error) {
+	var buf [7]byte // down flag, padding, key
+	if _, err := io.ReadFull(c, buf[:]); err != nil {
+		return nil, fmt.Errorf("key-event: failed to read message: %w", err)
+	}
+	return &KeyEvent{Down: buf[0], Key: Key(binary.BigEndian.Uint32(buf[3:]))}, nil
+}
+
 type PointerEvent struct {
 	Mask ButtonMask
 	X, Y uint16
@@ -537,10 +756,30 @@ func (m *PointerEvent) Write(c Conn) error {
 	return err
 }
 
+func (m *PointerEvent) Supported(c Conn) bool { return true }
+
+// String returns string
+func (m *PointerEvent) String() string {
+	return fmt.Sprintf("mask: %d, x: %d, y: %d", m.Mask, m.X, m.Y)
+}
+
+// Read unmarshal message from conn
+func (m *PointerEvent) Read(c Conn) (ClientMessage, error) {
+	msg := PointerEvent{}
+	if err := binary.Read(c, binary.BigEndian, &msg); err != nil {
+		return nil, fmt.Errorf("pointer-event: failed to read message: %w", err)
+	}
+	return &msg, nil
+}
+
 type CutTextMessage struct {
 	_      [1]byte
 	Length uint32
 	Text   []byte
+	// Decoded holds Text decoded as latin-1, or as UTF-8 when
+	// ServerConfig.DetectUTF8CutText is set and Text is valid UTF-8. It is
+	// only set by Read; Write sends Text.
+	Decoded string
 }
 
 // String returns string
@@ -562,6 +801,38 @@ func (m *CutTextMessage) Write(c Conn) error {
 	return err
 }
 
+func (m *CutTextMessage) Supported(c Conn) bool { return true }
+
+// maxCutTextLength bounds the clipboard text a server reads from a client,
+// so a client cannot make it allocate gigabytes.
+const maxCutTextLength = 16 << 20
+
+// Read unmarshal message from conn. Text longer than maxCutTextLength is
+// rejected.
+func (m *CutTextMessage) Read(c Conn) (ClientMessage, error) {
+	var padding [3]byte
+	if _, err := io.ReadFull(c, padding[:]); err != nil {
+		return nil, fmt.Errorf("cut-text: failed to read padding: %w", err)
+	}
+	var length uint32
+	if err := binary.Read(c, binary.BigEndian, &length); err != nil {
+		return nil, fmt.Errorf("cut-text: failed to read length: %w", err)
+	}
+	if length > maxCutTextLength {
+		return nil, fmt.Errorf("cut-text: text length %d exceeds %d bytes", length, maxCutTextLength)
+	}
+	msg := &CutTextMessage{Length: length, Text: make([]byte, length)}
+	if _, err := io.ReadFull(c, msg.Text); err != nil {
+		return nil, fmt.Errorf("cut-text: failed to read text: %w", err)
+	}
+	detectUTF8 := false
+	if cfg, ok := c.Config().(*ServerConfig); ok {
+		detectUTF8 = cfg.DetectUTF8CutText
+	}
+	msg.Decoded = DecodeCutText(msg.Text, detectUTF8)
+	return msg, nil
+}
+
 // --- Server-to-Client Messages ---
 
 type FramebufferUpdateMessage struct {
@@ -577,33 +848,78 @@ func (m *FramebufferUpdateMessage) String() string {
 func (msg *FramebufferUpdateMessage) Supported(c Conn) bool {
 	return true
 }
+
+// Read decodes a FramebufferUpdate message whose type byte has already been
+// read. It returns io.EOF only if the stream ends before the first byte of the
+// message; a stream that ends partway through the message yields an error
+// wrapping io.ErrUnexpectedEOF.
 func (m *FramebufferUpdateMessage) Read(c Conn) (ServerMessage, error) {
 	var padding [1]byte
 	if _, err := io.ReadFull(c, padding[:]); err != nil {
+		return nil, err // io.EOF here is a clean end of stream.
+	}
+	msg, err := m.readRects(c)
+	if errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("framebuffer-update: message truncated (%v): %w", err, io.ErrUnexpectedEOF)
+	}
+	return msg, err
+}
+
+// readRects reads the rest of the message after the padding byte.
+func (m *FramebufferUpdateMessage) readRects(c Conn) (ServerMessage, error) {
+	msg := &FramebufferUpdateMessage{}
+	if err := binary.Read(c, binary.BigEndian, &msg.NumRect); err != nil {
 		return nil, err
 	}
-	var numRects uint16
-	if err := binary.Read(c, binary.BigEndian, &numRects); err != nil {
+	untilLastRect := msg.NumRect == lastRectSentinel
+	if untilLastRect && !lastRectNegotiated(c) {
+		return nil, fmt.Errorf("framebuffer-update: server sent the LastRect sentinel without LastRect being negotiated")
+	}
+	pd := newParallelDecoder(c)
+	if err := m.decodeRects(c, msg, untilLastRect, pd); err != nil {
+		if pd != nil {
+			pd.wait() // Let in-flight rectangles finish before giving up.
+		}
 		return nil, err
 	}
-	for i := uint16(0); i < numRects; i++ {
-		var rect Rectangle
-		var encodingType EncodingType
-		if err := binary.Read(c, binary.BigEndian, &rect); err != nil {
+	if pd != nil {
+		if err := pd.wait(); err != nil {
 			return nil, err
 		}
-		if err := binary.Read(c, binary.BigEndian, &encodingType); err != nil {
-			return nil, err
+	}
+	return msg, nil
+}
+
+// decodeRects reads and decodes the rectangles of msg. A LastRect rectangle
+// ends the message, whatever its declared rectangle count; with untilLastRect
+// it is the only way the message ends. If pd is not nil, Raw rectangles are
+// handed to it and every other rectangle waits for them.
+func (m *FramebufferUpdateMessage) decodeRects(c Conn, msg *FramebufferUpdateMessage, untilLastRect bool, pd *parallelDecoder) error {
+	for i := 0; untilLastRect || i < int(msg.NumRect); i++ {
+		rect := &Rectangle{}
+		if err := rect.readHeader(c); err != nil {
+			return err
 		}
-		enc := c.GetEncInstance(encodingType)
-		if enc == nil {
-			return nil, fmt.Errorf("unsupported encoding: %v", encodingType)
+		if rect.EncType == EncLastRect {
+			break
 		}
-		if err := enc.Read(c, &rect); err != nil {
-			return nil, err
+		if pd != nil && pd.accepts(c, rect) {
+			if err := pd.decode(c, rect); err != nil {
+				return err
+			}
+		} else {
+			if pd != nil {
+				if err := pd.wait(); err != nil {
+					return err
+				}
+			}
+			if err := rect.decode(c); err != nil {
+				return &rectDecodeError{encType: rect.EncType, err: err}
+			}
 		}
+		msg.Rects = append(msg.Rects, rect)
 	}
-	return m, nil
+	return nil
 }
 
 // Write marshals message to conn
@@ -697,34 +1013,33 @@ func (msg *SetColorMapEntriesMessage) String() string {
 	return fmt.Sprintf("first color: %d, numcolors: %d, colors[]: { %v }", msg.FirstColor, msg.ColorsNum, msg.Colors)
 }
 
-// Read unmrashal message from conn
+// Read unmrashal message from conn. Each entry is three 16-bit values, red,
+// green and blue, whatever the pixel format.
 func (*SetColorMapEntriesMessage) Read(c Conn) (ServerMessage, error) {
 	logger.Info("Reading SetColorMapEntries message")
 	msg := SetColorMapEntriesMessage{}
-	var pad [1]byte
-	if err := binary.Read(c, binary.BigEndian, &pad); err != nil {
-		return nil, err
+	var hdr [5]byte // padding, first-color, number-of-colors
+	if _, err := io.ReadFull(c, hdr[:]); err != nil {
+		return nil, fmt.Errorf("set-color-map-entries: failed to read header: %w", err)
 	}
-
-	if err := binary.Read(c, binary.BigEndian, &msg.FirstColor); err != nil {
-		return nil, err
+	msg.FirstColor = binary.BigEndian.Uint16(hdr[1:])
+	msg.ColorsNum = binary.BigEndian.Uint16(hdr[3:])
+	if int(msg.FirstColor)+int(msg.ColorsNum) > len(ColorMap{}) {
+		return nil, fmt.Errorf("set-color-map-entries: colors %d to %d are out of range", msg.FirstColor, int(msg.FirstColor)+int(msg.ColorsNum)-1)
 	}
 
-	if err := binary.Read(c, binary.BigEndian, &msg.ColorsNum); err != nil {
-		return nil, err
+	entries := make([]byte, 6*int(msg.ColorsNum))
+	if _, err := io.ReadFull(c, entries); err != nil {
+		return nil, fmt.Errorf("set-color-map-entries: failed to read colors: %w", err)
 	}
-
 	msg.Colors = make([]Color, msg.ColorsNum)
 	colorMap := c.ColorMap()
-
-	for i := uint16(0); i < msg.ColorsNum; i++ {
-		color := &msg.Colors[i]
-		err := color.Read(c)
-		if err != nil {
-			//if err := binary.Read(c, binary.BigEndian, &color); err != nil {
-			return nil, err
-		}
-		colorMap[msg.FirstColor+i] = *color
+	for i := range msg.Colors {
+		e := entries[6*i:]
+		msg.Colors[i].R = binary.BigEndian.Uint16(e)
+		msg.Colors[i].G = binary.BigEndian.Uint16(e[2:])
+		msg.Colors[i].B = binary.BigEndian.Uint16(e[4:])
+		colorMap[int(msg.FirstColor)+i] = msg.Colors[i]
 	}
 	c.SetColorMap(colorMap)
 	return &msg, nil
@@ -732,32 +1047,22 @@ func (*SetColorMapEntriesMessage) Read(c Conn) (ServerMessage, error) {
 
 // Write marshal message to conn
 func (msg *SetColorMapEntriesMessage) Write(c Conn) error {
-	if err := binary.Write(c, binary.BigEndian, msg.Type()); err != nil {
-		return err
+	if int(msg.FirstColor)+len(msg.Colors) > len(ColorMap{}) {
+		return fmt.Errorf("set-color-map-entries: colors %d to %d are out of range", msg.FirstColor, int(msg.FirstColor)+len(msg.Colors)-1)
 	}
-	var pad [1]byte
-	if err := binary.Write(c, binary.BigEndian, &pad); err != nil {
-		return err
+	msg.ColorsNum = uint16(len(msg.Colors))
+	buf := make([]byte, 6, 6+6*len(msg.Colors))
+	buf[0] = byte(msg.Type())
+	binary.BigEndian.PutUint16(buf[2:], msg.FirstColor)
+	binary.BigEndian.PutUint16(buf[4:], msg.ColorsNum)
+	for _, clr := range msg.Colors {
+		buf = binary.BigEndian.AppendUint16(buf, clr.R)
+		buf = binary.BigEndian.AppendUint16(buf, clr.G)
+		buf = binary.BigEndian.AppendUint16(buf, clr.B)
 	}
-
-	if err := binary.Write(c, binary.BigEndian, msg.FirstColor); err != nil {
-		return err
-	}
-
-	if msg.ColorsNum < uint16(len(msg.Colors)) {
-		msg.ColorsNum = uint16(len(msg.Colors))
-	}
-	if err := binary.Write(c, binary.BigEndian, msg.ColorsNum); err != nil {
+	if _, err := c.Write(buf); err != nil {
 		return err
 	}
-
-	for i := 0; i < len(msg.Colors); i++ {
-		color := msg.Colors[i]
-		if err := binary.Write(c, binary.BigEndian, color); err != nil {
-			return err
-		}
-	}
-
 	return c.Flush()
 }
 
@@ -784,6 +1089,9 @@ type ServerCutTextMessage struct {
 	_      [1]byte
 	Length uint32
 	Text   []byte
+	// Decoded holds Text decoded as latin-1, or as UTF-8 when
+	// ClientConfig.DetectUTF8CutText is set and Text is valid UTF-8.
+	Decoded string
 }
 
 func (m *ServerCutTextMessage) Type() ServerMessageType { return ServerCutText }
@@ -806,11 +1114,43 @@ func (m *ServerCutTextMessage) Read(c Conn) (ServerMessage, error) {
 	if err := binary.Read(c, binary.BigEndian, &length); err != nil {
 		return nil, err
 	}
-	m.Text = make([]byte, length)
-	if _, err := io.ReadFull(c, m.Text); err != nil {
+	msg := &ServerCutTextMessage{Length: length, Text: make([]byte, length)}
+	if _, err := io.ReadFull(c, msg.Text); err != nil {
 		return nil, err
 	}
-	return m, nil
+	detectUTF8 := false
+	if cfg, ok := c.Config().(*ClientConfig); ok {
+		detectUTF8 = cfg.DetectUTF8CutText
+	}
+	msg.Decoded = DecodeCutText(msg.Text, detectUTF8)
+	return msg, nil
+}
+
+// DecodeCutText decodes clipboard text received from the other side. The
+// specification requires latin-1; if detectUTF8 is set, text that is valid
+// UTF-8 is decoded as UTF-8 instead.
+func DecodeCutText(text []byte, detectUTF8 bool) string {
+	if detectUTF8 && utf8.Valid(text) {
+		return string(text)
+	}
+	runes := make([]rune, len(text))
+	for i, b := range text {
+		runes[i] = rune(b) // latin-1 maps directly onto the first 256 code points
+	}
+	return string(runes)
+}
+
+// EncodeCutText encodes clipboard text as latin-1 for sending to the other
+// side. Runes outside latin-1 become '?'.
+func EncodeCutText(s string) []byte {
+	text := make([]byte, 0, len(s))
+	for _, r := range s {
+		if r > 0xff {
+			r = '?'
+		}
+		text = append(text, byte(r))
+	}
+	return text
 }
 
 // Write marshal message to conn
@@ -7,6 +7,8 @@ import (
 	"image/color"
 	"io"
 	"sync"
+
+	"github.com/bigangryrobot/avacadovnc/logger"
 )
 
 // ReadPixel reads the raw bytes for a single pixel from the reader based on the
@@ -47,9 +49,10 @@ func ReadPixel(r io.Reader, pf *PixelFormat) (uint32, error) {
 // translation in the VNC client.
 func PixelToRGBA(pixel uint32, pf *PixelFormat, cm *ColorMap) color.RGBA {
 	if pf.TrueColor == 0 {
-		// Paletted color. The pixel value is an index into the color map.
+		// Paletted color. The pixel value is an index into the color map,
+		// whose entries are 16-bit.
 		if cm != nil && pixel < uint32(len(cm)) {
-			return color.RGBA{uint8(cm[pixel].R), uint8(cm[pixel].G), uint8(cm[pixel].B), 255}
+			return color.RGBA{uint8(cm[pixel].R >> 8), uint8(cm[pixel].G >> 8), uint8(cm[pixel].B >> 8), 255}
 		}
 		// Fallback if color map is missing or index is out of bounds.
 		// This shouldn't happen in a valid VNC session.
@@ -64,13 +67,141 @@ func PixelToRGBA(pixel uint32, pf *PixelFormat, cm *ColorMap) color.RGBA {
 	// Scale the components to the full 0-255 range.
 	// This is crucial for correctly displaying colors with depths less than 24-bit
 	// (e.g., 16-bit color, where RedMax might be 31).
-	r := uint8((float64(red) * 255.0) / float64(pf.RedMax))
-	g := uint8((float64(green) * 255.0) / float64(pf.GreenMax))
-	b := uint8((float64(blue) * 255.0) / float64(pf.BlueMax))
+	r := scaleChannel(red, pf.RedMax)
+	g := scaleChannel(green, pf.GreenMax)
+	b := scaleChannel(blue, pf.BlueMax)
 
 	return color.RGBA{R: r, G: g, B: b, A: 255}
 }
 
+// scaleChannel scales a channel value in the range 0-max to 0-255. A channel
+// with a maximum of zero carries no information and is always 0.
+func scaleChannel(v uint32, max uint16) uint8 {
+	if max == 0 {
+		return 0
+	}
+	return uint8(v * 255 / uint32(max))
+}
+
+// ChannelOrderOverride names the order in which the color channels of a
+// 32-bit pixel arrive on the wire, overriding the shifts of the pixel format.
+type ChannelOrderOverride uint8
+
+const (
+	// ChannelOverrideNone decodes pixels as the pixel format describes them.
+	ChannelOverrideNone ChannelOrderOverride = iota
+	// ChannelOverrideRGBA takes the bytes of each pixel as red, green, blue
+	// and an unused byte.
+	ChannelOverrideRGBA
+	// ChannelOverrideBGRA takes the bytes of each pixel as blue, green, red
+	// and an unused byte.
+	ChannelOverrideBGRA
+	// ChannelOverrideARGB takes the bytes of each pixel as an unused byte,
+	// red, green and blue.
+	ChannelOverrideARGB
+)
+
+// String returns the name of the override.
+func (o ChannelOrderOverride) String() string {
+	switch o {
+	case ChannelOverrideNone:
+		return "none"
+	case ChannelOverrideRGBA:
+		return "RGBA"
+	case ChannelOverrideBGRA:
+		return "BGRA"
+	case ChannelOverrideARGB:
+		return "ARGB"
+	}
+	return fmt.Sprintf("ChannelOrderOverride(%d)", uint8(o))
+}
+
+// apply returns pf with its shifts set to match the override. Only 32-bit
+// true color formats with 8-bit channels can be overridden; others are
+// returned unchanged.
+func (o ChannelOrderOverride) apply(pf PixelFormat) PixelFormat {
+	var r, g, b int // Byte offsets of the channels within a pixel
+	switch o {
+	case ChannelOverrideRGBA:
+		r, g, b = 0, 1, 2
+	case ChannelOverrideBGRA:
+		r, g, b = 2, 1, 0
+	case ChannelOverrideARGB:
+		r, g, b = 1, 2, 3
+	default:
+		return pf
+	}
+	if pf.TrueColor == 0 || pf.BPP != 32 || pf.RedMax != 255 || pf.GreenMax != 255 || pf.BlueMax != 255 {
+		logger.Warnf("channel order override %s ignored for pixel format %s", o, pf)
+		return pf
+	}
+	shift := func(offset int) uint8 {
+		if pf.BigEndian != 0 {
+			return uint8(3-offset) * 8
+		}
+		return uint8(offset) * 8
+	}
+	pf.RedShift, pf.GreenShift, pf.BlueShift = shift(r), shift(g), shift(b)
+	return pf
+}
+
+// RGBAToPixel converts an RGBA color to a raw true color pixel value in the
+// given pixel format. It is the inverse of PixelToRGBA.
+func RGBAToPixel(clr color.RGBA, pf *PixelFormat) uint32 {
+	red := uint32(clr.R) * uint32(pf.RedMax) / 255
+	green := uint32(clr.G) * uint32(pf.GreenMax) / 255
+	blue := uint32(clr.B) * uint32(pf.BlueMax) / 255
+	return red<<pf.RedShift | green<<pf.GreenShift | blue<<pf.BlueShift
+}
+
+// WritePixel writes a raw pixel value to the writer using the byte size and
+// endianness of the pixel format.
+func WritePixel(w io.Writer, pixel uint32, pf *PixelFormat) error {
+	order := pixelOrder(pf)
+
+	switch pf.BPP {
+	case 8:
+		return binary.Write(w, order, uint8(pixel))
+	case 16:
+		return binary.Write(w, order, uint16(pixel))
+	case 32:
+		return binary.Write(w, order, pixel)
+	default:
+		return fmt.Errorf("unsupported BPP: %d", pf.BPP)
+	}
+}
+
+// ConvertPixels converts a buffer of pixels from srcPF to dstPF, handling
+// differences in bits per pixel, byte order, channel shifts and maximums.
+// Paletted source pixels are looked up in cm. The destination format must be
+// true color.
+func ConvertPixels(src []byte, srcPF PixelFormat, dstPF PixelFormat, cm *ColorMap) ([]byte, error) {
+	srcBPP := srcPF.BytesPerPixel()
+	dstBPP := dstPF.BytesPerPixel()
+	if srcBPP == 0 || dstBPP == 0 {
+		return nil, fmt.Errorf("convert-pixels: bytes per pixel is zero")
+	}
+	if dstPF.TrueColor == 0 {
+		return nil, fmt.Errorf("convert-pixels: destination pixel format must be true color")
+	}
+	if len(src)%srcBPP != 0 {
+		return nil, fmt.Errorf("convert-pixels: %d bytes is not a whole number of %d-byte pixels", len(src), srcBPP)
+	}
+
+	r := bytes.NewReader(src)
+	dst := bytes.NewBuffer(make([]byte, 0, len(src)/srcBPP*dstBPP))
+	for r.Len() > 0 {
+		px, err := ReadPixel(r, &srcPF)
+		if err != nil {
+			return nil, fmt.Errorf("convert-pixels: %w", err)
+		}
+		if err := WritePixel(dst, RGBAToPixel(PixelToRGBA(px, &srcPF, cm), &dstPF), &dstPF); err != nil {
+			return nil, fmt.Errorf("convert-pixels: %w", err)
+		}
+	}
+	return dst.Bytes(), nil
+}
+
 // pixelOrder is a helper function to determine the byte order from a PixelFormat.
 func pixelOrder(pf *PixelFormat) binary.ByteOrder {
 	if pf.BigEndian != 0 {
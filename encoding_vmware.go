@@ -0,0 +1,186 @@
+package avacadovnc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+)
+
+// VMware cursor types sent in the VMware cursor pseudo-encoding.
+const (
+	vmwareCursorClassic uint8 = 0 // AND/XOR masks in the connection pixel format
+	vmwareCursorAlpha   uint8 = 1 // 32-bit RGBA pixels
+)
+
+// VMwareCursorEncoding implements the VMware cursor pseudo-encoding, which
+// carries either a classic AND/XOR cursor or an RGBA alpha cursor. The
+// hotspot is sent in the X and Y fields of the rectangle header.
+type VMwareCursorEncoding struct{}
+
+// Type returns the encoding type identifier.
+func (e *VMwareCursorEncoding) Type() EncodingType {
+	return EncVMwareCursor
+}
+
+// Read decodes the cursor image from the connection.
+func (e *VMwareCursorEncoding) Read(c Conn, rect *Rectangle) error {
+	var header [2]byte // cursor type, padding
+	if _, err := io.ReadFull(c, header[:]); err != nil {
+		return fmt.Errorf("vmware-cursor: failed to read cursor type: %w", err)
+	}
+
+	width, height := int(rect.Width), int(rect.Height)
+	cursorImg := image.NewRGBA(image.Rect(0, 0, width, height))
+	cursorMask := image.NewAlpha(image.Rect(0, 0, width, height))
+
+	switch header[0] {
+	case vmwareCursorClassic:
+		pf := c.PixelFormat()
+		bytesPerPixel := pf.BytesPerPixel()
+		if bytesPerPixel == 0 {
+			return fmt.Errorf("vmware-cursor: bytes per pixel is zero")
+		}
+		andMask := make([]byte, width*height*bytesPerPixel)
+		if _, err := io.ReadFull(c, andMask); err != nil {
+			return fmt.Errorf("vmware-cursor: failed to read and-mask: %w", err)
+		}
+		xorMask := make([]byte, width*height*bytesPerPixel)
+		if _, err := io.ReadFull(c, xorMask); err != nil {
+			return fmt.Errorf("vmware-cursor: failed to read xor-mask: %w", err)
+		}
+
+		cm := c.ColorMap()
+		andReader := bytes.NewReader(andMask)
+		xorReader := bytes.NewReader(xorMask)
+		for i := 0; i < width*height; i++ {
+			andPixel, err := ReadPixel(andReader, &pf)
+			if err != nil {
+				return fmt.Errorf("vmware-cursor: %w", err)
+			}
+			xorPixel, err := ReadPixel(xorReader, &pf)
+			if err != nil {
+				return fmt.Errorf("vmware-cursor: %w", err)
+			}
+			// Only pixels with a clear AND mask replace the screen; the
+			// screen-inverting pixels are rendered as transparent.
+			if andPixel == 0 {
+				x, y := i%width, i/width
+				cursorImg.SetRGBA(x, y, PixelToRGBA(xorPixel, &pf, &cm))
+				cursorMask.SetAlpha(x, y, color.Alpha{A: 255})
+			}
+		}
+	case vmwareCursorAlpha:
+		pixels := make([]byte, width*height*4)
+		if _, err := io.ReadFull(c, pixels); err != nil {
+			return fmt.Errorf("vmware-cursor: failed to read alpha cursor: %w", err)
+		}
+		for i := 0; i < width*height; i++ {
+			x, y := i%width, i/width
+			cursorImg.SetRGBA(x, y, color.RGBA{R: pixels[i*4], G: pixels[i*4+1], B: pixels[i*4+2], A: 255})
+			cursorMask.SetAlpha(x, y, color.Alpha{A: pixels[i*4+3]})
+		}
+	default:
+		return fmt.Errorf("vmware-cursor: unsupported cursor type %d", header[0])
+	}
+
+	canvas := canvasOf(c)
+	if canvas == nil {
+		return nil // No canvas to draw on.
+	}
+	canvas.SetCursor(cursorImg, cursorMask, int(rect.X), int(rect.Y))
+	return nil
+}
+
+// Reset does nothing as this encoding is stateless.
+func (e *VMwareCursorEncoding) Reset() {}
+
+// VMware cursor state flags.
+const (
+	VMwareCursorStateVisible  uint16 = 0x01
+	VMwareCursorStateAbsolute uint16 = 0x02
+	VMwareCursorStateWarped   uint16 = 0x04
+)
+
+// VMwareCursorStateEncoding implements the VMware cursor state pseudo-encoding.
+type VMwareCursorStateEncoding struct {
+	// Flags holds the most recently received cursor state flags.
+	Flags uint16
+}
+
+// Type returns the encoding type identifier.
+func (e *VMwareCursorStateEncoding) Type() EncodingType {
+	return EncVMwareCursorState
+}
+
+// Read decodes the cursor state flags.
+func (e *VMwareCursorStateEncoding) Read(c Conn, rect *Rectangle) error {
+	if err := binary.Read(c, binary.BigEndian, &e.Flags); err != nil {
+		return fmt.Errorf("vmware-cursor-state: failed to read flags: %w", err)
+	}
+	return nil
+}
+
+// Reset clears the recorded cursor state.
+func (e *VMwareCursorStateEncoding) Reset() {
+	e.Flags = 0
+}
+
+// VMwareCursorPositionEncoding implements the VMware cursor position
+// pseudo-encoding. The new position is in the rectangle header.
+type VMwareCursorPositionEncoding struct{}
+
+// Type returns the encoding type identifier.
+func (e *VMwareCursorPositionEncoding) Type() EncodingType {
+	return EncVMwareCursorPosition
+}
+
+// Read moves the cursor to the position given in the rectangle header.
+func (e *VMwareCursorPositionEncoding) Read(c Conn, rect *Rectangle) error {
+	canvas := canvasOf(c)
+	if canvas == nil {
+		return nil // No canvas to update.
+	}
+	canvas.MoveCursor(int(rect.X), int(rect.Y))
+	return nil
+}
+
+// Reset does nothing as this encoding is stateless.
+func (e *VMwareCursorPositionEncoding) Reset() {}
+
+// VMwareLEDStateEncoding implements the VMware keyboard LED state pseudo-encoding.
+type VMwareLEDStateEncoding struct {
+	// State holds the most recently received LED state bitmask.
+	State uint32
+}
+
+// Type returns the encoding type identifier.
+func (e *VMwareLEDStateEncoding) Type() EncodingType {
+	return EncVMwareLEDState
+}
+
+// Read decodes the LED state bitmask.
+func (e *VMwareLEDStateEncoding) Read(c Conn, rect *Rectangle) error {
+	if err := binary.Read(c, binary.BigEndian, &e.State); err != nil {
+		return fmt.Errorf("vmware-led-state: failed to read state: %w", err)
+	}
+	return nil
+}
+
+// Reset clears the recorded LED state.
+func (e *VMwareLEDStateEncoding) Reset() {
+	e.State = 0
+}
+
+// vmwareEncodingFor returns a decoder for a VMware pseudo-encoding, or nil if
+// encType is not one. VMware servers send these whether or not the client
+// asked for them, so they are consumed even when not registered.
+func vmwareEncodingFor(encType EncodingType) Encoding {
+	switch encType {
+	case EncVMwareCursor, EncVMwareCursorState, EncVMwareCursorPosition, EncVMwareLEDState:
+		return newEncoding(encType)
+	}
+	return nil
+}
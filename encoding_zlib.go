@@ -1,8 +1,6 @@
 package avacadovnc
 
 import (
-	"bytes"
-	"compress/zlib"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -11,8 +9,9 @@ import (
 // ZlibEncoding implements the Zlib encoding, which sends zlib-compressed
 // raw pixel data.
 type ZlibEncoding struct {
-	zlibReader io.ReadCloser
-	buffer     *bytes.Buffer
+	// stream is the connection's single zlib stream, which continues across
+	// rectangles.
+	stream zlibStream
 }
 
 // Type returns the encoding type identifier.
@@ -36,52 +35,36 @@ func (e *ZlibEncoding) Read(c Conn, rect *Rectangle) error {
 		return fmt.Errorf("zlib: failed to read compressed data: %w", err)
 	}
 
-	if e.zlibReader == nil {
-		var err error
-		e.zlibReader, err = zlib.NewReader(bytes.NewReader(compressedData))
-		if err != nil {
-			return fmt.Errorf("zlib: failed to create zlib reader: %w", err)
-		}
-	} else {
-		// The zlib.Resetter interface allows us to reuse the reader.
-		if resetter, ok := e.zlibReader.(zlib.Resetter); ok {
-			if err := resetter.Reset(bytes.NewReader(compressedData), nil); err != nil {
-				return fmt.Errorf("zlib: failed to reset zlib reader: %w", err)
-			}
-		} else {
-			// Fallback for older zlib versions or different implementations.
-			e.zlibReader.Close()
-			var err error
-			e.zlibReader, err = zlib.NewReader(bytes.NewReader(compressedData))
-			if err != nil {
-				return fmt.Errorf("zlib: failed to create new zlib reader: %w", err)
-			}
-		}
+	zr, err := e.stream.feed(compressedData)
+	if err != nil {
+		return fmt.Errorf("zlib: %w", err)
 	}
 
 	// Calculate the size of the uncompressed pixel data.
-	bytesPerPixel := c.PixelFormat().BPP
-	uncompressedSize := int(rect.Width) * int(rect.Height) * int(bytesPerPixel)
+	bytesPerPixel := c.PixelFormat().BytesPerPixel()
+	uncompressedSize := int(rect.Width) * int(rect.Height) * bytesPerPixel
 
 	// Read the decompressed raw pixel data.
 	pixelData := make([]byte, uncompressedSize)
-	if _, err := io.ReadFull(e.zlibReader, pixelData); err != nil {
+	if _, err := io.ReadFull(zr, pixelData); err != nil {
 		return fmt.Errorf("zlib: failed to decompress pixel data: %w", err)
 	}
 
 	// Draw the decoded bytes to the canvas.
-	clientConn, ok := c.(*ClientConn)
-	if !ok || clientConn.Canvas == nil {
+	canvas := canvasOf(c)
+	if canvas == nil {
 		return nil // No canvas to draw on.
 	}
 
-	return clientConn.Canvas.DrawBytes(pixelData, rect)
+	return canvas.DrawBytes(pixelData, rect)
 }
 
-// Reset cleans up the zlib reader.
+// Reset cleans up the zlib stream.
 func (e *ZlibEncoding) Reset() {
-	if e.zlibReader != nil {
-		e.zlibReader.Close()
-		e.zlibReader = nil
-	}
+	e.stream.reset()
+}
+
+// zlibStreams returns the zlib stream.
+func (e *ZlibEncoding) zlibStreams() []*zlibStream {
+	return []*zlibStream{&e.stream}
 }
@@ -0,0 +1,91 @@
+package avacadovnc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// ZlibHexEncoding implements the ZlibHex encoding, Hextile with tiles that may
+// be zlib-compressed. Compressed raw tiles go through one zlib stream and the
+// bodies of other compressed tiles through a second one; both continue across
+// rectangles.
+type ZlibHexEncoding struct {
+	rawStream zlibStream
+	hexStream zlibStream
+}
+
+// Type returns the encoding type identifier.
+func (e *ZlibHexEncoding) Type() EncodingType {
+	return EncZlibHex
+}
+
+// Read decodes a ZlibHex-encoded rectangle.
+func (e *ZlibHexEncoding) Read(c Conn, rect *Rectangle) error {
+	dec, err := newHextileDecoder(c, rect)
+	if err != nil {
+		return fmt.Errorf("zlibhex: %w", err)
+	}
+	return forEachTile(rect, func(tile *Rectangle) error {
+		var subEncoding uint8
+		if err := binary.Read(c, binary.BigEndian, &subEncoding); err != nil {
+			return fmt.Errorf("zlibhex: failed to read sub-encoding mask: %w", err)
+		}
+		switch {
+		case subEncoding&hextileZlibRaw != 0:
+			zr, err := e.feed(c, &e.rawStream)
+			if err != nil {
+				return err
+			}
+			if err := dec.rawTile(zr, tile); err != nil {
+				return fmt.Errorf("zlibhex: compressed raw tile: %w", err)
+			}
+		case subEncoding&hextileRaw != 0:
+			if err := dec.rawTile(c, tile); err != nil {
+				return fmt.Errorf("zlibhex: raw tile: %w", err)
+			}
+		case subEncoding&hextileZlibHex != 0:
+			zr, err := e.feed(c, &e.hexStream)
+			if err != nil {
+				return err
+			}
+			if err := dec.tile(zr, subEncoding, tile); err != nil {
+				return fmt.Errorf("zlibhex: compressed tile: %w", err)
+			}
+		default:
+			if err := dec.tile(c, subEncoding, tile); err != nil {
+				return fmt.Errorf("zlibhex: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+// feed reads the compressed data of one tile, preceded by its 16-bit length,
+// into stream and returns the reader for the decompressed data.
+func (e *ZlibHexEncoding) feed(c Conn, stream *zlibStream) (io.Reader, error) {
+	var compressedLen uint16
+	if err := binary.Read(c, binary.BigEndian, &compressedLen); err != nil {
+		return nil, fmt.Errorf("zlibhex: failed to read compressed data length: %w", err)
+	}
+	compressed := make([]byte, compressedLen)
+	if _, err := io.ReadFull(c, compressed); err != nil {
+		return nil, fmt.Errorf("zlibhex: failed to read compressed data: %w", err)
+	}
+	zr, err := stream.feed(compressed)
+	if err != nil {
+		return nil, fmt.Errorf("zlibhex: %w", err)
+	}
+	return zr, nil
+}
+
+// Reset discards both zlib streams.
+func (e *ZlibHexEncoding) Reset() {
+	e.rawStream.reset()
+	e.hexStream.reset()
+}
+
+// zlibStreams returns the raw and hextile zlib streams.
+func (e *ZlibHexEncoding) zlibStreams() []*zlibStream {
+	return []*zlibStream{&e.rawStream, &e.hexStream}
+}
@@ -1,17 +1,19 @@
 package avacadovnc
 
 import (
-	"bytes"
-	"compress/zlib"
 	"encoding/binary"
 	"fmt"
+	"image/color"
 	"io"
 )
 
+// zrleTileSize is the width and height of a ZRLE tile.
+const zrleTileSize = 64
+
 // ZRLEEncoding implements the ZRLE (Zlib-compressed Run-Length Encoding),
 // which is a highly efficient encoding that combines zlib with RLE.
 type ZRLEEncoding struct {
-	zlibReader io.ReadCloser
+	stream zlibStream
 }
 
 // Type returns the encoding type identifier.
@@ -35,108 +37,282 @@ func (e *ZRLEEncoding) Read(c Conn, rect *Rectangle) error {
 		return fmt.Errorf("zrle: failed to read compressed data: %w", err)
 	}
 
-	if e.zlibReader == nil {
-		var err error
-		e.zlibReader, err = zlib.NewReader(bytes.NewReader(compressedData))
-		if err != nil {
-			return fmt.Errorf("zrle: failed to create zlib reader: %w", err)
+	zr, err := e.stream.feed(compressedData)
+	if err != nil {
+		return fmt.Errorf("zrle: %w", err)
+	}
+
+	pf := c.PixelFormat()
+	cm := c.ColorMap()
+	d := &zrleDecoder{name: "zrle", r: zr, pf: &pf, cm: &cm}
+	d.cpixelLen, d.cpixelPadFirst = zrleCPixel(&pf)
+
+	rgba, err := d.decodeRect(int(rect.Width), int(rect.Height), zrleTileSize)
+	if err != nil {
+		return err
+	}
+
+	canvas := canvasOf(c)
+	if canvas == nil {
+		return nil // No canvas to draw on.
+	}
+	return canvas.DrawRGBA(rgba, rect)
+}
+
+// Reset cleans up the zlib stream.
+func (e *ZRLEEncoding) Reset() {
+	e.stream.reset()
+}
+
+// zlibStreams returns the zlib stream.
+func (e *ZRLEEncoding) zlibStreams() []*zlibStream {
+	return []*zlibStream{&e.stream}
+}
+
+// zrleCPixel returns the size of a compressed pixel (CPIXEL) in pf, and for
+// 3-byte CPIXELs whether the omitted zero byte comes first in wire order.
+// A 32bpp true color format whose colors fit in three bytes sends only those.
+func zrleCPixel(pf *PixelFormat) (int, bool) {
+	bytesPerPixel := pf.BytesPerPixel()
+	if pf.TrueColor == 0 || pf.BPP != 32 || pf.Depth > 24 {
+		return bytesPerPixel, false
+	}
+	maxColor := uint32(pf.RedMax)<<pf.RedShift | uint32(pf.GreenMax)<<pf.GreenShift | uint32(pf.BlueMax)<<pf.BlueShift
+	fitsInLS3Bytes := maxColor&0xff000000 == 0
+	fitsInMS3Bytes := maxColor&0x000000ff == 0
+	switch {
+	case fitsInLS3Bytes:
+		return 3, pf.BigEndian != 0
+	case fitsInMS3Bytes:
+		return 3, pf.BigEndian == 0
+	}
+	return bytesPerPixel, false
+}
+
+// zrleDecoder reads tiles from the decompressed ZRLE data, or from the
+// connection for TRLE, which uses the same tile format.
+type zrleDecoder struct {
+	name           string // Encoding name used in errors
+	r              io.Reader
+	pf             *PixelFormat
+	cm             *ColorMap
+	cpixelLen      int
+	cpixelPadFirst bool
+	buf            [4]byte
+
+	// reusePalette enables the TRLE sub-encodings 127 and 129, which reuse
+	// the palette of the previous tile, kept in palette.
+	reusePalette bool
+	palette      []color.RGBA
+}
+
+// readCPixel reads one CPIXEL and converts it to a color.
+func (d *zrleDecoder) readCPixel() (color.RGBA, error) {
+	b := d.buf[:d.pf.BytesPerPixel()]
+	if d.cpixelLen == 3 {
+		b[0], b[3] = 0, 0
+		dst := b[:3]
+		if d.cpixelPadFirst {
+			dst = b[1:]
 		}
-	} else {
-		if resetter, ok := e.zlibReader.(zlib.Resetter); ok {
-			if err := resetter.Reset(bytes.NewReader(compressedData), nil); err != nil {
-				return fmt.Errorf("zrle: failed to reset zlib reader: %w", err)
-			}
-		} else {
-			e.zlibReader.Close()
-			var err error
-			e.zlibReader, err = zlib.NewReader(bytes.NewReader(compressedData))
-			if err != nil {
-				return fmt.Errorf("zrle: failed to create new zlib reader: %w", err)
-			}
+		if _, err := io.ReadFull(d.r, dst); err != nil {
+			return color.RGBA{}, fmt.Errorf("%s: failed to read pixel: %w", d.name, err)
 		}
+	} else if _, err := io.ReadFull(d.r, b); err != nil {
+		return color.RGBA{}, fmt.Errorf("%s: failed to read pixel: %w", d.name, err)
 	}
 
-	clientConn, ok := c.(*ClientConn)
-	if !ok {
-		return fmt.Errorf("zrle: connection is not a client connection")
+	var pixel uint32
+	order := pixelOrder(d.pf)
+	switch len(b) {
+	case 1:
+		pixel = uint32(b[0])
+	case 2:
+		pixel = uint32(order.Uint16(b))
+	case 4:
+		pixel = order.Uint32(b)
+	default:
+		return color.RGBA{}, fmt.Errorf("%s: unsupported BPP: %d", d.name, d.pf.BPP)
 	}
+	return PixelToRGBA(pixel, d.pf, d.cm), nil
+}
 
-	pf := c.PixelFormat()
-	bytesPerPixel := pf.BPP
+// readByte reads a single byte from the decompressed data.
+func (d *zrleDecoder) readByte() (byte, error) {
+	if _, err := io.ReadFull(d.r, d.buf[:1]); err != nil {
+		return 0, fmt.Errorf("%s: failed to read tile data: %w", d.name, err)
+	}
+	return d.buf[0], nil
+}
 
-	for y := uint16(0); y < rect.Height; {
-		for x := uint16(0); x < rect.Width; {
-			tileW := min(16, int(rect.Width-x))
-			tileH := min(16, int(rect.Height-y))
+// readRunLength reads an RLE run length: a sequence of bytes summed until a
+// byte other than 255, plus one.
+func (d *zrleDecoder) readRunLength() (int, error) {
+	n := 1
+	for {
+		b, err := d.readByte()
+		if err != nil {
+			return 0, err
+		}
+		n += int(b)
+		if b != 255 {
+			return n, nil
+		}
+	}
+}
 
-			var subEncoding uint8
-			if err := binary.Read(e.zlibReader, binary.BigEndian, &subEncoding); err != nil {
-				return fmt.Errorf("zrle: failed to read sub-encoding: %w", err)
-			}
+// readPalette reads size CPIXELs and keeps them for reuse by the next tile.
+func (d *zrleDecoder) readPalette(size int) ([]color.RGBA, error) {
+	palette := make([]color.RGBA, size)
+	for i := range palette {
+		clr, err := d.readCPixel()
+		if err != nil {
+			return nil, err
+		}
+		palette[i] = clr
+	}
+	d.palette = palette
+	return palette, nil
+}
 
-			paletteSize := subEncoding & 0x7F
-			isRLE := (subEncoding & 0x80) != 0
-
-			var palette [][]byte
-			if paletteSize > 0 {
-				palette = make([][]byte, paletteSize)
-				for i := 0; i < int(paletteSize); i++ {
-					colorBytes := make([]byte, bytesPerPixel)
-					if _, err := io.ReadFull(e.zlibReader, colorBytes); err != nil {
-						return fmt.Errorf("zrle: failed to read palette color: %w", err)
-					}
-					palette[i] = colorBytes
-				}
+// decodeRect decodes the tiles of a width by height rectangle, tileSize
+// pixels square, into an RGBA buffer for the whole rectangle.
+func (d *zrleDecoder) decodeRect(width, height, tileSize int) ([]byte, error) {
+	// Tiles are decoded in place into a buffer for the whole rectangle.
+	stride := width * 4
+	rgba := make([]byte, stride*height)
+	for ty := 0; ty < height; ty += tileSize {
+		for tx := 0; tx < width; tx += tileSize {
+			tileW := min(tileSize, width-tx)
+			tileH := min(tileSize, height-ty)
+			tile := rgbaTile{pix: rgba[ty*stride+tx*4:], stride: stride}
+			if err := d.decodeTile(tile, tileW, tileH); err != nil {
+				return nil, err
 			}
+		}
+	}
+	return rgba, nil
+}
+
+// decodeTile decodes one w by h tile as RGBA into t.
+func (d *zrleDecoder) decodeTile(t rgbaTile, w, h int) error {
+	subEncoding, err := d.readByte()
+	if err != nil {
+		return err
+	}
+	numPixels := w * h
 
-			// Decode the tile data.
-			if err := e.decodeTile(clientConn, rect.X+x, rect.Y+y, uint16(tileW), uint16(tileH), isRLE, palette, int(bytesPerPixel)); err != nil {
+	switch {
+	case subEncoding == 0: // Raw
+		for i := 0; i < numPixels; i++ {
+			clr, err := d.readCPixel()
+			if err != nil {
 				return err
 			}
+			t.set(i%w, i/w, clr)
+		}
 
-			x += uint16(tileW)
+	case subEncoding == 1: // Solid color
+		clr, err := d.readCPixel()
+		if err != nil {
+			return err
+		}
+		for i := 0; i < numPixels; i++ {
+			t.set(i%w, i/w, clr)
 		}
-		y += 16 // This logic assumes tiles are always 16 high, which might be incorrect.
-	}
 
-	return nil
-}
+	case subEncoding <= 16, subEncoding == 127 && d.reusePalette: // Packed palette
+		palette := d.palette
+		if subEncoding != 127 {
+			if palette, err = d.readPalette(int(subEncoding)); err != nil {
+				return err
+			}
+		}
+		bits := 4
+		switch {
+		case len(palette) == 2:
+			bits = 1
+		case len(palette) <= 4:
+			bits = 2
+		}
+		// Each row is padded to a whole number of bytes.
+		row := make([]byte, (w*bits+7)/8)
+		for y := 0; y < h; y++ {
+			if _, err := io.ReadFull(d.r, row); err != nil {
+				return fmt.Errorf("%s: failed to read packed palette: %w", d.name, err)
+			}
+			for x := 0; x < w; x++ {
+				bit := x * bits
+				index := int(row[bit/8]>>(8-bits-bit%8)) & (1<<bits - 1)
+				if index >= len(palette) {
+					return fmt.Errorf("%s: palette index %d out of range", d.name, index)
+				}
+				t.set(x, y, palette[index])
+			}
+		}
 
-// decodeTile decodes a single tile within the ZRLE stream.
-func (e *ZRLEEncoding) decodeTile(cc *ClientConn, x, y, w, h uint16, isRLE bool, palette [][]byte, bpp int) error {
-	// This is a complex decoding process that would need a full implementation.
-	// For now, we will just read and discard the tile data to keep the stream in sync.
-	// A full implementation would read pixels/runs and draw to the canvas.
-	for i := uint16(0); i < h; i++ {
-		for j := uint16(0); j < w; {
-			var val uint8
-			if err := binary.Read(e.zlibReader, binary.BigEndian, &val); err != nil {
-				return fmt.Errorf("zrle: failed to read tile data: %w", err)
+	case subEncoding == 128: // Plain RLE
+		for i := 0; i < numPixels; {
+			clr, err := d.readCPixel()
+			if err != nil {
+				return err
 			}
+			n, err := d.readRunLength()
+			if err != nil {
+				return err
+			}
+			if i+n > numPixels {
+				return fmt.Errorf("%s: run of %d overflows tile", d.name, n)
+			}
+			for end := i + n; i < end; i++ {
+				t.set(i%w, i/w, clr)
+			}
+		}
 
-			runLength := 1
-			if isRLE && val&0x80 != 0 {
-				// This is a run.
-				runLength = int(val&0x7F) + 1
+	case subEncoding >= 130, subEncoding == 129 && d.reusePalette: // Palette RLE
+		palette := d.palette
+		if subEncoding != 129 {
+			if palette, err = d.readPalette(int(subEncoding) - 128); err != nil {
+				return err
+			}
+		}
+		for i := 0; i < numPixels; {
+			index, err := d.readByte()
+			if err != nil {
+				return err
+			}
+			n := 1
+			if index&0x80 != 0 {
+				if n, err = d.readRunLength(); err != nil {
+					return err
+				}
+				index &= 0x7f
+			}
+			if int(index) >= len(palette) {
+				return fmt.Errorf("%s: palette index %d out of range", d.name, index)
+			}
+			if i+n > numPixels {
+				return fmt.Errorf("%s: run of %d overflows tile", d.name, n)
+			}
+			for end := i + n; i < end; i++ {
+				t.set(i%w, i/w, palette[index])
 			}
-			j += uint16(runLength)
 		}
+
+	default:
+		return fmt.Errorf("%s: unsupported sub-encoding %d", d.name, subEncoding)
 	}
 	return nil
 }
 
-// Reset cleans up the zlib reader.
-func (e *ZRLEEncoding) Reset() {
-	if e.zlibReader != nil {
-		e.zlibReader.Close()
-		e.zlibReader = nil
-	}
+// rgbaTile is a view of a tile within a larger RGBA buffer.
+type rgbaTile struct {
+	pix    []byte // First pixel of the tile
+	stride int    // Distance in bytes between rows
 }
 
-// min is a helper to find the minimum of two integers.
-func min(a, b int) int {
-	if a < b {
-		return a
-	}
-	return b
+// set stores clr at (x, y) relative to the tile.
+func (t rgbaTile) set(x, y int, clr color.RGBA) {
+	i := y*t.stride + x*4
+	t.pix[i], t.pix[i+1], t.pix[i+2], t.pix[i+3] = clr.R, clr.G, clr.B, 255
 }
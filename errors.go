@@ -0,0 +1,86 @@
+package avacadovnc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Handshake errors. Connect returns them wrapped, so callers can tell the
+// causes of a failed handshake apart with errors.Is. Where the server gave a
+// reason, the error wrapped is a *HandshakeError carrying it.
+var (
+	// ErrProtocolVersion means the peer sent a protocol version this
+	// library does not speak.
+	ErrProtocolVersion = errors.New("unsupported protocol version")
+	// ErrNoCommonSecurity means the client and the server have no security
+	// type in common, or the server refused the connection without offering
+	// any.
+	ErrNoCommonSecurity = errors.New("no common security type")
+	// ErrAuthFailed means authentication was rejected, for example because
+	// of a wrong password.
+	ErrAuthFailed = errors.New("authentication failed")
+	// ErrNoCommonEncoding means the client has no encoding to offer the
+	// server.
+	ErrNoCommonEncoding = errors.New("no common encoding")
+)
+
+// HandshakeError is a handshake failure for which the server sent a reason.
+type HandshakeError struct {
+	// Err is one of the handshake errors, such as ErrAuthFailed.
+	Err error
+	// Reason is the reason string sent by the server.
+	Reason string
+}
+
+// Error returns the error with the server's reason.
+func (e *HandshakeError) Error() string {
+	return fmt.Sprintf("%v: %s", e.Err, e.Reason)
+}
+
+// Unwrap returns Err.
+func (e *HandshakeError) Unwrap() error {
+	return e.Err
+}
+
+// maxReasonLength bounds the reason strings read from the server. Longer
+// reasons are truncated.
+const maxReasonLength = 64 << 10
+
+// readReason reads a reason string, as sent by the server after a handshake
+// failure. A reason longer than maxReasonLength is truncated and the rest
+// left unread, which is harmless as the handshake ends with the failure.
+func readReason(c Conn) (string, error) {
+	var reasonLen uint32
+	if err := binary.Read(c, binary.BigEndian, &reasonLen); err != nil {
+		return "", fmt.Errorf("failed to read reason length: %w", err)
+	}
+	reason := make([]byte, min(reasonLen, maxReasonLength))
+	if _, err := io.ReadFull(c, reason); err != nil {
+		return "", fmt.Errorf("failed to read reason: %w", err)
+	}
+	return string(reason), nil
+}
+
+// readSecurityResult reads the SecurityResult message that ends
+// authentication on the client, and turns a failure into ErrAuthFailed. From
+// RFB 3.8 on, the server follows a failure with a reason, which is included.
+// name prefixes the error.
+func readSecurityResult(c Conn, name string) error {
+	var result uint32
+	if err := binary.Read(c, binary.BigEndian, &result); err != nil {
+		return fmt.Errorf("%s: failed to read security result: %w", name, err)
+	}
+	if result == 0 {
+		return nil
+	}
+	if !speaksRFB38(c) {
+		return fmt.Errorf("%s: %w", name, ErrAuthFailed)
+	}
+	reason, err := readReason(c)
+	if err != nil {
+		return fmt.Errorf("%s: %w; %v", name, ErrAuthFailed, err)
+	}
+	return fmt.Errorf("%s: %w", name, &HandshakeError{Err: ErrAuthFailed, Reason: reason})
+}
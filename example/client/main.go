@@ -3,17 +3,16 @@ package main
 import (
 	"context"
 	"flag"
-	"fmt"
-	"image"
-	"image/png"
 	"log"
 	"net"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 
 	vnc "github.com/bigangryrobot/avacadovnc"
+	"github.com/bigangryrobot/avacadovnc/encoders"
 	"github.com/bigangryrobot/avacadovnc/logger"
 )
 
@@ -26,7 +25,7 @@ func main() {
 	flag.StringVar(&password, "password", "", "VNC server password")
 	flag.Parse()
 
-	addr := fmt.Sprintf("%s:%d", host, port)
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
 	logger.Infof("Connecting to VNC server at %s", addr)
 
 	// --- VNC Client Configuration ---
@@ -61,6 +60,8 @@ func main() {
 			&vnc.ServerCutTextMessage{},
 		},
 		DrawCursor: true, // Tell the canvas to render the mouse pointer.
+		// Keep an incremental update request outstanding so frames keep coming.
+		AutoRequest: vnc.AutoRequestContinuous,
 	}
 
 	// --- Connection ---
@@ -112,7 +113,11 @@ func main() {
 		Height: clientConn.Height(),
 	}
 
-	frameCount := 0
+	// Frames are saved as frame-00000.png and so on; updates that leave the
+	// screen unchanged are skipped.
+	sink := &encoders.PNGSequenceSink{}
+	defer sink.Close()
+
 	for {
 		select {
 		case <-ctx.Done():
@@ -126,47 +131,15 @@ func main() {
 
 			switch msg.(type) {
 			case *vnc.FramebufferUpdateMessage:
-				saveFrame(canvas, frameCount)
-				frameCount++
-
-				// Wait a moment before requesting the next frame to avoid flooding the server.
-				time.Sleep(100 * time.Millisecond)
-
-				// Request the next incremental update.
-				clientCh <- &vnc.FramebufferUpdateRequest{
-					Inc:    1,
-					X:      0,
-					Y:      0,
-					Width:  clientConn.Width(),
-					Height: clientConn.Height(),
+				// The next incremental request has already been sent by the
+				// client because AutoRequest is Continuous.
+				skipped, err := sink.Add(canvas.Image())
+				if err != nil {
+					logger.Errorf("Failed to save frame: %v", err)
+				} else if !skipped {
+					logger.Infof("Saved frame %d", sink.Written()-1)
 				}
 			}
 		}
 	}
 }
-
-// saveFrame saves the current state of the VncCanvas to a PNG file.
-func saveFrame(canvas *vnc.VncCanvas, frameIndex int) {
-	bounds := image.Rect(0, 0, canvas.Width(), canvas.Height())
-	img := image.NewRGBA(bounds)
-
-	// The canvas's Draw method renders its current state onto our image.
-	canvas.Draw(img, &vnc.Rectangle{
-		X: 0, Y: 0, Width: uint16(bounds.Dx()), Height: uint16(bounds.Dy()),
-	})
-
-	fileName := fmt.Sprintf("frame-%05d.png", frameIndex)
-	file, err := os.Create(fileName)
-	if err != nil {
-		logger.Errorf("Failed to create file %s: %v", fileName, err)
-		return
-	}
-	defer file.Close()
-
-	if err := png.Encode(file, img); err != nil {
-		logger.Errorf("Failed to encode PNG %s: %v", fileName, err)
-		return
-	}
-
-	logger.Infof("Saved frame: %s", fileName)
-}
@@ -1,53 +1,65 @@
-package main
-
-import (
-	"flag"
-	"fmt"
-	"os"
-
-	"github.com/bigangryrobot/avacadovnc"
-	"github.com/bigangryrobot/avacadovnc/logger"
-
-)
-
-func main() {
-	addr := flag.String("addr", ":5900", "Listen address for VNC server")
-	flag.Parse()
-
-	if *addr == "" {
-		fmt.Println("Error: Listen address is required.")
-		flag.Usage()
-		os.Exit(1)
-	}
-
-	//logger.SetLevel(logger.InfoLevel)
-
-	// Configure the VNC server.
-	cfg := &avacadovnc.ServerConfig{
-		SecurityHandlers: []avacadovnc.SecurityHandler{
-			&avacadovnc.SecurityNone{},
-		},
-		PixelFormat: avacadovnc.DefaultPixelFormat,
-		DesktopName: "avacadovnc-server",
-		Width:       1024,
-		Height:      768,
-		// Define the handlers for the server handshake process.
-		Handlers: []avacadovnc.Handler{
-			&avacadovnc.DefaultServerVersionHandler{},
-			&avacadovnc.DefaultServerSecurityHandler{},
-			&avacadovnc.DefaultServerClientInitHandler{},
-			&avacadovnc.DefaultServerServerInitHandler{},
-			// A message handler would go here to manage the session.
-		},
-	}
-
-	server, err := avacadovnc.NewServer(cfg)
-	if err != nil {
-		logger.Fatalf("failed to create server: %v", err)
-	}
-
-	// Start the server. This will block until the server is stopped.
-	if err := server.Start(*addr); err != nil {
-		logger.Fatalf("VNC server failed: %v", err)
-	}
-}
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/bigangryrobot/avacadovnc"
+	"github.com/bigangryrobot/avacadovnc/logger"
+
+)
+
+func main() {
+	addr := flag.String("addr", ":5900", "Listen address for VNC server")
+	password := flag.String("password", "", "Require VNC authentication with this password")
+	flag.Parse()
+
+	if *addr == "" {
+		fmt.Println("Error: Listen address is required.")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	//logger.SetLevel(logger.InfoLevel)
+
+	// Configure the VNC server.
+	cfg := &avacadovnc.ServerConfig{
+		SecurityHandlers: []avacadovnc.SecurityHandler{
+			&avacadovnc.SecurityNone{},
+		},
+		PixelFormat: avacadovnc.DefaultPixelFormat,
+		Password:    []byte(*password),
+		DesktopName: "avacadovnc-server",
+		Width:       1024,
+		Height:      768,
+		// Define the handlers for the server handshake process.
+		Handlers: []avacadovnc.Handler{
+			&avacadovnc.DefaultServerVersionHandler{},
+			&avacadovnc.DefaultServerSecurityHandler{},
+			&avacadovnc.DefaultServerClientInitHandler{},
+			&avacadovnc.DefaultServerServerInitHandler{},
+			&avacadovnc.DefaultServerMessageHandler{},
+		},
+		OnKeyEvent: func(sc *avacadovnc.ServerConn, ev *avacadovnc.KeyEvent) {
+			logger.Infof("key event from %s: %s", sc.Conn().RemoteAddr(), ev)
+		},
+		OnPointerEvent: func(sc *avacadovnc.ServerConn, ev *avacadovnc.PointerEvent) {
+			logger.Debugf("pointer event from %s: %s", sc.Conn().RemoteAddr(), ev)
+		},
+	}
+
+	if *password != "" {
+		cfg.SecurityHandlers = []avacadovnc.SecurityHandler{&avacadovnc.SecurityVNC{}}
+	}
+
+	server, err := avacadovnc.NewServer(cfg)
+	if err != nil {
+		logger.Fatalf("failed to create server: %v", err)
+	}
+
+	// Start the server. This will block until the server is stopped.
+	if err := server.Start(*addr); err != nil {
+		logger.Fatalf("VNC server failed: %v", err)
+	}
+}
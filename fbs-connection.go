@@ -1,105 +1,238 @@
-package avacadovnc
-
-import (
-	"bufio"
-	"encoding/binary"
-	"errors"
-	"fmt"
-	"io"
-	"net"
-	"os"
-)
-
-// FbsConnection represents a connection that records the VNC stream to a
-// Frame Buffer Stream (FBS) file. It wraps a standard net.Conn.
-type FbsConnection struct {
-	net.Conn
-	file *os.File
-}
-
-// NewFbsConnection creates a new recording connection.
-func NewFbsConnection(conn net.Conn, file *os.File) (*FbsConnection, error) {
-	if file == nil {
-		return nil, errors.New("fbs-connection: file cannot be nil")
-	}
-	return &FbsConnection{
-		Conn: conn,
-		file: file,
-	}, nil
-}
-
-// Read reads data from the underlying connection and writes it to the FBS file.
-func (fbs *FbsConnection) Read(b []byte) (n int, err error) {
-	n, err = fbs.Conn.Read(b)
-	if n > 0 {
-		// Write the chunk size followed by the data.
-		if errw := binary.Write(fbs.file, binary.BigEndian, uint32(n)); errw != nil {
-			return n, fmt.Errorf("fbs-connection: failed to write chunk size: %w", errw)
-		}
-		if _, errw := fbs.file.Write(b[0:n]); errw != nil {
-			return n, fmt.Errorf("fbs-connection: failed to write chunk data: %w", errw)
-		}
-	}
-	return n, err
-}
-
-// Write writes data to the underlying connection. It does not record outgoing data.
-func (fbs *FbsConnection) Write(b []byte) (n int, err error) {
-	return fbs.Conn.Write(b)
-}
-
-// Close closes both the network connection and the file.
-func (fbs *FbsConnection) Close() error {
-	fbs.file.Close()
-	return fbs.Conn.Close()
-}
-
-// FbsStreamer is a utility to record a VNC session to an FBS file.
-type FbsStreamer struct {
-	clientConn *ClientConn
-	file       *os.File
-}
-
-// NewFbsStreamer creates a new streamer.
-func NewFbsStreamer(cc *ClientConn, f *os.File) *FbsStreamer {
-	return &FbsStreamer{
-		clientConn: cc,
-		file:       f,
-	}
-}
-
-// RecordSession starts the recording process.
-// This function should be called after a successful VNC handshake.
-func (s *FbsStreamer) RecordSession() error {
-	// Write the FBS header with the server's initial parameters.
-	// This data is now read from the ClientConn object, not a ServerInit message.
-	pf := s.clientConn.PixelFormat()
-	width := s.clientConn.Width()
-	height := s.clientConn.Height()
-	name := s.clientConn.DesktopName()
-
-	// Write pixel format
-	if err := binary.Write(s.file, binary.BigEndian, &pf); err != nil {
-		return fmt.Errorf("fbs-streamer: failed to write pixel format: %w", err)
-	}
-	// Write screen dimensions
-	if err := binary.Write(s.file, binary.BigEndian, &width); err != nil {
-		return fmt.Errorf("fbs-streamer: failed to write width: %w", err)
-	}
-	if err := binary.Write(s.file, binary.BigEndian, &height); err != nil {
-		return fmt.Errorf("fbs-streamer: failed to write height: %w", err)
-	}
-	// Write desktop name
-	nameLen := uint32(len(name))
-	if err := binary.Write(s.file, binary.BigEndian, &nameLen); err != nil {
-		return fmt.Errorf("fbs-streamer: failed to write name length: %w", err)
-	}
-	if _, err := s.file.Write(name); err != nil {
-		return fmt.Errorf("fbs-streamer: failed to write name: %w", err)
-	}
-
-	// The rest of the data is read from the connection and written to the file
-	// by the FbsConnection's Read method. We just need to drain the reader.
-	_, err := io.Copy(io.Discard, bufio.NewReader(s.clientConn.Conn()))
-	return err
-}
+package avacadovnc
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// fbsMagic starts every standard FBS file. It is followed by chunks of the
+// server's side of the session, from the ProtocolVersion message on: a
+// length, the data padded to a multiple of four bytes, and a millisecond
+// timestamp.
+const fbsMagic = "FBS 001.000\n"
+
+// FbsConnection represents a connection that records the VNC stream to a
+// Frame Buffer Stream (FBS) file. It wraps a standard net.Conn.
+type FbsConnection struct {
+	net.Conn
+	file *os.File
+	w    io.Writer    // file, or gz; nil until StartRecording. Guarded by mu
+	gz   *gzip.Writer // non-nil if the recording is compressed
+
+	// TimestampFunc returns the timestamp, in milliseconds, recorded with
+	// each chunk. If nil, chunks are stamped with the time since the first
+	// chunk was recorded. Setting it allows deterministic recordings and
+	// re-timestamping when transcoding.
+	TimestampFunc func() uint32
+
+	start time.Time // when the first chunk was recorded
+
+	mu       sync.Mutex // Guards w, paused and resuming
+	paused   bool
+	resuming bool // Resume was called; recording restarts at the next message
+}
+
+// NewFbsConnection creates a new recording connection. Nothing is recorded
+// until StartRecording is called once the handshake is done.
+func NewFbsConnection(conn net.Conn, file *os.File) (*FbsConnection, error) {
+	if file == nil {
+		return nil, errors.New("fbs-connection: file cannot be nil")
+	}
+	return &FbsConnection{
+		Conn: conn,
+		file: file,
+	}, nil
+}
+
+// NewGzipFbsConnection creates a new recording connection that gzip-compresses
+// the recording, header included. The gzip stream is finished when the
+// connection is closed.
+func NewGzipFbsConnection(conn net.Conn, file *os.File) (*FbsConnection, error) {
+	fbs, err := NewFbsConnection(conn, file)
+	if err != nil {
+		return nil, err
+	}
+	fbs.gz = gzip.NewWriter(file)
+	return fbs, nil
+}
+
+// StartRecording writes the FBS magic and a handshake leading to a ServerInit
+// with the pixel format, framebuffer size and desktop name of c, and switches
+// recording on. It must be called once, after the handshake on c. The real
+// handshake is not recorded: the file gets RFB 3.3 with security type None
+// instead, which standard FBS players expect and which needs no password.
+func (fbs *FbsConnection) StartRecording(c Conn) error {
+	var w io.Writer = fbs.file
+	if fbs.gz != nil {
+		w = fbs.gz
+	}
+	fbs.mu.Lock()
+	defer fbs.mu.Unlock()
+	if fbs.w != nil {
+		return errors.New("fbs-connection: recording already started")
+	}
+	if _, err := io.WriteString(w, fbsMagic); err != nil {
+		return fmt.Errorf("fbs-connection: failed to write magic: %w", err)
+	}
+	fbs.w = w
+	if err := fbs.writeChunk(fbsHandshake(c)); err != nil {
+		fbs.w = nil
+		return err
+	}
+	return nil
+}
+
+// Read reads data from the underlying connection and writes it to the FBS file.
+func (fbs *FbsConnection) Read(b []byte) (n int, err error) {
+	n, err = fbs.Conn.Read(b)
+	if n > 0 {
+		fbs.mu.Lock()
+		defer fbs.mu.Unlock()
+		if fbs.w == nil || fbs.paused {
+			return n, err
+		}
+		if errw := fbs.writeChunk(b[:n]); errw != nil {
+			return n, errw
+		}
+	}
+	return n, err
+}
+
+// Pause stops recording. The connection itself is unaffected, so the session
+// carries on while nothing is written to the file.
+func (fbs *FbsConnection) Pause() {
+	fbs.mu.Lock()
+	defer fbs.mu.Unlock()
+	fbs.paused, fbs.resuming = true, false
+}
+
+// Resume restarts a paused recording. Recording restarts at the start of the
+// next server message read by the ClientConn on top of this connection, and
+// is preceded by a gap marker, a chunk without data, which makes FbsReader
+// return ErrFbsGap at that point. Stateful encodings such as Zlib and Tight
+// cannot be decoded past a gap, since their streams lose the data sent while
+// paused.
+func (fbs *FbsConnection) Resume() {
+	fbs.mu.Lock()
+	defer fbs.mu.Unlock()
+	if fbs.paused {
+		fbs.resuming = true
+	}
+}
+
+// messageBoundary is called by the read loop of the ClientConn reading from
+// fbs before each server message, with the reader that buffers the
+// connection. If Resume is pending, it writes the gap marker and the buffered
+// bytes, which start with the next message, and switches recording back on.
+func (fbs *FbsConnection) messageBoundary(br *bufio.Reader) error {
+	fbs.mu.Lock()
+	defer fbs.mu.Unlock()
+	if !fbs.resuming || fbs.w == nil {
+		return nil
+	}
+	if err := fbs.writeChunk(nil); err != nil {
+		return err
+	}
+	if n := br.Buffered(); n > 0 {
+		buffered, _ := br.Peek(n)
+		if err := fbs.writeChunk(buffered); err != nil {
+			return err
+		}
+	}
+	fbs.paused, fbs.resuming = false, false
+	return nil
+}
+
+// timestamp returns the timestamp of the next chunk.
+func (fbs *FbsConnection) timestamp() uint32 {
+	if fbs.TimestampFunc != nil {
+		return fbs.TimestampFunc()
+	}
+	if fbs.start.IsZero() {
+		fbs.start = time.Now()
+	}
+	return uint32(time.Since(fbs.start) / time.Millisecond)
+}
+
+// writeChunk records data as one chunk: its length, the data padded to a
+// multiple of four bytes, and a timestamp in milliseconds. The caller must
+// hold mu.
+func (fbs *FbsConnection) writeChunk(data []byte) error {
+	padded := (len(data) + 3) &^ 3
+	buf := make([]byte, 4+padded+4)
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+	copy(buf[4:], data)
+	binary.BigEndian.PutUint32(buf[4+padded:], fbs.timestamp())
+	if _, err := fbs.w.Write(buf); err != nil {
+		return fmt.Errorf("fbs-connection: failed to write chunk: %w", err)
+	}
+	return nil
+}
+
+// Write writes data to the underlying connection. It does not record outgoing data.
+func (fbs *FbsConnection) Write(b []byte) (n int, err error) {
+	return fbs.Conn.Write(b)
+}
+
+// Close closes both the network connection and the file.
+func (fbs *FbsConnection) Close() error {
+	if fbs.gz != nil {
+		fbs.mu.Lock()
+		fbs.gz.Close()
+		fbs.mu.Unlock()
+	}
+	fbs.file.Close()
+	return fbs.Conn.Close()
+}
+
+// FbsStreamer is a utility to record a VNC session to an FBS file. The
+// ClientConn must run over an FbsConnection, plain or gzip-compressed, which
+// writes the file.
+type FbsStreamer struct {
+	clientConn *ClientConn
+}
+
+// NewFbsStreamer creates a new streamer.
+func NewFbsStreamer(cc *ClientConn) *FbsStreamer {
+	return &FbsStreamer{
+		clientConn: cc,
+	}
+}
+
+// RecordSession starts the recording process.
+// This function should be called after a successful VNC handshake.
+func (s *FbsStreamer) RecordSession() error {
+	fbs, ok := s.clientConn.Conn().(*FbsConnection)
+	if !ok {
+		return errors.New("fbs-streamer: connection is not an FbsConnection")
+	}
+	// Write the FBS magic and a handshake with the server's initial parameters.
+	if err := fbs.StartRecording(s.clientConn); err != nil {
+		return err
+	}
+
+	// The rest of the data is read from the connection and written to the file
+	// by the FbsConnection's Read method. We just need to drain the reader.
+	_, err := io.Copy(io.Discard, bufio.NewReader(s.clientConn.Conn()))
+	return err
+}
+
+// fbsHandshake returns the server side of an RFB 3.3 handshake with security
+// type None, ending in a ServerInit that describes c.
+func fbsHandshake(c Conn) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("RFB 003.003\n")
+	binary.Write(&buf, binary.BigEndian, uint32(SecTypeNone))
+	si := &ServerInit{Width: c.Width(), Height: c.Height(), PixelFormat: c.PixelFormat(), Name: c.DesktopName()}
+	si.Write(&buf)
+	return buf.Bytes()
+}
@@ -0,0 +1,355 @@
+package avacadovnc
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"time"
+)
+
+// FbsFrame describes one FramebufferUpdate of a recording, as found by
+// FbsPlayer.BuildIndex.
+type FbsFrame struct {
+	// Offset is the position of the update in the recorded data; see
+	// FbsReader.Offset.
+	Offset int64
+	// Timestamp is the time of the update since the recording began.
+	Timestamp time.Duration
+	// Keyframe is set for frames from which decoding can start: the first
+	// frame, the first frame after each gap, and frames that repaint the
+	// whole framebuffer without CopyRect at a point where no zlib stream
+	// carries over. Decoder state such as the zlib streams of Tight, Zlib
+	// and ZRLE carries over from one frame to the next, so other frames can
+	// only be decoded by replaying from the keyframe before them. Zlib,
+	// ZlibHex and ZRLE streams are never reset by the server, so once one
+	// of them is in use only gaps make keyframes; Tight servers reset their
+	// streams with the compression control byte.
+	Keyframe bool
+
+	// The framebuffer size and color map in effect before the frame,
+	// restored when playback restarts from it.
+	width, height uint16
+	colorMap      *ColorMap
+}
+
+// FbsPlayer decodes an FBS recording onto a canvas, one FramebufferUpdate at
+// a time, and seeks to any frame by replaying from the nearest keyframe; see
+// FbsFrame.Keyframe. A recording whose server never repaints the whole screen,
+// or keeps a Zlib or ZRLE stream going, only has keyframes at its start and
+// after each gap left by FbsConnection.Pause, so seeking in it replays from
+// there. A seek onto a keyframe that follows a gap shows the areas the server
+// has not yet repainted as black.
+type FbsPlayer struct {
+	path   string
+	encs   []Encoding
+	reader *FbsReader
+	conn   *decodeConn
+	frames []FbsFrame
+	next   int // Number of the next frame to decode
+}
+
+// NewFbsPlayer opens the recording at path for playback with encs, which
+// must include every encoding used in the recording.
+func NewFbsPlayer(path string, encs []Encoding) (*FbsPlayer, error) {
+	p := &FbsPlayer{path: path, encs: encs}
+	if err := p.rewind(nil); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Canvas returns the canvas the recording is decoded onto.
+func (p *FbsPlayer) Canvas() *VncCanvas {
+	return p.conn.canvas
+}
+
+// Reader returns the reader of the recording, for its header fields.
+func (p *FbsPlayer) Reader() *FbsReader {
+	return p.reader
+}
+
+// Frame returns the number of frames decoded since the start of the
+// recording, which is the number of the next frame Next decodes.
+func (p *FbsPlayer) Frame() int {
+	return p.next
+}
+
+// Close closes the recording.
+func (p *FbsPlayer) Close() error {
+	return p.reader.Close()
+}
+
+// rewind reopens the recording and, if from is not nil, moves to that
+// keyframe with the decoder state it needs.
+func (p *FbsPlayer) rewind(from *FbsFrame) error {
+	reader, err := NewFbsReader(p.path)
+	if err != nil {
+		return err
+	}
+	if p.reader != nil {
+		p.reader.Close()
+	}
+	p.reader = reader
+	for _, enc := range p.encs {
+		enc.Reset()
+	}
+
+	mock := NewMockConn(reader, io.Discard, p.encs)
+	mock.SetPixelFormat(reader.PixelFormat())
+	mock.SetDesktopName(reader.DesktopName())
+	mock.SetWidth(reader.Width())
+	mock.SetHeight(reader.Height())
+	if from != nil {
+		if err := reader.skipTo(from.Offset); err != nil {
+			return fmt.Errorf("fbs-player: failed to seek: %w", err)
+		}
+		mock.SetWidth(from.width)
+		mock.SetHeight(from.height)
+		if from.colorMap != nil {
+			mock.SetColorMap(*from.colorMap)
+		}
+	}
+	canvas := NewVncCanvas(int(mock.Width()), int(mock.Height()), mock.PixelFormat())
+	canvas.SetColorMap(mock.ColorMap())
+	p.conn = &decodeConn{wrappedConn: mock, canvas: canvas}
+	return nil
+}
+
+// BuildIndex decodes the whole recording to find its frames, then rewinds
+// to the start. It must be called before Seek and Frames.
+func (p *FbsPlayer) BuildIndex() error {
+	if err := p.rewind(nil); err != nil {
+		return err
+	}
+	p.frames, p.next = nil, 0
+	streams := newStreamTracker(p.encs)
+	var colorMap *ColorMap
+	keyframe := true
+	for {
+		// A replay starting at this message starts from the state before it.
+		offset, width, height := p.reader.Offset(), p.conn.Width(), p.conn.Height()
+		streams.mark()
+		msg, err := p.readMessage()
+		switch {
+		case errors.Is(err, io.EOF):
+			return p.rewind(nil)
+		case errors.Is(err, ErrFbsGap):
+			p.resetDecoders()
+			keyframe = true
+			continue
+		case err != nil:
+			return fmt.Errorf("fbs-player: failed to index frame %d: %w", len(p.frames), err)
+		}
+		switch m := msg.(type) {
+		case *SetColorMapEntriesMessage:
+			cm := p.conn.ColorMap()
+			colorMap = &cm
+		case *FramebufferUpdateMessage:
+			frame := FbsFrame{
+				Offset:    offset,
+				Timestamp: p.reader.Timestamp(),
+				Keyframe:  keyframe || repaintsAll(m, p.conn.Width(), p.conn.Height()),
+				width:     width,
+				height:    height,
+				colorMap:  colorMap,
+			}
+			p.frames = append(p.frames, frame)
+			streams.frameDone(p.frames)
+			keyframe = false
+		}
+	}
+}
+
+// repaintsAll reports whether msg paints every pixel of a width by height
+// framebuffer without reading the pixels already there, as CopyRect does.
+func repaintsAll(msg *FramebufferUpdateMessage, width, height uint16) bool {
+	left := []image.Rectangle{image.Rect(0, 0, int(width), int(height))}
+	for _, rect := range msg.Rects {
+		if rect.EncType == EncCopyRect || rect.EncType.IsPseudo() {
+			continue
+		}
+		r := image.Rect(int(rect.X), int(rect.Y), int(rect.X)+int(rect.Width), int(rect.Y)+int(rect.Height))
+		var next []image.Rectangle
+		for _, l := range left {
+			next = appendDifference(next, l, r)
+		}
+		if left = next; len(left) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// appendDifference appends the parts of a outside b, as up to four
+// rectangles, to list.
+func appendDifference(list []image.Rectangle, a, b image.Rectangle) []image.Rectangle {
+	i := a.Intersect(b)
+	if i.Empty() {
+		return append(list, a)
+	}
+	for _, r := range []image.Rectangle{
+		image.Rect(a.Min.X, a.Min.Y, a.Max.X, i.Min.Y), // Above
+		image.Rect(a.Min.X, i.Max.Y, a.Max.X, a.Max.Y), // Below
+		image.Rect(a.Min.X, i.Min.Y, i.Min.X, i.Max.Y), // Left
+		image.Rect(i.Max.X, i.Min.Y, a.Max.X, i.Max.Y), // Right
+	} {
+		if !r.Empty() {
+			list = append(list, r)
+		}
+	}
+	return list
+}
+
+// streamTracker follows the zlib streams of the decoders during BuildIndex
+// and takes the keyframe flag off every frame that a stream carries over: a
+// replay from there would start the stream afresh while the recording goes
+// on with it.
+type streamTracker struct {
+	streams []*trackedStream
+}
+
+// trackedStream is the state of one zlib stream as seen by streamTracker.
+type trackedStream struct {
+	z *zlibStream
+	// feeds, resets and chainFeeds are the counts of z when the current
+	// message started.
+	feeds, resets, chainFeeds int
+	// start is the frame the current chain of feeds began in, and cleared
+	// the last frame whose keyframe flag was taken off for it.
+	start, cleared int
+}
+
+// newStreamTracker returns a tracker for the zlib streams of encs.
+func newStreamTracker(encs []Encoding) *streamTracker {
+	t := &streamTracker{}
+	for _, enc := range encs {
+		if zs, ok := enc.(zlibStreamer); ok {
+			for _, z := range zs.zlibStreams() {
+				t.streams = append(t.streams, &trackedStream{z: z, start: -1, cleared: -1})
+			}
+		}
+	}
+	return t
+}
+
+// mark records the state of the streams before the next message.
+func (t *streamTracker) mark() {
+	for _, s := range t.streams {
+		s.feeds, s.resets, s.chainFeeds = s.z.feeds, s.z.resets, s.z.chainFeeds
+	}
+}
+
+// frameDone is called once the last frame of frames has been decoded.
+func (t *streamTracker) frameDone(frames []FbsFrame) {
+	n := len(frames) - 1
+	for _, s := range t.streams {
+		fed := s.z.feeds - s.feeds
+		if fed == 0 {
+			continue
+		}
+		// Feeds made before a reset in this frame continue the chain that
+		// was open when it started, if any.
+		continued := s.chainFeeds > 0 && (s.z.resets == s.resets || fed > s.z.chainFeeds)
+		if continued {
+			for i := max(s.start, s.cleared) + 1; i <= n; i++ {
+				frames[i].Keyframe = false
+			}
+			s.cleared = n
+		}
+		if s.z.resets != s.resets || s.chainFeeds == 0 {
+			s.start = n // A new chain began in this frame.
+		}
+	}
+}
+
+// Frames returns the frames found by BuildIndex.
+func (p *FbsPlayer) Frames() []FbsFrame {
+	return p.frames
+}
+
+// Next decodes messages up to and including the next FramebufferUpdate. It
+// returns io.EOF at the end of the recording. A message cut short by a gap
+// is dropped, and decoding resumes after the gap.
+func (p *FbsPlayer) Next() error {
+	for {
+		msg, err := p.readMessage()
+		if errors.Is(err, ErrFbsGap) {
+			p.resetDecoders()
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if msg.Type() == ServerFramebufferUpdate {
+			p.next++
+			return nil
+		}
+	}
+}
+
+// Seek decodes the recording up to and including frame n, so that the
+// canvas shows it. If n lies ahead and no keyframe comes between it and the
+// current position, decoding simply carries on; otherwise it replays from the
+// keyframe before n.
+func (p *FbsPlayer) Seek(n int) error {
+	if p.frames == nil {
+		return errors.New("fbs-player: seek needs an index; call BuildIndex first")
+	}
+	if n < 0 || n >= len(p.frames) {
+		return fmt.Errorf("fbs-player: frame %d out of range [0, %d)", n, len(p.frames))
+	}
+	key := n
+	for !p.frames[key].Keyframe {
+		key--
+	}
+	if p.next < key || p.next > n+1 {
+		if err := p.rewind(&p.frames[key]); err != nil {
+			return err
+		}
+		p.next = key
+	}
+	for p.next <= n {
+		if err := p.Next(); err != nil {
+			return fmt.Errorf("fbs-player: failed to decode frame %d: %w", p.next, err)
+		}
+	}
+	return nil
+}
+
+// readMessage reads and applies one server message, and returns it.
+func (p *FbsPlayer) readMessage() (ServerMessage, error) {
+	var typ [1]byte
+	if _, err := io.ReadFull(p.conn, typ[:]); err != nil {
+		return nil, err
+	}
+	msg, ok := fbsPlayerMessages[ServerMessageType(typ[0])]
+	if !ok {
+		return nil, fmt.Errorf("fbs-player: unsupported message type %d", typ[0])
+	}
+	parsed, err := msg.Read(p.conn)
+	if err != nil {
+		return nil, err
+	}
+	if msg.Type() == ServerSetColorMapEntries {
+		p.conn.canvas.SetColorMap(p.conn.ColorMap())
+	}
+	return parsed, nil
+}
+
+// resetDecoders drops the decoder state after a gap.
+func (p *FbsPlayer) resetDecoders() {
+	for _, enc := range p.encs {
+		enc.Reset()
+	}
+}
+
+// fbsPlayerMessages are the server messages FbsPlayer understands.
+var fbsPlayerMessages = map[ServerMessageType]ServerMessage{
+	ServerFramebufferUpdate:      &FramebufferUpdateMessage{},
+	ServerSetColorMapEntries:     &SetColorMapEntriesMessage{},
+	ServerBell:                   &ServerBellMessage{},
+	ServerCutText:                &ServerCutTextMessage{},
+	ServerEndOfContinuousUpdates: &EndOfContinuousUpdatesMessage{},
+	ServerFence:                  &ServerFenceMessage{},
+}
@@ -1,106 +1,273 @@
-package avacadovnc
-
-import (
-	"encoding/binary"
-	"errors"
-	"fmt"
-	"io"
-	"os"
-)
-
-// FbsReader reads a Frame Buffer Stream (FBS) file, which is a recording
-// of a VNC session.
-type FbsReader struct {
-	file        *os.File
-	pixelFormat PixelFormat
-	width       uint16
-	height      uint16
-	desktopName []byte
-
-	// Internal buffer for the current data chunk being read.
-	chunk []byte
-}
-
-// NewFbsReader opens and initializes a reader for the given FBS file.
-// It reads the header to populate the session's metadata.
-func NewFbsReader(filename string) (*FbsReader, error) {
-	file, err := os.Open(filename)
-	if err != nil {
-		return nil, fmt.Errorf("fbs-reader: failed to open file: %w", err)
-	}
-
-	reader := &FbsReader{file: file}
-
-	// Read the FBS header.
-	if err := binary.Read(file, binary.BigEndian, &reader.pixelFormat); err != nil {
-		return nil, fmt.Errorf("fbs-reader: failed to read pixel format: %w", err)
-	}
-	if err := binary.Read(file, binary.BigEndian, &reader.width); err != nil {
-		return nil, fmt.Errorf("fbs-reader: failed to read width: %w", err)
-	}
-	if err := binary.Read(file, binary.BigEndian, &reader.height); err != nil {
-		return nil, fmt.Errorf("fbs-reader: failed to read height: %w", err)
-	}
-	var nameLen uint32
-	if err := binary.Read(file, binary.BigEndian, &nameLen); err != nil {
-		return nil, fmt.Errorf("fbs-reader: failed to read name length: %w", err)
-	}
-	reader.desktopName = make([]byte, nameLen)
-	if _, err := io.ReadFull(file, reader.desktopName); err != nil {
-		return nil, fmt.Errorf("fbs-reader: failed to read desktop name: %w", err)
-	}
-
-	return reader, nil
-}
-
-// Read implements the io.Reader interface. It reads the next data chunk
-// from the FBS file into the provided buffer.
-func (r *FbsReader) Read(p []byte) (n int, err error) {
-	// If the internal chunk buffer is empty, read the next chunk from the file.
-	if len(r.chunk) == 0 {
-		var chunkSize uint32
-		if err := binary.Read(r.file, binary.BigEndian, &chunkSize); err != nil {
-			if errors.Is(err, io.EOF) {
-				return 0, io.EOF // Clean end-of-file.
-			}
-			return 0, fmt.Errorf("fbs-reader: failed to read chunk size: %w", err)
-		}
-
-		r.chunk = make([]byte, chunkSize)
-		if _, err := io.ReadFull(r.file, r.chunk); err != nil {
-			return 0, fmt.Errorf("fbs-reader: failed to read chunk data: %w", err)
-		}
-	}
-
-	// Copy data from the internal chunk buffer to the destination buffer `p`.
-	n = copy(p, r.chunk)
-	// Slice the chunk to reflect the bytes that have been "read".
-	r.chunk = r.chunk[n:]
-
-	return n, nil
-}
-
-// Close closes the underlying file.
-func (r *FbsReader) Close() error {
-	return r.file.Close()
-}
-
-// PixelFormat returns the pixel format from the FBS header.
-func (r *FbsReader) PixelFormat() PixelFormat {
-	return r.pixelFormat
-}
-
-// Width returns the framebuffer width from the FBS header.
-func (r *FbsReader) Width() uint16 {
-	return r.width
-}
-
-// Height returns the framebuffer height from the FBS header.
-func (r *FbsReader) Height() uint16 {
-	return r.height
-}
-
-// DesktopName returns the desktop name from the FBS header.
-func (r *FbsReader) DesktopName() []byte {
-	return r.desktopName
-}
+package avacadovnc
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// ErrFbsGap is returned by FbsReader.Read where the recording was paused and
+// resumed. The data before it may end partway through a message; the data
+// after it starts with a new message. Decoder state should be reset, for
+// example with ResetAllEncodings, before reading on.
+var ErrFbsGap = errors.New("fbs-reader: gap in recording")
+
+// FbsReader reads a Frame Buffer Stream (FBS) file, which is a recording
+// of a VNC session. Gzip-compressed recordings are decompressed transparently.
+type FbsReader struct {
+	file        *os.File
+	r           io.Reader    // file, or a gzip reader on top of it
+	gz          *gzip.Reader // non-nil if the file is compressed
+	pixelFormat PixelFormat
+	width       uint16
+	height      uint16
+	desktopName []byte
+
+	// timestamped is set for files that start with fbsMagic, whose chunks
+	// are padded and carry a timestamp.
+	timestamped bool
+	// timestamp is the time of the current chunk since the recording began.
+	timestamp time.Duration
+
+	// Internal buffer for the current data chunk being read.
+	chunk []byte
+	// offset counts the data bytes returned by Read so far.
+	offset int64
+}
+
+// NewFbsReader opens and initializes a reader for the given FBS file.
+// It reads the header to populate the session's metadata.
+func NewFbsReader(filename string) (*FbsReader, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("fbs-reader: failed to open file: %w", err)
+	}
+
+	reader := &FbsReader{file: file}
+
+	// Detect gzip-compressed recordings by their magic number.
+	br := bufio.NewReader(file)
+	reader.r = br
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		reader.gz, err = gzip.NewReader(br)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("fbs-reader: failed to open gzip stream: %w", err)
+		}
+		br = bufio.NewReader(reader.gz)
+		reader.r = br
+	}
+
+	// Standard FBS files start with the magic, and their data with the
+	// server side of the handshake.
+	if magic, err := br.Peek(len(fbsMagic)); err == nil && string(magic) == fbsMagic {
+		br.Discard(len(fbsMagic))
+		reader.timestamped = true
+		si, err := readFbsHandshake(reader)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("fbs-reader: %w", err)
+		}
+		reader.pixelFormat, reader.width, reader.height, reader.desktopName = si.PixelFormat, si.Width, si.Height, si.Name
+		return reader, nil
+	}
+
+	// Files without the magic come from older versions of this package.
+	// They start with a header of their own, and their chunks have no
+	// padding or timestamps.
+	if err := binary.Read(reader.r, binary.BigEndian, &reader.pixelFormat); err != nil {
+		return nil, fmt.Errorf("fbs-reader: failed to read pixel format: %w", err)
+	}
+	if err := binary.Read(reader.r, binary.BigEndian, &reader.width); err != nil {
+		return nil, fmt.Errorf("fbs-reader: failed to read width: %w", err)
+	}
+	if err := binary.Read(reader.r, binary.BigEndian, &reader.height); err != nil {
+		return nil, fmt.Errorf("fbs-reader: failed to read height: %w", err)
+	}
+	name, err := readDesktopName(reader.r)
+	if err != nil {
+		return nil, fmt.Errorf("fbs-reader: %w", err)
+	}
+	reader.desktopName = name
+
+	return reader, nil
+}
+
+// readFbsHandshake reads the server side of the handshake that starts the
+// data of a standard FBS file, up to and including ServerInit. Recorders
+// usually rewrite it to RFB 3.3 with security type None. RFB 3.7 and 3.8
+// handshakes are accepted if the server offered a single security type, so
+// that the client's choice, which is not recorded, is known.
+func readFbsHandshake(r io.Reader) (*ServerInit, error) {
+	var version [12]byte
+	if _, err := io.ReadFull(r, version[:]); err != nil {
+		return nil, fmt.Errorf("failed to read protocol version: %w", err)
+	}
+	var major, minor int
+	if _, err := fmt.Sscanf(string(version[:]), "RFB %03d.%03d\n", &major, &minor); err != nil {
+		return nil, fmt.Errorf("invalid protocol version %q: %w", version, ErrProtocolVersion)
+	}
+	rfb38 := major > 3 || major == 3 && minor >= 8
+
+	var secType SecurityType
+	if major == 3 && minor < 7 {
+		var t uint32
+		if err := binary.Read(r, binary.BigEndian, &t); err != nil {
+			return nil, fmt.Errorf("failed to read security type: %w", err)
+		}
+		secType = SecurityType(t)
+	} else {
+		var types [2]byte // count, then the only type
+		if _, err := io.ReadFull(r, types[:1]); err != nil {
+			return nil, fmt.Errorf("failed to read number of security types: %w", err)
+		}
+		if types[0] != 1 {
+			return nil, fmt.Errorf("cannot tell which of %d security types was chosen", types[0])
+		}
+		if _, err := io.ReadFull(r, types[1:]); err != nil {
+			return nil, fmt.Errorf("failed to read security type: %w", err)
+		}
+		secType = SecurityType(types[1])
+	}
+
+	switch secType {
+	case SecTypeNone:
+		if !rfb38 {
+			break
+		}
+		if err := readFbsSecurityResult(r); err != nil {
+			return nil, err
+		}
+	case SecTypeVNCAuth:
+		var challenge [16]byte
+		if _, err := io.ReadFull(r, challenge[:]); err != nil {
+			return nil, fmt.Errorf("failed to read vnc auth challenge: %w", err)
+		}
+		if err := readFbsSecurityResult(r); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("cannot play back a session using security type %s", secType)
+	}
+	return ReadServerInit(r)
+}
+
+// readFbsSecurityResult reads a recorded SecurityResult, which must report
+// success.
+func readFbsSecurityResult(r io.Reader) error {
+	var result uint32
+	if err := binary.Read(r, binary.BigEndian, &result); err != nil {
+		return fmt.Errorf("failed to read security result: %w", err)
+	}
+	if result != 0 {
+		return fmt.Errorf("recorded session failed authentication: %w", ErrAuthFailed)
+	}
+	return nil
+}
+
+// Read implements the io.Reader interface. It reads the next data chunk
+// from the FBS file into the provided buffer.
+func (r *FbsReader) Read(p []byte) (n int, err error) {
+	// If the internal chunk buffer is empty, read the next chunk from the file.
+	if len(r.chunk) == 0 {
+		var chunkSize uint32
+		if err := binary.Read(r.r, binary.BigEndian, &chunkSize); err != nil {
+			if errors.Is(err, io.EOF) {
+				return 0, io.EOF // Clean end-of-file.
+			}
+			return 0, fmt.Errorf("fbs-reader: failed to read chunk size: %w", err)
+		}
+
+		size := int(chunkSize)
+		if r.timestamped {
+			size = (size + 3) &^ 3
+		}
+		r.chunk = make([]byte, size)
+		if _, err := io.ReadFull(r.r, r.chunk); err != nil {
+			return 0, fmt.Errorf("fbs-reader: failed to read chunk data: %w", err)
+		}
+		r.chunk = r.chunk[:chunkSize]
+		if r.timestamped {
+			var ms uint32
+			if err := binary.Read(r.r, binary.BigEndian, &ms); err != nil {
+				return 0, fmt.Errorf("fbs-reader: failed to read chunk timestamp: %w", err)
+			}
+			r.timestamp = time.Duration(ms) * time.Millisecond
+		}
+		if chunkSize == 0 {
+			return 0, ErrFbsGap
+		}
+	}
+
+	// Copy data from the internal chunk buffer to the destination buffer `p`.
+	n = copy(p, r.chunk)
+	// Slice the chunk to reflect the bytes that have been "read".
+	r.chunk = r.chunk[n:]
+	r.offset += int64(n)
+
+	return n, nil
+}
+
+// Offset returns the number of bytes of recorded data returned by Read so
+// far. Chunk framing is not counted, so offsets identify positions in the
+// recorded stream whether or not the file is compressed.
+func (r *FbsReader) Offset() int64 {
+	return r.offset
+}
+
+// skipTo reads and discards data up to offset, passing over gaps.
+func (r *FbsReader) skipTo(offset int64) error {
+	buf := make([]byte, 32*1024)
+	for r.offset < offset {
+		n := int64(len(buf))
+		if rest := offset - r.offset; rest < n {
+			n = rest
+		}
+		if _, err := r.Read(buf[:n]); err != nil && !errors.Is(err, ErrFbsGap) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the underlying file.
+func (r *FbsReader) Close() error {
+	if r.gz != nil {
+		r.gz.Close()
+	}
+	return r.file.Close()
+}
+
+// Timestamp returns the time since the start of the recording at which the
+// chunk currently being read was recorded. A player can sleep for the
+// difference between successive timestamps to keep the original pace. It is
+// always zero for recordings made before timestamps were added.
+func (r *FbsReader) Timestamp() time.Duration {
+	return r.timestamp
+}
+
+// PixelFormat returns the pixel format from the recording's ServerInit.
+func (r *FbsReader) PixelFormat() PixelFormat {
+	return r.pixelFormat
+}
+
+// Width returns the framebuffer width from the recording's ServerInit.
+func (r *FbsReader) Width() uint16 {
+	return r.width
+}
+
+// Height returns the framebuffer height from the recording's ServerInit.
+func (r *FbsReader) Height() uint16 {
+	return r.height
+}
+
+// DesktopName returns the desktop name from the recording's ServerInit. It is empty, not
+// nil, for a recording of a session without a name.
+func (r *FbsReader) DesktopName() []byte {
+	return r.desktopName
+}
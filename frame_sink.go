@@ -0,0 +1,109 @@
+package avacadovnc
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"os"
+	"path/filepath"
+)
+
+// FrameSink consumes a sequence of frames, such as successive snapshots of a
+// VncCanvas or of an FBS playback. PNGSequenceSink and the ffmpeg based
+// encoders.VideoEncoder implement it, and a Recorder writes its frames to one.
+type FrameSink interface {
+	// WriteFrame adds img as the next frame. The sink does not keep img.
+	WriteFrame(img image.Image) error
+	// Close finishes the output.
+	Close() error
+}
+
+// BlockingFrameSink is a FrameSink that can be set to drop frames from
+// WriteFrame when it falls behind, such as encoders.VideoEncoder with
+// DropFrames. WriteFrameBlocking never drops a frame; it waits instead. A
+// Recorder writing video at a constant frame rate uses it, since every
+// dropped frame would shorten the video.
+type BlockingFrameSink interface {
+	FrameSink
+	// WriteFrameBlocking adds img as the next frame, waiting until the
+	// sink has room for it.
+	WriteFrameBlocking(img image.Image) error
+}
+
+// PNGSequenceSink writes each frame to its own numbered PNG file. A frame that
+// is pixel for pixel the same as the previously written one is skipped, so a
+// recording of an idle screen does not fill the disk with copies. Written
+// frames are numbered consecutively from zero.
+type PNGSequenceSink struct {
+	// Dir is the directory the files are written to. It is created if it
+	// does not exist. Empty means the current directory.
+	Dir string
+	// Template is the fmt template of the file names, given the frame
+	// number. Empty means "frame-%05d.png".
+	Template string
+
+	last    *image.RGBA
+	written int
+	skipped int
+}
+
+// WriteFrame writes img unless it repeats the previous frame.
+func (s *PNGSequenceSink) WriteFrame(img image.Image) error {
+	_, err := s.Add(img)
+	return err
+}
+
+// Add writes img unless it repeats the previous frame, and reports whether
+// it was skipped.
+func (s *PNGSequenceSink) Add(img image.Image) (skipped bool, err error) {
+	frame := image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+	draw.Draw(frame, frame.Bounds(), img, img.Bounds().Min, draw.Src)
+	if s.last != nil && s.last.Rect == frame.Rect && bytes.Equal(s.last.Pix, frame.Pix) {
+		s.skipped++
+		return true, nil
+	}
+
+	template := s.Template
+	if template == "" {
+		template = "frame-%05d.png"
+	}
+	if s.Dir != "" {
+		if err := os.MkdirAll(s.Dir, 0o755); err != nil {
+			return false, fmt.Errorf("png-sequence: failed to create %s: %w", s.Dir, err)
+		}
+	}
+	path := filepath.Join(s.Dir, fmt.Sprintf(template, s.written))
+	f, err := os.Create(path)
+	if err != nil {
+		return false, fmt.Errorf("png-sequence: failed to create %s: %w", path, err)
+	}
+	if err := png.Encode(f, frame); err != nil {
+		f.Close()
+		return false, fmt.Errorf("png-sequence: failed to encode %s: %w", path, err)
+	}
+	if err := f.Close(); err != nil {
+		return false, fmt.Errorf("png-sequence: failed to write %s: %w", path, err)
+	}
+	s.last = frame
+	s.written++
+	return false, nil
+}
+
+// Written returns the number of files written so far.
+func (s *PNGSequenceSink) Written() int {
+	return s.written
+}
+
+// Skipped returns the number of frames skipped as repeats.
+func (s *PNGSequenceSink) Skipped() int {
+	return s.skipped
+}
+
+// Close releases the copy of the last frame. The files are complete as soon
+// as WriteFrame returns, so Close never fails.
+func (s *PNGSequenceSink) Close() error {
+	s.last = nil
+	return nil
+}
@@ -0,0 +1,83 @@
+package avacadovnc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// maxFrameSize bounds the frames accepted by a length-delimited FramedConn.
+const maxFrameSize = 64 * 1024 * 1024
+
+// FramedConn adapts a transport that preserves message boundaries, such as a
+// WebSocket or a tunnel, to the byte stream RFB expects. A frame may end in
+// the middle of a protocol value; Read hands out the bytes of each frame in
+// order and keeps what the caller has not yet consumed for the next call, so
+// multi-byte values split across frames are reassembled.
+type FramedConn struct {
+	net.Conn
+	readFrame  func() ([]byte, error)
+	writeFrame func([]byte) error
+	pending    []byte
+}
+
+// NewFramedConn returns a FramedConn that reads frames with readFrame and
+// sends each Write as one frame with writeFrame. If writeFrame is nil, writes
+// go to conn unchanged.
+func NewFramedConn(conn net.Conn, readFrame func() ([]byte, error), writeFrame func([]byte) error) *FramedConn {
+	return &FramedConn{Conn: conn, readFrame: readFrame, writeFrame: writeFrame}
+}
+
+// NewLengthDelimitedConn returns a FramedConn for transports that prefix each
+// frame with its length as a 32-bit big-endian value.
+func NewLengthDelimitedConn(conn net.Conn) *FramedConn {
+	readFrame := func() ([]byte, error) {
+		var size uint32
+		if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+			return nil, err
+		}
+		if size > maxFrameSize {
+			return nil, fmt.Errorf("framed-conn: frame of %d bytes is too large", size)
+		}
+		frame := make([]byte, size)
+		if _, err := io.ReadFull(conn, frame); err != nil {
+			return nil, fmt.Errorf("framed-conn: failed to read frame: %w", err)
+		}
+		return frame, nil
+	}
+	writeFrame := func(b []byte) error {
+		frame := make([]byte, 4+len(b))
+		binary.BigEndian.PutUint32(frame, uint32(len(b)))
+		copy(frame[4:], b)
+		_, err := conn.Write(frame)
+		return err
+	}
+	return NewFramedConn(conn, readFrame, writeFrame)
+}
+
+// Read reads from the current frame, fetching the next one when it is used
+// up. Empty frames are skipped.
+func (fc *FramedConn) Read(b []byte) (int, error) {
+	for len(fc.pending) == 0 {
+		frame, err := fc.readFrame()
+		if err != nil {
+			return 0, err
+		}
+		fc.pending = frame
+	}
+	n := copy(b, fc.pending)
+	fc.pending = fc.pending[n:]
+	return n, nil
+}
+
+// Write sends b as a single frame.
+func (fc *FramedConn) Write(b []byte) (int, error) {
+	if fc.writeFrame == nil {
+		return fc.Conn.Write(b)
+	}
+	if err := fc.writeFrame(b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
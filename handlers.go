@@ -1,263 +1,342 @@
-package avacadovnc
-
-import (
-	"bytes"
-	"encoding/binary"
-	"errors"
-	"fmt"
-	"io"
-)
-
-const (
-	// ProtocolVersion is the VNC protocol version this library supports.
-	ProtocolVersion = "RFB 003.008\n"
-)
-
-// --- Client Handlers ---
-
-// DefaultClientVersionHandler handles the protocol version negotiation for the client.
-type DefaultClientVersionHandler struct{}
-
-// Handle reads the server's protocol version and sends the client's version.
-func (h *DefaultClientVersionHandler) Handle(c Conn) error {
-	var serverVersion [12]byte
-	if _, err := io.ReadFull(c, serverVersion[:]); err != nil {
-		return fmt.Errorf("failed to read server version: %w", err)
-	}
-
-	// For now, we don't do anything with the server's version, but a more
-	// robust client might check it for compatibility.
-	c.SetProtoVersion(string(serverVersion[:]))
-
-	if _, err := c.Write([]byte(ProtocolVersion)); err != nil {
-		return fmt.Errorf("failed to write client version: %w", err)
-	}
-	return c.Flush()
-}
-
-// DefaultClientSecurityHandler handles the security negotiation for the client.
-type DefaultClientSecurityHandler struct{}
-
-// Handle negotiates a security type with the server and performs authentication.
-func (h *DefaultClientSecurityHandler) Handle(c Conn) error {
-	var numSecTypes uint8
-	if err := binary.Read(c, binary.BigEndian, &numSecTypes); err != nil {
-		return fmt.Errorf("failed to read number of security types: %w", err)
-	}
-
-	if numSecTypes == 0 {
-		// If the server sends 0 security types, it's followed by a reason string.
-		var reasonLen uint32
-		if err := binary.Read(c, binary.BigEndian, &reasonLen); err != nil {
-			return fmt.Errorf("failed to read security failure reason length: %w", err)
-		}
-		reason := make([]byte, reasonLen)
-		if _, err := io.ReadFull(c, reason); err != nil {
-			return fmt.Errorf("failed to read security failure reason: %w", err)
-		}
-		return fmt.Errorf("server reported security failure: %s", reason)
-	}
-
-	// Read the raw security types into a byte slice.
-	serverSecTypesBytes := make([]byte, numSecTypes)
-	if _, err := io.ReadFull(c, serverSecTypesBytes); err != nil {
-		return fmt.Errorf("failed to read server security types: %w", err)
-	}
-
-	// Convert the byte slice to a slice of SecurityType.
-	serverSecTypes := make([]SecurityType, numSecTypes)
-	for i, b := range serverSecTypesBytes {
-		serverSecTypes[i] = SecurityType(b)
-	}
-
-	cfg, ok := c.Config().(*ClientConfig)
-	if !ok {
-		return errors.New("invalid connection config type for client")
-	}
-
-	// Find the first security handler supported by both client and server.
-	for _, clientHandler := range cfg.SecurityHandlers {
-		for _, serverSecType := range serverSecTypes {
-			if clientHandler.Type() == serverSecType {
-				// We found a match. Send our choice to the server.
-				if _, err := c.Write([]byte{byte(clientHandler.Type())}); err != nil {
-					return fmt.Errorf("failed to write security type: %w", err)
-				}
-				if err := c.Flush(); err != nil {
-					return err
-				}
-				// Perform authentication.
-				c.SetSecurityHandler(clientHandler)
-				return clientHandler.Authenticate(c)
-			}
-		}
-	}
-
-	return errors.New("no supported security types found")
-}
-
-// DefaultClientClientInitHandler sends the ClientInit message.
-type DefaultClientClientInitHandler struct{}
-
-// Handle sends the "shared" flag to the server.
-func (h *DefaultClientClientInitHandler) Handle(c Conn) error {
-	cfg, ok := c.Config().(*ClientConfig)
-	if !ok {
-		return errors.New("invalid connection config type for client")
-	}
-
-	var sharedFlag uint8
-	if !cfg.Exclusive {
-		sharedFlag = 1
-	}
-
-	if _, err := c.Write([]byte{sharedFlag}); err != nil {
-		return fmt.Errorf("failed to write shared flag: %w", err)
-	}
-	return c.Flush()
-}
-
-// DefaultClientServerInitHandler reads the ServerInit message.
-type DefaultClientServerInitHandler struct{}
-
-// Handle reads the server's framebuffer dimensions, pixel format, and desktop name.
-func (h *DefaultClientServerInitHandler) Handle(c Conn) error {
-	var width, height uint16
-	if err := binary.Read(c, binary.BigEndian, &width); err != nil {
-		return err
-	}
-	if err := binary.Read(c, binary.BigEndian, &height); err != nil {
-		return err
-	}
-	c.SetWidth(width)
-	c.SetHeight(height)
-
-	var pf PixelFormat
-	if err := binary.Read(c, binary.BigEndian, &pf); err != nil {
-		return err
-	}
-	c.SetPixelFormat(pf)
-
-	var nameLength uint32
-	if err := binary.Read(c, binary.BigEndian, &nameLength); err != nil {
-		return err
-	}
-	name := make([]byte, nameLength)
-	if _, err := io.ReadFull(c, name); err != nil {
-		return err
-	}
-	c.SetDesktopName(name)
-
-	return nil
-}
-
-// --- Server Handlers ---
-
-// DefaultServerVersionHandler handles protocol version negotiation for the server.
-type DefaultServerVersionHandler struct{}
-
-// Handle sends the server's version and reads the client's.
-func (h *DefaultServerVersionHandler) Handle(c Conn) error {
-	if _, err := c.Write([]byte(ProtocolVersion)); err != nil {
-		return fmt.Errorf("failed to write server version: %w", err)
-	}
-	if err := c.Flush(); err != nil {
-		return err
-	}
-
-	var clientVersion [12]byte
-	if _, err := io.ReadFull(c, clientVersion[:]); err != nil {
-		return fmt.Errorf("failed to read client version: %w", err)
-	}
-
-	// A real server might validate the client version.
-	if !bytes.HasPrefix(clientVersion[:], []byte("RFB")) {
-		return fmt.Errorf("invalid client version signature: %s", clientVersion)
-	}
-
-	return nil
-}
-
-// DefaultServerSecurityHandler handles security negotiation for the server.
-type DefaultServerSecurityHandler struct{}
-
-// Handle sends supported security types and authenticates the client.
-func (h *DefaultServerSecurityHandler) Handle(c Conn) error {
-	cfg, ok := c.Config().(*ServerConfig)
-	if !ok {
-		return errors.New("invalid connection config type for server")
-	}
-
-	secTypes := make([]byte, len(cfg.SecurityHandlers))
-	for i, handler := range cfg.SecurityHandlers {
-		secTypes[i] = byte(handler.Type())
-	}
-
-	if _, err := c.Write([]byte{uint8(len(secTypes))}); err != nil {
-		return fmt.Errorf("failed to write number of security types: %w", err)
-	}
-	if _, err := c.Write(secTypes); err != nil {
-		return fmt.Errorf("failed to write security types: %w", err)
-	}
-	if err := c.Flush(); err != nil {
-		return err
-	}
-
-	var clientChoice uint8
-	if err := binary.Read(c, binary.BigEndian, &clientChoice); err != nil {
-		return fmt.Errorf("failed to read client security choice: %w", err)
-	}
-
-	for _, handler := range cfg.SecurityHandlers {
-		if handler.Type() == SecurityType(clientChoice) {
-			c.SetSecurityHandler(handler)
-			return handler.Authenticate(c)
-		}
-	}
-
-	return fmt.Errorf("client chose an unsupported security type: %d", clientChoice)
-}
-
-// DefaultServerClientInitHandler reads the ClientInit message on the server.
-type DefaultServerClientInitHandler struct{}
-
-// Handle reads the client's "shared" flag.
-func (h *DefaultServerClientInitHandler) Handle(c Conn) error {
-	var sharedFlag [1]byte
-	if _, err := io.ReadFull(c, sharedFlag[:]); err != nil {
-		return fmt.Errorf("failed to read client init (shared flag): %w", err)
-	}
-	// A real server would use this flag to manage session sharing.
-	return nil
-}
-
-// DefaultServerServerInitHandler sends the ServerInit message.
-type DefaultServerServerInitHandler struct{}
-
-// Handle sends the server's framebuffer info to the client.
-func (h *DefaultServerServerInitHandler) Handle(c Conn) error {
-	cfg, ok := c.Config().(*ServerConfig)
-	if !ok {
-		return errors.New("invalid connection config type for server")
-	}
-
-	if err := binary.Write(c, binary.BigEndian, cfg.Width); err != nil {
-		return err
-	}
-	if err := binary.Write(c, binary.BigEndian, cfg.Height); err != nil {
-		return err
-	}
-	if err := binary.Write(c, binary.BigEndian, cfg.PixelFormat); err != nil {
-		return err
-	}
-
-	name := []byte(cfg.DesktopName)
-	if err := binary.Write(c, binary.BigEndian, uint32(len(name))); err != nil {
-		return err
-	}
-	if _, err := c.Write(name); err != nil {
-		return err
-	}
-
-	return c.Flush()
-}
+package avacadovnc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/bigangryrobot/avacadovnc/logger"
+)
+
+const (
+	// ProtocolVersion is the VNC protocol version this library supports.
+	ProtocolVersion = "RFB 003.008\n"
+
+	// rfb37 and rfb33 are the older versions the client falls back to.
+	rfb37 = "RFB 003.007\n"
+	rfb33 = "RFB 003.003\n"
+)
+
+// --- Client Handlers ---
+
+// DefaultClientVersionHandler handles the protocol version negotiation for the client.
+type DefaultClientVersionHandler struct{}
+
+// Handle reads the server's protocol version and answers with the highest
+// version both sides speak: 3.8 to servers of 3.8 and later, 3.7 to 3.7 and
+// 3.3 to anything older, as RFB asks of clients seeing the unofficial 3.4 to
+// 3.6. The answered version is the one spoken from then on; it is stored
+// with SetProtoVersion, so Protocol returns it.
+func (h *DefaultClientVersionHandler) Handle(c Conn) error {
+	var serverVersion [12]byte
+	if _, err := io.ReadFull(c, serverVersion[:]); err != nil {
+		return fmt.Errorf("failed to read server version: %w", err)
+	}
+
+	var major, minor int
+	if _, err := fmt.Sscanf(string(serverVersion[:]), "RFB %03d.%03d\n", &major, &minor); err != nil {
+		return fmt.Errorf("invalid server version %q: %w", serverVersion, ErrProtocolVersion)
+	}
+	if major < 3 {
+		return fmt.Errorf("server version %d.%d is too old: %w", major, minor, ErrProtocolVersion)
+	}
+	auditHandshake(c, HandshakeEvent{Kind: HandshakeServerVersion, Version: string(serverVersion[:])})
+
+	version := ProtocolVersion
+	switch {
+	case major > 3 || minor >= 8:
+	case minor == 7:
+		version = rfb37
+	default:
+		version = rfb33
+	}
+	c.SetProtoVersion(version)
+
+	if _, err := c.Write([]byte(version)); err != nil {
+		return fmt.Errorf("failed to write client version: %w", err)
+	}
+	if err := c.Flush(); err != nil {
+		return err
+	}
+	auditHandshake(c, HandshakeEvent{Kind: HandshakeClientVersion, Version: version})
+	return nil
+}
+
+// speaksRFB38 reports whether the protocol spoken on the client connection c
+// is RFB 3.8. A connection whose version is unknown, such as a MockConn,
+// counts as 3.8.
+func speaksRFB38(c Conn) bool {
+	v := c.Protocol()
+	return v == "" || v >= ProtocolVersion
+}
+
+// speaksRFB33 reports whether the protocol spoken on the client connection c
+// is RFB 3.3, in which the server picks the security type.
+func speaksRFB33(c Conn) bool {
+	v := c.Protocol()
+	return v != "" && v < rfb37
+}
+
+// DefaultClientSecurityHandler handles the security negotiation for the client.
+type DefaultClientSecurityHandler struct{}
+
+// Handle negotiates a security type with the server and performs authentication.
+func (h *DefaultClientSecurityHandler) Handle(c Conn) error {
+	cfg, ok := c.Config().(*ClientConfig)
+	if !ok {
+		return errors.New("invalid connection config type for client")
+	}
+	if speaksRFB33(c) {
+		return h.handleRFB33(c, cfg)
+	}
+
+	var numSecTypes uint8
+	if err := binary.Read(c, binary.BigEndian, &numSecTypes); err != nil {
+		return fmt.Errorf("failed to read number of security types: %w", err)
+	}
+
+	if numSecTypes == 0 {
+		// If the server sends 0 security types, it's followed by a reason string.
+		reason, err := readReason(c)
+		if err != nil {
+			return fmt.Errorf("security failure: %w", err)
+		}
+		return fmt.Errorf("server reported security failure: %w", &HandshakeError{Err: ErrNoCommonSecurity, Reason: reason})
+	}
+
+	// Read the raw security types into a byte slice.
+	serverSecTypesBytes := make([]byte, numSecTypes)
+	if _, err := io.ReadFull(c, serverSecTypesBytes); err != nil {
+		return fmt.Errorf("failed to read server security types: %w", err)
+	}
+
+	// Convert the byte slice to a slice of SecurityType.
+	serverSecTypes := make([]SecurityType, numSecTypes)
+	for i, b := range serverSecTypesBytes {
+		serverSecTypes[i] = SecurityType(b)
+	}
+	auditHandshake(c, HandshakeEvent{Kind: HandshakeSecurityTypes, SecurityTypes: serverSecTypes})
+
+	// Find the first security handler supported by both client and server.
+	for _, clientHandler := range cfg.SecurityHandlers {
+		for _, serverSecType := range serverSecTypes {
+			if clientHandler.Type() == serverSecType {
+				// We found a match. Send our choice to the server.
+				if _, err := c.Write([]byte{byte(clientHandler.Type())}); err != nil {
+					return fmt.Errorf("failed to write security type: %w", err)
+				}
+				if err := c.Flush(); err != nil {
+					return err
+				}
+				auditHandshake(c, HandshakeEvent{Kind: HandshakeSecurityChosen, SecurityType: clientHandler.Type()})
+				// Perform authentication.
+				c.SetSecurityHandler(clientHandler)
+				err := clientHandler.Authenticate(c)
+				auditHandshake(c, HandshakeEvent{Kind: HandshakeSecurityResult, SecurityType: clientHandler.Type(), Err: err})
+				return err
+			}
+		}
+	}
+
+	return fmt.Errorf("%w: server offers %v", ErrNoCommonSecurity, serverSecTypes)
+}
+
+// handleRFB33 performs the RFB 3.3 security handshake, in which the server
+// sends the security type it has picked as a u32, with zero meaning failure,
+// and the client does not answer with a choice of its own.
+func (h *DefaultClientSecurityHandler) handleRFB33(c Conn, cfg *ClientConfig) error {
+	var secType uint32
+	if err := binary.Read(c, binary.BigEndian, &secType); err != nil {
+		return fmt.Errorf("failed to read security type: %w", err)
+	}
+	if secType == 0 {
+		reason, err := readReason(c)
+		if err != nil {
+			return fmt.Errorf("security failure: %w", err)
+		}
+		return fmt.Errorf("server reported security failure: %w", &HandshakeError{Err: ErrNoCommonSecurity, Reason: reason})
+	}
+	if secType > 0xff {
+		return fmt.Errorf("invalid security type %d: %w", secType, ErrNoCommonSecurity)
+	}
+	serverSecType := SecurityType(secType)
+	auditHandshake(c, HandshakeEvent{Kind: HandshakeSecurityTypes, SecurityTypes: []SecurityType{serverSecType}})
+
+	for _, clientHandler := range cfg.SecurityHandlers {
+		if clientHandler.Type() == serverSecType {
+			auditHandshake(c, HandshakeEvent{Kind: HandshakeSecurityChosen, SecurityType: serverSecType})
+			c.SetSecurityHandler(clientHandler)
+			err := clientHandler.Authenticate(c)
+			auditHandshake(c, HandshakeEvent{Kind: HandshakeSecurityResult, SecurityType: serverSecType, Err: err})
+			return err
+		}
+	}
+	return fmt.Errorf("%w: server requires %v", ErrNoCommonSecurity, serverSecType)
+}
+
+// DefaultClientClientInitHandler sends the ClientInit message.
+type DefaultClientClientInitHandler struct{}
+
+// Handle sends the "shared" flag to the server.
+func (h *DefaultClientClientInitHandler) Handle(c Conn) error {
+	cfg, ok := c.Config().(*ClientConfig)
+	if !ok {
+		return errors.New("invalid connection config type for client")
+	}
+
+	var sharedFlag uint8
+	if !cfg.Exclusive {
+		sharedFlag = 1
+	}
+
+	if _, err := c.Write([]byte{sharedFlag}); err != nil {
+		return fmt.Errorf("failed to write shared flag: %w", err)
+	}
+	return c.Flush()
+}
+
+// DefaultClientServerInitHandler reads the ServerInit message.
+type DefaultClientServerInitHandler struct{}
+
+// Handle reads the server's framebuffer dimensions, pixel format, and desktop name.
+func (h *DefaultClientServerInitHandler) Handle(c Conn) error {
+	var width, height uint16
+	if err := binary.Read(c, binary.BigEndian, &width); err != nil {
+		return err
+	}
+	if err := binary.Read(c, binary.BigEndian, &height); err != nil {
+		return err
+	}
+	c.SetWidth(width)
+	c.SetHeight(height)
+
+	var pf PixelFormat
+	if err := binary.Read(c, binary.BigEndian, &pf); err != nil {
+		return err
+	}
+	if err := pf.Validate(); err != nil {
+		logger.Warnf("server-init: server sent a questionable pixel format %s: %v", pf, err)
+	}
+	c.SetPixelFormat(pf)
+
+	name, err := readDesktopName(c)
+	if err != nil {
+		return fmt.Errorf("server-init: %w", err)
+	}
+	c.SetDesktopName(name)
+
+	return nil
+}
+
+// --- Server Handlers ---
+
+// DefaultServerVersionHandler handles protocol version negotiation for the server.
+type DefaultServerVersionHandler struct{}
+
+// Handle sends the server's version and reads the client's.
+func (h *DefaultServerVersionHandler) Handle(c Conn) error {
+	if _, err := c.Write([]byte(ProtocolVersion)); err != nil {
+		return fmt.Errorf("failed to write server version: %w", err)
+	}
+	if err := c.Flush(); err != nil {
+		return err
+	}
+
+	var clientVersion [12]byte
+	if _, err := io.ReadFull(c, clientVersion[:]); err != nil {
+		return fmt.Errorf("failed to read client version: %w", err)
+	}
+
+	// A real server might validate the client version.
+	if !bytes.HasPrefix(clientVersion[:], []byte("RFB")) {
+		return fmt.Errorf("invalid client version signature %q: %w", clientVersion, ErrProtocolVersion)
+	}
+
+	return nil
+}
+
+// DefaultServerSecurityHandler handles security negotiation for the server.
+type DefaultServerSecurityHandler struct{}
+
+// Handle sends supported security types and authenticates the client.
+func (h *DefaultServerSecurityHandler) Handle(c Conn) error {
+	cfg, ok := c.Config().(*ServerConfig)
+	if !ok {
+		return errors.New("invalid connection config type for server")
+	}
+
+	secTypes := make([]byte, len(cfg.SecurityHandlers))
+	for i, handler := range cfg.SecurityHandlers {
+		secTypes[i] = byte(handler.Type())
+	}
+
+	if _, err := c.Write([]byte{uint8(len(secTypes))}); err != nil {
+		return fmt.Errorf("failed to write number of security types: %w", err)
+	}
+	if _, err := c.Write(secTypes); err != nil {
+		return fmt.Errorf("failed to write security types: %w", err)
+	}
+	if err := c.Flush(); err != nil {
+		return err
+	}
+
+	var clientChoice uint8
+	if err := binary.Read(c, binary.BigEndian, &clientChoice); err != nil {
+		return fmt.Errorf("failed to read client security choice: %w", err)
+	}
+
+	for _, handler := range cfg.SecurityHandlers {
+		if handler.Type() == SecurityType(clientChoice) {
+			c.SetSecurityHandler(handler)
+			return handler.Authenticate(c)
+		}
+	}
+
+	return fmt.Errorf("client chose an unsupported security type %d: %w", clientChoice, ErrNoCommonSecurity)
+}
+
+// DefaultServerClientInitHandler reads the ClientInit message on the server.
+type DefaultServerClientInitHandler struct{}
+
+// Handle reads the client's "shared" flag.
+func (h *DefaultServerClientInitHandler) Handle(c Conn) error {
+	var sharedFlag [1]byte
+	if _, err := io.ReadFull(c, sharedFlag[:]); err != nil {
+		return fmt.Errorf("failed to read client init (shared flag): %w", err)
+	}
+	// A real server would use this flag to manage session sharing.
+	return nil
+}
+
+// DefaultServerServerInitHandler sends the ServerInit message.
+type DefaultServerServerInitHandler struct{}
+
+// Handle sends the server's framebuffer info to the client.
+func (h *DefaultServerServerInitHandler) Handle(c Conn) error {
+	cfg, ok := c.Config().(*ServerConfig)
+	if !ok {
+		return errors.New("invalid connection config type for server")
+	}
+
+	if err := binary.Write(c, binary.BigEndian, cfg.Width); err != nil {
+		return err
+	}
+	if err := binary.Write(c, binary.BigEndian, cfg.Height); err != nil {
+		return err
+	}
+	if err := binary.Write(c, binary.BigEndian, cfg.PixelFormat); err != nil {
+		return err
+	}
+
+	name := []byte(cfg.DesktopName)
+	if err := binary.Write(c, binary.BigEndian, uint32(len(name))); err != nil {
+		return err
+	}
+	if _, err := c.Write(name); err != nil {
+		return err
+	}
+
+	return c.Flush()
+}
@@ -0,0 +1,46 @@
+package avacadovnc
+
+// HandshakeEventKind identifies a step of the client handshake reported to
+// ClientConfig.OnHandshakeEvent.
+type HandshakeEventKind int
+
+const (
+	// HandshakeServerVersion reports the protocol version offered by the
+	// server, in Version.
+	HandshakeServerVersion HandshakeEventKind = iota
+	// HandshakeClientVersion reports the protocol version the client sent,
+	// in Version.
+	HandshakeClientVersion
+	// HandshakeSecurityTypes reports the security types offered by the
+	// server, in SecurityTypes.
+	HandshakeSecurityTypes
+	// HandshakeSecurityChosen reports the security type the client chose,
+	// in SecurityType.
+	HandshakeSecurityChosen
+	// HandshakeTLS reports that the connection was upgraded to TLS, with
+	// the negotiated TLSVersion and TLSCipherSuite.
+	HandshakeTLS
+	// HandshakeSecurityResult reports the outcome of authentication with
+	// SecurityType; Err is nil if it succeeded.
+	HandshakeSecurityResult
+)
+
+// HandshakeEvent describes one step of the client handshake. Only the fields
+// named by the Kind are set. Events carry no credentials, so they can be
+// logged as they are.
+type HandshakeEvent struct {
+	Kind           HandshakeEventKind
+	Version        string
+	SecurityTypes  []SecurityType
+	SecurityType   SecurityType
+	TLSVersion     uint16 // as in tls.ConnectionState
+	TLSCipherSuite uint16 // as in tls.ConnectionState
+	Err            error
+}
+
+// auditHandshake reports ev to the client's OnHandshakeEvent callback, if any.
+func auditHandshake(c Conn, ev HandshakeEvent) {
+	if cfg, ok := c.Config().(*ClientConfig); ok && cfg.OnHandshakeEvent != nil {
+		cfg.OnHandshakeEvent(ev)
+	}
+}
@@ -0,0 +1,267 @@
+package avacadovnc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Message types of the ContinuousUpdates and Fence extensions. Client and
+// server messages of each extension share the same type number.
+const (
+	ClientEnableContinuousUpdates ClientMessageType = 150
+	ClientFence                   ClientMessageType = 248
+
+	ServerEndOfContinuousUpdates ServerMessageType = 150
+	ServerFence                  ServerMessageType = 248
+)
+
+// Pseudo-encodings a client advertises in SetEncodings to announce the
+// Fence and ContinuousUpdates extensions, with FenceEncoding and
+// ContinuousUpdatesEncoding. A server that supports continuous
+// updates answers EncContinuousUpdates with an EndOfContinuousUpdates message.
+const (
+	EncFence             EncodingType = -312
+	EncContinuousUpdates EncodingType = -313
+)
+
+// Fence flags.
+const (
+	FenceBlockBefore uint32 = 1 << 0
+	FenceBlockAfter  uint32 = 1 << 1
+	FenceSyncNext    uint32 = 1 << 2
+	FenceRequest     uint32 = 1 << 31
+
+	// fenceSupported are the flags this package honors. Messages are
+	// handled one at a time, so the blocking flags hold trivially.
+	fenceSupported = FenceBlockBefore | FenceBlockAfter | FenceSyncNext
+)
+
+// maxFencePayload is the largest payload a fence message may carry.
+const maxFencePayload = 64
+
+// EnableContinuousUpdates asks the server to send updates for an area of the
+// framebuffer as it changes, without waiting for FramebufferUpdateRequests.
+type EnableContinuousUpdates struct {
+	Enable              uint8
+	X, Y, Width, Height uint16
+}
+
+func (msg *EnableContinuousUpdates) Supported(c Conn) bool {
+	return true
+}
+
+// String returns string
+func (msg *EnableContinuousUpdates) String() string {
+	return fmt.Sprintf("enable: %d, x: %d, y: %d, width: %d, height: %d", msg.Enable, msg.X, msg.Y, msg.Width, msg.Height)
+}
+
+func (*EnableContinuousUpdates) Type() ClientMessageType { return ClientEnableContinuousUpdates }
+
+// Write marshals message to conn
+func (msg *EnableContinuousUpdates) Write(c Conn) error {
+	buf := []byte{byte(ClientEnableContinuousUpdates), msg.Enable, byte(msg.X >> 8), byte(msg.X), byte(msg.Y >> 8), byte(msg.Y), byte(msg.Width >> 8), byte(msg.Width), byte(msg.Height >> 8), byte(msg.Height)}
+	_, err := c.Write(buf)
+	return err
+}
+
+// Read unmarshal message from conn
+func (*EnableContinuousUpdates) Read(c Conn) (ClientMessage, error) {
+	msg := EnableContinuousUpdates{}
+	if err := binary.Read(c, binary.BigEndian, &msg); err != nil {
+		return nil, fmt.Errorf("enable-continuous-updates: failed to read message: %w", err)
+	}
+	return &msg, nil
+}
+
+// EndOfContinuousUpdatesMessage is sent by the server when continuous updates
+// have stopped, and once in reply to the EncContinuousUpdates pseudo-encoding
+// to announce that it supports them.
+type EndOfContinuousUpdatesMessage struct{}
+
+func (*EndOfContinuousUpdatesMessage) String() string {
+	return "end of continuous updates"
+}
+func (m *EndOfContinuousUpdatesMessage) Supported(c Conn) bool {
+	return true
+}
+func (m *EndOfContinuousUpdatesMessage) Type() ServerMessageType {
+	return ServerEndOfContinuousUpdates
+}
+func (m *EndOfContinuousUpdatesMessage) Read(c Conn) (ServerMessage, error) { return m, nil }
+
+// Write marshal message to conn
+func (m *EndOfContinuousUpdatesMessage) Write(c Conn) error {
+	if err := binary.Write(c, binary.BigEndian, m.Type()); err != nil {
+		return err
+	}
+	return c.Flush()
+}
+
+// fence is the body shared by the client and server fence messages.
+type fence struct {
+	Flags   uint32
+	Payload []byte
+}
+
+func (f *fence) String() string {
+	return fmt.Sprintf("flags: %#x, payload: %d bytes", f.Flags, len(f.Payload))
+}
+
+func (f *fence) read(c Conn) error {
+	var hdr [8]byte // padding, flags, length
+	if _, err := io.ReadFull(c, hdr[:]); err != nil {
+		return fmt.Errorf("fence: failed to read message: %w", err)
+	}
+	f.Flags = binary.BigEndian.Uint32(hdr[3:])
+	if hdr[7] > maxFencePayload {
+		return fmt.Errorf("fence: payload of %d bytes is too large", hdr[7])
+	}
+	f.Payload = make([]byte, hdr[7])
+	if _, err := io.ReadFull(c, f.Payload); err != nil {
+		return fmt.Errorf("fence: failed to read payload: %w", err)
+	}
+	return nil
+}
+
+func (f *fence) write(c Conn, typ uint8) error {
+	if len(f.Payload) > maxFencePayload {
+		return fmt.Errorf("fence: payload of %d bytes is too large", len(f.Payload))
+	}
+	buf := make([]byte, 9, 9+len(f.Payload))
+	buf[0] = typ
+	binary.BigEndian.PutUint32(buf[4:], f.Flags)
+	buf[8] = byte(len(f.Payload))
+	_, err := c.Write(append(buf, f.Payload...))
+	return err
+}
+
+// ClientFenceMessage is a fence sent by the client.
+type ClientFenceMessage struct {
+	fence
+}
+
+func (*ClientFenceMessage) Supported(c Conn) bool   { return true }
+func (*ClientFenceMessage) Type() ClientMessageType { return ClientFence }
+
+// Write marshals message to conn
+func (msg *ClientFenceMessage) Write(c Conn) error { return msg.write(c, byte(ClientFence)) }
+
+// Read unmarshal message from conn
+func (*ClientFenceMessage) Read(c Conn) (ClientMessage, error) {
+	msg := &ClientFenceMessage{}
+	if err := msg.read(c); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// ServerFenceMessage is a fence sent by the server. The client answers fences
+// with the FenceRequest flag on its own.
+type ServerFenceMessage struct {
+	fence
+}
+
+func (*ServerFenceMessage) Supported(c Conn) bool   { return true }
+func (*ServerFenceMessage) Type() ServerMessageType { return ServerFence }
+
+// Write marshals message to conn
+func (msg *ServerFenceMessage) Write(c Conn) error {
+	if err := msg.write(c, byte(ServerFence)); err != nil {
+		return err
+	}
+	return c.Flush()
+}
+
+// Read unmarshal message from conn
+func (*ServerFenceMessage) Read(c Conn) (ServerMessage, error) {
+	msg := &ServerFenceMessage{}
+	if err := msg.read(c); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// EnableContinuousUpdates asks the server to keep sending updates for rect
+// as it changes. While continuous updates are on, the client stops sending
+// the incremental requests of its AutoRequest mode. The server should only
+// be asked if it has announced support with an EndOfContinuousUpdates
+// message; see ContinuousUpdatesSupported.
+func (c *ClientConn) EnableContinuousUpdates(rect Rectangle) error {
+	c.reqMu.Lock()
+	c.continuous = true
+	c.reqMu.Unlock()
+	return c.sendInput("enable continuous updates", &EnableContinuousUpdates{
+		Enable: 1,
+		X:      rect.X,
+		Y:      rect.Y,
+		Width:  rect.Width,
+		Height: rect.Height,
+	})
+}
+
+// DisableContinuousUpdates asks the server to stop continuous updates. The
+// AutoRequest mode takes over again once the server confirms with an
+// EndOfContinuousUpdates message.
+func (c *ClientConn) DisableContinuousUpdates() error {
+	return c.sendInput("disable continuous updates", &EnableContinuousUpdates{})
+}
+
+// ContinuousUpdatesSupported reports whether the server has sent an
+// EndOfContinuousUpdates message, which it does in reply to the
+// EncContinuousUpdates pseudo-encoding if it supports the extension.
+func (c *ClientConn) ContinuousUpdatesSupported() bool {
+	c.reqMu.Lock()
+	defer c.reqMu.Unlock()
+	return c.continuousSupported
+}
+
+// SendFence sends a fence to the server. With FenceRequest set in flags, the
+// server answers with a fence carrying the same payload once the messages
+// before it have been processed; the answer is delivered on ServerMessageCh
+// as a *ServerFenceMessage. Flags other than FenceRequest, FenceBlockBefore,
+// FenceBlockAfter and FenceSyncNext are rejected, as is a payload longer than
+// 64 bytes. The server must have announced fence support by sending a fence,
+// in reply to the EncFence pseudo-encoding, first.
+func (c *ClientConn) SendFence(flags uint32, payload []byte) error {
+	if flags&^(fenceSupported|FenceRequest) != 0 {
+		return fmt.Errorf("client: failed to send fence: unknown flags %#x", flags&^(fenceSupported|FenceRequest))
+	}
+	if len(payload) > maxFencePayload {
+		return fmt.Errorf("client: failed to send fence: payload of %d bytes is too large", len(payload))
+	}
+	return c.sendInput("fence", &ClientFenceMessage{fence{Flags: flags, Payload: payload}})
+}
+
+// continuousUpdatesActive reports whether continuous updates are on.
+func (c *ClientConn) continuousUpdatesActive() bool {
+	c.reqMu.Lock()
+	defer c.reqMu.Unlock()
+	return c.continuous
+}
+
+// handleExtensionMessage does the protocol work the ContinuousUpdates and
+// Fence extensions require from the read loop: it answers fence requests
+// and, when continuous updates end, resumes the AutoRequest mode.
+func (c *ClientConn) handleExtensionMessage(msg ServerMessage) error {
+	switch m := msg.(type) {
+	case *ServerFenceMessage:
+		c.reqMu.Lock()
+		c.fenceSupported = true
+		c.reqMu.Unlock()
+		if m.Flags&FenceRequest == 0 {
+			return nil
+		}
+		reply := &ClientFenceMessage{fence{Flags: m.Flags & fenceSupported, Payload: m.Payload}}
+		return c.send(reply)
+	case *EndOfContinuousUpdatesMessage:
+		c.reqMu.Lock()
+		wasActive := c.continuous
+		c.continuous, c.continuousSupported = false, true
+		c.reqMu.Unlock()
+		if wasActive && c.cfg.AutoRequest == AutoRequestContinuous {
+			return c.sendUpdateRequest(true)
+		}
+	}
+	return nil
+}
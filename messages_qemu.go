@@ -0,0 +1,176 @@
+package avacadovnc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// QEMU client message type. All QEMU extensions share a single message type
+// and are distinguished by a sub-type byte that follows it.
+const (
+	ClientQEMU ClientMessageType = 255
+)
+
+// QEMU client message sub-types
+const (
+	QEMUExtendedKeyEventSubType uint8 = 0
+	QEMUAudioSubType            uint8 = 1
+)
+
+// QEMU audio operations
+const (
+	QEMUAudioEnable    uint16 = 0
+	QEMUAudioDisable   uint16 = 1
+	QEMUAudioSetFormat uint16 = 2
+)
+
+// QEMUClientMessage reads any QEMU extension message sent by a client and
+// dispatches it to the matching sub-type reader. The values it returns from
+// Read are the concrete sub-type messages. The server message loop accepts it
+// by default and passes the messages to ServerConfig.OnQEMUExtendedKeyEvent
+// and OnQEMUAudio.
+type QEMUClientMessage struct{}
+
+func (msg *QEMUClientMessage) Supported(c Conn) bool {
+	return true
+}
+
+// String return string representation
+func (msg *QEMUClientMessage) String() string {
+	return "qemu"
+}
+
+// Type return ClientMessageType
+func (*QEMUClientMessage) Type() ClientMessageType {
+	return ClientQEMU
+}
+
+// Read unmarshal message from conn
+func (*QEMUClientMessage) Read(c Conn) (ClientMessage, error) {
+	var subType uint8
+	if err := binary.Read(c, binary.BigEndian, &subType); err != nil {
+		return nil, err
+	}
+	switch subType {
+	case QEMUExtendedKeyEventSubType:
+		return readQEMUExtendedKeyEvent(c)
+	case QEMUAudioSubType:
+		return readQEMUAudio(c)
+	default:
+		return nil, fmt.Errorf("qemu: unsupported sub-type %d", subType)
+	}
+}
+
+// Write is not used; the concrete sub-type messages marshal themselves.
+func (*QEMUClientMessage) Write(c Conn) error {
+	return fmt.Errorf("qemu: write a concrete sub-type message instead")
+}
+
+// QEMUExtendedKeyEvent is a key event that carries the hardware keycode in
+// addition to the X keysym.
+type QEMUExtendedKeyEvent struct {
+	Down    uint16 // down-flag
+	Key     Key    // keysym
+	KeyCode uint32 // XT keycode
+}
+
+func (msg *QEMUExtendedKeyEvent) Supported(c Conn) bool {
+	return true
+}
+
+// String return string representation
+func (msg *QEMUExtendedKeyEvent) String() string {
+	return fmt.Sprintf("down: %d, key: %d, keycode: %d", msg.Down, msg.Key, msg.KeyCode)
+}
+
+// Type return ClientMessageType
+func (*QEMUExtendedKeyEvent) Type() ClientMessageType {
+	return ClientQEMU
+}
+
+// Read unmarshal message from conn. The message type and sub-type must
+// already have been consumed.
+func (*QEMUExtendedKeyEvent) Read(c Conn) (ClientMessage, error) {
+	return readQEMUExtendedKeyEvent(c)
+}
+
+func readQEMUExtendedKeyEvent(c io.Reader) (*QEMUExtendedKeyEvent, error) {
+	msg := QEMUExtendedKeyEvent{}
+	if err := binary.Read(c, binary.BigEndian, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// Write marshal message to conn
+func (msg *QEMUExtendedKeyEvent) Write(c Conn) error {
+	buf := []byte{byte(ClientQEMU), QEMUExtendedKeyEventSubType}
+	if _, err := c.Write(buf); err != nil {
+		return err
+	}
+	return binary.Write(c, binary.BigEndian, msg)
+}
+
+// QEMUAudioMessage controls the QEMU audio stream. SampleFormat, Channels and
+// Frequency are only present on the wire for QEMUAudioSetFormat.
+type QEMUAudioMessage struct {
+	Operation    uint16
+	SampleFormat uint8
+	Channels     uint8
+	Frequency    uint32
+}
+
+func (msg *QEMUAudioMessage) Supported(c Conn) bool {
+	return true
+}
+
+// String return string representation
+func (msg *QEMUAudioMessage) String() string {
+	return fmt.Sprintf("operation: %d, format: %d, channels: %d, frequency: %d", msg.Operation, msg.SampleFormat, msg.Channels, msg.Frequency)
+}
+
+// Type return ClientMessageType
+func (*QEMUAudioMessage) Type() ClientMessageType {
+	return ClientQEMU
+}
+
+// Read unmarshal message from conn. The message type and sub-type must
+// already have been consumed.
+func (*QEMUAudioMessage) Read(c Conn) (ClientMessage, error) {
+	return readQEMUAudio(c)
+}
+
+func readQEMUAudio(c io.Reader) (*QEMUAudioMessage, error) {
+	msg := QEMUAudioMessage{}
+	if err := binary.Read(c, binary.BigEndian, &msg.Operation); err != nil {
+		return nil, err
+	}
+	switch msg.Operation {
+	case QEMUAudioEnable, QEMUAudioDisable:
+	case QEMUAudioSetFormat:
+		if err := binary.Read(c, binary.BigEndian, &msg.SampleFormat); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(c, binary.BigEndian, &msg.Channels); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(c, binary.BigEndian, &msg.Frequency); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("qemu-audio: unsupported operation %d", msg.Operation)
+	}
+	return &msg, nil
+}
+
+// Write marshal message to conn
+func (msg *QEMUAudioMessage) Write(c Conn) error {
+	buf := []byte{byte(ClientQEMU), QEMUAudioSubType, byte(msg.Operation >> 8), byte(msg.Operation)}
+	if msg.Operation == QEMUAudioSetFormat {
+		f := msg.Frequency
+		buf = append(buf, msg.SampleFormat, msg.Channels, byte(f>>24), byte(f>>16), byte(f>>8), byte(f))
+	}
+	_, err := c.Write(buf)
+	return err
+}
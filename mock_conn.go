@@ -22,6 +22,7 @@ type MockConn struct {
 	protocol        string
 	colorMap        ColorMap
 	securityHandler SecurityHandler
+	client          bool
 }
 
 // NewMockConn creates a new mock connection.
@@ -81,3 +82,7 @@ func (m *MockConn) ColorMap() ColorMap                          { return m.color
 func (m *MockConn) SetColorMap(cm ColorMap)                     { m.colorMap = cm }
 func (m *MockConn) SecurityHandler() SecurityHandler            { return m.securityHandler }
 func (m *MockConn) SetSecurityHandler(sh SecurityHandler) error { m.securityHandler = sh; return nil }
+func (m *MockConn) IsClient() bool                              { return m.client }
+
+// SetClient sets the role IsClient reports. A new MockConn plays the server.
+func (m *MockConn) SetClient(client bool) { m.client = client }
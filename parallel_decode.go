@@ -0,0 +1,105 @@
+package avacadovnc
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"runtime"
+	"sync"
+)
+
+// parallelDecoder converts the Raw rectangles of one FramebufferUpdate on
+// several goroutines. The payloads are still read from the connection in
+// order; only the pixel conversion and drawing run concurrently. A rectangle
+// that overlaps one still in flight, and any rectangle in another encoding,
+// waits for the in-flight rectangles first, so the canvas ends up exactly as
+// with serial decoding. Stateful encodings such as Tight and Zlib are always
+// decoded serially.
+type parallelDecoder struct {
+	canvas *VncCanvas
+	sem    chan struct{} // Bounds the number of conversions in flight
+	wg     sync.WaitGroup
+
+	inFlight []image.Rectangle // Areas queued since the last wait
+
+	mu  sync.Mutex // Guards err
+	err error
+}
+
+// newParallelDecoder returns a parallelDecoder for c, or nil if c has not
+// opted in with ClientConfig.ParallelDecode or has no canvas.
+func newParallelDecoder(c Conn) *parallelDecoder {
+	conn, ok := c.(*ClientConn)
+	if !ok || conn.cfg == nil || !conn.cfg.ParallelDecode || conn.Canvas == nil {
+		return nil
+	}
+	return &parallelDecoder{
+		canvas: conn.Canvas,
+		sem:    make(chan struct{}, runtime.GOMAXPROCS(0)),
+	}
+}
+
+// accepts reports whether rect can be decoded concurrently.
+func (p *parallelDecoder) accepts(c Conn, rect *Rectangle) bool {
+	if rect.EncType != EncRaw {
+		return false
+	}
+	enc, ok := c.GetEncInstance(EncRaw).(*RawEncoding)
+	return ok && enc.Rows == nil
+}
+
+// decode reads the payload of the Raw rectangle rect and converts it into the
+// canvas in the background.
+func (p *parallelDecoder) decode(c Conn, rect *Rectangle) error {
+	rect.Enc = c.GetEncInstance(EncRaw)
+	bytesPerPixel := c.PixelFormat().BytesPerPixel()
+	if bytesPerPixel == 0 {
+		return fmt.Errorf("raw: bytes per pixel is zero")
+	}
+	bytesToRead := int(rect.Width) * int(rect.Height) * bytesPerPixel
+	if bytesToRead == 0 {
+		return nil
+	}
+	pixelData := make([]byte, bytesToRead)
+	if _, err := io.ReadFull(c, pixelData); err != nil {
+		return fmt.Errorf("raw: failed to read pixel data: %w", err)
+	}
+
+	area := image.Rect(int(rect.X), int(rect.Y), int(rect.X)+int(rect.Width), int(rect.Y)+int(rect.Height))
+	for _, r := range p.inFlight {
+		if r.Overlaps(area) {
+			if err := p.wait(); err != nil {
+				return err
+			}
+			break
+		}
+	}
+	p.inFlight = append(p.inFlight, area)
+
+	p.sem <- struct{}{}
+	p.wg.Add(1)
+	go func() {
+		defer func() {
+			<-p.sem
+			p.wg.Done()
+		}()
+		if err := p.canvas.drawBytesShared(pixelData, rect); err != nil {
+			p.mu.Lock()
+			if p.err == nil {
+				p.err = fmt.Errorf("raw: %w", err)
+			}
+			p.mu.Unlock()
+		}
+	}()
+	return nil
+}
+
+// wait blocks until every queued rectangle has been drawn and returns the
+// first error any of them hit.
+func (p *parallelDecoder) wait() error {
+	p.wg.Wait()
+	p.inFlight = p.inFlight[:0]
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
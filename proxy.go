@@ -0,0 +1,193 @@
+package avacadovnc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ServerInit is the ServerInit message sent by the server at the end of the
+// handshake.
+type ServerInit struct {
+	Width, Height uint16
+	PixelFormat   PixelFormat
+	Name          []byte
+}
+
+// ReadServerInit reads a ServerInit message. Desktop names longer than 1 MiB
+// are refused, so a corrupt length cannot exhaust memory.
+func ReadServerInit(r io.Reader) (*ServerInit, error) {
+	var hdr struct {
+		Width, Height uint16
+		PixelFormat   PixelFormat
+	}
+	if err := binary.Read(r, binary.BigEndian, &hdr); err != nil {
+		return nil, fmt.Errorf("server-init: failed to read header: %w", err)
+	}
+	name, err := readDesktopName(r)
+	if err != nil {
+		return nil, fmt.Errorf("server-init: failed to read desktop name: %w", err)
+	}
+	return &ServerInit{
+		Width:       hdr.Width,
+		Height:      hdr.Height,
+		PixelFormat: hdr.PixelFormat,
+		Name:        name,
+	}, nil
+}
+
+// Write writes the ServerInit message.
+func (si *ServerInit) Write(w io.Writer) error {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, si.Width)
+	binary.Write(&buf, binary.BigEndian, si.Height)
+	binary.Write(&buf, binary.BigEndian, si.PixelFormat)
+	binary.Write(&buf, binary.BigEndian, uint32(len(si.Name)))
+	buf.Write(si.Name)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// ProxyHandshake relays the handshake between a downstream client and an
+// upstream server, up to and including ServerInit, so a proxy can rewrite
+// the ServerInit before the client sees it. Afterwards the caller relays the
+// rest of the session as plain bytes.
+//
+// If rewrite changes the pixel format, a SetPixelFormat message is sent to
+// the server so that the pixel data it sends matches what the client was
+// told. Only the None and VNC authentication security types can be relayed.
+func ProxyHandshake(client, server io.ReadWriter, rewrite func(*ServerInit)) error {
+	// Protocol version: the client replies with the version to use.
+	if _, err := relay(client, server, 12); err != nil {
+		return fmt.Errorf("proxy: failed to relay server version: %w", err)
+	}
+	version, err := relay(server, client, 12)
+	if err != nil {
+		return fmt.Errorf("proxy: failed to relay client version: %w", err)
+	}
+	rfb33 := string(version) == "RFB 003.003\n"
+	rfb38 := !rfb33 && string(version) >= "RFB 003.008\n"
+
+	if err := relaySecurity(client, server, rfb33, rfb38); err != nil {
+		return err
+	}
+
+	// ClientInit: the shared flag.
+	if _, err := relay(server, client, 1); err != nil {
+		return fmt.Errorf("proxy: failed to relay client init: %w", err)
+	}
+
+	si, err := ReadServerInit(server)
+	if err != nil {
+		return fmt.Errorf("proxy: %w", err)
+	}
+	upstreamPF := si.PixelFormat
+	if rewrite != nil {
+		rewrite(si)
+	}
+	if err := si.Write(client); err != nil {
+		return fmt.Errorf("proxy: failed to write server init: %w", err)
+	}
+
+	if si.PixelFormat != upstreamPF {
+		var buf bytes.Buffer
+		buf.Write([]byte{byte(ClientSetPixelFormat), 0, 0, 0})
+		binary.Write(&buf, binary.BigEndian, si.PixelFormat)
+		if _, err := server.Write(buf.Bytes()); err != nil {
+			return fmt.Errorf("proxy: failed to set upstream pixel format: %w", err)
+		}
+	}
+	return nil
+}
+
+// relaySecurity relays the security negotiation and authentication.
+func relaySecurity(client, server io.ReadWriter, rfb33, rfb38 bool) error {
+	var secType SecurityType
+	if rfb33 {
+		// The server decides and sends the type as a 32-bit value.
+		b, err := relay(client, server, 4)
+		if err != nil {
+			return fmt.Errorf("proxy: failed to relay security type: %w", err)
+		}
+		secType = SecurityType(binary.BigEndian.Uint32(b))
+	} else {
+		b, err := relay(client, server, 1)
+		if err != nil {
+			return fmt.Errorf("proxy: failed to relay number of security types: %w", err)
+		}
+		if b[0] == 0 {
+			secType = SecTypeInvalid
+		} else {
+			if _, err := relay(client, server, int(b[0])); err != nil {
+				return fmt.Errorf("proxy: failed to relay security types: %w", err)
+			}
+			choice, err := relay(server, client, 1)
+			if err != nil {
+				return fmt.Errorf("proxy: failed to relay security choice: %w", err)
+			}
+			secType = SecurityType(choice[0])
+		}
+	}
+
+	switch secType {
+	case SecTypeInvalid:
+		// The server refused the connection and sends a reason.
+		reason, _ := relayReason(client, server)
+		return fmt.Errorf("proxy: server refused connection: %s", reason)
+	case SecTypeNone:
+		// Only RFB 3.8 sends a security result for None.
+		if !rfb38 {
+			return nil
+		}
+	case SecTypeVNCAuth:
+		if _, err := relay(client, server, 16); err != nil {
+			return fmt.Errorf("proxy: failed to relay vnc auth challenge: %w", err)
+		}
+		if _, err := relay(server, client, 16); err != nil {
+			return fmt.Errorf("proxy: failed to relay vnc auth response: %w", err)
+		}
+	default:
+		return fmt.Errorf("proxy: cannot relay security type %s", secType)
+	}
+
+	result, err := relay(client, server, 4)
+	if err != nil {
+		return fmt.Errorf("proxy: failed to relay security result: %w", err)
+	}
+	if binary.BigEndian.Uint32(result) != 0 {
+		var reason string
+		if rfb38 {
+			reason, _ = relayReason(client, server)
+		}
+		return fmt.Errorf("proxy: authentication failed: %s", reason)
+	}
+	return nil
+}
+
+// relay copies n bytes from src to dst and returns them.
+func relay(dst io.Writer, src io.Reader, n int) ([]byte, error) {
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(src, buf); err != nil {
+		return nil, err
+	}
+	if _, err := dst.Write(buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// relayReason relays a length-prefixed failure reason string.
+func relayReason(dst io.Writer, src io.Reader) (string, error) {
+	b, err := relay(dst, src, 4)
+	if err != nil {
+		return "", err
+	}
+	n := binary.BigEndian.Uint32(b)
+	if n > 1<<16 {
+		return "", errors.New("proxy: failure reason too long")
+	}
+	reason, err := relay(dst, src, int(n))
+	return string(reason), err
+}
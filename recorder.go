@@ -0,0 +1,375 @@
+package avacadovnc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// RecordFormat selects what a Recorder writes.
+type RecordFormat int
+
+const (
+	// RecordFBS writes the raw server stream to an FBS file, which can be
+	// replayed with NewFbsReader.
+	RecordFBS RecordFormat = iota
+	// RecordPNG writes each frame as a numbered PNG file in a directory
+	// with a PNGSequenceSink.
+	RecordPNG
+	// RecordVideo passes each frame to a video encoder, such as the ffmpeg
+	// based encoders.VideoEncoder.
+	RecordVideo
+)
+
+// RecorderOptions configures a Recorder.
+type RecorderOptions struct {
+	// Format selects the sink. The default is RecordFBS.
+	Format RecordFormat
+	// Path is the FBS file or the directory for PNG frames. A video
+	// encoder is given its output file when it is created.
+	Path string
+	// VideoEncoder encodes frames when Format is RecordVideo. The Recorder
+	// closes it when recording ends.
+	VideoEncoder FrameSink
+	// FrameInterval is the minimum time between frames written to PNG or
+	// video sinks. Zero writes a frame after every update.
+	FrameInterval time.Duration
+	// FPS, if positive, writes video at a constant frame rate instead: the
+	// canvas is written FPS times a second whether or not the server sent
+	// updates, repeating the last frame while the screen is idle, so the
+	// video's timeline matches the session's. It should match the frame
+	// rate of the VideoEncoder, and replaces FrameInterval for video.
+	// Frames are written with WriteFrameBlocking if the VideoEncoder is a
+	// BlockingFrameSink, so none are dropped.
+	FPS int
+	// SecurityHandlers are offered to the server. The default is SecurityNone.
+	SecurityHandlers []SecurityHandler
+	// Encodings are requested from the server. The default is ZRLE,
+	// Hextile, Zlib, RRE, CopyRect and Raw, plus the desktop size, desktop
+	// name and LastRect pseudo-encodings.
+	Encodings []Encoding
+}
+
+// defaultRecorderEncodings are requested when RecorderOptions.Encodings is
+// empty.
+var defaultRecorderEncodings = []EncodingType{
+	EncZRLE, EncHextile, EncZlib, EncRRE, EncCopyRect, EncRaw,
+	EncDesktopSize, EncDesktopName, EncLastRect,
+}
+
+// Recorder connects to a VNC server and records the session until stopped.
+type Recorder struct {
+	addr string
+	opts RecorderOptions
+
+	mu     sync.Mutex
+	conn   *ClientConn
+	fbs    *FbsConnection // Set for FBS recordings
+	sink   FrameSink      // Set for PNG and video recordings
+	done   chan struct{}
+	err    error
+	frames int
+}
+
+// NewRecorder returns a Recorder for the server at addr. Nothing happens until
+// Start is called.
+func NewRecorder(addr string, opts RecorderOptions) *Recorder {
+	return &Recorder{addr: addr, opts: opts}
+}
+
+// Start dials the server, performs the handshake and starts recording in the
+// background. Recording ends when Stop is called, ctx is done or the server
+// closes the connection.
+func (r *Recorder) Start(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.done != nil {
+		return errors.New("recorder: already started")
+	}
+	var sink FrameSink
+	switch {
+	case r.opts.Format == RecordVideo:
+		if r.opts.VideoEncoder == nil {
+			return errors.New("recorder: video format requires a VideoEncoder")
+		}
+		sink = r.opts.VideoEncoder
+	case r.opts.Path == "":
+		return errors.New("recorder: path cannot be empty")
+	case r.opts.Format == RecordPNG:
+		if err := os.MkdirAll(r.opts.Path, 0o755); err != nil {
+			return fmt.Errorf("recorder: failed to create frame directory: %w", err)
+		}
+		sink = &PNGSequenceSink{Dir: r.opts.Path}
+	}
+
+	var d net.Dialer
+	nc, err := d.DialContext(ctx, "tcp", r.addr)
+	if err != nil {
+		return fmt.Errorf("recorder: failed to dial %s: %w", r.addr, err)
+	}
+
+	var fbs *FbsConnection
+	if r.opts.Format == RecordFBS {
+		f, err := os.Create(r.opts.Path)
+		if err != nil {
+			nc.Close()
+			return fmt.Errorf("recorder: failed to create fbs file: %w", err)
+		}
+		// Recording is switched on once the header has been written, so
+		// the handshake itself is not recorded.
+		fbs = &FbsConnection{Conn: nc, file: f}
+		nc = fbs
+	}
+
+	msgCh := make(chan ServerMessage, 16)
+	cfg := &ClientConfig{
+		SecurityHandlers: r.opts.SecurityHandlers,
+		Encodings:        r.opts.Encodings,
+		ServerMessageCh:  msgCh,
+		Messages: []ServerMessage{
+			&FramebufferUpdateMessage{},
+			&SetColorMapEntriesMessage{},
+			&ServerBellMessage{},
+			&ServerCutTextMessage{},
+		},
+		AutoRequest: AutoRequestContinuous,
+	}
+	if len(cfg.SecurityHandlers) == 0 {
+		cfg.SecurityHandlers = []SecurityHandler{&SecurityNone{}}
+	}
+	if len(cfg.Encodings) == 0 {
+		for _, e := range defaultRecorderEncodings {
+			cfg.Encodings = append(cfg.Encodings, newEncoding(e))
+		}
+	}
+	cfg.Handlers = []Handler{
+		&DefaultClientVersionHandler{},
+		&DefaultClientSecurityHandler{},
+		&DefaultClientClientInitHandler{},
+		&DefaultClientServerInitHandler{},
+		&recorderSetupHandler{fbs: fbs, withCanvas: r.opts.Format != RecordFBS},
+		&DefaultClientMessageHandler{},
+	}
+
+	conn, err := Connect(ctx, nc, cfg)
+	if err != nil {
+		if fbs != nil {
+			fbs.file.Close()
+		}
+		return fmt.Errorf("recorder: %w", err)
+	}
+	r.conn = conn
+	r.fbs = fbs
+	r.sink = sink
+	r.done = make(chan struct{})
+
+	go r.run(ctx, fbs, msgCh)
+	return nil
+}
+
+// Stop ends the recording, closes the connection and finishes the sink.
+func (r *Recorder) Stop() error {
+	r.mu.Lock()
+	conn, done := r.conn, r.done
+	r.mu.Unlock()
+	if conn == nil {
+		return errors.New("recorder: not started")
+	}
+	conn.Close()
+	<-done
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+// Pause stops writing the session to the FBS file while the session itself
+// continues. It only applies to RecordFBS recordings, and is refused if a
+// stateful encoding such as Zlib or ZRLE has been negotiated, since its data
+// could not be decoded after the gap; choose stateless Encodings in
+// RecorderOptions to be able to pause.
+func (r *Recorder) Pause() error {
+	r.mu.Lock()
+	conn, fbs := r.conn, r.fbs
+	r.mu.Unlock()
+	if conn == nil {
+		return errors.New("recorder: not started")
+	}
+	if fbs == nil {
+		return errors.New("recorder: only fbs recordings can be paused")
+	}
+	conn.encMu.Lock()
+	defer conn.encMu.Unlock()
+	for _, e := range conn.advertised {
+		if e.Stateful() {
+			return fmt.Errorf("recorder: cannot pause a recording using the stateful %s encoding", e)
+		}
+	}
+	fbs.Pause()
+	return nil
+}
+
+// Resume restarts writing to the FBS file after Pause. The file gets a gap
+// marker, see ErrFbsGap, and the server is asked for a full framebuffer
+// update so that playback starts again from a complete frame.
+func (r *Recorder) Resume() error {
+	r.mu.Lock()
+	conn, fbs := r.conn, r.fbs
+	r.mu.Unlock()
+	if conn == nil {
+		return errors.New("recorder: not started")
+	}
+	if fbs == nil {
+		return errors.New("recorder: only fbs recordings can be paused")
+	}
+	fbs.Resume()
+	return conn.sendUpdateRequest(false)
+}
+
+// Frames returns the number of frames passed to the PNG or video sink. A
+// PNG sink skips frames that repeat the previous one.
+func (r *Recorder) Frames() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.frames
+}
+
+// run writes frames until the connection closes, then finishes the sink.
+func (r *Recorder) run(ctx context.Context, fbs *FbsConnection, msgCh <-chan ServerMessage) {
+	defer close(r.done)
+	closed := make(chan struct{})
+	go func() {
+		r.conn.Wait()
+		close(closed)
+	}()
+
+	// At a constant frame rate, frames are written on a ticker instead of
+	// after updates, which only change the canvas.
+	var tick <-chan time.Time
+	var start time.Time
+	var ticks int
+	constantRate := r.opts.Format == RecordVideo && r.opts.FPS > 0
+	if constantRate {
+		ticker := time.NewTicker(time.Second / time.Duration(r.opts.FPS))
+		defer ticker.Stop()
+		tick, start = ticker.C, time.Now()
+	}
+
+	var last time.Time
+	ctxDone := ctx.Done()
+	for {
+		select {
+		case now := <-tick:
+			// The ticker drops ticks when the encoder is slow, so the frames
+			// due are counted from the start and any missed are made up.
+			due := int(now.Sub(start) * time.Duration(r.opts.FPS) / time.Second)
+			for ; ticks < due; ticks++ {
+				if err := r.writeFrameBlocking(r.conn.Canvas.Image()); err != nil {
+					r.setErr(err)
+					r.conn.Close()
+					break
+				}
+			}
+		case msg := <-msgCh:
+			if _, ok := msg.(*FramebufferUpdateMessage); !ok || r.opts.Format == RecordFBS || constantRate {
+				continue
+			}
+			if r.opts.FrameInterval > 0 && time.Since(last) < r.opts.FrameInterval {
+				continue
+			}
+			last = time.Now()
+			if err := r.writeFrame(r.conn.Canvas.Image()); err != nil {
+				r.setErr(err)
+				r.conn.Close()
+			}
+		case <-ctxDone:
+			ctxDone = nil
+			r.conn.Close()
+		case <-closed:
+			r.finish(fbs)
+			return
+		}
+	}
+}
+
+// writeFrame writes one frame to the PNG or video sink.
+func (r *Recorder) writeFrame(img image.Image) error {
+	r.mu.Lock()
+	r.frames++
+	r.mu.Unlock()
+	if err := r.sink.WriteFrame(img); err != nil {
+		return fmt.Errorf("recorder: failed to write frame: %w", err)
+	}
+	return nil
+}
+
+// writeFrameBlocking writes one frame like writeFrame, but waits for a
+// BlockingFrameSink to accept it instead of letting it drop the frame, so
+// the frames made up after missed ticks all reach the video.
+func (r *Recorder) writeFrameBlocking(img image.Image) error {
+	bs, ok := r.sink.(BlockingFrameSink)
+	if !ok {
+		return r.writeFrame(img)
+	}
+	r.mu.Lock()
+	r.frames++
+	r.mu.Unlock()
+	if err := bs.WriteFrameBlocking(img); err != nil {
+		return fmt.Errorf("recorder: failed to write frame: %w", err)
+	}
+	return nil
+}
+
+// finish closes the sink once the connection has closed.
+func (r *Recorder) finish(fbs *FbsConnection) {
+	switch r.opts.Format {
+	case RecordFBS:
+		if err := fbs.file.Close(); err != nil && !errors.Is(err, os.ErrClosed) {
+			r.setErr(fmt.Errorf("recorder: failed to close fbs file: %w", err))
+		}
+	default:
+		if err := r.sink.Close(); err != nil {
+			r.setErr(fmt.Errorf("recorder: failed to close sink: %w", err))
+		}
+	}
+}
+
+// setErr records the first error of the recording.
+func (r *Recorder) setErr(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err == nil {
+		r.err = err
+	}
+}
+
+// recorderSetupHandler runs after ServerInit and before the message loops
+// start. It attaches a canvas and, for FBS recordings, writes the header and
+// switches recording on.
+type recorderSetupHandler struct {
+	fbs        *FbsConnection
+	withCanvas bool
+}
+
+// Handle prepares the connection for recording.
+func (h *recorderSetupHandler) Handle(c Conn) error {
+	clientConn, ok := c.(*ClientConn)
+	if !ok {
+		return errors.New("recorder: handler expected a *ClientConn")
+	}
+	if h.withCanvas {
+		clientConn.Canvas = NewVncCanvas(int(c.Width()), int(c.Height()), c.PixelFormat())
+		clientConn.Canvas.SetColorMap(c.ColorMap())
+	}
+	if h.fbs != nil {
+		if err := h.fbs.StartRecording(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
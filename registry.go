@@ -0,0 +1,169 @@
+package avacadovnc
+
+import "fmt"
+
+// registeredEncoding describes an encoding implemented by this package.
+type registeredEncoding struct {
+	typ  EncodingType
+	name string
+	// stateful is set for encodings whose decoders carry state, such as
+	// zlib streams, from one rectangle to the next.
+	stateful bool
+	// pseudo is set for pseudo-encodings, whose rectangles carry no pixels.
+	pseudo bool
+	new    func() Encoding
+}
+
+// encodingRegistry lists every encoding and pseudo-encoding this package can
+// decode, in the order they are reported by SupportedEncodings. New encodings
+// must be added here.
+var encodingRegistry = []registeredEncoding{
+	{EncRaw, "Raw", false, false, func() Encoding { return &RawEncoding{} }},
+	{EncCopyRect, "CopyRect", false, false, func() Encoding { return &CopyRectEncoding{} }},
+	{EncRRE, "RRE", false, false, func() Encoding { return &RREEncoding{} }},
+	{EncCoRRE, "CoRRE", false, false, func() Encoding { return &CoRREEncoding{} }},
+	{EncHextile, "Hextile", false, false, func() Encoding { return &HextileEncoding{} }},
+	{EncZlib, "Zlib", true, false, func() Encoding { return &ZlibEncoding{} }},
+	{EncTight, "Tight", true, false, func() Encoding { return &TightEncoding{} }},
+	{EncZlibHex, "ZlibHex", true, false, func() Encoding { return &ZlibHexEncoding{} }},
+	{EncTRLE, "TRLE", false, false, func() Encoding { return &TRLEEncoding{} }},
+	{EncZRLE, "ZRLE", true, false, func() Encoding { return &ZRLEEncoding{} }},
+	{EncTightPNG, "TightPNG", false, false, func() Encoding { return &TightPNGEncoding{} }},
+	{EncAtenHermon, "AtenHermon", false, false, func() Encoding { return &AtenHermonEncoding{} }},
+	{EncDesktopSize, "DesktopSize", false, true, func() Encoding { return &DesktopSizeEncoding{} }},
+	{EncDesktopName, "DesktopName", false, true, func() Encoding { return &DesktopNameEncoding{} }},
+	{EncExtendedDesktopSize, "ExtendedDesktopSize", false, true, func() Encoding { return &ExtendedDesktopSizeEncoding{} }},
+	{EncCursor, "Cursor", false, true, func() Encoding { return &CursorEncoding{} }},
+	{EncXCursor, "XCursor", false, true, func() Encoding { return &XCursorEncoding{} }},
+	{EncPointerPos, "PointerPos", false, true, func() Encoding { return &PointerPosEncoding{} }},
+	{EncLastRect, "LastRect", false, true, func() Encoding { return &LastRectEncoding{} }},
+	{EncFence, "Fence", false, true, func() Encoding { return &FenceEncoding{} }},
+	{EncContinuousUpdates, "ContinuousUpdates", false, true, func() Encoding { return &ContinuousUpdatesEncoding{} }},
+	{EncQEMUExtendedKeyEvent, "QEMUExtendedKeyEvent", false, true, func() Encoding { return &QEMUExtendedKeyEventEncoding{} }},
+	{EncQEMULedState, "QEMULedState", false, true, func() Encoding { return &QEMULedStateEncoding{} }},
+	{EncQEMUPointerMotionChange, "QEMUPointerMotionChange", false, true, func() Encoding { return &QEMUPointerMotionChangeEncoding{Absolute: true} }},
+	{EncVMwareCursor, "VMwareCursor", false, true, func() Encoding { return &VMwareCursorEncoding{} }},
+	{EncVMwareCursorState, "VMwareCursorState", false, true, func() Encoding { return &VMwareCursorStateEncoding{} }},
+	{EncVMwareCursorPosition, "VMwareCursorPosition", false, true, func() Encoding { return &VMwareCursorPositionEncoding{} }},
+	{EncVMwareLEDState, "VMwareLEDState", false, true, func() Encoding { return &VMwareLEDStateEncoding{} }},
+}
+
+// encodingNames names encoding types that have no decoder of their own.
+var encodingNames = map[EncodingType]string{
+	EncJPEGQualityLevel0: "JPEGQualityLevel0",
+	EncJPEGQualityLevel9: "JPEGQualityLevel9",
+}
+
+// registeredSecurityType describes a security type implemented by this package.
+type registeredSecurityType struct {
+	typ  SecurityType
+	name string
+}
+
+// securityRegistry lists every security type this package has a handler for,
+// in the order they are reported by SupportedSecurityTypes. New security
+// handlers must be added here.
+var securityRegistry = []registeredSecurityType{
+	{SecTypeNone, "None"},
+	{SecTypeVNCAuth, "VNCAuth"},
+	{SecTypeTight, "Tight"},
+	{SecTypeVeNCrypt, "VeNCrypt"},
+	{SecTypeAtenHermon, "AtenHermon"},
+	{SecTypeARD, "ARD"},
+}
+
+// securityNames names security types that have no handler of their own.
+var securityNames = map[SecurityType]string{
+	SecTypeInvalid:      "Invalid",
+	SecTypeAtenUltraVNC: "AtenUltraVNC",
+	SecTypeAtenTLS:      "AtenTLS",
+	SecTypeAtenSASL:     "AtenSASL",
+	SecTypeAtenXVP:      "AtenXVP",
+}
+
+// SupportedEncodings returns the encodings and pseudo-encodings this package
+// can decode. Use EncodingType.String for a human readable name.
+func SupportedEncodings() []EncodingType {
+	types := make([]EncodingType, len(encodingRegistry))
+	for i, e := range encodingRegistry {
+		types[i] = e.typ
+	}
+	return types
+}
+
+// SupportedSecurityTypes returns the security types this package has handlers
+// for. Use SecurityType.String for a human readable name.
+func SupportedSecurityTypes() []SecurityType {
+	types := make([]SecurityType, len(securityRegistry))
+	for i, s := range securityRegistry {
+		types[i] = s.typ
+	}
+	return types
+}
+
+// lookupEncoding returns the registry entry for e, or nil if this package
+// does not implement it.
+func lookupEncoding(e EncodingType) *registeredEncoding {
+	for i := range encodingRegistry {
+		if encodingRegistry[i].typ == e {
+			return &encodingRegistry[i]
+		}
+	}
+	return nil
+}
+
+// newEncoding returns a new decoder for e, or nil if this package does not
+// implement it.
+func newEncoding(e EncodingType) Encoding {
+	if r := lookupEncoding(e); r != nil {
+		return r.new()
+	}
+	return nil
+}
+
+// Stateful reports whether decoders of the encoding keep state across
+// rectangles, so that rectangles must be decoded in order and the decoder
+// must not be reset while the server's stream goes on. It is true for Zlib,
+// ZlibHex, Tight and ZRLE, and false for unknown encodings.
+func (e EncodingType) Stateful() bool {
+	if r := lookupEncoding(e); r != nil {
+		return r.stateful
+	}
+	return false
+}
+
+// IsPseudo reports whether e is a pseudo-encoding, whose rectangles carry
+// something other than pixels, such as a cursor or a desktop size. That
+// includes the VMware pseudo-encodings, which have positive numbers. Unknown
+// encodings are taken to be pseudo-encodings if they are negative, as RFB
+// numbers them.
+func (e EncodingType) IsPseudo() bool {
+	if r := lookupEncoding(e); r != nil {
+		return r.pseudo
+	}
+	return e < 0
+}
+
+// String returns the name of the encoding type.
+func (e EncodingType) String() string {
+	if r := lookupEncoding(e); r != nil {
+		return r.name
+	}
+	if name, ok := encodingNames[e]; ok {
+		return name
+	}
+	return fmt.Sprintf("EncodingType(%d)", int32(e))
+}
+
+// String returns the name of the security type.
+func (s SecurityType) String() string {
+	for _, r := range securityRegistry {
+		if r.typ == s {
+			return r.name
+		}
+	}
+	if name, ok := securityNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("SecurityType(%d)", uint8(s))
+}
@@ -0,0 +1,162 @@
+package avacadovnc
+
+import (
+	"crypto/aes"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+)
+
+// ardCredentialLen is the size of each of the username and password fields
+// in the encrypted credentials block.
+const ardCredentialLen = 64
+
+// SecurityARD implements Apple Remote Desktop authentication (security type
+// 30), used by macOS Screen Sharing. The client performs a Diffie-Hellman
+// exchange with the server's parameters and sends its username and password
+// encrypted with AES-128-ECB under the MD5 digest of the shared secret.
+type SecurityARD struct {
+	Username []byte
+	Password []byte
+}
+
+// Type returns the security type identifier.
+func (s *SecurityARD) Type() SecurityType {
+	return SecTypeARD
+}
+
+// Authenticate performs the ARD handshake.
+func (s *SecurityARD) Authenticate(c Conn) error {
+	// This security handler is client-side only in this implementation.
+	if !c.IsClient() {
+		return errors.New("ard: server-side authentication not implemented")
+	}
+
+	dh, err := readARDParams(c)
+	if err != nil {
+		return err
+	}
+	if err := dh.generateKey(rand.Reader); err != nil {
+		return err
+	}
+	ciphertext, err := s.encryptCredentials(dh.sharedSecret(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	if _, err := c.Write(ciphertext); err != nil {
+		return fmt.Errorf("ard: failed to write credentials: %w", err)
+	}
+	if _, err := c.Write(dh.publicKey()); err != nil {
+		return fmt.Errorf("ard: failed to write public key: %w", err)
+	}
+	if err := c.Flush(); err != nil {
+		return err
+	}
+
+	return readSecurityResult(c, "ard")
+}
+
+// encryptCredentials builds the 128-byte credentials block (null-terminated
+// username and password, each in a 64-byte field padded with random bytes)
+// and encrypts it with AES-128-ECB keyed by MD5(secret).
+func (s *SecurityARD) encryptCredentials(secret []byte, rnd io.Reader) ([]byte, error) {
+	if len(s.Username) >= ardCredentialLen || len(s.Password) >= ardCredentialLen {
+		return nil, fmt.Errorf("ard: username and password must be shorter than %d bytes", ardCredentialLen)
+	}
+
+	plaintext := make([]byte, 2*ardCredentialLen)
+	if _, err := io.ReadFull(rnd, plaintext); err != nil {
+		return nil, fmt.Errorf("ard: failed to generate padding: %w", err)
+	}
+	copy(plaintext, s.Username)
+	plaintext[len(s.Username)] = 0
+	copy(plaintext[ardCredentialLen:], s.Password)
+	plaintext[ardCredentialLen+len(s.Password)] = 0
+
+	key := md5.Sum(secret)
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, fmt.Errorf("ard: failed to create aes cipher: %w", err)
+	}
+	ciphertext := make([]byte, len(plaintext))
+	for i := 0; i < len(plaintext); i += aes.BlockSize {
+		block.Encrypt(ciphertext[i:i+aes.BlockSize], plaintext[i:i+aes.BlockSize])
+	}
+	return ciphertext, nil
+}
+
+// ardDH holds the Diffie-Hellman parameters announced by an Apple Remote
+// Desktop (macOS Screen Sharing) server, and the client's key pair.
+type ardDH struct {
+	generator *big.Int
+	prime     *big.Int
+	serverPub *big.Int
+	keyLen    int
+
+	private *big.Int
+	public  *big.Int
+}
+
+// readARDParams reads the server's DH parameters: a 16-bit generator, a
+// 16-bit key length, then the prime modulus and the server public key, each
+// key-length bytes long.
+func readARDParams(r io.Reader) (*ardDH, error) {
+	var hdr struct {
+		Generator uint16
+		KeyLen    uint16
+	}
+	if err := binary.Read(r, binary.BigEndian, &hdr); err != nil {
+		return nil, fmt.Errorf("ard: failed to read dh header: %w", err)
+	}
+	if hdr.KeyLen == 0 {
+		return nil, errors.New("ard: server sent zero key length")
+	}
+	buf := make([]byte, 2*int(hdr.KeyLen))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, fmt.Errorf("ard: failed to read dh parameters: %w", err)
+	}
+	return &ardDH{
+		generator: new(big.Int).SetUint64(uint64(hdr.Generator)),
+		prime:     new(big.Int).SetBytes(buf[:hdr.KeyLen]),
+		serverPub: new(big.Int).SetBytes(buf[hdr.KeyLen:]),
+		keyLen:    int(hdr.KeyLen),
+	}, nil
+}
+
+// generateKey picks a random private key and derives the public key from it.
+func (dh *ardDH) generateKey(rnd io.Reader) error {
+	if dh.prime.Cmp(big.NewInt(3)) < 0 {
+		return errors.New("ard: dh prime is too small")
+	}
+	// A server public key of 0, 1 or prime-1 would make the shared secret,
+	// and so the AES key, predictable.
+	pMinus1 := new(big.Int).Sub(dh.prime, big.NewInt(1))
+	if dh.serverPub.Cmp(big.NewInt(1)) <= 0 || dh.serverPub.Cmp(pMinus1) >= 0 {
+		return errors.New("ard: server sent an invalid dh public key")
+	}
+	// Private key in [1, prime-2].
+	max := new(big.Int).Sub(dh.prime, big.NewInt(2))
+	priv, err := rand.Int(rnd, max)
+	if err != nil {
+		return fmt.Errorf("ard: failed to generate private key: %w", err)
+	}
+	dh.private = priv.Add(priv, big.NewInt(1))
+	dh.public = new(big.Int).Exp(dh.generator, dh.private, dh.prime)
+	return nil
+}
+
+// publicKey returns the client public key padded to the key length.
+func (dh *ardDH) publicKey() []byte {
+	return dh.public.FillBytes(make([]byte, dh.keyLen))
+}
+
+// sharedSecret returns the shared secret padded to the key length.
+func (dh *ardDH) sharedSecret() []byte {
+	secret := new(big.Int).Exp(dh.serverPub, dh.private, dh.prime)
+	return secret.FillBytes(make([]byte, dh.keyLen))
+}
@@ -1,40 +1,34 @@
-package avacadovnc
-
-import (
-	"encoding/binary"
-	"errors"
-)
-
-// SecurityNone implements the "None" security type (type 1), which involves
-// no authentication.
-type SecurityNone struct{}
-
-// Type returns the security type identifier.
-func (s *SecurityNone) Type() SecurityType {
-	return SecTypeNone
-}
-
-// Authenticate performs the security handshake for the "None" type.
-// For the client, this means reading the security result from the server.
-// For the server, it means sending a success result to the client.
-func (s *SecurityNone) Authenticate(c Conn) error {
-	// The logic differs slightly if this is a client or server connection.
-	// A simple way to check is if the config is a ClientConfig.
-	if _, ok := c.Config().(*ClientConfig); ok {
-		// Client-side implementation
-		var securityResult uint32
-		if err := binary.Read(c, binary.BigEndian, &securityResult); err != nil {
-			return err
-		}
-		if securityResult != 0 {
-			return errors.New("security-none: authentication failed")
-		}
-		return nil
-	}
-
-	// Server-side implementation
-	if err := binary.Write(c, binary.BigEndian, uint32(0)); err != nil {
-		return err
-	}
-	return c.Flush()
-}
+package avacadovnc
+
+import "encoding/binary"
+
+// SecurityNone implements the "None" security type (type 1), which involves
+// no authentication.
+type SecurityNone struct{}
+
+// Type returns the security type identifier.
+func (s *SecurityNone) Type() SecurityType {
+	return SecTypeNone
+}
+
+// Authenticate performs the security handshake for the "None" type.
+// For the client, this means reading the security result from the server,
+// which the server only sends for this type once RFB 3.8 has been
+// negotiated; under 3.3 and 3.7 there is nothing to read.
+// For the server, it means sending a success result to the client.
+func (s *SecurityNone) Authenticate(c Conn) error {
+	// The logic differs slightly if this is a client or server connection.
+	if c.IsClient() {
+		// Client-side implementation
+		if !speaksRFB38(c) {
+			return nil
+		}
+		return readSecurityResult(c, "security-none")
+	}
+
+	// Server-side implementation
+	if err := binary.Write(c, binary.BigEndian, uint32(0)); err != nil {
+		return err
+	}
+	return c.Flush()
+}
@@ -1,27 +1,126 @@
-package avacadovnc
-
-import "encoding/binary"
-
-func readTightTunnels(c Conn) (uint32, error) {
-	var n uint32
-	if err := binary.Read(c, binary.BigEndian, &n); err != nil {
-		return 0, err
-	}
-	return n, nil
-}
-
-func readTightCaps(c Conn) (int32, []byte, []byte, error) {
-	var code int32
-	var vendor [4]byte
-	var signature [8]byte
-	if err := binary.Read(c, binary.BigEndian, &code); err != nil {
-		return 0, nil, nil, err
-	}
-	if err := binary.Read(c, binary.BigEndian, &vendor); err != nil {
-		return 0, nil, nil, err
-	}
-	if err := binary.Read(c, binary.BigEndian, &signature); err != nil {
-		return 0, nil, nil, err
-	}
-	return code, vendor[:], signature[:], nil
-}
+package avacadovnc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Capability codes used by the Tight security type.
+const (
+	tightNoTunnel    int32 = 0
+	tightAuthNone    int32 = 1
+	tightAuthVNCAuth int32 = 2
+)
+
+// SecurityTight implements the Tight security type (type 16) used by
+// TightVNC servers. It declines tunneling, picks VNC Auth or no
+// authentication from the server's capability list and then runs the
+// handshake of SecurityVNC or SecurityNone. VNC Auth is preferred when a
+// Password is set.
+type SecurityTight struct {
+	Password []byte
+}
+
+// Type returns the security type identifier.
+func (s *SecurityTight) Type() SecurityType {
+	return SecTypeTight
+}
+
+// Authenticate performs the Tight capability negotiation and the chosen
+// authentication.
+func (s *SecurityTight) Authenticate(c Conn) error {
+	// This security handler is client-side only in this implementation.
+	if !c.IsClient() {
+		return errors.New("tight-security: server-side authentication not implemented")
+	}
+
+	tunnels, err := readTightTunnels(c)
+	if err != nil {
+		return fmt.Errorf("tight-security: failed to read tunnel count: %w", err)
+	}
+	if tunnels > 0 {
+		if err := s.declineTunneling(c, tunnels); err != nil {
+			return err
+		}
+	}
+
+	authTypes, err := readTightTunnels(c)
+	if err != nil {
+		return fmt.Errorf("tight-security: failed to read auth count: %w", err)
+	}
+	if authTypes == 0 {
+		// No authentication; the server goes on with the security result.
+		return (&SecurityNone{}).Authenticate(c)
+	}
+	offered := make(map[int32]bool, authTypes)
+	for i := uint32(0); i < authTypes; i++ {
+		code, _, _, err := readTightCaps(c)
+		if err != nil {
+			return fmt.Errorf("tight-security: failed to read auth capability: %w", err)
+		}
+		offered[code] = true
+	}
+
+	var handler SecurityHandler
+	var code int32
+	switch {
+	case offered[tightAuthVNCAuth] && (len(s.Password) > 0 || !offered[tightAuthNone]):
+		handler, code = &SecurityVNC{Password: s.Password}, tightAuthVNCAuth
+	case offered[tightAuthNone]:
+		handler, code = &SecurityNone{}, tightAuthNone
+	default:
+		return fmt.Errorf("tight-security: %w among the auth types the server offers", ErrNoCommonSecurity)
+	}
+	if err := binary.Write(c, binary.BigEndian, code); err != nil {
+		return fmt.Errorf("tight-security: failed to write auth type: %w", err)
+	}
+	if err := c.Flush(); err != nil {
+		return err
+	}
+	return handler.Authenticate(c)
+}
+
+// declineTunneling reads the server's tunnel capabilities and selects
+// NOTUNNEL, which the server must offer.
+func (s *SecurityTight) declineTunneling(c Conn, tunnels uint32) error {
+	found := false
+	for i := uint32(0); i < tunnels; i++ {
+		code, _, _, err := readTightCaps(c)
+		if err != nil {
+			return fmt.Errorf("tight-security: failed to read tunnel capability: %w", err)
+		}
+		found = found || code == tightNoTunnel
+	}
+	if !found {
+		return errors.New("tight-security: server requires tunneling")
+	}
+	if err := binary.Write(c, binary.BigEndian, tightNoTunnel); err != nil {
+		return fmt.Errorf("tight-security: failed to write tunnel type: %w", err)
+	}
+	return c.Flush()
+}
+
+func readTightTunnels(c Conn) (uint32, error) {
+	var n uint32
+	if err := binary.Read(c, binary.BigEndian, &n); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+func readTightCaps(c Conn) (int32, []byte, []byte, error) {
+	var code int32
+	var vendor [4]byte
+	var signature [8]byte
+	if err := binary.Read(c, binary.BigEndian, &code); err != nil {
+		return 0, nil, nil, err
+	}
+	if err := binary.Read(c, binary.BigEndian, &vendor); err != nil {
+		return 0, nil, nil, err
+	}
+	if err := binary.Read(c, binary.BigEndian, &signature); err != nil {
+		return 0, nil, nil, err
+	}
+	return code, vendor[:], signature[:], nil
+}
@@ -0,0 +1,205 @@
+package avacadovnc
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/bigangryrobot/avacadovnc/logger"
+)
+
+// VeNCryptSubType identifies an authentication scheme within VeNCrypt.
+type VeNCryptSubType uint32
+
+const (
+	VeNCryptPlain     VeNCryptSubType = 256
+	VeNCryptTLSNone   VeNCryptSubType = 257
+	VeNCryptTLSVnc    VeNCryptSubType = 258
+	VeNCryptTLSPlain  VeNCryptSubType = 259
+	VeNCryptX509None  VeNCryptSubType = 260
+	VeNCryptX509Vnc   VeNCryptSubType = 261
+	VeNCryptX509Plain VeNCryptSubType = 262
+)
+
+// SecurityVeNCrypt implements the VeNCrypt security type (type 19). It
+// negotiates VeNCrypt 0.2, picks a sub-type offered by the server, upgrades
+// the connection to TLS unless the sub-type is Plain, and then runs the inner
+// authentication over it: none, VNC Auth with Password, or Plain with
+// Username and Password.
+//
+// The TLS* sub-types are meant to use anonymous Diffie-Hellman, which
+// crypto/tls does not support; they only work with servers that present a
+// certificate, and TLSConfig must then skip or customize verification.
+type SecurityVeNCrypt struct {
+	// TLSConfig configures the TLS client. If nil, certificates are
+	// verified against the system roots, with ServerName taken from the
+	// remote address.
+	TLSConfig *tls.Config
+	Username  []byte
+	Password  []byte
+	// SubTypes lists the acceptable sub-types in order of preference. If
+	// empty, X509 sub-types are preferred over TLS ones, and only inner
+	// schemes for which credentials are set are considered.
+	SubTypes []VeNCryptSubType
+}
+
+// Type returns the security type identifier.
+func (s *SecurityVeNCrypt) Type() SecurityType {
+	return SecTypeVeNCrypt
+}
+
+// Authenticate performs the VeNCrypt handshake.
+func (s *SecurityVeNCrypt) Authenticate(c Conn) error {
+	// This security handler is client-side only in this implementation.
+	if !c.IsClient() {
+		return errors.New("vencrypt: server-side authentication not implemented")
+	}
+	cc, ok := c.(*ClientConn)
+	if !ok {
+		return errors.New("vencrypt: connection cannot be upgraded to tls")
+	}
+
+	var version [2]byte
+	if _, err := io.ReadFull(c, version[:]); err != nil {
+		return fmt.Errorf("vencrypt: failed to read version: %w", err)
+	}
+	if version[0] == 0 && version[1] < 2 {
+		return fmt.Errorf("vencrypt: unsupported server version %d.%d", version[0], version[1])
+	}
+	if _, err := c.Write([]byte{0, 2}); err != nil {
+		return fmt.Errorf("vencrypt: failed to write version: %w", err)
+	}
+	if err := c.Flush(); err != nil {
+		return err
+	}
+	var status uint8
+	if err := binary.Read(c, binary.BigEndian, &status); err != nil {
+		return fmt.Errorf("vencrypt: failed to read version status: %w", err)
+	}
+	if status != 0 {
+		return errors.New("vencrypt: server rejected version 0.2")
+	}
+
+	var count uint8
+	if err := binary.Read(c, binary.BigEndian, &count); err != nil {
+		return fmt.Errorf("vencrypt: failed to read number of sub-types: %w", err)
+	}
+	offered := make([]VeNCryptSubType, count)
+	if err := binary.Read(c, binary.BigEndian, offered); err != nil {
+		return fmt.Errorf("vencrypt: failed to read sub-types: %w", err)
+	}
+	subType, err := s.choose(offered)
+	if err != nil {
+		return err
+	}
+	logger.Debugf("vencrypt: server offered %v, using %d", offered, subType)
+	if err := binary.Write(c, binary.BigEndian, subType); err != nil {
+		return fmt.Errorf("vencrypt: failed to write sub-type: %w", err)
+	}
+	if err := c.Flush(); err != nil {
+		return err
+	}
+	var accepted uint8
+	if err := binary.Read(c, binary.BigEndian, &accepted); err != nil {
+		return fmt.Errorf("vencrypt: failed to read sub-type status: %w", err)
+	}
+	if accepted != 1 {
+		return fmt.Errorf("vencrypt: server rejected sub-type %d", subType)
+	}
+
+	if subType != VeNCryptPlain {
+		if err := s.startTLS(cc); err != nil {
+			return err
+		}
+	}
+
+	switch subType {
+	case VeNCryptTLSVnc, VeNCryptX509Vnc:
+		return (&SecurityVNC{Password: s.Password}).authenticateClient(c)
+	case VeNCryptPlain, VeNCryptTLSPlain, VeNCryptX509Plain:
+		if err := s.writePlain(c); err != nil {
+			return err
+		}
+	}
+	return readSecurityResult(c, "vencrypt")
+}
+
+// choose returns the most preferred sub-type that the server offers.
+func (s *SecurityVeNCrypt) choose(offered []VeNCryptSubType) (VeNCryptSubType, error) {
+	preferred := s.SubTypes
+	if len(preferred) == 0 {
+		for _, t := range []VeNCryptSubType{
+			VeNCryptX509Vnc, VeNCryptX509Plain, VeNCryptX509None,
+			VeNCryptTLSVnc, VeNCryptTLSPlain, VeNCryptTLSNone,
+		} {
+			switch t {
+			case VeNCryptX509Vnc, VeNCryptTLSVnc:
+				if len(s.Password) == 0 {
+					continue
+				}
+			case VeNCryptX509Plain, VeNCryptTLSPlain:
+				if len(s.Username) == 0 {
+					continue
+				}
+			}
+			preferred = append(preferred, t)
+		}
+	}
+	for _, want := range preferred {
+		for _, t := range offered {
+			if t == want {
+				return t, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("vencrypt: no supported sub-type among %v", offered)
+}
+
+// startTLS performs the TLS handshake over the connection's network
+// connection and re-points the connection's buffers at the TLS session.
+func (s *SecurityVeNCrypt) startTLS(c *ClientConn) error {
+	cfg := &tls.Config{}
+	if s.TLSConfig != nil {
+		cfg = s.TLSConfig.Clone()
+	}
+	if cfg.ServerName == "" && !cfg.InsecureSkipVerify {
+		host, _, err := net.SplitHostPort(c.c.RemoteAddr().String())
+		if err != nil {
+			host = c.c.RemoteAddr().String()
+		}
+		cfg.ServerName = host
+	}
+	if c.br.Buffered() > 0 {
+		return errors.New("vencrypt: unexpected data before tls handshake")
+	}
+
+	tlsConn := tls.Client(c.c, cfg)
+	if err := tlsConn.Handshake(); err != nil {
+		return fmt.Errorf("vencrypt: tls handshake failed: %w", err)
+	}
+	state := tlsConn.ConnectionState()
+	auditHandshake(c, HandshakeEvent{Kind: HandshakeTLS, TLSVersion: state.Version, TLSCipherSuite: state.CipherSuite})
+	c.c = tlsConn
+	c.br = bufio.NewReader(tlsConn)
+	c.bw = bufio.NewWriter(tlsConn)
+	return nil
+}
+
+// writePlain sends the credentials of the Plain inner scheme.
+func (s *SecurityVeNCrypt) writePlain(c Conn) error {
+	lengths := [2]uint32{uint32(len(s.Username)), uint32(len(s.Password))}
+	if err := binary.Write(c, binary.BigEndian, lengths); err != nil {
+		return fmt.Errorf("vencrypt: failed to write credentials: %w", err)
+	}
+	if _, err := c.Write(s.Username); err != nil {
+		return fmt.Errorf("vencrypt: failed to write credentials: %w", err)
+	}
+	if _, err := c.Write(s.Password); err != nil {
+		return fmt.Errorf("vencrypt: failed to write credentials: %w", err)
+	}
+	return c.Flush()
+}
@@ -1,69 +1,139 @@
-package avacadovnc
-
-import (
-	"crypto/des"
-	"encoding/binary"
-	"errors"
-	"fmt"
-	"io"
-)
-
-// SecurityVNC implements the VNC Challenge-Handshake Authentication protocol.
-type SecurityVNC struct {
-	Password []byte
-}
-
-// Type returns the security type identifier.
-func (s *SecurityVNC) Type() SecurityType {
-	return SecTypeVNCAuth
-}
-
-// Authenticate performs the VNC Auth handshake.
-func (s *SecurityVNC) Authenticate(c Conn) error {
-	// The logic differs for client and server.
-	if _, ok := c.Config().(*ClientConfig); ok {
-		return s.authenticateClient(c)
-	}
-	return s.authenticateServer(c)
-}
-
-func (s *SecurityVNC) authenticateClient(c Conn) error {
-	var challenge [16]byte
-	if _, err := io.ReadFull(c, challenge[:]); err != nil {
-		return fmt.Errorf("vnc-auth: failed to read challenge: %w", err)
-	}
-
-	// Key is the user password, padded with nulls to 8 bytes.
-	key := make([]byte, 8)
-	copy(key, s.Password)
-
-	cipher, err := des.NewCipher(key)
-	if err != nil {
-		return fmt.Errorf("vnc-auth: failed to create des cipher: %w", err)
-	}
-
-	response := make([]byte, 16)
-	cipher.Encrypt(response[0:8], challenge[0:8])
-	cipher.Encrypt(response[8:16], challenge[8:16])
-
-	if _, err := c.Write(response); err != nil {
-		return fmt.Errorf("vnc-auth: failed to write response: %w", err)
-	}
-	if err := c.Flush(); err != nil {
-		return err
-	}
-
-	var securityResult uint32
-	if err := binary.Read(c, binary.BigEndian, &securityResult); err != nil {
-		return err
-	}
-	if securityResult != 0 {
-		return errors.New("vnc-auth: authentication failed")
-	}
-	return nil
-}
-
-func (s *SecurityVNC) authenticateServer(c Conn) error {
-	// Server-side VNC auth is not implemented in this library.
-	return errors.New("server-side VNC auth is not supported")
-}
+package avacadovnc
+
+import (
+	"crypto/des"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"sync"
+
+	"github.com/bigangryrobot/avacadovnc/logger"
+)
+
+// SecurityVNC implements the VNC Challenge-Handshake Authentication protocol.
+//
+// The password is used as a DES key, so only its first 8 bytes are
+// significant; longer passwords are truncated and a warning is logged once.
+// On the server, Password falls back to ServerConfig.Password when empty.
+type SecurityVNC struct {
+	Password []byte
+
+	truncateWarning sync.Once
+}
+
+// Type returns the security type identifier.
+func (s *SecurityVNC) Type() SecurityType {
+	return SecTypeVNCAuth
+}
+
+// Authenticate performs the VNC Auth handshake.
+func (s *SecurityVNC) Authenticate(c Conn) error {
+	// The logic differs for client and server.
+	if c.IsClient() {
+		return s.authenticateClient(c)
+	}
+	return s.authenticateServer(c)
+}
+
+func (s *SecurityVNC) authenticateClient(c Conn) error {
+	var challenge [16]byte
+	if _, err := io.ReadFull(c, challenge[:]); err != nil {
+		return fmt.Errorf("vnc-auth: failed to read challenge: %w", err)
+	}
+
+	response, err := s.encryptChallenge(s.Password, challenge)
+	if err != nil {
+		return err
+	}
+	if _, err := c.Write(response); err != nil {
+		return fmt.Errorf("vnc-auth: failed to write response: %w", err)
+	}
+	if err := c.Flush(); err != nil {
+		return err
+	}
+
+	return readSecurityResult(c, "vnc-auth")
+}
+
+func (s *SecurityVNC) authenticateServer(c Conn) error {
+	password := s.Password
+	if len(password) == 0 {
+		if cfg, ok := c.Config().(*ServerConfig); ok {
+			password = cfg.Password
+		}
+	}
+	if len(password) == 0 {
+		return errors.New("vnc-auth: no password configured")
+	}
+
+	var challenge [16]byte
+	if _, err := rand.Read(challenge[:]); err != nil {
+		return fmt.Errorf("vnc-auth: failed to generate challenge: %w", err)
+	}
+	if _, err := c.Write(challenge[:]); err != nil {
+		return fmt.Errorf("vnc-auth: failed to write challenge: %w", err)
+	}
+	if err := c.Flush(); err != nil {
+		return err
+	}
+
+	var response [16]byte
+	if _, err := io.ReadFull(c, response[:]); err != nil {
+		return fmt.Errorf("vnc-auth: failed to read response: %w", err)
+	}
+	expected, err := s.encryptChallenge(password, challenge)
+	if err != nil {
+		return err
+	}
+
+	if subtle.ConstantTimeCompare(response[:], expected) != 1 {
+		// Result 1 is failure; RFB 3.8 follows it with a reason string.
+		reason := "authentication failed"
+		if err := binary.Write(c, binary.BigEndian, uint32(1)); err != nil {
+			return err
+		}
+		if err := binary.Write(c, binary.BigEndian, uint32(len(reason))); err != nil {
+			return err
+		}
+		if _, err := c.Write([]byte(reason)); err != nil {
+			return err
+		}
+		c.Flush()
+		return fmt.Errorf("vnc-auth: client sent a wrong password: %w", ErrAuthFailed)
+	}
+
+	if err := binary.Write(c, binary.BigEndian, uint32(0)); err != nil {
+		return err
+	}
+	return c.Flush()
+}
+
+// encryptChallenge returns the response to challenge for password: the
+// challenge encrypted with DES, keyed by the password padded with nulls to 8
+// bytes. VNC reverses the bit order of each key byte, a quirk of the original
+// implementation's DES library.
+func (s *SecurityVNC) encryptChallenge(password []byte, challenge [16]byte) ([]byte, error) {
+	if len(password) > 8 {
+		s.truncateWarning.Do(func() {
+			logger.Warnf("vnc-auth: password is %d bytes, only the first 8 are used", len(password))
+		})
+	}
+	key := make([]byte, 8)
+	copy(key, password)
+	for i, b := range key {
+		key[i] = bits.Reverse8(b)
+	}
+
+	cipher, err := des.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("vnc-auth: failed to create des cipher: %w", err)
+	}
+	response := make([]byte, 16)
+	cipher.Encrypt(response[0:8], challenge[0:8])
+	cipher.Encrypt(response[8:16], challenge[8:16])
+	return response, nil
+}
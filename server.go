@@ -1,241 +1,853 @@
-package avacadovnc
-
-import (
-	"bufio"
-	"errors"
-	"fmt"
-	"net"
-	"sync"
-
-	"github.com/bigangryrobot/avacadovnc/logger"
-)
-
-// Server represents a VNC server that listens for and manages incoming client connections.
-type Server struct {
-	listener net.Listener
-	config   *ServerConfig
-}
-
-// NewServer creates a new VNC server with the given configuration.
-func NewServer(cfg *ServerConfig) (*Server, error) {
-	if cfg == nil {
-		return nil, errors.New("server config cannot be nil")
-	}
-	// Initialize the quit channel for graceful shutdown.
-	cfg.quit = make(chan struct{})
-	return &Server{config: cfg}, nil
-}
-
-// Start begins listening for incoming client connections on the specified address.
-// This function blocks until the server is stopped.
-func (s *Server) Start(addr string) error {
-	ln, err := net.Listen("tcp", addr)
-	if err != nil {
-		return fmt.Errorf("failed to start listener on %s: %w", addr, err)
-	}
-	s.listener = ln
-	logger.Infof("VNC server listening on %s", addr)
-
-	// The main accept loop.
-	for {
-		conn, err := s.listener.Accept()
-		if err != nil {
-			// Check if the listener was closed intentionally.
-			select {
-			case <-s.config.quit:
-				logger.Info("VNC server shutting down.")
-				return nil
-			default:
-				// An unexpected error occurred.
-				return fmt.Errorf("failed to accept connection: %w", err)
-			}
-		}
-		// Handle each new connection in its own goroutine.
-		go s.handleConnection(conn)
-	}
-}
-
-// Stop gracefully shuts down the server by closing the listener and signaling all
-// active connections to terminate.
-func (s *Server) Stop() {
-	// Signal shutdown to the Start loop and all connections.
-	close(s.config.quit)
-	if s.listener != nil {
-		// Closing the listener will cause the Accept() call in Start() to return an error.
-		s.listener.Close()
-	}
-}
-
-// handleConnection manages the entire lifecycle of a single client connection.
-func (s *Server) handleConnection(conn net.Conn) {
-	serverConn, err := NewServerConn(conn, s.config)
-	if err != nil {
-		logger.Errorf("failed to create server connection for %s: %v", conn.RemoteAddr(), err)
-		conn.Close()
-		return
-	}
-	defer serverConn.Close()
-
-	logger.Infof("client connected: %s", conn.RemoteAddr())
-
-	// Execute the handshake process.
-	if len(s.config.Handlers) == 0 {
-		logger.Errorf("no server handlers configured for client %s", conn.RemoteAddr())
-		return
-	}
-	for _, h := range s.config.Handlers {
-		if err := h.Handle(serverConn); err != nil {
-			logger.Errorf("handshake failed for client %s: %v", conn.RemoteAddr(), err)
-			return
-		}
-	}
-
-	// The connection is now established. Wait for it to be closed either by the
-	// client or by a server shutdown.
-	serverConn.Wait()
-	logger.Infof("client disconnected: %s", conn.RemoteAddr())
-}
-
-// ServerConn represents a server-side VNC connection. It implements the Conn interface.
-type ServerConn struct {
-	c        net.Conn
-	br       *bufio.Reader
-	bw       *bufio.Writer
-	cfg      *ServerConfig
-	protocol string
-
-	colorMap    ColorMap
-	desktopName []byte
-	encodings   []Encoding
-
-	securityHandler SecurityHandler
-
-	fbHeight uint16
-	fbWidth  uint16
-
-	pixelFormat PixelFormat
-
-	quit   chan struct{}
-	wg     sync.WaitGroup
-	mu     sync.Mutex
-	closed bool
-}
-
-// NewServerConn creates a new server-side connection object.
-func NewServerConn(c net.Conn, cfg *ServerConfig) (*ServerConn, error) {
-	return &ServerConn{
-		c:           c,
-		cfg:         cfg,
-		br:          bufio.NewReader(c),
-		bw:          bufio.NewWriter(c),
-		pixelFormat: cfg.PixelFormat,
-		fbWidth:     cfg.Width,
-		fbHeight:    cfg.Height,
-		desktopName: []byte(cfg.DesktopName),
-		encodings:   cfg.Encodings,
-		quit:        cfg.quit, // Use the server's quit channel.
-	}, nil
-}
-
-// GetEncInstance returns the encoding instance for a given encoding type.
-func (sc *ServerConn) GetEncInstance(typ EncodingType) Encoding {
-	for _, enc := range sc.encodings {
-		if enc.Type() == typ {
-			return enc
-		}
-	}
-	return nil
-}
-
-// SetEncodings is a client-to-server operation. The server does not send this message.
-func (sc *ServerConn) SetEncodings(encs []EncodingType) error {
-	return errors.New("server cannot set encodings; this is a client-side message")
-}
-
-// ResetAllEncodings resets the state of all supported encodings.
-func (sc *ServerConn) ResetAllEncodings() {
-	for _, enc := range sc.encodings {
-		enc.Reset()
-	}
-}
-
-// Wait blocks until the connection is closed.
-func (sc *ServerConn) Wait() { sc.wg.Wait() }
-
-// Conn returns the underlying network connection.
-func (sc *ServerConn) Conn() net.Conn { return sc.c }
-
-// Read reads data from the connection.
-func (sc *ServerConn) Read(buf []byte) (int, error) { return sc.br.Read(buf) }
-
-// Write writes data to the connection.
-func (sc *ServerConn) Write(buf []byte) (int, error) { return sc.bw.Write(buf) }
-
-// Flush writes buffered data to the network.
-func (sc *ServerConn) Flush() error { return sc.bw.Flush() }
-
-// Close closes the connection and cleans up resources.
-func (sc *ServerConn) Close() error {
-	sc.mu.Lock()
-	if sc.closed {
-		sc.mu.Unlock()
-		return nil
-	}
-	sc.closed = true
-	sc.mu.Unlock()
-	return sc.c.Close()
-}
-
-// ColorMap returns the connection's color map.
-func (sc *ServerConn) ColorMap() ColorMap { return sc.colorMap }
-
-// SetColorMap sets the connection's color map.
-func (sc *ServerConn) SetColorMap(cm ColorMap) { sc.colorMap = cm }
-
-// DesktopName returns the server's desktop name.
-func (sc *ServerConn) DesktopName() []byte { return sc.desktopName }
-
-// SetDesktopName is a no-op on the server side, as the server defines the name.
-func (sc *ServerConn) SetDesktopName(name []byte) {}
-
-// Encodings returns the server's supported encodings.
-func (sc *ServerConn) Encodings() []Encoding { return sc.encodings }
-
-// PixelFormat returns the server's pixel format.
-func (sc *ServerConn) PixelFormat() PixelFormat { return sc.pixelFormat }
-
-// SetPixelFormat sets the client's desired pixel format.
-func (sc *ServerConn) SetPixelFormat(pf PixelFormat) error {
-	sc.pixelFormat = pf
-	return nil
-}
-
-// Protocol returns the negotiated protocol version.
-func (sc *ServerConn) Protocol() string { return sc.protocol }
-
-// SetProtoVersion sets the protocol version.
-func (sc *ServerConn) SetProtoVersion(pv string) { sc.protocol = pv }
-
-// SecurityHandler returns the negotiated security handler.
-func (sc *ServerConn) SecurityHandler() SecurityHandler { return sc.securityHandler }
-
-// SetSecurityHandler sets the security handler.
-func (sc *ServerConn) SetSecurityHandler(sh SecurityHandler) error {
-	sc.securityHandler = sh
-	return nil
-}
-
-// Width returns the framebuffer width.
-func (sc *ServerConn) Width() uint16 { return sc.fbWidth }
-
-// SetWidth is a no-op on the server side, as the server defines the width.
-func (sc *ServerConn) SetWidth(width uint16) {}
-
-// Height returns the framebuffer height.
-func (sc *ServerConn) Height() uint16 { return sc.fbHeight }
-
-// SetHeight is a no-op on the server side, as the server defines the height.
-func (sc *ServerConn) SetHeight(height uint16) {}
-
-// Config returns the server's configuration.
-func (sc *ServerConn) Config() interface{} { return sc.cfg }
+package avacadovnc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/bigangryrobot/avacadovnc/logger"
+)
+
+// Server represents a VNC server that listens for and manages incoming client connections.
+type Server struct {
+	listener net.Listener
+	config   *ServerConfig
+
+	mu      sync.Mutex // Guards listener, conns and stopped
+	conns   map[*ServerConn]struct{}
+	stopped bool
+	wg      sync.WaitGroup // Tracks handleConnection goroutines
+}
+
+// stopTimeout bounds how long Stop waits for connections to finish.
+const stopTimeout = 5 * time.Second
+
+// NewServer creates a new VNC server with the given configuration.
+func NewServer(cfg *ServerConfig) (*Server, error) {
+	if cfg == nil {
+		return nil, errors.New("server config cannot be nil")
+	}
+	// Initialize the quit channel for graceful shutdown.
+	cfg.quit = make(chan struct{})
+	return &Server{config: cfg, conns: make(map[*ServerConn]struct{})}, nil
+}
+
+// Start begins listening for incoming client connections on the specified address.
+// This function blocks until the server is stopped.
+func (s *Server) Start(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to start listener on %s: %w", addr, err)
+	}
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		ln.Close()
+		return nil
+	}
+	s.listener = ln
+	s.mu.Unlock()
+	logger.Infof("VNC server listening on %s", addr)
+
+	// The main accept loop.
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			// Check if the listener was closed intentionally.
+			select {
+			case <-s.config.quit:
+				logger.Info("VNC server shutting down.")
+				return nil
+			default:
+				// An unexpected error occurred.
+				return fmt.Errorf("failed to accept connection: %w", err)
+			}
+		}
+		serverConn, err := NewServerConn(conn, s.config)
+		if err != nil {
+			logger.Errorf("failed to create server connection for %s: %v", conn.RemoteAddr(), err)
+			conn.Close()
+			continue
+		}
+		if !s.track(serverConn) {
+			serverConn.Close()
+			continue
+		}
+		// Handle each new connection in its own goroutine.
+		go s.handleConnection(serverConn)
+	}
+}
+
+// track registers sc as active. It reports false once the server is stopping.
+func (s *Server) track(sc *ServerConn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return false
+	}
+	s.conns[sc] = struct{}{}
+	s.wg.Add(1)
+	return true
+}
+
+// untrack removes sc from the active connections.
+func (s *Server) untrack(sc *ServerConn) {
+	s.mu.Lock()
+	delete(s.conns, sc)
+	s.mu.Unlock()
+	s.wg.Done()
+}
+
+// Stop gracefully shuts down the server by closing the listener and all
+// active connections, then waits up to five seconds for their goroutines to
+// finish. See Shutdown.
+func (s *Server) Stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		logger.Warnf("server: %v", err)
+	}
+}
+
+// Shutdown stops the server: it closes the listener, so Start returns, and
+// closes every active connection. It then waits for the connections'
+// goroutines to finish, or for ctx to be done, in which case it returns an
+// error. Calling Shutdown again only waits again.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	if !s.stopped {
+		s.stopped = true
+		// Signal shutdown to the Start loop and all connections.
+		close(s.config.quit)
+		if s.listener != nil {
+			// Closing the listener will cause the Accept() call in Start() to return an error.
+			s.listener.Close()
+		}
+		for sc := range s.conns {
+			sc.Close()
+		}
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("server: connections still active at shutdown: %w", ctx.Err())
+	}
+}
+
+// handleConnection manages the entire lifecycle of a single client connection.
+func (s *Server) handleConnection(serverConn *ServerConn) {
+	defer s.untrack(serverConn)
+	defer serverConn.Close()
+	conn := serverConn.c
+
+	logger.Infof("client connected: %s", conn.RemoteAddr())
+
+	// Execute the handshake process.
+	if len(s.config.Handlers) == 0 {
+		logger.Errorf("no server handlers configured for client %s", conn.RemoteAddr())
+		return
+	}
+	for _, h := range s.config.Handlers {
+		if err := h.Handle(serverConn); err != nil {
+			logger.Errorf("handshake failed for client %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+	}
+
+	// The connection is now established. Wait for it to be closed either by the
+	// client or by a server shutdown.
+	serverConn.Wait()
+	logger.Infof("client disconnected: %s", conn.RemoteAddr())
+}
+
+// ServerConn represents a server-side VNC connection. It implements the Conn interface.
+type ServerConn struct {
+	c        net.Conn
+	br       *bufio.Reader
+	bw       *bufio.Writer
+	cfg      *ServerConfig
+	protocol string
+
+	colorMap    ColorMap
+	desktopName []byte
+	encodings   []Encoding
+
+	securityHandler SecurityHandler
+
+	fbHeight uint16
+	fbWidth  uint16
+	screens  []Screen
+
+	pixelFormat PixelFormat
+
+	clientEncodings []EncodingType
+
+	umu     sync.Mutex // Guards sent, scratch and pending
+	sent    *image.RGBA
+	scratch *image.RGBA
+	pending *FramebufferUpdateRequest
+
+	quit   chan struct{}
+	done   chan struct{}
+	wg     sync.WaitGroup
+	mu     sync.Mutex // Guards pixelFormat, the framebuffer layout, clientEncodings and closed
+	wmu    sync.Mutex // Serializes framebuffer updates and fence replies; taken before mu
+	closed bool
+}
+
+// NewServerConn creates a new server-side connection object.
+func NewServerConn(c net.Conn, cfg *ServerConfig) (*ServerConn, error) {
+	return &ServerConn{
+		c:           c,
+		cfg:         cfg,
+		br:          bufio.NewReader(c),
+		bw:          bufio.NewWriter(c),
+		pixelFormat: cfg.PixelFormat,
+		fbWidth:     cfg.Width,
+		fbHeight:    cfg.Height,
+		desktopName: []byte(cfg.DesktopName),
+		encodings:   cfg.Encodings,
+		quit:        cfg.quit, // Use the server's quit channel.
+		done:        make(chan struct{}),
+	}, nil
+}
+
+// GetEncInstance returns the encoding instance for a given encoding type.
+func (sc *ServerConn) GetEncInstance(typ EncodingType) Encoding {
+	for _, enc := range sc.encodings {
+		if enc.Type() == typ {
+			return enc
+		}
+	}
+	return nil
+}
+
+// ClientEncodings returns the encodings the client listed in its most recent
+// SetEncodings message, in order of preference.
+func (sc *ServerConn) ClientEncodings() []EncodingType {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.clientEncodings
+}
+
+// SetEncodings is a client-to-server operation. The server does not send this message.
+func (sc *ServerConn) SetEncodings(encs []EncodingType) error {
+	return errors.New("server cannot set encodings; this is a client-side message")
+}
+
+// ResetAllEncodings resets the state of all supported encodings.
+func (sc *ServerConn) ResetAllEncodings() {
+	for _, enc := range sc.encodings {
+		enc.Reset()
+	}
+}
+
+// Wait blocks until the connection is closed.
+func (sc *ServerConn) Wait() { sc.wg.Wait() }
+
+// Conn returns the underlying network connection.
+func (sc *ServerConn) Conn() net.Conn { return sc.c }
+
+// Read reads data from the connection.
+func (sc *ServerConn) Read(buf []byte) (int, error) { return sc.br.Read(buf) }
+
+// Write writes data to the connection.
+func (sc *ServerConn) Write(buf []byte) (int, error) { return sc.bw.Write(buf) }
+
+// Flush writes buffered data to the network.
+func (sc *ServerConn) Flush() error { return sc.bw.Flush() }
+
+// Close closes the connection and cleans up resources.
+func (sc *ServerConn) Close() error {
+	sc.mu.Lock()
+	if sc.closed {
+		sc.mu.Unlock()
+		return nil
+	}
+	sc.closed = true
+	close(sc.done)
+	sc.mu.Unlock()
+	return sc.c.Close()
+}
+
+// ColorMap returns the connection's color map.
+func (sc *ServerConn) ColorMap() ColorMap { return sc.colorMap }
+
+// SetColorMap sets the connection's color map.
+func (sc *ServerConn) SetColorMap(cm ColorMap) { sc.colorMap = cm }
+
+// SendColorMap sets entries first onwards of the client's color map to
+// colors, and records them in the connection's color map. Clients use the
+// color map when their pixel format is not true color.
+func (sc *ServerConn) SendColorMap(first uint16, colors []Color) error {
+	if int(first)+len(colors) > len(sc.colorMap) {
+		return fmt.Errorf("server: color map entries %d to %d are out of range", first, int(first)+len(colors)-1)
+	}
+	copy(sc.colorMap[first:], colors)
+	sc.wmu.Lock()
+	defer sc.wmu.Unlock()
+	return (&SetColorMapEntriesMessage{FirstColor: first, Colors: colors}).Write(sc)
+}
+
+// DesktopName returns the server's desktop name.
+func (sc *ServerConn) DesktopName() []byte { return sc.desktopName }
+
+// SetDesktopName is a no-op on the server side, as the server defines the name.
+func (sc *ServerConn) SetDesktopName(name []byte) {}
+
+// Encodings returns the server's supported encodings.
+func (sc *ServerConn) Encodings() []Encoding { return sc.encodings }
+
+// PixelFormat returns the pixel format updates are sent in.
+func (sc *ServerConn) PixelFormat() PixelFormat {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.pixelFormat
+}
+
+// SetPixelFormat sets the client's desired pixel format. Changing the format
+// resets all encodings so no compressed stream carries data in the old format.
+// It waits for an update being written to finish, so every update is encoded
+// in a single format.
+func (sc *ServerConn) SetPixelFormat(pf PixelFormat) error {
+	sc.wmu.Lock()
+	defer sc.wmu.Unlock()
+	sc.mu.Lock()
+	changed := pf != sc.pixelFormat
+	sc.pixelFormat = pf
+	sc.mu.Unlock()
+	if changed {
+		sc.ResetAllEncodings()
+	}
+	return nil
+}
+
+// Protocol returns the negotiated protocol version.
+func (sc *ServerConn) Protocol() string { return sc.protocol }
+
+// SetProtoVersion sets the protocol version.
+func (sc *ServerConn) SetProtoVersion(pv string) { sc.protocol = pv }
+
+// SecurityHandler returns the negotiated security handler.
+func (sc *ServerConn) SecurityHandler() SecurityHandler { return sc.securityHandler }
+
+// SetSecurityHandler sets the security handler.
+func (sc *ServerConn) SetSecurityHandler(sh SecurityHandler) error {
+	sc.securityHandler = sh
+	return nil
+}
+
+// Width returns the framebuffer width.
+func (sc *ServerConn) Width() uint16 {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.fbWidth
+}
+
+// SetWidth is a no-op on the server side, as the server defines the width.
+func (sc *ServerConn) SetWidth(width uint16) {}
+
+// Height returns the framebuffer height.
+func (sc *ServerConn) Height() uint16 {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.fbHeight
+}
+
+// SetHeight is a no-op on the server side, as the server defines the height.
+func (sc *ServerConn) SetHeight(height uint16) {}
+
+// Config returns the server's configuration.
+func (sc *ServerConn) Config() interface{} { return sc.cfg }
+
+// IsClient reports false: a ServerConn is the server end of a connection.
+func (sc *ServerConn) IsClient() bool { return false }
+
+// DefaultServerMessageHandler is the default handler for processing client
+// messages after the handshake is complete. It starts the server's message
+// loop, which applies SetPixelFormat and SetEncodings to the connection and
+// passes the other messages to the ServerConfig callbacks. If
+// ServerConfig.Messages is empty, all standard client messages are accepted.
+type DefaultServerMessageHandler struct{}
+
+// defaultClientMessages are the messages accepted when ServerConfig.Messages
+// is empty.
+func defaultClientMessages() []ClientMessage {
+	return []ClientMessage{
+		&SetPixelFormat{},
+		&SetEncodings{},
+		&FramebufferUpdateRequest{},
+		&KeyEvent{},
+		&PointerEvent{},
+		&CutTextMessage{},
+		&ClientFenceMessage{},
+		&SetDesktopSize{},
+		&QEMUClientMessage{},
+	}
+}
+
+// Handle starts the message handling loop for the server connection.
+func (*DefaultServerMessageHandler) Handle(c Conn) error {
+	logger.Trace("starting DefaultServerMessageHandler")
+	serverConn, ok := c.(*ServerConn)
+	if !ok {
+		return errors.New("handler expected a *ServerConn")
+	}
+
+	// Create a map of client message types to their handlers for quick lookup.
+	messages := serverConn.cfg.Messages
+	if len(messages) == 0 {
+		messages = defaultClientMessages()
+	}
+	clientMessages := make(map[ClientMessageType]ClientMessage)
+	for _, m := range messages {
+		clientMessages[m.Type()] = m
+	}
+
+	serverConn.wg.Add(1)
+	go serverConn.handleIncomingMessages(clientMessages)
+	if serverConn.cfg.FramebufferSource != nil && serverConn.cfg.OnFramebufferRequest == nil {
+		serverConn.wg.Add(1)
+		go serverConn.pollDamage()
+	}
+	return nil
+}
+
+// handleIncomingMessages runs in a dedicated goroutine, reading and processing
+// messages from the client.
+func (sc *ServerConn) handleIncomingMessages(clientMessages map[ClientMessageType]ClientMessage) {
+	defer sc.wg.Done()
+	defer sc.Close() // Ensure connection is closed if this loop exits.
+
+	for {
+		var msgType ClientMessageType
+		if err := binary.Read(sc, binary.BigEndian, &msgType); err != nil {
+			// A read error, often io.EOF, means the connection is closed.
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				logger.Errorf("error reading message type: %v", err)
+			}
+			return
+		}
+
+		msg, ok := clientMessages[msgType]
+		if !ok {
+			logger.Errorf("unsupported message type %d from client %s", msgType, sc.c.RemoteAddr())
+			return // Unknown message type is a fatal error.
+		}
+
+		parsedMsg, err := msg.Read(sc)
+		if err != nil {
+			logger.Errorf("error reading message body for type %d: %v", msgType, err)
+			return
+		}
+
+		if err := sc.dispatch(parsedMsg); err != nil {
+			logger.Errorf("error handling message type %d: %v", msgType, err)
+			return
+		}
+
+		// Send the parsed message to the application logic, if it listens.
+		if sc.cfg.ClientMessageCh == nil {
+			continue
+		}
+		select {
+		case sc.cfg.ClientMessageCh <- parsedMsg:
+		case <-sc.quit:
+			return
+		}
+	}
+}
+
+// dispatch applies a client message to the connection and passes it to the
+// matching ServerConfig callback.
+func (sc *ServerConn) dispatch(msg ClientMessage) error {
+	switch m := msg.(type) {
+	case *SetPixelFormat:
+		return sc.SetPixelFormat(m.PixelFormat)
+	case *SetEncodings:
+		announce := !sc.clientSupports(EncExtendedDesktopSize)
+		sc.mu.Lock()
+		sc.clientEncodings = m.Encodings
+		sc.mu.Unlock()
+		if announce && sc.clientSupports(EncExtendedDesktopSize) {
+			// Announce support, and the current layout, as the extension
+			// requires before the client may send SetDesktopSize.
+			return sc.sendDesktopLayout(DesktopSizeReasonServer, DesktopSizeStatusOK)
+		}
+	case *SetDesktopSize:
+		return sc.setDesktopSize(m)
+	case *FramebufferUpdateRequest:
+		if sc.cfg.OnFramebufferRequest != nil {
+			return sc.cfg.OnFramebufferRequest(sc, m)
+		}
+		return sc.sendFramebufferUpdate(m)
+	case *KeyEvent:
+		if sc.cfg.OnKeyEvent != nil {
+			sc.cfg.OnKeyEvent(sc, m)
+		}
+	case *PointerEvent:
+		if sc.cfg.OnPointerEvent != nil {
+			sc.cfg.OnPointerEvent(sc, m)
+		}
+	case *CutTextMessage:
+		if sc.cfg.OnCutText != nil {
+			sc.cfg.OnCutText(sc, m)
+		}
+	case *QEMUExtendedKeyEvent:
+		if sc.cfg.OnQEMUExtendedKeyEvent != nil {
+			sc.cfg.OnQEMUExtendedKeyEvent(sc, m)
+		}
+	case *QEMUAudioMessage:
+		if sc.cfg.OnQEMUAudio != nil {
+			sc.cfg.OnQEMUAudio(sc, m)
+		}
+	case *ClientFenceMessage:
+		if m.Flags&FenceRequest != 0 {
+			// Requests are handled in order, so the blocking flags hold.
+			reply := &ServerFenceMessage{fence{Flags: m.Flags & fenceSupported, Payload: m.Payload}}
+			sc.wmu.Lock()
+			defer sc.wmu.Unlock()
+			return reply.Write(sc)
+		}
+	}
+	return nil
+}
+
+// Screens returns the screen layout of the framebuffer. Unless a client has
+// set another layout, it is a single screen covering the whole framebuffer.
+func (sc *ServerConn) Screens() []Screen {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if len(sc.screens) == 0 {
+		return []Screen{{Width: sc.fbWidth, Height: sc.fbHeight}}
+	}
+	return sc.screens
+}
+
+// setDesktopSize answers a SetDesktopSize request with an ExtendedDesktopSize
+// rectangle carrying the outcome and the resulting layout. Requests from
+// clients that did not advertise ExtendedDesktopSize are ignored.
+func (sc *ServerConn) setDesktopSize(req *SetDesktopSize) error {
+	if !sc.clientSupports(EncExtendedDesktopSize) {
+		logger.Warnf("server: ignoring SetDesktopSize from %s, which did not advertise ExtendedDesktopSize", sc.c.RemoteAddr())
+		return nil
+	}
+	status := DesktopSizeStatusProhibited
+	switch {
+	case !validLayout(req):
+		status = DesktopSizeStatusInvalidLayout
+	case sc.cfg.OnSetDesktopSize != nil:
+		status = sc.cfg.OnSetDesktopSize(sc, req)
+	}
+	if status == DesktopSizeStatusOK {
+		// Updates being written finish with the old size.
+		sc.wmu.Lock()
+		sc.mu.Lock()
+		sc.fbWidth, sc.fbHeight = req.Width, req.Height
+		sc.screens = req.Screens
+		sc.mu.Unlock()
+		sc.wmu.Unlock()
+	}
+	return sc.sendDesktopLayout(DesktopSizeReasonClient, status)
+}
+
+// validLayout reports whether req asks for a non-empty framebuffer with at
+// least one screen, all of which lie within it.
+func validLayout(req *SetDesktopSize) bool {
+	if req.Width == 0 || req.Height == 0 || len(req.Screens) == 0 {
+		return false
+	}
+	for _, s := range req.Screens {
+		if s.Width == 0 || s.Height == 0 ||
+			int(s.X)+int(s.Width) > int(req.Width) || int(s.Y)+int(s.Height) > int(req.Height) {
+			return false
+		}
+	}
+	return true
+}
+
+// sendDesktopLayout sends a FramebufferUpdate holding a single
+// ExtendedDesktopSize rectangle with the current size and layout.
+func (sc *ServerConn) sendDesktopLayout(reason, status uint16) error {
+	sc.wmu.Lock()
+	defer sc.wmu.Unlock()
+	if _, err := sc.Write([]byte{byte(ServerFramebufferUpdate), 0, 0, 1}); err != nil {
+		return err
+	}
+	if err := writeExtendedDesktopSize(sc, reason, status, sc.Width(), sc.Height(), sc.Screens()); err != nil {
+		return err
+	}
+	return sc.Flush()
+}
+
+// SendQEMULedState tells the client which keyboard LEDs are lit, as a
+// combination of QEMULedScrollLock, QEMULedNumLock and QEMULedCapsLock. The
+// client must have advertised EncQEMULedState.
+func (sc *ServerConn) SendQEMULedState(state uint8) error {
+	return sc.sendPseudoRect(&Rectangle{EncType: EncQEMULedState}, []byte{state})
+}
+
+// SendQEMUPointerMotionChange asks the client to send absolute pointer
+// positions, or relative motion if absolute is false. The client must have
+// advertised EncQEMUPointerMotionChange.
+func (sc *ServerConn) SendQEMUPointerMotionChange(absolute bool) error {
+	rect := &Rectangle{EncType: EncQEMUPointerMotionChange}
+	if absolute {
+		rect.X = 1
+	}
+	return sc.sendPseudoRect(rect, nil)
+}
+
+// sendPseudoRect sends a FramebufferUpdate holding the single
+// pseudo-encoding rectangle rect followed by payload.
+func (sc *ServerConn) sendPseudoRect(rect *Rectangle, payload []byte) error {
+	if !sc.clientSupports(rect.EncType) {
+		return fmt.Errorf("server: client did not advertise %s", rect.EncType)
+	}
+	sc.wmu.Lock()
+	defer sc.wmu.Unlock()
+	if _, err := sc.Write([]byte{byte(ServerFramebufferUpdate), 0, 0, 1}); err != nil {
+		return err
+	}
+	if err := rect.Write(sc); err != nil {
+		return err
+	}
+	if _, err := sc.Write(payload); err != nil {
+		return err
+	}
+	return sc.Flush()
+}
+
+// sendFramebufferUpdate answers a FramebufferUpdateRequest. Without a
+// FramebufferSource the update has no rectangles, so clients waiting for a
+// reply are not left hanging. Otherwise the requested area is sent Raw-encoded,
+// or split into tiles encoded as chosen by the configured EncodingStrategy.
+// An incremental request gets only the parts of the area that changed since
+// they were last sent, and is held until there are some; see pollDamage.
+func (sc *ServerConn) sendFramebufferUpdate(req *FramebufferUpdateRequest) error {
+	if sc.cfg.FramebufferSource == nil {
+		return sc.writeUpdate(nil, nil)
+	}
+	sc.umu.Lock()
+	defer sc.umu.Unlock()
+	return sc.answerUpdate(req)
+}
+
+// answerUpdate sends the update for req from the FramebufferSource, or holds
+// req as pending if it is incremental and nothing in its area has changed.
+// The caller must hold umu.
+func (sc *ServerConn) answerUpdate(req *FramebufferUpdateRequest) error {
+	sc.pending = nil
+	area := image.Rect(int(req.X), int(req.Y), int(req.X)+int(req.Width), int(req.Y)+int(req.Height))
+	img := sc.cfg.FramebufferSource.Framebuffer()
+	area = area.Intersect(img.Bounds())
+	if area.Empty() {
+		return sc.writeUpdate(nil, nil)
+	}
+	regions := sc.damage(img, area, req.Inc != 0)
+	if len(regions) == 0 {
+		sc.pending = req
+		return nil
+	}
+
+	var rects []*Rectangle
+	for _, r := range regions {
+		if sc.cfg.EncodingStrategy != nil {
+			rects = append(rects, encodeRegions(sc.cfg.EncodingStrategy, img, r)...)
+			continue
+		}
+		rects = append(rects, &Rectangle{
+			X:       uint16(r.Min.X),
+			Y:       uint16(r.Min.Y),
+			Width:   uint16(r.Dx()),
+			Height:  uint16(r.Dy()),
+			EncType: EncRaw,
+		})
+	}
+	for _, rect := range rects {
+		rect.EncType = sc.preferredEncoding(rect.EncType)
+	}
+
+	return sc.writeUpdate(img, rects)
+}
+
+// damagePollInterval is how often a held incremental request is checked for
+// changes in its area.
+const damagePollInterval = 50 * time.Millisecond
+
+// pollDamage answers the pending incremental FramebufferUpdateRequest once
+// its area changes, so clients that request updates continuously wait for
+// changes instead of receiving a stream of empty updates.
+func (sc *ServerConn) pollDamage() {
+	defer sc.wg.Done()
+	ticker := time.NewTicker(damagePollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-sc.done:
+			return
+		case <-sc.quit:
+			return
+		}
+		var err error
+		sc.umu.Lock()
+		if sc.pending != nil {
+			err = sc.answerUpdate(sc.pending)
+		}
+		sc.umu.Unlock()
+		if err != nil {
+			logger.Errorf("server: failed to send framebuffer update to %s: %v", sc.c.RemoteAddr(), err)
+			sc.Close()
+			return
+		}
+	}
+}
+
+// damage returns the parts of area to send: all of it for a non-incremental
+// request, and otherwise the tiles whose pixels in img differ from those last
+// sent. It records the returned parts of img as sent. The caller must hold
+// umu.
+func (sc *ServerConn) damage(img image.Image, area image.Rectangle, incremental bool) []image.Rectangle {
+	bounds := img.Bounds()
+	if sc.sent == nil || sc.sent.Rect != bounds {
+		sc.sent = image.NewRGBA(bounds)
+		incremental = false
+	}
+	if !incremental {
+		draw.Draw(sc.sent, area, img, area.Min, draw.Src)
+		return []image.Rectangle{area}
+	}
+
+	if sc.scratch == nil || sc.scratch.Rect != bounds {
+		sc.scratch = image.NewRGBA(bounds)
+	}
+	draw.Draw(sc.scratch, area, img, area.Min, draw.Src)
+	var changed []image.Rectangle
+	for y := area.Min.Y; y < area.Max.Y; y += encodeTileSize {
+		for x := area.Min.X; x < area.Max.X; x += encodeTileSize {
+			tile := image.Rect(x, y, x+encodeTileSize, y+encodeTileSize).Intersect(area)
+			if !samePixels(sc.sent, sc.scratch, tile) {
+				draw.Draw(sc.sent, tile, sc.scratch, tile.Min, draw.Src)
+				changed = append(changed, tile)
+			}
+		}
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+	return CoalesceRects(changed, coalesceGap)
+}
+
+// samePixels reports whether a and b hold the same pixels in r.
+func samePixels(a, b *image.RGBA, r image.Rectangle) bool {
+	n := r.Dx() * 4
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		i, j := a.PixOffset(r.Min.X, y), b.PixOffset(r.Min.X, y)
+		if !bytes.Equal(a.Pix[i:i+n], b.Pix[j:j+n]) {
+			return false
+		}
+	}
+	return true
+}
+
+// SendFrame sends a FramebufferUpdate with the dirty regions of img, each
+// encoded with enc, for servers that push frames from their own loop instead
+// of setting a FramebufferSource. A nil dirty list sends the whole image;
+// nearby dirty rectangles are merged with CoalesceRects.
+// enc must be EncRaw, EncRRE or EncTight; if the client did not list it in
+// SetEncodings, the frame is sent as Raw. It is safe to call concurrently
+// with the message loop.
+func (sc *ServerConn) SendFrame(img image.Image, dirty []image.Rectangle, enc EncodingType) error {
+	if !canEncode(enc) {
+		return fmt.Errorf("server: cannot encode %s", enc)
+	}
+	enc = sc.preferredEncoding(enc)
+	if dirty == nil {
+		dirty = []image.Rectangle{img.Bounds()}
+	}
+	dirty = CoalesceRects(dirty, coalesceGap)
+
+	var rects []*Rectangle
+	for _, r := range dirty {
+		r = r.Intersect(img.Bounds())
+		if r.Empty() {
+			continue
+		}
+		rects = append(rects, &Rectangle{
+			X:       uint16(r.Min.X),
+			Y:       uint16(r.Min.Y),
+			Width:   uint16(r.Dx()),
+			Height:  uint16(r.Dy()),
+			EncType: enc,
+		})
+	}
+	return sc.writeUpdate(img, rects)
+}
+
+// preferredEncoding returns enc if the server can emit it and the client
+// listed it in SetEncodings, and EncRaw otherwise. Every client supports Raw,
+// so a client that asks only for encodings the server cannot produce still
+// gets updates.
+func (sc *ServerConn) preferredEncoding(enc EncodingType) EncodingType {
+	if enc == EncRaw || !canEncode(enc) || !sc.clientSupports(enc) {
+		return EncRaw
+	}
+	return enc
+}
+
+// clientSupports reports whether the client listed enc in SetEncodings.
+func (sc *ServerConn) clientSupports(enc EncodingType) bool {
+	for _, e := range sc.ClientEncodings() {
+		if e == enc {
+			return true
+		}
+	}
+	return false
+}
+
+// jpegQuality returns the image/jpeg quality for the JPEG quality level the
+// client listed in SetEncodings, or zero if it listed none and so must not be
+// sent Tight JPEG.
+func (sc *ServerConn) jpegQuality() int {
+	for _, e := range sc.ClientEncodings() {
+		if e >= EncJPEGQualityLevel0 && e <= EncJPEGQualityLevel9 {
+			return tightJPEGQuality[e-EncJPEGQualityLevel0]
+		}
+	}
+	return 0
+}
+
+// writeUpdate writes a FramebufferUpdate message with rects taken from img.
+func (sc *ServerConn) writeUpdate(img image.Image, rects []*Rectangle) error {
+	quality := sc.jpegQuality()
+	sc.wmu.Lock()
+	defer sc.wmu.Unlock()
+	n := len(rects)
+	if _, err := sc.Write([]byte{byte(ServerFramebufferUpdate), 0, byte(n >> 8), byte(n)}); err != nil {
+		return err
+	}
+	for _, rect := range rects {
+		if err := writeEncodedRect(sc, img, rect, quality); err != nil {
+			return err
+		}
+	}
+	return sc.Flush()
+}
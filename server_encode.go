@@ -0,0 +1,335 @@
+package avacadovnc
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+)
+
+// EncodingStrategy chooses how the server encodes each region of a
+// framebuffer update. Regions for which it returns an encoding the client has
+// not listed in SetEncodings, or one the server cannot produce, are sent as
+// Raw.
+type EncodingStrategy interface {
+	// Choose returns the encoding for the region r of img.
+	Choose(img image.Image, r image.Rectangle) EncodingType
+}
+
+// encodeTileSize is the size of the square regions an update is split into
+// when an EncodingStrategy is configured.
+const encodeTileSize = 64
+
+// HeuristicStrategy is an EncodingStrategy that picks Tight fill for solid
+// regions, RRE for regions with few colors and Tight JPEG for everything
+// else, such as photos and gradients. Clients that cannot take JPEG get
+// zlib-compressed Tight instead.
+type HeuristicStrategy struct {
+	// MaxRREColors is the largest number of distinct colors for which RRE is
+	// chosen. Zero means 16.
+	MaxRREColors int
+}
+
+// Choose implements EncodingStrategy.
+func (s *HeuristicStrategy) Choose(img image.Image, r image.Rectangle) EncodingType {
+	maxColors := s.MaxRREColors
+	if maxColors == 0 {
+		maxColors = 16
+	}
+	switch n := countColors(img, r, maxColors+1); {
+	case n == 1:
+		return EncTight // sent as a Tight fill
+	case n <= maxColors:
+		return EncRRE
+	default:
+		return EncTight // sent as Tight JPEG if the client accepts it
+	}
+}
+
+// countColors returns the number of distinct colors in r, stopping once limit
+// is reached.
+func countColors(img image.Image, r image.Rectangle, limit int) int {
+	seen := make(map[color.RGBA]struct{}, limit)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			seen[rgbaAt(img, x, y)] = struct{}{}
+			if len(seen) >= limit {
+				return len(seen)
+			}
+		}
+	}
+	return len(seen)
+}
+
+// rgbaAt returns the color at (x, y) without alpha.
+func rgbaAt(img image.Image, x, y int) color.RGBA {
+	clr := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+	clr.A = 255
+	return clr
+}
+
+// encodeRegions splits area into tiles and asks the strategy for the encoding
+// of each one.
+func encodeRegions(strategy EncodingStrategy, img image.Image, area image.Rectangle) []*Rectangle {
+	var rects []*Rectangle
+	for y := area.Min.Y; y < area.Max.Y; y += encodeTileSize {
+		for x := area.Min.X; x < area.Max.X; x += encodeTileSize {
+			tile := image.Rect(x, y, x+encodeTileSize, y+encodeTileSize).Intersect(area)
+			rects = append(rects, &Rectangle{
+				X:       uint16(tile.Min.X),
+				Y:       uint16(tile.Min.Y),
+				Width:   uint16(tile.Dx()),
+				Height:  uint16(tile.Dy()),
+				EncType: strategy.Choose(img, tile),
+			})
+		}
+	}
+	return rects
+}
+
+// coalesceGap is the gap, in pixels, up to which SendFrame merges dirty
+// rectangles.
+const coalesceGap = 8
+
+// CoalesceRects merges rectangles that overlap or lie within maxGap pixels of
+// each other into their bounding box, as long as the box covers little more
+// than the two rectangles and the strip between them: one larger rectangle
+// costs less to send than many small ones, but an L-shaped pair is left
+// alone. Every pixel covered by rects is covered by the result. Empty
+// rectangles are dropped.
+func CoalesceRects(rects []image.Rectangle, maxGap int) []image.Rectangle {
+	out := make([]image.Rectangle, 0, len(rects))
+	for _, r := range rects {
+		if !r.Empty() {
+			out = append(out, r.Canon())
+		}
+	}
+	for merged := true; merged; {
+		merged = false
+		for i := 0; i < len(out); i++ {
+			for j := i + 1; j < len(out); j++ {
+				if !mergeable(out[i], out[j], maxGap) {
+					continue
+				}
+				out[i] = out[i].Union(out[j])
+				out = append(out[:j], out[j+1:]...)
+				merged = true
+				j = i // Retry the grown rectangle against the rest.
+			}
+		}
+	}
+	return out
+}
+
+// mergeable reports whether a and b are close enough to be merged, and
+// whether their bounding box wastes at most a maxGap wide strip.
+func mergeable(a, b image.Rectangle, maxGap int) bool {
+	if !a.Inset(-maxGap).Overlaps(b) {
+		return false
+	}
+	area := func(r image.Rectangle) int { return r.Dx() * r.Dy() }
+	u := a.Union(b)
+	covered := area(a) + area(b) - area(a.Intersect(b))
+	return area(u)-covered <= maxGap*max(u.Dx(), u.Dy())
+}
+
+// canEncode reports whether writeEncodedRect can produce enc.
+func canEncode(enc EncodingType) bool {
+	switch enc {
+	case EncRaw, EncRRE, EncTight:
+		return true
+	}
+	return false
+}
+
+// writeEncodedRect writes rect's header and the pixels of img it covers,
+// encoded with rect.EncType. Tight rectangles use JPEG at jpegQuality, or
+// zlib if jpegQuality is zero or the pixel format is not true color.
+func writeEncodedRect(c Conn, img image.Image, rect *Rectangle, jpegQuality int) error {
+	if err := rect.Write(c); err != nil {
+		return err
+	}
+	r := image.Rect(int(rect.X), int(rect.Y), int(rect.X)+int(rect.Width), int(rect.Y)+int(rect.Height))
+	pf := c.PixelFormat()
+
+	switch rect.EncType {
+	case EncRaw:
+		return writeRaw(c, img, r, &pf)
+	case EncRRE:
+		return writeRRE(c, img, r, &pf)
+	case EncTight:
+		if countColors(img, r, 2) == 1 {
+			return writeTightFill(c, rgbaAt(img, r.Min.X, r.Min.Y), &pf)
+		}
+		if jpegQuality > 0 && pf.TrueColor != 0 && pf.BPP >= 16 {
+			return writeTightJPEG(c, img, r, jpegQuality)
+		}
+		return writeTightBasic(c, img, r, &pf)
+	default:
+		return fmt.Errorf("server: cannot encode %s", rect.EncType)
+	}
+}
+
+// writeRaw writes the pixels of r row by row.
+func writeRaw(c Conn, img image.Image, r image.Rectangle, pf *PixelFormat) error {
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			if err := WritePixel(c, RGBAToPixel(rgbaAt(img, x, y), pf), pf); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeRRE writes r as RRE: the most common color as background, and one
+// subrectangle per horizontal run of any other color.
+func writeRRE(c Conn, img image.Image, r image.Rectangle, pf *PixelFormat) error {
+	counts := make(map[color.RGBA]int)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			counts[rgbaAt(img, x, y)]++
+		}
+	}
+	var bg color.RGBA
+	for clr, n := range counts {
+		if n > counts[bg] {
+			bg = clr
+		}
+	}
+
+	var subrects bytes.Buffer
+	var num uint32
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; {
+			clr := rgbaAt(img, x, y)
+			start := x
+			for x < r.Max.X && rgbaAt(img, x, y) == clr {
+				x++
+			}
+			if clr == bg {
+				continue
+			}
+			if err := WritePixel(&subrects, RGBAToPixel(clr, pf), pf); err != nil {
+				return err
+			}
+			geometry := [4]uint16{uint16(start - r.Min.X), uint16(y - r.Min.Y), uint16(x - start), 1}
+			if err := binary.Write(&subrects, binary.BigEndian, geometry); err != nil {
+				return err
+			}
+			num++
+		}
+	}
+
+	if err := binary.Write(c, binary.BigEndian, num); err != nil {
+		return err
+	}
+	if err := WritePixel(c, RGBAToPixel(bg, pf), pf); err != nil {
+		return err
+	}
+	_, err := c.Write(subrects.Bytes())
+	return err
+}
+
+// writeTightFill writes a Tight fill rectangle.
+func writeTightFill(c Conn, clr color.RGBA, pf *PixelFormat) error {
+	if _, err := c.Write([]byte{0x80}); err != nil {
+		return err
+	}
+	if isTightTPixel(pf) {
+		_, err := c.Write([]byte{clr.R, clr.G, clr.B})
+		return err
+	}
+	return WritePixel(c, RGBAToPixel(clr, pf), pf)
+}
+
+// writeTightBasic writes r as a Tight basic rectangle with the copy filter,
+// compressed on zlib stream 0. The stream is reset for every rectangle, so the
+// server keeps no compression state between updates.
+func writeTightBasic(c Conn, img image.Image, r image.Rectangle, pf *PixelFormat) error {
+	var data bytes.Buffer
+	tpixel := isTightTPixel(pf)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			clr := rgbaAt(img, x, y)
+			if tpixel {
+				data.Write([]byte{clr.R, clr.G, clr.B})
+				continue
+			}
+			if err := WritePixel(&data, RGBAToPixel(clr, pf), pf); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Basic compression on stream 0, after resetting stream 0.
+	if _, err := c.Write([]byte{0x01}); err != nil {
+		return err
+	}
+	if data.Len() < tightMinToCompress {
+		_, err := c.Write(data.Bytes())
+		return err
+	}
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	if _, err := zw.Write(data.Bytes()); err != nil {
+		return fmt.Errorf("tight: failed to compress rectangle: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("tight: failed to compress rectangle: %w", err)
+	}
+	if _, err := c.Write(tightCompactLength(compressed.Len())); err != nil {
+		return err
+	}
+	_, err := c.Write(compressed.Bytes())
+	return err
+}
+
+// tightJPEGQuality maps the JPEG quality levels 0 to 9 of the
+// EncJPEGQualityLevel pseudo-encodings to image/jpeg qualities.
+var tightJPEGQuality = [10]int{15, 29, 41, 42, 62, 77, 79, 86, 92, 100}
+
+// writeTightJPEG writes r as a Tight JPEG rectangle.
+func writeTightJPEG(c Conn, img image.Image, r image.Rectangle, quality int) error {
+	sub := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	for y := 0; y < r.Dy(); y++ {
+		for x := 0; x < r.Dx(); x++ {
+			sub.SetRGBA(x, y, rgbaAt(img, r.Min.X+x, r.Min.Y+y))
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, sub, &jpeg.Options{Quality: quality}); err != nil {
+		return fmt.Errorf("tight: failed to encode jpeg: %w", err)
+	}
+	if _, err := c.Write([]byte{0x90}); err != nil {
+		return err
+	}
+	if _, err := c.Write(tightCompactLength(buf.Len())); err != nil {
+		return err
+	}
+	_, err := c.Write(buf.Bytes())
+	return err
+}
+
+// isTightTPixel reports whether Tight sends pixels in pf as 3-byte RGB TPIXELs.
+func isTightTPixel(pf *PixelFormat) bool {
+	return pf.TrueColor != 0 && pf.BPP == 32 && pf.Depth == 24 &&
+		pf.RedMax == 255 && pf.GreenMax == 255 && pf.BlueMax == 255
+}
+
+// tightCompactLength encodes n in Tight's 1-3 byte compact length format.
+func tightCompactLength(n int) []byte {
+	b := []byte{byte(n & 0x7f)}
+	if n > 0x7f {
+		b[0] |= 0x80
+		b = append(b, byte((n>>7)&0x7f))
+		if n > 0x3fff {
+			b[1] |= 0x80
+			b = append(b, byte(n>>14))
+		}
+	}
+	return b
+}
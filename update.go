@@ -0,0 +1,90 @@
+package avacadovnc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+)
+
+// FramebufferUpdate is a data-only description of a decoded FramebufferUpdate
+// message, for tools that analyze or transcode a stream rather than display it.
+type FramebufferUpdate struct {
+	Rects []UpdateRect
+}
+
+// UpdateRect describes one rectangle of a FramebufferUpdate.
+type UpdateRect struct {
+	X, Y, Width, Height uint16
+	EncType             EncodingType
+	// Pixels holds the decoded pixels of the rectangle. It is nil for
+	// CopyRect and pseudo-encodings, which carry no pixels of their own.
+	Pixels *image.RGBA
+}
+
+// DecodeUpdate reads one FramebufferUpdate message from c and describes it
+// without touching any canvas attached to the connection. As with
+// FramebufferUpdateMessage.Read, the message type must already have been read.
+// Decoder state such as zlib streams is shared with c's encodings.
+func DecodeUpdate(c Conn) (*FramebufferUpdate, error) {
+	var header [3]byte // padding, number-of-rectangles
+	if _, err := io.ReadFull(c, header[:]); err != nil {
+		return nil, err
+	}
+	numRects := binary.BigEndian.Uint16(header[1:])
+
+	// Decoders draw into a scratch canvas, from which each rectangle's
+	// pixels are cut out.
+	scratch := &decodeConn{
+		wrappedConn: c,
+		canvas:      NewVncCanvas(int(c.Width()), int(c.Height()), c.PixelFormat()),
+	}
+	scratch.canvas.SetColorMap(c.ColorMap())
+
+	update := &FramebufferUpdate{}
+	untilLastRect := numRects == lastRectSentinel
+	if untilLastRect && !lastRectNegotiated(c) {
+		return nil, fmt.Errorf("decode-update: server sent the LastRect sentinel without LastRect being negotiated")
+	}
+	for i := 0; untilLastRect || i < int(numRects); i++ {
+		rect := &Rectangle{}
+		if err := rect.readHeader(c); err != nil {
+			return nil, fmt.Errorf("decode-update: failed to read rectangle header: %w", err)
+		}
+		if rect.EncType == EncLastRect {
+			break
+		}
+		if err := rect.decode(scratch); err != nil {
+			return nil, err
+		}
+
+		ur := UpdateRect{X: rect.X, Y: rect.Y, Width: rect.Width, Height: rect.Height, EncType: rect.EncType}
+		if !rect.EncType.IsPseudo() && rect.EncType != EncCopyRect {
+			ur.Pixels = scratch.canvas.subImage(image.Rect(int(rect.X), int(rect.Y), int(rect.X)+int(rect.Width), int(rect.Y)+int(rect.Height)))
+		}
+		update.Rects = append(update.Rects, ur)
+	}
+	return update, nil
+}
+
+// decodeConn wraps a Conn so that decoders draw into its own canvas.
+type decodeConn struct {
+	wrappedConn
+	canvas *VncCanvas
+}
+
+// wrappedConn lets decodeConn embed a Conn without its field name clashing
+// with the Conn method.
+type wrappedConn = Conn
+
+// canvasOf returns the canvas decoders should draw into for c, or nil if
+// there is none.
+func canvasOf(c Conn) *VncCanvas {
+	switch conn := c.(type) {
+	case *ClientConn:
+		return conn.Canvas
+	case *decodeConn:
+		return conn.canvas
+	}
+	return nil
+}
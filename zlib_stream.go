@@ -0,0 +1,56 @@
+package avacadovnc
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+)
+
+// zlibStream is a zlib stream that continues across rectangles. Encodings
+// like ZRLE, Zlib, ZlibHex and Tight compress all rectangles of a session with one
+// zlib stream per stream ID, flushing at the end of each rectangle, so the
+// decompressor's state must be kept between rectangles.
+type zlibStream struct {
+	in bytes.Buffer // compressed data not yet consumed by r
+	r  io.ReadCloser
+
+	// The counts below let FbsPlayer tell where a replay can start.
+	feeds      int // Calls to feed
+	resets     int // Calls to reset
+	chainFeeds int // Calls to feed since the last reset
+}
+
+// zlibStreamer is implemented by decoders that keep zlib streams across
+// rectangles.
+type zlibStreamer interface {
+	zlibStreams() []*zlibStream
+}
+
+// feed appends the compressed data of one rectangle and returns the reader
+// to decompress it from. bytes.Buffer is an io.ByteReader, so the zlib
+// reader never reads past the data it needs.
+func (z *zlibStream) feed(compressed []byte) (io.Reader, error) {
+	z.feeds++
+	z.chainFeeds++
+	z.in.Write(compressed)
+	if z.r == nil {
+		r, err := zlib.NewReader(&z.in)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create zlib reader: %w", err)
+		}
+		z.r = r
+	}
+	return z.r, nil
+}
+
+// reset discards the stream so the next feed starts a new one.
+func (z *zlibStream) reset() {
+	z.resets++
+	z.chainFeeds = 0
+	if z.r != nil {
+		z.r.Close()
+		z.r = nil
+	}
+	z.in.Reset()
+}